@@ -0,0 +1,49 @@
+package client
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"fmt"
+	"slices"
+
+	"github.com/go-jose/go-jose/v4"
+
+	. "go-citrus/internal"
+)
+
+/*
+Offline break-glass recovery, for data bound to a Tang server which is lost for good.
+The recovery 'y' is computed locally with an exported server exchange private key 'S', instead of POST /rec/{thumbprint}:
+	y = x * S
+The client side is the regular Protocol.Decrypt: 'x' stays blinded, and 'S' only ever answers the JWE whose 'kid'
+is its own thumbprint.
+*/
+
+// OfflineRecovery returns a RecoveryFn computing the server side of the recovery with the exchange private key.
+func OfflineRecovery(key jose.JSONWebKey) (RecoveryFn, error) {
+	S, ok := key.Key.(*ecdsa.PrivateKey)
+	if !ok || !IsExchangeKey(key) {
+		return nil, fmt.Errorf("offline recovery requires a server exchange private key")
+	}
+	thumbs, err := Thumbprints(key.Public())
+	if err != nil {
+		return nil, err
+	}
+	algorithm := NewECAlgorithm(S.Curve)
+
+	return func(thumbprint string, request []byte) ([]byte, error) {
+		if !slices.Contains(thumbs, thumbprint) {
+			thp, _ := Thumbprints(key.Public(), crypto.SHA256)
+			return nil, fmt.Errorf("server key '%s' does not match the JWE key ID '%s'", thp[0], thumbprint)
+		}
+		var jwkX jose.JSONWebKey
+		if err := jwkX.UnmarshalJSON(request); err != nil {
+			return nil, fmt.Errorf("invalid recovery request: %w", err)
+		}
+		x, ok := jwkX.Key.(*ecdsa.PublicKey)
+		if !ok || !IsECMRKey(jwkX) || x.Curve != S.Curve {
+			return nil, fmt.Errorf("recovery request is not an ECMR key of the server key curve")
+		}
+		return CreateExchangeKey(algorithm.Multiply(x, S)).MarshalJSON()
+	}, nil
+}
@@ -0,0 +1,37 @@
+package client
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	. "go-citrus/internal"
+)
+
+func TestOfflineRecovery(t *testing.T) {
+	secret := []byte("disk encryption passphrase")
+	cipher, err := NewProtocol(nil).Encrypt(secret, ExchangeKey1.Public())
+	require.NoError(t, err)
+
+	t.Run("exported exchange key decrypts", func(t *testing.T) {
+		recovery, err := OfflineRecovery(ExchangeKey1)
+		require.NoError(t, err)
+		data, err := NewProtocol(recovery).Decrypt(cipher)
+		require.NoError(t, err)
+		require.Equal(t, secret, data)
+	})
+
+	t.Run("keys must match the JWE key ID", func(t *testing.T) {
+		recovery, err := OfflineRecovery(ExchangeKey2)
+		require.NoError(t, err)
+		_, err = NewProtocol(recovery).Decrypt(cipher)
+		require.ErrorContains(t, err, "does not match the JWE key ID")
+	})
+
+	t.Run("only exchange private keys are accepted", func(t *testing.T) {
+		_, err := OfflineRecovery(ExchangeKey1.Public())
+		require.Error(t, err)
+		_, err = OfflineRecovery(SigningKey1)
+		require.Error(t, err)
+	})
+}
@@ -1,6 +1,24 @@
 package client
 
-import "github.com/go-jose/go-jose/v4"
+import (
+	"crypto"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/go-jose/go-jose/v4"
+	josecipher "github.com/go-jose/go-jose/v4/cipher"
+
+	. "go-citrus/internal"
+)
 
 /*
 Custom recovery handler to perform server key recovery call: POST /rec/{thumbprint} + body{x}
@@ -26,19 +44,48 @@ func NewProtocol(recoveryHandler RecoveryFn) *Protocol {
 	c = g * C
 3. Calculate the shared secret K using server's advertised public key 's' and its private key 'C'
 	K = s * C = g * S * C
-4. Construct symmetric key from K
-	symmetric-key = jose.Recipient{Algorithm: ECDH_ES, Key: K.Public(), KeyID: thp(K)}
-5. Encrypt the data using an encryption mode (i.e. AES or AES+HMAC), and return cipher as encoded JWE structure.
+4. Derive symmetric key from K, as ECDH-ES does (Concat KDF over the x-coordinate of K)
+	symmetric-key = ConcatKDF(K.x, "A256GCM")
+5. Encrypt the data using an encryption mode (A256GCM), and return cipher as encoded JWE structure, with kid = thp(s) and epk = c.
 	cipher = encryptionMode-encrypt(data, symmetric-key)
 
-K and C will be discarded so K cannot be used for decrypting data and client remove itself as primary stakeholder for using C to derive K.
+K and C will be discarded (zeroized) so K cannot be used for decrypting data and client remove itself as primary stakeholder for using C to derive K.
 This is where our computing server helps.
 
 Client will keep the cipher to reconstruct the data, with the help of thp(s) and 'c' during recovery operation.
 */
 
-func (t *Protocol) Encrypt(cipher []byte, advServerKey jose.JSONWebKey) ([]byte, error) {
-	return nil, nil
+func (t *Protocol) Encrypt(data []byte, advServerKey jose.JSONWebKey) ([]byte, error) {
+	if !IsExchangeKey(advServerKey) {
+		return nil, fmt.Errorf("advertised key is not an exchange key")
+	}
+	s, ok := advServerKey.Public().Key.(*ecdsa.PublicKey)
+	if !ok {
+		return nil, fmt.Errorf("advertised key is not an EC public key")
+	}
+	thumbs, err := Thumbprints(advServerKey, crypto.SHA256)
+	if err != nil {
+		return nil, err
+	}
+	kid := thumbs[0]
+
+	C, err := ecdsa.GenerateKey(s.Curve, rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	defer WipePrivateKey(C)
+	K := NewECAlgorithm(s.Curve).Multiply(s, C)
+	defer WipePoint(K)
+
+	header := jweHeader{
+		Algorithm:    string(jose.ECDH_ES),
+		Encryption:   string(jose.A256GCM),
+		KeyID:        kid,
+		EphemeralKey: &jose.JSONWebKey{Key: &C.PublicKey},
+		Clevis:       &clevisHeader{Pin: "tang"},
+	}
+	header.Clevis.Tang.Advertisement.Keys = []jose.JSONWebKey{advServerKey.Public()}
+	return sealJWE(header, K, data)
 }
 
 /* ----- Client key recovery and decryption -----
@@ -53,10 +100,211 @@ func (t *Protocol) Encrypt(cipher []byte, advServerKey jose.JSONWebKey) ([]byte,
 5. Recover the original shared secret 'K'
 	K = y - z = (g * S * C + g * S * E) - (g * S * E) = g * S * C
 6. Derive symmetric key from 'K', and decrypt the cipher
-	symmetric-key = go-jose/josecipher.DeriveECDHES(K)
+	symmetric-key = ConcatKDF(K.x, "A256GCM")
 	data = encryptionMode-decrypt(cipher, symmetric-key)
+
+E, z and K are zeroized once the data is decrypted.
 */
 
 func (t *Protocol) Decrypt(cipher []byte) ([]byte, error) {
-	return nil, nil
+	jwe, err := parseJWE(cipher)
+	if err != nil {
+		return nil, err
+	}
+	s, err := jwe.header.serverKey()
+	if err != nil {
+		return nil, err
+	}
+	c := jwe.header.EphemeralKey.Key.(*ecdsa.PublicKey)
+	algorithm := NewECAlgorithm(s.Curve)
+
+	E, err := ecdsa.GenerateKey(s.Curve, rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	defer WipePrivateKey(E)
+	x := CreateExchangeKey(algorithm.Add(c, &E.PublicKey))
+	request, err := x.MarshalJSON()
+	if err != nil {
+		return nil, err
+	}
+
+	response, err := t.recoveryHandler(jwe.header.KeyID, request)
+	if err != nil {
+		return nil, err
+	}
+	var jwkY jose.JSONWebKey
+	if err = jwkY.UnmarshalJSON(response); err != nil {
+		return nil, fmt.Errorf("unable to parse server recovery response: %w", err)
+	}
+	y, ok := jwkY.Key.(*ecdsa.PublicKey)
+	if !ok || y.Curve != s.Curve {
+		return nil, fmt.Errorf("server recovery response is not a point of the exchange key curve")
+	}
+
+	z := algorithm.Multiply(s, E)
+	defer WipePoint(z)
+	K := algorithm.Subtract(y, z)
+	defer WipePoint(K)
+	return jwe.open(K)
+}
+
+/* ----- JWE compact serialization -----
+Encrypted data is a compact JWE, directly encrypted with the ECDH-ES derived key (RFC 7518 4.6), as clevis tang does:
+
+	BASE64URL(header) . (empty encrypted key) . BASE64URL(iv) . BASE64URL(ciphertext) . BASE64URL(tag)
+
+Besides 'epk' (the client key 'c'), the header keeps the advertised server key 's' and its thumbprint in 'kid',
+so that the data can be decrypted without the advertisement.
+*/
+
+type jweHeader struct {
+	Algorithm    string           `json:"alg"`
+	Encryption   string           `json:"enc"`
+	KeyID        string           `json:"kid"`
+	EphemeralKey *jose.JSONWebKey `json:"epk"`
+	PartyUInfo   string           `json:"apu,omitempty"`
+	PartyVInfo   string           `json:"apv,omitempty"`
+	Clevis       *clevisHeader    `json:"clevis,omitempty"`
+}
+
+type clevisHeader struct {
+	Pin  string `json:"pin"`
+	Tang struct {
+		Advertisement jose.JSONWebKeySet `json:"adv"`
+	} `json:"tang"`
+}
+
+// serverKey returns the advertised server key 's' whose thumbprint is the header key ID.
+func (t jweHeader) serverKey() (*ecdsa.PublicKey, error) {
+	if t.Clevis == nil {
+		return nil, fmt.Errorf("JWE header does not contain the advertised server key")
+	}
+	for _, key := range t.Clevis.Tang.Advertisement.Keys {
+		thumbs, err := Thumbprints(key)
+		if err != nil || !slices.Contains(thumbs, t.KeyID) {
+			continue
+		}
+		s, ok := key.Key.(*ecdsa.PublicKey)
+		if !ok || s.Curve != t.EphemeralKey.Key.(*ecdsa.PublicKey).Curve {
+			return nil, fmt.Errorf("advertised server key '%s' is not an EC public key of the 'epk' curve", t.KeyID)
+		}
+		return s, nil
+	}
+	return nil, fmt.Errorf("advertised server key '%s' not found in JWE header", t.KeyID)
+}
+
+type compactJWE struct {
+	header     jweHeader
+	protected  string // encoded header, the additional authenticated data
+	iv         []byte
+	ciphertext []byte
+	tag        []byte
+}
+
+func parseJWE(data []byte) (*compactJWE, error) {
+	parts := strings.Split(strings.TrimSpace(string(data)), ".")
+	if len(parts) != 5 {
+		return nil, fmt.Errorf("data is not a compact JWE")
+	}
+	jwe := compactJWE{protected: parts[0]}
+	decoded := make([][]byte, len(parts))
+	for i, part := range parts {
+		var err error
+		if decoded[i], err = base64.RawURLEncoding.DecodeString(part); err != nil {
+			return nil, fmt.Errorf("invalid JWE encoding: %w", err)
+		}
+	}
+	if err := json.Unmarshal(decoded[0], &jwe.header); err != nil {
+		return nil, fmt.Errorf("invalid JWE header: %w", err)
+	}
+	if jwe.header.Algorithm != string(jose.ECDH_ES) || jwe.header.Encryption != string(jose.A256GCM) || len(decoded[1]) != 0 {
+		return nil, fmt.Errorf("unsupported JWE algorithm '%s' and encryption '%s'", jwe.header.Algorithm, jwe.header.Encryption)
+	}
+	if jwe.header.EphemeralKey == nil {
+		return nil, fmt.Errorf("JWE header does not contain an ephemeral key")
+	}
+	if _, ok := jwe.header.EphemeralKey.Key.(*ecdsa.PublicKey); !ok {
+		return nil, fmt.Errorf("JWE ephemeral key is not an EC public key")
+	}
+	jwe.iv, jwe.ciphertext, jwe.tag = decoded[2], decoded[3], decoded[4]
+	return &jwe, nil
+}
+
+func sealJWE(header jweHeader, K *ecdsa.PublicKey, data []byte) ([]byte, error) {
+	encoded, err := json.Marshal(header)
+	if err != nil {
+		return nil, err
+	}
+	protected := base64.RawURLEncoding.EncodeToString(encoded)
+
+	aead, err := newAEAD(header, K)
+	if err != nil {
+		return nil, err
+	}
+	iv := make([]byte, aead.NonceSize())
+	if _, err = rand.Read(iv); err != nil {
+		return nil, err
+	}
+	sealed := aead.Seal(nil, iv, data, []byte(protected))
+	ciphertext, tag := sealed[:len(data)], sealed[len(data):]
+
+	return []byte(strings.Join([]string{
+		protected,
+		"",
+		base64.RawURLEncoding.EncodeToString(iv),
+		base64.RawURLEncoding.EncodeToString(ciphertext),
+		base64.RawURLEncoding.EncodeToString(tag),
+	}, ".")), nil
+}
+
+func (t *compactJWE) open(K *ecdsa.PublicKey) ([]byte, error) {
+	aead, err := newAEAD(t.header, K)
+	if err != nil {
+		return nil, err
+	}
+	if len(t.iv) != aead.NonceSize() {
+		return nil, fmt.Errorf("invalid JWE initialization vector")
+	}
+	data, err := aead.Open(nil, t.iv, append(slices.Clip(t.ciphertext), t.tag...), []byte(t.protected))
+	if err != nil {
+		return nil, errors.New("unable to decrypt JWE, the recovered key does not match")
+	}
+	return data, nil
+}
+
+// newAEAD derives the content encryption key from the shared secret 'K' (RFC 7518 4.6.2).
+// The derived key is wiped once the cipher is set up, the AES key schedule keeps its own expansion of it.
+func newAEAD(header jweHeader, K *ecdsa.PublicKey) (cipher.AEAD, error) {
+	apu, err := base64.RawURLEncoding.DecodeString(header.PartyUInfo)
+	if err != nil {
+		return nil, fmt.Errorf("invalid JWE 'apu': %w", err)
+	}
+	apv, err := base64.RawURLEncoding.DecodeString(header.PartyVInfo)
+	if err != nil {
+		return nil, fmt.Errorf("invalid JWE 'apv': %w", err)
+	}
+
+	const size = 32 // A256GCM
+	z := make([]byte, (K.Curve.Params().BitSize+7)/8)
+	defer WipeBytes(z)
+	K.X.FillBytes(z)
+	supPubInfo := binary.BigEndian.AppendUint32(nil, size*8)
+	kdf := josecipher.NewConcatKDF(crypto.SHA256, z,
+		lengthPrefixed([]byte(header.Encryption)), lengthPrefixed(apu), lengthPrefixed(apv), supPubInfo, nil)
+
+	cek := make([]byte, size)
+	defer WipeBytes(cek)
+	if _, err = kdf.Read(cek); err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(cek)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func lengthPrefixed(data []byte) []byte {
+	return append(binary.BigEndian.AppendUint32(nil, uint32(len(data))), data...)
 }
@@ -0,0 +1,97 @@
+package client
+
+import (
+	"crypto/ecdsa"
+	"fmt"
+	"testing"
+
+	"github.com/go-jose/go-jose/v4"
+	"github.com/stretchr/testify/require"
+
+	. "go-citrus/internal"
+)
+
+func TestProtocol(t *testing.T) {
+	server := newTestProtocol(t)
+	client := NewProtocol(server.Recover)
+	secret := []byte("disk encryption passphrase")
+
+	t.Run("encrypt then recover", func(t *testing.T) {
+		cipher, err := client.Encrypt(secret, ExchangeKey1.Public())
+		require.NoError(t, err)
+		require.NotContains(t, string(cipher), string(secret))
+
+		data, err := client.Decrypt(cipher)
+		require.NoError(t, err)
+		require.Equal(t, secret, data)
+	})
+
+	t.Run("signing keys are refused", func(t *testing.T) {
+		_, err := client.Encrypt(secret, SigningKey1.Public())
+		require.Error(t, err)
+	})
+
+	t.Run("recovery errors are returned", func(t *testing.T) {
+		cipher, err := client.Encrypt(secret, ExchangeKey1.Public())
+		require.NoError(t, err)
+		failing := NewProtocol(func(string, []byte) ([]byte, error) {
+			return nil, fmt.Errorf("server unreachable")
+		})
+		_, err = failing.Decrypt(cipher)
+		require.ErrorContains(t, err, "server unreachable")
+	})
+
+	t.Run("recovery with another key does not decrypt", func(t *testing.T) {
+		cipher, err := client.Encrypt(secret, ExchangeKey1.Public())
+		require.NoError(t, err)
+		wrong := NewProtocol(func(_ string, x []byte) ([]byte, error) {
+			var jwkX jose.JSONWebKey
+			require.NoError(t, jwkX.UnmarshalJSON(x))
+			point := jwkX.Key.(*ecdsa.PublicKey)
+			y := NewECAlgorithm(point.Curve).Multiply(point, ExchangeKey2.Key.(*ecdsa.PrivateKey))
+			return CreateExchangeKey(y).MarshalJSON()
+		})
+		_, err = wrong.Decrypt(cipher)
+		require.ErrorContains(t, err, "does not match")
+	})
+
+	t.Run("invalid JWE", func(t *testing.T) {
+		_, err := client.Decrypt([]byte("not.a.jwe"))
+		require.Error(t, err)
+	})
+}
+
+func TestProtocol_JOSECompatibility(t *testing.T) {
+	client := NewProtocol(newTestProtocol(t).Recover)
+	secret := []byte("disk encryption passphrase")
+
+	t.Run("decrypted by the server key", func(t *testing.T) {
+		cipher, err := client.Encrypt(secret, ExchangeKey1.Public())
+		require.NoError(t, err)
+
+		jwe, err := jose.ParseEncrypted(string(cipher), []jose.KeyAlgorithm{jose.ECDH_ES}, []jose.ContentEncryption{jose.A256GCM})
+		require.NoError(t, err)
+		data, err := jwe.Decrypt(ExchangeKey1.Key)
+		require.NoError(t, err)
+		require.Equal(t, secret, data)
+	})
+
+	t.Run("encrypted to the server key", func(t *testing.T) {
+		public := ExchangeKey1.Public()
+		options := (&jose.EncrypterOptions{}).WithHeader("clevis", map[string]interface{}{
+			"pin":  "tang",
+			"tang": map[string]interface{}{"adv": jose.JSONWebKeySet{Keys: []jose.JSONWebKey{public}}},
+		})
+		encrypter, err := jose.NewEncrypter(jose.A256GCM,
+			jose.Recipient{Algorithm: jose.ECDH_ES, Key: public.Key, KeyID: ExchangeKey1Thp}, options)
+		require.NoError(t, err)
+		jwe, err := encrypter.Encrypt(secret)
+		require.NoError(t, err)
+		cipher, err := jwe.CompactSerialize()
+		require.NoError(t, err)
+
+		data, err := client.Decrypt([]byte(cipher))
+		require.NoError(t, err)
+		require.Equal(t, secret, data)
+	})
+}
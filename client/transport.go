@@ -0,0 +1,246 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/go-jose/go-jose/v4"
+
+	. "go-citrus/internal"
+)
+
+/*
+HTTP transport to a Tang server, reached by URL or through a Unix domain socket:
+  - Advertisement - GET  {url}/adv[/{thumbprint}], verified by VerifiedAdvertisement
+  - Recover       - POST {url}/rec/{thumbprint}, usable as RecoveryFn, waits for approvals with WithApprovalWait
+  - Admin         - POST {url}{path}, signed admin API requests (see server.AdminPath and server.SignAdminRequest)
+*/
+const (
+	recoveryContentType = "application/jwk+json"
+	adminContentType    = "application/jose"
+
+	defaultTimeout  = 30 * time.Second
+	maxResponseSize = 1024 * 1024
+)
+
+// Host name sent to servers reached through a Unix domain socket.
+const unixHost = "localhost"
+
+// Header carrying the approval ticket of a recovery, both ways.
+const ticketHeader = "Citrus-Ticket"
+
+type Transport struct {
+	url       string
+	transport *http.Transport
+	client    *http.Client
+
+	approvalPoll    time.Duration // interval between the retries of a recovery waiting for approvals, 0 does not wait
+	approvalTimeout time.Duration
+
+	signatureAlgorithms []jose.SignatureAlgorithm // accepted by VerifiedAdvertisement
+}
+
+// ApprovalPendingError is returned by Recover for a recovery still waiting for operator approvals.
+type ApprovalPendingError struct {
+	Ticket    string    `json:"ticket"`
+	Approvals int       `json:"approvals"`
+	Required  int       `json:"required"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+func (e *ApprovalPendingError) Error() string {
+	return fmt.Sprintf("recovery waiting for approvals (%d/%d), ticket '%s'", e.Approvals, e.Required, e.Ticket)
+}
+
+func NewTransport(url string) *Transport {
+	transport := &http.Transport{Proxy: http.ProxyFromEnvironment}
+	return &Transport{
+		url:                 strings.TrimSuffix(url, "/"),
+		transport:           transport,
+		client:              &http.Client{Transport: transport, Timeout: defaultTimeout},
+		signatureAlgorithms: SigningAlgorithms,
+	}
+}
+
+// NewUnixTransport reaches the server through the Unix domain socket at path, e.g. a local proxy.
+func NewUnixTransport(path string) *Transport {
+	t := NewTransport("http://" + unixHost)
+	t.transport.Proxy = nil
+	t.transport.DialContext = func(ctx context.Context, _ string, _ string) (net.Conn, error) {
+		var dialer net.Dialer
+		return dialer.DialContext(ctx, "unix", path)
+	}
+	return t
+}
+
+// WithTLS sets the TLS configuration used for https URLs, see TLSOptions.
+func (t *Transport) WithTLS(config *tls.Config) *Transport {
+	t.transport.TLSClientConfig = config
+	return t
+}
+
+// WithApprovalWait makes Recover wait up to timeout for operator approvals, retrying every interval.
+// Without, Recover fails right away with an ApprovalPendingError.
+func (t *Transport) WithApprovalWait(interval time.Duration, timeout time.Duration) *Transport {
+	t.approvalPoll = interval
+	t.approvalTimeout = timeout
+	return t
+}
+
+// Advertisement fetches the advertisement signed by the signing key with the given thumbprint, or the default one.
+func (t *Transport) Advertisement(thumbprint string) ([]byte, error) {
+	url := t.url + "/adv"
+	if thumbprint != "" {
+		url += "/" + thumbprint
+	}
+	resp, err := t.client.Get(url)
+	if err != nil {
+		return nil, err
+	}
+	return readResponse(resp)
+}
+
+// WithSignatureAlgorithms restricts the advertisement signature algorithms accepted by VerifiedAdvertisement,
+// every one of SigningAlgorithms by default.
+func (t *Transport) WithSignatureAlgorithms(algorithms ...jose.SignatureAlgorithm) *Transport {
+	t.signatureAlgorithms = algorithms
+	return t
+}
+
+// VerifiedAdvertisement fetches an advertisement like Advertisement, and verifies its signatures.
+// Advertisements whose signatures all use disallowed algorithms are rejected, see WithSignatureAlgorithms.
+// With a thumbprint, the signing key it names must be among the verified ones.
+func (t *Transport) VerifiedAdvertisement(thumbprint string) (*Advertisement, error) {
+	data, err := t.Advertisement(thumbprint)
+	if err != nil {
+		return nil, err
+	}
+	adv, err := ParseAdvertisement(data, t.signatureAlgorithms)
+	if err != nil {
+		return nil, fmt.Errorf("invalid advertisement: %w", err)
+	}
+	if thumbprint == "" {
+		return adv, nil
+	}
+	for _, key := range adv.SigningKeys() {
+		thumbs, err := Thumbprints(key)
+		if err != nil {
+			return nil, err
+		}
+		if slices.Contains(thumbs, thumbprint) {
+			return adv, nil
+		}
+	}
+	return nil, fmt.Errorf("advertisement is not signed by the signing key '%s' with an allowed algorithm", thumbprint)
+}
+
+// Recover sends the recovery request 'x' for the exchange key with the given thumbprint, and returns 'y'.
+// Recoveries waiting for approvals are retried with the same 'x' and their ticket, see WithApprovalWait.
+func (t *Transport) Recover(thumbprint string, x []byte) ([]byte, error) {
+	deadline := time.Now().Add(t.approvalTimeout)
+	ticket := ""
+	for {
+		req, err := http.NewRequest(http.MethodPost, t.url+"/rec/"+thumbprint, bytes.NewReader(x))
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Content-Type", recoveryContentType)
+		if ticket != "" {
+			req.Header.Set(ticketHeader, ticket)
+		}
+		resp, err := t.client.Do(req)
+		if err != nil {
+			return nil, err
+		}
+		if resp.StatusCode != http.StatusAccepted {
+			return readResponse(resp)
+		}
+
+		pending, err := readTicket(resp)
+		if err != nil {
+			return nil, err
+		}
+		if t.approvalPoll <= 0 || time.Now().Add(t.approvalPoll).After(deadline) {
+			return nil, pending
+		}
+		ticket = pending.Ticket
+		time.Sleep(t.approvalPoll)
+	}
+}
+
+func readTicket(resp *http.Response) (*ApprovalPendingError, error) {
+	body, err := readResponse(resp)
+	if err != nil {
+		return nil, err
+	}
+	var pending ApprovalPendingError
+	if err = json.Unmarshal(body, &pending); err != nil || pending.Ticket == "" {
+		return nil, fmt.Errorf("invalid approval ticket from server")
+	}
+	return &pending, nil
+}
+
+// Admin sends a signed admin request to path, and returns the response body, empty for actions without result.
+func (t *Transport) Admin(path string, request []byte) ([]byte, error) {
+	resp, err := t.client.Post(t.url+path, adminContentType, bytes.NewReader(request))
+	if err != nil {
+		return nil, err
+	}
+	return readResponse(resp)
+}
+
+func readResponse(resp *http.Response) ([]byte, error) {
+	defer resp.Body.Close()
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxResponseSize))
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusAccepted && resp.StatusCode != http.StatusNoContent {
+		return nil, fmt.Errorf("server answered %s: %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+	return body, nil
+}
+
+// TLSOptions are the PEM files used to reach a server over TLS.
+type TLSOptions struct {
+	CAFile     string // server CA bundle, the system roots when empty
+	CertFile   string // client certificate, for servers requiring mutual TLS
+	KeyFile    string
+	ServerName string // expected server name, when it differs from the URL host
+}
+
+func (t TLSOptions) Config() (*tls.Config, error) {
+	config := &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		ServerName: t.ServerName,
+	}
+	if t.CAFile != "" {
+		data, err := os.ReadFile(t.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		config.RootCAs = x509.NewCertPool()
+		if !config.RootCAs.AppendCertsFromPEM(data) {
+			return nil, fmt.Errorf("no certificate found in CA bundle '%s'", t.CAFile)
+		}
+	}
+	if t.CertFile != "" || t.KeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(t.CertFile, t.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	return config, nil
+}
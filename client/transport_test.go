@@ -0,0 +1,183 @@
+package client
+
+import (
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/go-jose/go-jose/v4"
+	"github.com/stretchr/testify/require"
+
+	. "go-citrus/internal"
+	"go-citrus/server"
+)
+
+func newTestProtocol(t *testing.T) *server.Protocol {
+	protocol, err := server.NewProtocol(server.NewMemoryKeyStore(KeyList{ExchangeKey1, SigningKey1}))
+	require.NoError(t, err)
+	return protocol
+}
+
+// requireTransport fetches an advertisement and performs a recovery through transport.
+func requireTransport(t *testing.T, transport *Transport) {
+	data, err := transport.Advertisement("")
+	require.NoError(t, err)
+	adv, err := ParseAdvertisement(data, []jose.SignatureAlgorithm{DefaultSignatureAlgorithm})
+	require.NoError(t, err)
+	require.Len(t, adv.ExchangeKeys(), 1)
+
+	_, err = transport.Advertisement(SigningKey1Thp)
+	require.NoError(t, err)
+
+	x, err := GenerateExchangeKey()
+	require.NoError(t, err)
+	public := x.Public()
+	request, err := public.MarshalJSON()
+	require.NoError(t, err)
+	response, err := transport.Recover(ExchangeKey1Thp, request)
+	require.NoError(t, err)
+	var y jose.JSONWebKey
+	require.NoError(t, y.UnmarshalJSON(response))
+	require.True(t, IsExchangeKey(y))
+
+	_, err = transport.Recover(ExchangeKey2Thp, request)
+	require.ErrorContains(t, err, "404")
+}
+
+func TestTransport(t *testing.T) {
+	t.Run("plain HTTP", func(t *testing.T) {
+		srv := httptest.NewServer(server.NewHandler(newTestProtocol(t)))
+		t.Cleanup(srv.Close)
+		requireTransport(t, NewTransport(srv.URL+"/"))
+	})
+
+	t.Run("Unix domain socket", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "citrus.sock")
+		listener, err := server.ListenUnix(path, 0o600, -1, -1)
+		require.NoError(t, err)
+		srv := &http.Server{Handler: server.NewHandler(newTestProtocol(t))}
+		go func() { _ = srv.Serve(listener) }()
+		t.Cleanup(func() { _ = srv.Close() })
+
+		requireTransport(t, NewUnixTransport(path))
+
+		_, err = NewUnixTransport(filepath.Join(t.TempDir(), "missing.sock")).Advertisement("")
+		require.Error(t, err)
+	})
+
+	t.Run("mutual TLS", func(t *testing.T) {
+		pki, err := WriteTestPKI(t.TempDir(), "unlock-agent")
+		require.NoError(t, err)
+		reloader, err := server.NewTLSReloader(server.TLSFiles{CertFile: pki.ServerCertFile, KeyFile: pki.ServerKeyFile, ClientCAFile: pki.CAFile})
+		require.NoError(t, err)
+		srv := httptest.NewUnstartedServer(server.NewHandler(newTestProtocol(t)))
+		srv.TLS = reloader.Config()
+		srv.StartTLS()
+		t.Cleanup(srv.Close)
+
+		config, err := TLSOptions{CAFile: pki.CAFile, CertFile: pki.ClientCertFile, KeyFile: pki.ClientKeyFile}.Config()
+		require.NoError(t, err)
+		requireTransport(t, NewTransport(srv.URL).WithTLS(config))
+
+		config, err = TLSOptions{CAFile: pki.CAFile}.Config()
+		require.NoError(t, err)
+		_, err = NewTransport(srv.URL).WithTLS(config).Advertisement("")
+		require.Error(t, err)
+	})
+}
+
+func TestTransport_VerifiedAdvertisement(t *testing.T) {
+	eddsa, err := GenerateSigningKeyWith(jose.EdDSA)
+	require.NoError(t, err)
+	eddsaThumbs, err := Thumbprints(eddsa)
+	require.NoError(t, err)
+	protocol, err := server.NewProtocol(server.NewMemoryKeyStore(KeyList{ExchangeKey1, SigningKey1, eddsa}))
+	require.NoError(t, err)
+	srv := httptest.NewServer(server.NewHandler(protocol))
+	t.Cleanup(srv.Close)
+
+	t.Run("every algorithm", func(t *testing.T) {
+		adv, err := NewTransport(srv.URL).VerifiedAdvertisement("")
+		require.NoError(t, err)
+		require.Len(t, adv.SigningKeys(), 2)
+		require.Len(t, adv.ExchangeKeys(), 1)
+
+		_, err = NewTransport(srv.URL).VerifiedAdvertisement(eddsaThumbs[0])
+		require.NoError(t, err)
+	})
+
+	t.Run("restricted algorithms", func(t *testing.T) {
+		transport := NewTransport(srv.URL).WithSignatureAlgorithms(jose.EdDSA)
+		adv, err := transport.VerifiedAdvertisement("")
+		require.NoError(t, err)
+		require.Len(t, adv.SigningKeys(), 1)
+
+		_, err = transport.VerifiedAdvertisement(SigningKey1Thp)
+		require.Error(t, err)
+
+		_, err = NewTransport(srv.URL).WithSignatureAlgorithms(jose.ES256).VerifiedAdvertisement("")
+		require.ErrorContains(t, err, "not signed with any allowed algorithm")
+	})
+}
+
+func TestTransport_ApprovalWait(t *testing.T) {
+	dir := t.TempDir()
+	for _, key := range []jose.JSONWebKey{ExchangeKey1, SigningKey1} {
+		_, err := server.WriteKey(dir, key, nil)
+		require.NoError(t, err)
+	}
+	protocol, err := server.NewProtocolFromDir(dir, nil)
+	require.NoError(t, err)
+	rotator := server.NewRotator(protocol, dir, nil, server.RotationPolicy{}, slog.New(slog.NewTextHandler(io.Discard, nil)))
+	require.NoError(t, rotator.SetApprovals(ExchangeKey1Thp, 1))
+	queue := server.NewApprovalQueue(time.Hour)
+	protocol.SetApprovalQueue(queue)
+	srv := httptest.NewServer(server.NewHandler(protocol))
+	t.Cleanup(srv.Close)
+
+	x, err := GenerateExchangeKey()
+	require.NoError(t, err)
+	public := x.Public()
+	request, err := public.MarshalJSON()
+	require.NoError(t, err)
+
+	t.Run("pending recoveries fail without wait", func(t *testing.T) {
+		_, err := NewTransport(srv.URL).Recover(ExchangeKey1Thp, request)
+		var pending *ApprovalPendingError
+		require.ErrorAs(t, err, &pending)
+		require.NotEmpty(t, pending.Ticket)
+		require.Equal(t, 0, pending.Approvals)
+		require.Equal(t, 1, pending.Required)
+	})
+
+	t.Run("recoveries wait until approved", func(t *testing.T) {
+		done := make(chan struct{})
+		go func() {
+			for {
+				select {
+				case <-done:
+					return
+				case <-time.After(10 * time.Millisecond):
+				}
+				for _, ticket := range queue.Pending() {
+					_, _ = queue.Approve(ticket.ID, "alice")
+				}
+			}
+		}()
+		response, err := NewTransport(srv.URL).WithApprovalWait(20*time.Millisecond, 5*time.Second).Recover(ExchangeKey1Thp, request)
+		close(done)
+		require.NoError(t, err)
+		var y jose.JSONWebKey
+		require.NoError(t, y.UnmarshalJSON(response))
+	})
+
+	t.Run("waits time out", func(t *testing.T) {
+		_, err := NewTransport(srv.URL).WithApprovalWait(20*time.Millisecond, 100*time.Millisecond).Recover(ExchangeKey1Thp, request)
+		var pending *ApprovalPendingError
+		require.ErrorAs(t, err, &pending)
+	})
+}
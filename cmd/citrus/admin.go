@@ -0,0 +1,135 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/go-jose/go-jose/v4"
+
+	"go-citrus/client"
+	"go-citrus/server"
+)
+
+var adminActions = []string{
+	server.AdminActionList, server.AdminActionGenerate, server.AdminActionRotate,
+	server.AdminActionDemote, server.AdminActionRetire, server.AdminActionReload,
+	server.AdminActionRequireApprovals, server.AdminActionPending, server.AdminActionApprove,
+}
+
+// citrus admin -url URL -key FILE [-use KIND [-alg ALG]] [-approvals N] <list|generate|rotate|demote|retire|reload|require-approvals|pending|approve> [THUMBPRINT|TICKET]
+func runAdmin(args []string) error {
+	fs := flag.NewFlagSet("admin", flag.ContinueOnError)
+	url := fs.String("url", "http://localhost:8081", "admin API `url`, or unix:PATH for a Unix domain socket")
+	keyFile := fs.String("key", "", "operator private JWK `file`, its \"kid\" naming the operator")
+	use := fs.String("use", server.KeyKindExchange, "`kind` of key to generate: exchange or signing")
+	alg := fs.String("alg", "", "`algorithm` of the signing key to generate: ES256, ES384, ES512 or EdDSA (default ES512)")
+	approvals := fs.Int("approvals", 1, "`number` of operator approvals required by require-approvals, 0 disables them")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() == 0 {
+		return fmt.Errorf("missing admin action, one of: %s", strings.Join(adminActions, ", "))
+	}
+	action, thumbprint := fs.Arg(0), fs.Arg(1)
+	switch action {
+	case server.AdminActionDemote, server.AdminActionRetire, server.AdminActionRequireApprovals:
+		if thumbprint == "" {
+			return fmt.Errorf("missing thumbprint of the key to %s", action)
+		}
+	case server.AdminActionApprove:
+		if thumbprint == "" {
+			return fmt.Errorf("missing ticket to approve")
+		}
+	case server.AdminActionList, server.AdminActionGenerate, server.AdminActionRotate, server.AdminActionReload,
+		server.AdminActionPending:
+		thumbprint = ""
+	default:
+		return fmt.Errorf("unknown admin action '%s', one of: %s", action, strings.Join(adminActions, ", "))
+	}
+	if *keyFile == "" {
+		return fmt.Errorf("missing -key operator key file")
+	}
+
+	data, err := os.ReadFile(*keyFile)
+	if err != nil {
+		return err
+	}
+	var key jose.JSONWebKey
+	if err = key.UnmarshalJSON(data); err != nil {
+		return fmt.Errorf("unable to parse operator key '%s': %w", *keyFile, err)
+	}
+
+	// The positional argument of approve is a ticket, not a key thumbprint.
+	target := thumbprint
+	if action == server.AdminActionApprove {
+		thumbprint = ""
+	}
+	request, err := server.NewAdminRequest(action, thumbprint)
+	if err != nil {
+		return err
+	}
+	switch action {
+	case server.AdminActionGenerate:
+		request.Use, request.Algorithm = *use, *alg
+	case server.AdminActionRequireApprovals:
+		request.Approvals = *approvals
+	case server.AdminActionApprove:
+		request.Ticket = target
+	}
+	signed, err := server.SignAdminRequest(key, request)
+	if err != nil {
+		return err
+	}
+
+	transport := client.NewTransport(*url)
+	if path, ok := strings.CutPrefix(*url, "unix:"); ok {
+		transport = client.NewUnixTransport(path)
+	}
+	response, err := transport.Admin(server.AdminPath(action, target), signed)
+	if err != nil {
+		return err
+	}
+
+	switch action {
+	case server.AdminActionList:
+		var keys []server.KeyInfo
+		if err = json.Unmarshal(response, &keys); err != nil {
+			return err
+		}
+		return printKeys(keys)
+	case server.AdminActionGenerate:
+		var generated map[string]string
+		if err = json.Unmarshal(response, &generated); err != nil {
+			return err
+		}
+		fmt.Println(generated["thumbprint"])
+	case server.AdminActionPending:
+		var tickets []server.Ticket
+		if err = json.Unmarshal(response, &tickets); err != nil {
+			return err
+		}
+		return printTickets(tickets)
+	case server.AdminActionApprove:
+		var ticket server.Ticket
+		if err = json.Unmarshal(response, &ticket); err != nil {
+			return err
+		}
+		fmt.Printf("%s: %d/%d approvals\n", ticket.ID, len(ticket.Approvers), ticket.Required)
+	}
+	return nil
+}
+
+func printTickets(tickets []server.Ticket) error {
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "TICKET\tTHUMBPRINT\tCLIENT\tSUBJECT\tAPPROVALS\tAPPROVERS\tEXPIRES")
+	for _, ticket := range tickets {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%d/%d\t%s\t%s\n",
+			ticket.ID, ticket.Thumbprint, ticket.Client, ticket.Subject, len(ticket.Approvers), ticket.Required,
+			strings.Join(ticket.Approvers, ","), formatTime(&ticket.ExpiresAt))
+	}
+	return w.Flush()
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/go-jose/go-jose/v4"
+
+	"go-citrus/internal"
+	"go-citrus/server"
+)
+
+var auditCommands = map[string]command{
+	"verify": {"check the hash chain and checkpoint signatures of audit files", runAuditVerify},
+}
+
+// citrus audit <command> [flags]
+func runAudit(args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("missing audit command, one of: %s", strings.Join(commandNames(auditCommands), ", "))
+	}
+	cmd, ok := auditCommands[args[0]]
+	if !ok {
+		return fmt.Errorf("unknown audit command '%s', one of: %s", args[0], strings.Join(commandNames(auditCommands), ", "))
+	}
+	return cmd.run(args[1:])
+}
+
+// citrus audit verify [-d DIR [passphrase flags]] [-adv FILE...] [-keys FILE...] [-partial] [-allow-unsealed]
+// [-expect-seq SEQ [-expect-head HEAD]] FILE...
+// Truncation right after a checkpoint is only detected up to the expected entry, e.g. the last checkpoint reported
+// by a previous verification and kept apart from the audit files.
+func runAuditVerify(args []string) error {
+	fs := flag.NewFlagSet("audit verify", flag.ContinueOnError)
+	dir := fs.String("d", "", "take the signing keys from key `directory`, rotated keys included")
+	var advFiles, keyFiles fileFlags
+	fs.Var(&advFiles, "adv", "take the signing keys from a saved advertisement `file`, may be repeated")
+	fs.Var(&keyFiles, "keys", "take the signing keys from a JWK set `file` of public keys, e.g. retired ones, may be repeated")
+	partial := fs.Bool("partial", false, "accept a chain whose first entries were rotated away")
+	allowUnsealed := fs.Bool("allow-unsealed", false, "accept records after the last checkpoint, e.g. for a live audit file")
+	expectSeq := fs.Int64("expect-seq", -1, "require the chain to reach the entry `seq`, e.g. the last checkpoint of a previous verification")
+	expectHead := fs.String("expect-head", "", "require the -expect-seq entry to have the `hash` reported by a previous verification")
+	var pass passphraseFlags
+	pass.register(fs)
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() == 0 {
+		return fmt.Errorf("missing audit files, oldest first")
+	}
+	var anchor *server.AuditAnchor
+	switch {
+	case *expectSeq >= 0:
+		anchor = &server.AuditAnchor{Seq: uint64(*expectSeq), Head: *expectHead}
+	case *expectHead != "":
+		return fmt.Errorf("-expect-head requires -expect-seq")
+	}
+
+	keys, err := auditSigningKeys(*dir, advFiles, keyFiles, pass)
+	if err != nil {
+		return err
+	}
+
+	var files []io.Reader
+	for _, name := range fs.Args() {
+		file, err := os.Open(name)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		files = append(files, file)
+	}
+
+	result, err := server.VerifyAuditChain(files, keys, *partial, anchor)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("verified %d entries from seq %d, %d checkpoints\n", result.Entries, result.First, result.Checkpoints)
+	if result.Checkpoints > 0 {
+		fmt.Printf("last checkpoint: %s, keep it apart to detect truncations with -expect-seq and -expect-head\n", result.Sealed)
+	}
+	if result.Unsealed > 0 && !*allowUnsealed {
+		return fmt.Errorf("%d records after the last checkpoint are not sealed, the audit file may have been truncated", result.Unsealed)
+	}
+	return nil
+}
+
+func auditSigningKeys(dir string, advFiles []string, keyFiles []string, pass passphraseFlags) (internal.KeyList, error) {
+	var keys internal.KeyList
+	if dir != "" {
+		passphrase, err := pass.source()
+		if err != nil {
+			return nil, err
+		}
+		active, err := server.LoadKeys(dir, passphrase)
+		if err != nil {
+			return nil, err
+		}
+		rotated, err := server.LoadRotatedKeys(dir, passphrase)
+		if err != nil {
+			return nil, err
+		}
+		for _, key := range append(active, rotated...) {
+			if internal.IsSigningKey(key) {
+				keys = append(keys, key.Public())
+			}
+		}
+	}
+	for _, path := range advFiles {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		adv, err := internal.ParseAdvertisement(data, internal.SigningAlgorithms)
+		if err != nil {
+			return nil, fmt.Errorf("advertisement '%s': %w", path, err)
+		}
+		keys = append(keys, adv.SigningKeys()...)
+	}
+	for _, path := range keyFiles {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		var set jose.JSONWebKeySet
+		if err = json.Unmarshal(data, &set); err != nil {
+			return nil, fmt.Errorf("unable to parse signing keys '%s': %w", path, err)
+		}
+		for _, key := range set.Keys {
+			if !key.IsPublic() {
+				return nil, fmt.Errorf("signing keys in '%s' must be public keys", path)
+			}
+			keys = append(keys, key)
+		}
+	}
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("no signing key given, use -d, -adv or -keys")
+	}
+	return keys, nil
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/go-jose/go-jose/v4"
+
+	"go-citrus/server"
+)
+
+const backupFile = "backup.jwe"
+
+// citrus keys backup -d DIR -out DIR -shares N -threshold T [-recipients FILE] [passphrase flags]
+func runKeysBackup(args []string) error {
+	fs := flag.NewFlagSet("keys backup", flag.ContinueOnError)
+	dir := fs.String("d", "/var/db/citrus", "key `directory`")
+	out := fs.String("out", "", "`directory` receiving the backup and one share file per administrator")
+	shares := fs.Int("shares", 0, "`number` of administrator shares")
+	threshold := fs.Int("threshold", 0, "`number` of shares required to restore the backup")
+	recipients := fs.String("recipients", "", "JWK set `file` of the administrator public keys, one per share, encrypting their shares")
+	var pass passphraseFlags
+	pass.register(fs)
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *out == "" {
+		return fmt.Errorf("missing -out directory")
+	}
+
+	var admins []jose.JSONWebKey
+	if *recipients != "" {
+		data, err := os.ReadFile(*recipients)
+		if err != nil {
+			return err
+		}
+		var set jose.JSONWebKeySet
+		if err = json.Unmarshal(data, &set); err != nil {
+			return fmt.Errorf("unable to parse recipients '%s': %w", *recipients, err)
+		}
+		if len(set.Keys) != *shares {
+			return fmt.Errorf("%d recipients given for %d shares", len(set.Keys), *shares)
+		}
+		for _, key := range set.Keys {
+			if key.KeyID == "" || !key.IsPublic() {
+				return fmt.Errorf("recipients must be public keys with a key ID")
+			}
+		}
+		admins = set.Keys
+	}
+
+	passphrase, err := pass.source()
+	if err != nil {
+		return err
+	}
+	backup, split, err := server.CreateBackup(*dir, passphrase, *shares, *threshold)
+	if err != nil {
+		return err
+	}
+
+	if err = os.MkdirAll(*out, 0o700); err != nil {
+		return err
+	}
+	if err = os.WriteFile(filepath.Join(*out, backupFile), backup, 0o600); err != nil {
+		return err
+	}
+	fmt.Println(filepath.Join(*out, backupFile))
+	for i, share := range split {
+		name := "share-" + strconv.Itoa(share.Index) + ".json"
+		var recipient *jose.JSONWebKey
+		if admins != nil {
+			recipient = &admins[i]
+			name = "share-" + recipient.KeyID + ".jwe"
+		}
+		data, err := server.EncryptShare(share, recipient)
+		if err != nil {
+			return err
+		}
+		path := filepath.Join(*out, name)
+		if err = os.WriteFile(path, data, 0o600); err != nil {
+			return err
+		}
+		fmt.Println(path)
+	}
+	return nil
+}
+
+// citrus keys restore -d DIR -backup FILE [-key FILE]... [passphrase flags] SHARE...
+func runKeysRestore(args []string) error {
+	fs := flag.NewFlagSet("keys restore", flag.ContinueOnError)
+	dir := fs.String("d", "/var/db/citrus", "key `directory` to restore, holding no key yet")
+	backupPath := fs.String("backup", "", "backup `file` written by keys backup")
+	var keyFiles fileFlags
+	fs.Var(&keyFiles, "key", "administrator private JWK `file` decrypting encrypted shares, may be repeated")
+	var pass passphraseFlags
+	pass.register(fs)
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *backupPath == "" {
+		return fmt.Errorf("missing -backup file")
+	}
+	if fs.NArg() == 0 {
+		return fmt.Errorf("missing share files")
+	}
+
+	var keys []jose.JSONWebKey
+	for _, path := range keyFiles {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		var key jose.JSONWebKey
+		if err = key.UnmarshalJSON(data); err != nil {
+			return fmt.Errorf("unable to parse administrator key '%s': %w", path, err)
+		}
+		keys = append(keys, key)
+	}
+
+	backup, err := os.ReadFile(*backupPath)
+	if err != nil {
+		return err
+	}
+	var shares []server.BackupShare
+	for _, path := range fs.Args() {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		share, err := server.ParseShare(data, keys...)
+		if err != nil {
+			return fmt.Errorf("%s: %w", path, err)
+		}
+		shares = append(shares, share)
+	}
+
+	passphrase, err := pass.source()
+	if err != nil {
+		return err
+	}
+	if err = os.MkdirAll(*dir, 0o700); err != nil {
+		return err
+	}
+	count, err := server.RestoreBackup(backup, shares, *dir, passphrase)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("restored %d keys to %s\n", count, *dir)
+	return nil
+}
+
+// fileFlags collects repeated file flags.
+type fileFlags []string
+
+func (t *fileFlags) String() string {
+	return strings.Join(*t, ",")
+}
+
+func (t *fileFlags) Set(value string) error {
+	*t = append(*t, value)
+	return nil
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"go-citrus/server"
+)
+
+// citrus server check-config [-config FILE] [flags]
+// Validates the settings, and loads every file they name, without listening nor changing any key directory.
+func runServerCheckConfig(args []string) error {
+	config, err := serverConfig("server check-config", args)
+	if err != nil {
+		return err
+	}
+	pass := passphraseFlags(config.Keys.Passphrase)
+	passphrase, err := pass.source()
+	if err != nil {
+		return err
+	}
+
+	var errs []error
+	check := func(what string, err error) {
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", what, err))
+		}
+	}
+	if config.Keys.Seed.File != "" {
+		store, err := newDerivedKeyStore(config.Keys.Seed)
+		if err == nil {
+			err = checkKeyStore(store)
+		}
+		check("keys.seed", err)
+	} else {
+		check("keys.dir", checkKeyDir(config.Keys.Dir, passphrase))
+	}
+	for _, ns := range config.Namespaces {
+		check(fmt.Sprintf("namespace '%s'", ns.Name), checkKeyDir(ns.Dir, passphrase))
+	}
+
+	if config.TLS.Cert != "" {
+		_, err := server.NewTLSReloader(tlsFiles(config.TLS))
+		check("tls", err)
+	}
+	if config.Policy != "" {
+		_, err := server.LoadPolicy(config.Policy)
+		check("policy", err)
+	}
+	if config.Admin.Operators != "" {
+		_, err := server.LoadOperatorKeys(config.Admin.Operators)
+		check("admin.operators", err)
+	}
+	if config.Replication.Replicas != "" {
+		_, err := server.LoadReplicas(config.Replication.Replicas)
+		check("replication.replicas", err)
+		_, err = readKeyFile(config.Replication.Key, pass)
+		check("replication.key", err)
+	}
+	if config.Replication.ReplicaKey != "" {
+		_, err := readKeyFile(config.Replication.ReplicaKey, pass)
+		check("replication.replica_key", err)
+	}
+	// Audit files are created on start, only their directories must exist.
+	if config.Audit.File != "" {
+		check("audit.file", checkDir(filepath.Dir(config.Audit.File)))
+	}
+	for _, ns := range config.Namespaces {
+		if ns.AuditFile != "" {
+			check(fmt.Sprintf("namespace '%s' audit_file", ns.Name), checkDir(filepath.Dir(ns.AuditFile)))
+		}
+	}
+	if err = errors.Join(errs...); err != nil {
+		return err
+	}
+	fmt.Printf("configuration ok, %d key sets checked\n", 1+len(config.Namespaces))
+	return nil
+}
+
+// checkKeyDir checks the key set of a key directory without changing it. A key set left committed by a replication
+// is checked instead of the current one, as it replaces it on start.
+func checkKeyDir(dir string, passphrase server.PassphraseFn) error {
+	pending, err := server.PendingReplication(dir)
+	if err != nil {
+		return err
+	}
+	if pending != "" {
+		fmt.Printf("'%s': a replicated key set is pending, and will replace the current keys on start\n", dir)
+		dir = pending
+	}
+	store, err := server.LoadKeyStore(dir, passphrase)
+	if err != nil {
+		return err
+	}
+	return checkKeyStore(store)
+}
+
+// checkKeyStore builds the advertisements of store, and runs their self-test.
+func checkKeyStore(store server.KeyStore) error {
+	protocol, err := server.NewProtocol(store)
+	if err != nil {
+		return err
+	}
+	defer protocol.Close()
+	return protocol.Ready()
+}
+
+func checkDir(path string) error {
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	if !info.IsDir() {
+		return fmt.Errorf("'%s' is not a directory", path)
+	}
+	return nil
+}
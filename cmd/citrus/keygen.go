@@ -0,0 +1,95 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/go-jose/go-jose/v4"
+
+	"go-citrus/internal"
+	"go-citrus/server"
+)
+
+// citrus keygen -d DIR [-sign-alg ALG] [-valid-for DURATION] [-label KEY=VALUE...] [passphrase flags]
+func runKeygen(args []string) error {
+	fs := flag.NewFlagSet("keygen", flag.ContinueOnError)
+	dir := fs.String("d", "/var/db/citrus", "key `directory`")
+	signAlg := fs.String("sign-alg", string(internal.DefaultSignatureAlgorithm), "`algorithm` of the signing key: ES256, ES384, ES512 or EdDSA")
+	validFor := fs.Duration("valid-for", 0, "stop advertising the keys after `duration` (0 means forever)")
+	labels := labelFlags{}
+	fs.Var(labels, "label", "attach a `key=value` label to the keys, may be repeated")
+	var pass passphraseFlags
+	pass.register(fs)
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	passphrase, err := pass.source()
+	if err != nil {
+		return err
+	}
+	if err = os.MkdirAll(*dir, 0o700); err != nil {
+		return err
+	}
+
+	exchange, err := internal.GenerateExchangeKey()
+	if err != nil {
+		return err
+	}
+	signing, err := internal.GenerateSigningKeyWith(jose.SignatureAlgorithm(*signAlg))
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	for _, key := range []jose.JSONWebKey{exchange, signing} {
+		thp, err := server.KeyThumbprint(key)
+		if err != nil {
+			return err
+		}
+		meta, err := server.NewKeyMetadata(key, now)
+		if err != nil {
+			return err
+		}
+		if *validFor > 0 {
+			notAfter := meta.CreatedAt.Add(*validFor)
+			meta.NotAfter = &notAfter
+		}
+		if len(labels) > 0 {
+			meta.Labels = labels
+		}
+
+		path, err := server.WriteKey(*dir, key, passphrase)
+		if err != nil {
+			return err
+		}
+		if err = server.WriteMetadata(*dir, thp, meta); err != nil {
+			return err
+		}
+		fmt.Println(path)
+	}
+	return nil
+}
+
+// labelFlags collects repeated -label key=value flags.
+type labelFlags map[string]string
+
+func (t labelFlags) String() string {
+	var pairs []string
+	for k, v := range t {
+		pairs = append(pairs, k+"="+v)
+	}
+	return strings.Join(pairs, ",")
+}
+
+func (t labelFlags) Set(value string) error {
+	k, v, ok := strings.Cut(value, "=")
+	if !ok || k == "" {
+		return fmt.Errorf("label '%s' is not in key=value form", value)
+	}
+	t[k] = v
+	return nil
+}
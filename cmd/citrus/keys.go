@@ -0,0 +1,142 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"go-citrus/server"
+)
+
+var keysCommands = map[string]command{
+	"list":    {"show the keys of a key directory with their metadata", runKeysList},
+	"import":  {"copy the keys of a tangd key database into a key directory", runKeysImport},
+	"export":  {"write the keys of a key directory as a tangd key database", runKeysExport},
+	"backup":  {"encrypt the keys of a key directory into a backup split among administrators", runKeysBackup},
+	"restore": {"rebuild a key directory from a backup and enough administrator shares", runKeysRestore},
+}
+
+// citrus keys <command> [flags]
+func runKeys(args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("missing keys command, one of: %s", strings.Join(commandNames(keysCommands), ", "))
+	}
+	cmd, ok := keysCommands[args[0]]
+	if !ok {
+		return fmt.Errorf("unknown keys command '%s', one of: %s", args[0], strings.Join(commandNames(keysCommands), ", "))
+	}
+	return cmd.run(args[1:])
+}
+
+// citrus keys list -d DIR [passphrase flags]
+func runKeysList(args []string) error {
+	fs := flag.NewFlagSet("keys list", flag.ContinueOnError)
+	dir := fs.String("d", "/var/db/citrus", "key `directory`")
+	var pass passphraseFlags
+	pass.register(fs)
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	passphrase, err := pass.source()
+	if err != nil {
+		return err
+	}
+	keys, err := server.ListKeys(*dir, passphrase, time.Now())
+	if err != nil {
+		return err
+	}
+	return printKeys(keys)
+}
+
+func printKeys(keys []server.KeyInfo) error {
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "THUMBPRINT\tKID\tUSE\tALG\tCREATED\tNOT AFTER\tSTATE\tAPPROVALS\tLABELS")
+	for _, key := range keys {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%s\t%d\t%s\n",
+			key.Thumbprint, key.KeyID, key.Use, key.Algorithm, formatTime(key.CreatedAt), formatTime(key.NotAfter),
+			key.State, key.Approvals, formatLabels(key.Labels))
+	}
+	return w.Flush()
+}
+
+// citrus keys import -from-tang TANGDIR -d DIR [passphrase flags]
+func runKeysImport(args []string) error {
+	fs := flag.NewFlagSet("keys import", flag.ContinueOnError)
+	dir := fs.String("d", "/var/db/citrus", "key `directory`")
+	tangDir := fs.String("from-tang", "", "tangd key database `directory`, e.g. /var/db/tang")
+	var pass passphraseFlags
+	pass.register(fs)
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *tangDir == "" {
+		return fmt.Errorf("missing -from-tang directory")
+	}
+
+	passphrase, err := pass.source()
+	if err != nil {
+		return err
+	}
+	if err = os.MkdirAll(*dir, 0o700); err != nil {
+		return err
+	}
+	count, err := server.ImportTang(*tangDir, *dir, passphrase)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("imported %d keys from %s\n", count, *tangDir)
+	return nil
+}
+
+// citrus keys export -to-tang TANGDIR -d DIR [passphrase flags]
+func runKeysExport(args []string) error {
+	fs := flag.NewFlagSet("keys export", flag.ContinueOnError)
+	dir := fs.String("d", "/var/db/citrus", "key `directory`")
+	tangDir := fs.String("to-tang", "", "tangd key database `directory`, holding no key yet, keys are written unencrypted")
+	var pass passphraseFlags
+	pass.register(fs)
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *tangDir == "" {
+		return fmt.Errorf("missing -to-tang directory")
+	}
+
+	passphrase, err := pass.source()
+	if err != nil {
+		return err
+	}
+	if err = os.MkdirAll(*tangDir, 0o700); err != nil {
+		return err
+	}
+	count, err := server.ExportTang(*dir, passphrase, *tangDir)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("exported %d keys to %s\n", count, *tangDir)
+	return nil
+}
+
+func formatTime(t *time.Time) string {
+	if t == nil {
+		return "-"
+	}
+	return t.Format(time.RFC3339)
+}
+
+func formatLabels(labels map[string]string) string {
+	if len(labels) == 0 {
+		return "-"
+	}
+	var pairs []string
+	for k, v := range labels {
+		pairs = append(pairs, k+"="+v)
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, ",")
+}
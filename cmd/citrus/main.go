@@ -0,0 +1,94 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+
+	"go-citrus/server"
+)
+
+/*
+citrus - command line entry point.
+Each sub-command owns its flag set: citrus <command> [flags]
+*/
+type command struct {
+	usage string
+	run   func(args []string) error
+}
+
+var commands = map[string]command{
+	"admin":           {"send a signed request to the admin API of a server", runAdmin},
+	"audit":           {"verify tamper-evident audit files", runAudit},
+	"keygen":          {"generate a new exchange and signing key pair into a key directory", runKeygen},
+	"keys":            {"manage the keys of a key directory", runKeys},
+	"recover-offline": {"decrypt a JWE with an exported server exchange key, without the server", runRecoverOffline},
+	"server":          {"serve the Tang HTTP API from a key directory", runServer},
+}
+
+func main() {
+	if len(os.Args) < 2 {
+		usage()
+		os.Exit(2)
+	}
+	cmd, ok := commands[os.Args[1]]
+	if !ok {
+		usage()
+		os.Exit(2)
+	}
+	if err := cmd.run(os.Args[2:]); err != nil {
+		fmt.Fprintf(os.Stderr, "citrus %s: %v\n", os.Args[1], err)
+		var exit *exitError
+		if errors.As(err, &exit) {
+			os.Exit(exit.code)
+		}
+		os.Exit(1)
+	}
+}
+
+// exitError fails a command with a specific exit status, 1 being used for other errors.
+type exitError struct {
+	code int
+	err  error
+}
+
+func (e *exitError) Error() string {
+	return e.err.Error()
+}
+
+func (e *exitError) Unwrap() error {
+	return e.err
+}
+
+func usage() {
+	fmt.Fprintln(os.Stderr, "usage: citrus <command> [flags]")
+	for _, name := range commandNames(commands) {
+		fmt.Fprintf(os.Stderr, "  %-16s %s\n", name, commands[name].usage)
+	}
+}
+
+func commandNames(commands map[string]command) []string {
+	names := make([]string, 0, len(commands))
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Passphrase flags shared by every command touching encrypted key files.
+type passphraseFlags server.PassphraseConfig
+
+// register adds the passphrase flags to fs, their current values being the defaults.
+func (t *passphraseFlags) register(fs *flag.FlagSet) {
+	fs.StringVar(&t.File, "passphrase-file", t.File, "read the key passphrase from `file`")
+	fs.StringVar(&t.Env, "passphrase-env", t.Env, "read the key passphrase from environment `variable`")
+	fs.StringVar(&t.Credential, "passphrase-credential", t.Credential, "read the key passphrase from systemd credential `name`")
+}
+
+// source returns nil when no passphrase was requested, meaning keys are kept in plain JWK form.
+func (t *passphraseFlags) source() (server.PassphraseFn, error) {
+	return server.PassphraseConfig(*t).Source()
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/go-jose/go-jose/v4"
+
+	"go-citrus/client"
+	"go-citrus/internal"
+)
+
+// citrus recover-offline -key FILE -in FILE [-out FILE] [passphrase flags]
+func runRecoverOffline(args []string) error {
+	fs := flag.NewFlagSet("recover-offline", flag.ContinueOnError)
+	keyFile := fs.String("key", "", "exported server exchange private key `file`, plain or wrapped JWK")
+	in := fs.String("in", "", "compact JWE `file` to decrypt, - for stdin")
+	out := fs.String("out", "", "write the decrypted data to `file` instead of stdout")
+	var pass passphraseFlags
+	pass.register(fs)
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *keyFile == "" || *in == "" {
+		return fmt.Errorf("missing -key server key file or -in JWE file")
+	}
+
+	key, err := readKeyFile(*keyFile, pass)
+	if err != nil {
+		return err
+	}
+	if S, ok := key.Key.(*ecdsa.PrivateKey); ok {
+		defer internal.WipePrivateKey(S)
+	}
+	recovery, err := client.OfflineRecovery(key)
+	if err != nil {
+		return err
+	}
+
+	var cipher []byte
+	if *in == "-" {
+		cipher, err = io.ReadAll(os.Stdin)
+	} else {
+		cipher, err = os.ReadFile(*in)
+	}
+	if err != nil {
+		return err
+	}
+	data, err := client.NewProtocol(recovery).Decrypt(cipher)
+	if err != nil {
+		return err
+	}
+	defer internal.WipeBytes(data)
+
+	if *out != "" {
+		return os.WriteFile(*out, data, 0o600)
+	}
+	_, err = os.Stdout.Write(data)
+	return err
+}
+
+// readKeyFile reads a single JWK file, unwrapping it with the passphrase when it is encrypted.
+func readKeyFile(path string, pass passphraseFlags) (jose.JSONWebKey, error) {
+	var key jose.JSONWebKey
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return key, err
+	}
+	if !internal.IsWrappedKey(data) {
+		if err = key.UnmarshalJSON(data); err != nil {
+			return key, fmt.Errorf("unable to parse key file '%s': %w", path, err)
+		}
+		return key, nil
+	}
+
+	passphrase, err := pass.source()
+	if err != nil {
+		return key, err
+	}
+	if passphrase == nil {
+		return key, fmt.Errorf("key file '%s' is encrypted but no passphrase was provided", path)
+	}
+	secret, err := passphrase()
+	if err != nil {
+		return key, err
+	}
+	defer internal.WipeBytes(secret)
+	return internal.UnwrapKey(data, secret)
+}
@@ -0,0 +1,454 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"os/user"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"go-citrus/server"
+)
+
+// citrus server [-config FILE] [flags], flags overriding the settings of the configuration file
+// citrus server check-config [-config FILE] [flags]
+func runServer(args []string) error {
+	if len(args) > 0 && args[0] == "check-config" {
+		return runServerCheckConfig(args[1:])
+	}
+	config, err := serverConfig("server", args)
+	if err != nil {
+		return err
+	}
+
+	pass := passphraseFlags(config.Keys.Passphrase)
+	passphrase, err := pass.source()
+	if err != nil {
+		return err
+	}
+	logger := slog.New(slog.NewTextHandler(os.Stderr, nil))
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, os.Interrupt)
+	defer stop()
+
+	var store server.KeyStore
+	var derived *server.DerivedKeyStore
+	if config.Keys.Seed.File != "" {
+		if derived, err = newDerivedKeyStore(config.Keys.Seed); err != nil {
+			return err
+		}
+		store = derived
+	} else if store, err = server.NewFileKeyStore(config.Keys.Dir, passphrase); err != nil {
+		return err
+	}
+	protocol, err := server.NewProtocol(store)
+	if err != nil {
+		return err
+	}
+	if derived != nil {
+		go reloadEpochs(ctx, protocol, derived, logger)
+	}
+	if config.Policy != "" {
+		policy, err := server.LoadPolicy(config.Policy)
+		if err != nil {
+			return err
+		}
+		protocol.SetPolicy(policy)
+	}
+	// A single rotator, so that rotation passes and admin key operations do not interleave.
+	rotation := server.RotationPolicy{RotateAfter: config.Rotation.RotateAfter, RetireAfter: config.Rotation.RetireAfter}
+	rotator := server.NewRotator(protocol, config.Keys.Dir, passphrase, rotation, logger)
+	if rotation != (server.RotationPolicy{}) {
+		go rotator.Run(ctx, config.Rotation.Check)
+	}
+	if config.Replication.Replicas != "" {
+		list, err := server.LoadReplicas(config.Replication.Replicas)
+		if err != nil {
+			return err
+		}
+		signer, err := readKeyFile(config.Replication.Key, pass)
+		if err != nil {
+			return err
+		}
+		go server.NewReplicator(rotator, signer, list, logger).Run(ctx, config.Replication.Interval)
+	}
+
+	// Keys only require approvals once marked through the admin API, see server.ApprovalQueue.
+	approvals := server.NewApprovalQueue(config.Admin.ApprovalTTL).WithMaxPending(config.Admin.MaxPending)
+	protocol.SetApprovalQueue(approvals)
+
+	handler := server.NewHandler(protocol)
+	if len(config.RateLimits) > 0 || config.MaxRecoveries > 0 {
+		handler = handler.WithRateLimiter(server.NewRateLimiter(config.RateLimits, config.MaxRecoveries))
+	}
+	if config.Metrics {
+		handler = handler.WithMetrics(server.NewMetrics(protocol))
+	}
+	var audit server.AuditSink
+	switch {
+	case config.Audit.Chain:
+		file, err := server.NewAuditFile(config.Audit.File, config.Audit.MaxSize, config.Audit.Backups)
+		if err != nil {
+			return err
+		}
+		chain, err := server.NewAuditChain(file, store, config.Audit.CheckpointEvery)
+		if err != nil {
+			return err
+		}
+		defer chain.Close()
+		go func() {
+			if err := chain.Run(ctx, config.Audit.CheckpointInterval); err != nil {
+				logger.Error("audit checkpoint failed", "error", err)
+			}
+		}()
+		audit = chain
+	case config.Audit.File != "":
+		file, err := server.NewAuditFile(config.Audit.File, config.Audit.MaxSize, config.Audit.Backups)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		audit = file
+	case config.Audit.Log:
+		audit = server.NewSlogAuditSink(logger)
+	}
+	if audit != nil {
+		handler = handler.WithAudit(audit)
+	}
+
+	// Plain paths stay served by the default namespace, see server.NamespaceRouter.
+	var root http.Handler = handler
+	var tenants []*server.Namespace
+	if len(config.Namespaces) > 0 {
+		router := server.NewNamespaceRouter(handler)
+		for _, nsConfig := range config.Namespaces {
+			ns, err := server.NewNamespace(nsConfig, passphrase, audit, logger)
+			if err != nil {
+				return err
+			}
+			defer ns.Close()
+			if err = router.Handle(ns.Name, ns.Handler); err != nil {
+				return err
+			}
+			go ns.Run(ctx, config.Rotation.Check)
+			tenants = append(tenants, ns)
+		}
+		root = router
+	}
+
+	srv := &http.Server{
+		Handler:           root,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	if config.TLS.Cert != "" {
+		reloader, err := server.NewTLSReloader(tlsFiles(config.TLS))
+		if err != nil {
+			return err
+		}
+		srv.TLSConfig = reloader.Config()
+	}
+
+	if config.Admin.Listen != "" {
+		operators, err := server.LoadOperatorKeys(config.Admin.Operators)
+		if err != nil {
+			return err
+		}
+		admin := server.NewAdminHandler(rotator, operators).WithApprovals(approvals)
+		if config.Replication.ReplicaKey != "" {
+			key, err := readKeyFile(config.Replication.ReplicaKey, pass)
+			if err != nil {
+				return err
+			}
+			admin = admin.WithReplication(key)
+		}
+		if audit != nil {
+			admin = admin.WithAudit(audit)
+		}
+		listener, err := listenAddress(config.Admin.Listen, config.Listen.UnixMode, config.Listen.UnixOwner)
+		if err != nil {
+			return err
+		}
+		adminSrv := &http.Server{Handler: admin, ReadHeaderTimeout: 10 * time.Second}
+		logger.Info("serving admin API", "address", listener.Addr().String())
+		go func() {
+			if err := adminSrv.Serve(listener); !errors.Is(err, http.ErrServerClosed) {
+				logger.Error("admin API listener failed", "error", err)
+			}
+		}()
+		defer adminSrv.Close()
+	}
+
+	if config.Listen.Inetd {
+		conn := server.InetdConn()
+		if srv.TLSConfig != nil {
+			conn = tls.Server(conn, srv.TLSConfig)
+		}
+		defer protocol.Close()
+		return server.ServeConn(srv, conn)
+	}
+
+	listeners, err := server.ActivationListeners()
+	if err != nil {
+		return err
+	}
+	if len(listeners) == 0 {
+		listener, err := listenAddress(config.Listen.Address, config.Listen.UnixMode, config.Listen.UnixOwner)
+		if err != nil {
+			return err
+		}
+		listeners = append(listeners, listener)
+	}
+	return serve(ctx, srv, protocol, tenants, listeners, config.Listen.ShutdownTimeout, logger)
+}
+
+// serverConfig reads the -config file over the defaults, then applies the other flags over its settings.
+func serverConfig(name string, args []string) (*server.Config, error) {
+	// A first pass finds the configuration file, the flags being parsed again over it.
+	var configFile, namespaces string
+	if err := serverFlags(name, server.DefaultConfig(), &configFile, &namespaces).Parse(args); err != nil {
+		return nil, err
+	}
+	config := server.DefaultConfig()
+	if configFile != "" {
+		var err error
+		if config, err = server.LoadConfig(configFile); err != nil {
+			return nil, err
+		}
+	}
+	if err := serverFlags(name, config, &configFile, &namespaces).Parse(args); err != nil {
+		return nil, err
+	}
+	if namespaces != "" {
+		configs, err := server.LoadNamespaces(namespaces)
+		if err != nil {
+			return nil, err
+		}
+		config.Namespaces = append(config.Namespaces, configs...)
+	}
+	return config, config.Validate()
+}
+
+// serverFlags binds the server flags to config, its settings being the defaults.
+func serverFlags(name string, config *server.Config, configFile *string, namespaces *string) *flag.FlagSet {
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	fs.StringVar(configFile, "config", *configFile, "read the settings from the YAML configuration `file`, the other flags overriding them")
+	fs.StringVar(&config.Keys.Dir, "d", config.Keys.Dir, "key `directory`")
+	fs.StringVar(&config.Keys.Seed.File, "seed-file", config.Keys.Seed.File, "derive the keys from the master seed `file` instead of reading them from -d")
+	fs.StringVar(&config.Keys.Seed.Curve, "seed-curve", config.Keys.Seed.Curve, "`curve` of the derived keys: P-256, P-384 or P-521")
+	fs.DurationVar(&config.Keys.Seed.Epoch, "seed-epoch", config.Keys.Seed.Epoch, "`duration` of a key derivation epoch, derived keys are replaced at each epoch start")
+	fs.IntVar(&config.Keys.Seed.Retain, "seed-retain", config.Keys.Seed.Retain, "`number` of previous epochs whose derived keys stay recoverable")
+	fs.StringVar(&config.Listen.Address, "listen", config.Listen.Address, "HTTP listen `address`, or unix:PATH for a Unix domain socket, unless started with systemd socket activation")
+	fs.StringVar(&config.Listen.UnixMode, "unix-mode", config.Listen.UnixMode, "Unix domain socket file `mode`, in octal")
+	fs.StringVar(&config.Listen.UnixOwner, "unix-owner", config.Listen.UnixOwner, "Unix domain socket file `owner[:group]`, names or ids")
+	fs.DurationVar(&config.Listen.ShutdownTimeout, "shutdown-timeout", config.Listen.ShutdownTimeout, "on SIGTERM, wait up to `duration` for in-flight requests")
+	fs.BoolVar(&config.Listen.Inetd, "inetd", config.Listen.Inetd, "serve a single request on stdin/stdout, e.g. under a tangd.socket unit with Accept=yes")
+	fs.StringVar(&config.TLS.Cert, "tls-cert", config.TLS.Cert, "serve HTTPS with the PEM certificate `file`, reloaded when it changes")
+	fs.StringVar(&config.TLS.Key, "tls-key", config.TLS.Key, "PEM private key `file` of -tls-cert, when not in the certificate file")
+	fs.StringVar(&config.TLS.ClientCA, "tls-client-ca", config.TLS.ClientCA, "require client certificates issued by the PEM CA bundle `file`")
+	fs.DurationVar(&config.Rotation.RotateAfter, "rotate-after", config.Rotation.RotateAfter, "rotate keys older than `duration` (0 disables rotation)")
+	fs.DurationVar(&config.Rotation.RetireAfter, "retire-after", config.Rotation.RetireAfter, "delete rotated keys after `duration` (0 keeps them)")
+	fs.DurationVar(&config.Rotation.Check, "rotate-check", config.Rotation.Check, "key rotation check `interval`")
+	if config.RateLimits == nil {
+		config.RateLimits = make(map[string]server.RateLimit)
+	}
+	fs.Var(rateLimitFlags(config.RateLimits), "rate-limit", "per client `route=rate:burst` limit (routes: adv, rec; rate per second), may be repeated")
+	fs.IntVar(&config.MaxRecoveries, "max-recoveries", config.MaxRecoveries, "maximum concurrent recovery computations (0 means unlimited)")
+	fs.StringVar(&config.Admin.Listen, "admin-listen", config.Admin.Listen, "serve the admin API on `address`, or unix:PATH for a Unix domain socket")
+	fs.StringVar(&config.Admin.Operators, "admin-operators", config.Admin.Operators, "JWK set `file` of the operator keys allowed to sign admin requests")
+	fs.StringVar(&config.Replication.Replicas, "replicas", config.Replication.Replicas, "push the key set to the replicas listed in JSON `file` (url and public key of each), as a primary")
+	fs.StringVar(&config.Replication.Key, "replication-key", config.Replication.Key, "private JWK `file` signing the key set pushes, an operator key of every replica")
+	fs.DurationVar(&config.Replication.Interval, "replication-interval", config.Replication.Interval, "push the key set at least every `interval`, besides every change")
+	fs.StringVar(&config.Replication.ReplicaKey, "replica-key", config.Replication.ReplicaKey, "private JWK `file` receiving the key set of a primary through the admin API, as a replica")
+	fs.StringVar(namespaces, "namespaces", *namespaces, "also serve the namespaces listed in JSON `file` under /NAME/, each with its own key directory")
+	fs.DurationVar(&config.Admin.ApprovalTTL, "approval-ttl", config.Admin.ApprovalTTL, "recoveries waiting for operator approvals expire after `duration`")
+	fs.IntVar(&config.Admin.MaxPending, "max-pending-approvals", config.Admin.MaxPending, "answer 429 to new recoveries once `n` are waiting for operator approvals")
+	fs.StringVar(&config.Policy, "policy", config.Policy, "recovery policy JSON `file`, every recovery is allowed without")
+	fs.BoolVar(&config.Metrics, "metrics", config.Metrics, "serve Prometheus metrics on /metrics")
+	fs.StringVar(&config.Audit.File, "audit-file", config.Audit.File, "append audit records as JSON lines to `file`")
+	fs.Int64Var(&config.Audit.MaxSize, "audit-max-size", config.Audit.MaxSize, "rotate the audit file once it reaches `bytes` (0 disables rotation)")
+	fs.IntVar(&config.Audit.Backups, "audit-backups", config.Audit.Backups, "number of rotated audit files to keep")
+	fs.BoolVar(&config.Audit.Log, "audit-log", config.Audit.Log, "write audit records to the server log")
+	fs.BoolVar(&config.Audit.Chain, "audit-chain", config.Audit.Chain, "hash-chain the audit file records and sign checkpoints")
+	fs.IntVar(&config.Audit.CheckpointEvery, "audit-checkpoint-every", config.Audit.CheckpointEvery, "sign an audit checkpoint every `n` records")
+	fs.DurationVar(&config.Audit.CheckpointInterval, "audit-checkpoint-interval", config.Audit.CheckpointInterval, "sign an audit checkpoint at least every `interval`")
+	(*passphraseFlags)(&config.Keys.Passphrase).register(fs)
+	return fs
+}
+
+func tlsFiles(config server.TLSConfig) server.TLSFiles {
+	files := server.TLSFiles{CertFile: config.Cert, KeyFile: config.Key, ClientCAFile: config.ClientCA}
+	if files.KeyFile == "" {
+		files.KeyFile = files.CertFile
+	}
+	return files
+}
+
+func newDerivedKeyStore(config server.SeedConfig) (*server.DerivedKeyStore, error) {
+	curve, err := server.ParseCurve(config.Curve)
+	if err != nil {
+		return nil, err
+	}
+	seed, err := server.LoadSeed(config.File)
+	if err != nil {
+		return nil, err
+	}
+	defer clear(seed)
+	return server.NewDerivedKeyStore(seed, server.Derivation{Curve: curve, Epoch: config.Epoch, Retained: config.Retain})
+}
+
+// reloadEpochs moves the derived keys to each new epoch until ctx is done, retrying failed reloads every minute.
+func reloadEpochs(ctx context.Context, protocol *server.Protocol, store *server.DerivedKeyStore, logger *slog.Logger) {
+	var err error
+	for {
+		wait := time.Until(store.NextEpoch())
+		if err != nil {
+			wait = time.Minute
+		}
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+		if err = protocol.Reload(); err != nil {
+			logger.Error("unable to derive the keys of the new epoch", "error", err)
+		} else {
+			logger.Info("derived the keys of the new epoch")
+		}
+	}
+}
+
+// Exit status of a shutdown which had to cut off in-flight requests.
+const exitDrainTimeout = 3
+
+// serve runs srv on every listener until one of them fails, or ctx is done and srv shut down gracefully.
+// The namespaces report not ready with the default protocol, their keys are wiped by their owner.
+func serve(ctx context.Context, srv *http.Server, protocol *server.Protocol, namespaces []*server.Namespace,
+	listeners []net.Listener, timeout time.Duration, logger *slog.Logger) error {
+	errs := make(chan error, len(listeners))
+	for _, listener := range listeners {
+		logger.Info("serving", "address", listener.Addr().String(), "tls", srv.TLSConfig != nil)
+		if srv.TLSConfig != nil {
+			listener = tls.NewListener(listener, srv.TLSConfig)
+		}
+		go func() {
+			errs <- srv.Serve(listener)
+		}()
+	}
+
+	select {
+	case err := <-errs:
+		protocol.Close()
+		return err
+	case <-ctx.Done():
+	}
+	logger.Info("shutting down", "timeout", timeout)
+	for _, ns := range namespaces {
+		ns.Protocol.Drain()
+	}
+	err := server.Shutdown(srv, protocol, timeout)
+	if errors.Is(err, server.ErrDrainTimeout) {
+		return &exitError{code: exitDrainTimeout, err: err}
+	}
+	if err == nil {
+		logger.Info("shutdown complete")
+	}
+	return err
+}
+
+// listenAddress listens on a TCP address, or on a Unix domain socket for unix:PATH addresses.
+func listenAddress(address string, unixMode string, unixOwner string) (net.Listener, error) {
+	if path, ok := strings.CutPrefix(address, "unix:"); ok {
+		return listenUnix(path, unixMode, unixOwner)
+	}
+	return net.Listen("tcp", address)
+}
+
+func listenUnix(path string, mode string, owner string) (net.Listener, error) {
+	perm, err := strconv.ParseUint(mode, 8, 32)
+	if err != nil || perm > 0o777 {
+		return nil, fmt.Errorf("invalid Unix socket mode '%s'", mode)
+	}
+	uid, gid := -1, -1
+	if owner != "" {
+		name, group, _ := strings.Cut(owner, ":")
+		if uid, err = lookupID(name, func(name string) (string, error) {
+			u, err := user.Lookup(name)
+			if err != nil {
+				return "", err
+			}
+			return u.Uid, nil
+		}); err != nil {
+			return nil, err
+		}
+		if group != "" {
+			if gid, err = lookupID(group, func(name string) (string, error) {
+				g, err := user.LookupGroup(name)
+				if err != nil {
+					return "", err
+				}
+				return g.Gid, nil
+			}); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return server.ListenUnix(path, os.FileMode(perm), uid, gid)
+}
+
+// lookupID resolves a user or group name, numeric ids being used as is.
+func lookupID(name string, lookup func(string) (string, error)) (int, error) {
+	if name == "" {
+		return -1, nil
+	}
+	if id, err := strconv.Atoi(name); err == nil {
+		return id, nil
+	}
+	id, err := lookup(name)
+	if err != nil {
+		return -1, err
+	}
+	return strconv.Atoi(id)
+}
+
+// rateLimitFlags collects repeated -rate-limit route=rate:burst flags.
+type rateLimitFlags map[string]server.RateLimit
+
+func (t rateLimitFlags) String() string {
+	var limits []string
+	for route, limit := range t {
+		limits = append(limits, fmt.Sprintf("%s=%g:%d", route, limit.Rate, limit.Burst))
+	}
+	return strings.Join(limits, ",")
+}
+
+func (t rateLimitFlags) Set(value string) error {
+	route, limit, ok := strings.Cut(value, "=")
+	if !ok || (route != server.RouteAdvertisement && route != server.RouteRecovery) {
+		return fmt.Errorf("rate limit '%s' is not in route=rate:burst form", value)
+	}
+	rate, burst, ok := strings.Cut(limit, ":")
+	if !ok {
+		return fmt.Errorf("rate limit '%s' is not in route=rate:burst form", value)
+	}
+	r, err := strconv.ParseFloat(rate, 64)
+	if err != nil || r <= 0 {
+		return fmt.Errorf("invalid rate in '%s'", value)
+	}
+	b, err := strconv.Atoi(burst)
+	if err != nil || b <= 0 {
+		return fmt.Errorf("invalid burst in '%s'", value)
+	}
+	t[route] = server.RateLimit{Rate: r, Burst: b}
+	return nil
+}
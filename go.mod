@@ -7,11 +7,11 @@ toolchain go1.22.2
 require (
 	github.com/go-jose/go-jose/v4 v4.0.4
 	github.com/stretchr/testify v1.10.0
+	golang.org/x/crypto v0.32.0
+	gopkg.in/yaml.v3 v3.0.1
 )
 
 require (
 	github.com/davecgh/go-spew v1.1.1 // indirect
 	github.com/pmezard/go-difflib v1.0.0 // indirect
-	golang.org/x/crypto v0.32.0 // indirect
-	gopkg.in/yaml.v3 v3.0.1 // indirect
 )
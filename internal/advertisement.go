@@ -3,6 +3,7 @@ package internal
 import (
 	"encoding/json"
 	"fmt"
+	"slices"
 
 	"github.com/go-jose/go-jose/v4"
 )
@@ -17,6 +18,14 @@ func NewAdvertisement(advertised ...jose.JSONWebKey) (*Advertisement, error) {
 	var sig KeyList
 
 	for i, key := range advertised {
+		if IsSigningKey(key) {
+			if _, err := SigningKeyAlgorithm(key); err != nil {
+				return nil, fmt.Errorf("advertised key %d: %w", i, err)
+			}
+			sig = append(sig, key)
+			continue
+		}
+
 		if !isECKey(key) {
 			return nil, fmt.Errorf("advertised key %d is not an EC public key", i)
 		}
@@ -24,10 +33,6 @@ func NewAdvertisement(advertised ...jose.JSONWebKey) (*Advertisement, error) {
 		if IsExchangeKey(key) {
 			exc = append(exc, key)
 		}
-
-		if IsSigningKey(key) {
-			sig = append(sig, key)
-		}
 	}
 
 	if len(sig) == 0 {
@@ -49,31 +54,48 @@ func (t *Advertisement) SigningKeys() KeyList {
 	return t.signingKeys
 }
 
-// Marshall returns a signed advertised key set in JSON Web Signature(JWS) format.
-// Based on the JWS example: https://github.com/go-jose/go-jose/blob/c74720ddfdb440c7df134a12251ca6001073ba5a/doc_test.go#L90
-func (t *Advertisement) Marshall() ([]byte, error) {
+// Payload returns the public advertised key set in JSON, as covered by the advertisement signatures.
+func (t *Advertisement) Payload() ([]byte, error) {
 	var advertised KeyList
 	advertised = append(advertised, t.exchangeKeys...)
 	advertised = append(advertised, t.signingKeys...)
 
 	// Collect public keys from the advertised key list
 	public := jose.JSONWebKeySet{Keys: advertised.PublicKeys()}
-	payload, err := json.Marshal(public)
+	return json.Marshal(public)
+}
+
+// Marshall returns a signed advertised key set in JSON Web Signature(JWS) format.
+// Based on the JWS example: https://github.com/go-jose/go-jose/blob/c74720ddfdb440c7df134a12251ca6001073ba5a/doc_test.go#L90
+func (t *Advertisement) Marshall() ([]byte, error) {
+	payload, err := t.Payload()
 	if err != nil {
 		return nil, err
 	}
+	return SignAdvertisement(payload, t.signingKeys)
+}
+
+// AdvertisementContentType is the JWS content type of signed advertisements.
+const AdvertisementContentType = jose.ContentType("jwk-set+json")
 
-	// Sign the payload
+// SignAdvertisement signs an advertisement payload with every given private signing key.
+func SignAdvertisement(payload []byte, signingKeys KeyList) ([]byte, error) {
+	return SignPayload(payload, AdvertisementContentType, signingKeys)
+}
+
+// SignPayload signs any payload with every given private signing key, returning the JWS JSON serialization.
+func SignPayload(payload []byte, contentType jose.ContentType, signingKeys KeyList) ([]byte, error) {
 	var keys []jose.SigningKey
-	for _, key := range t.signingKeys {
+	for _, key := range signingKeys {
 		keys = append(keys, jose.SigningKey{Algorithm: jose.SignatureAlgorithm(key.Algorithm), Key: key})
 	}
 
 	opts := &jose.SignerOptions{}
-	signer, err := jose.NewMultiSigner(keys, opts.WithContentType("jwk-set+json"))
+	signer, err := jose.NewMultiSigner(keys, opts.WithContentType(contentType))
 	if err != nil {
 		return nil, err
 	}
+
 	signature, err := signer.Sign(payload)
 	if err != nil {
 		return nil, err
@@ -82,10 +104,13 @@ func (t *Advertisement) Marshall() ([]byte, error) {
 	return []byte(signature.FullSerialize()), nil
 }
 
-// ParseAdvertisement reverts the JWS-marshalled blob.
+// ParseAdvertisement reverts the JWS-marshalled blob, verifying its signatures with the allowed signAlgorithms.
+// Every advertised signing key with an allowed algorithm must sign the advertisement, the others are left out of
+// SigningKeys. An advertisement without any signing key of an allowed algorithm is rejected.
 // Based on the JWS example: https://github.com/go-jose/go-jose/blob/c74720ddfdb440c7df134a12251ca6001073ba5a/doc_test.go#L106
 func ParseAdvertisement(data []byte, signAlgorithms []jose.SignatureAlgorithm) (*Advertisement, error) {
-	jws, err := jose.ParseSigned(string(data), signAlgorithms)
+	// Signatures of disallowed algorithms are skipped rather than failing the whole advertisement.
+	jws, err := jose.ParseSigned(string(data), SigningAlgorithms)
 	if err != nil {
 		return nil, err
 	}
@@ -101,13 +126,22 @@ func ParseAdvertisement(data []byte, signAlgorithms []jose.SignatureAlgorithm) (
 		return nil, err
 	}
 
-	// Validate JWS signatures. Payload-provided signing keys must sign the advertisement
+	// Validate JWS signatures. Payload-provided signing keys of allowed algorithms must sign the advertisement
+	var allowed KeyList
 	for _, key := range result.signingKeys {
+		if !slices.Contains(signAlgorithms, jose.SignatureAlgorithm(key.Algorithm)) {
+			continue
+		}
 		_, _, _, err = jws.VerifyMulti(key)
 		if err != nil {
 			return nil, err
 		}
+		allowed = append(allowed, key)
+	}
+	if len(allowed) == 0 {
+		return nil, fmt.Errorf("advertisement is not signed with any allowed algorithm (%v)", signAlgorithms)
 	}
+	result.signingKeys = allowed
 
 	return result, nil
 }
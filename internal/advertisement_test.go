@@ -81,3 +81,54 @@ func TestAdvertisement_Parse(t *testing.T) {
 		require.NoError(t, err)
 	})
 }
+
+func TestAdvertisement_SignatureAlgorithms(t *testing.T) {
+	var signing KeyList
+	for _, algorithm := range SigningAlgorithms {
+		key, err := GenerateSigningKeyWith(algorithm)
+		require.NoError(t, err)
+		signing = append(signing, key)
+	}
+	original, err := NewAdvertisement(append(KeyList{ExchangeKey1}, signing...)...)
+	require.NoError(t, err)
+	data, err := original.Marshall()
+	require.NoError(t, err)
+
+	t.Run("every algorithm allowed", func(t *testing.T) {
+		adv, err := ParseAdvertisement(data, SigningAlgorithms)
+		require.NoError(t, err)
+		require.Len(t, adv.SigningKeys(), len(SigningAlgorithms))
+	})
+
+	t.Run("some algorithms allowed", func(t *testing.T) {
+		adv, err := ParseAdvertisement(data, []jose.SignatureAlgorithm{jose.EdDSA, jose.ES384})
+		require.NoError(t, err)
+		require.Len(t, adv.SigningKeys(), 2)
+		for _, key := range adv.SigningKeys() {
+			require.Contains(t, []string{string(jose.EdDSA), string(jose.ES384)}, key.Algorithm)
+		}
+		require.Len(t, adv.ExchangeKeys(), 1)
+	})
+
+	t.Run("no algorithm allowed", func(t *testing.T) {
+		single, err := NewAdvertisement(ExchangeKey1, signing[3])
+		require.NoError(t, err)
+		data, err := single.Marshall()
+		require.NoError(t, err)
+		_, err = ParseAdvertisement(data, []jose.SignatureAlgorithm{jose.ES256, jose.ES512})
+		require.ErrorContains(t, err, "allowed algorithm")
+	})
+
+	t.Run("missing signature of an allowed key", func(t *testing.T) {
+		payload, err := original.Payload()
+		require.NoError(t, err)
+		data, err := SignAdvertisement(payload, signing[:2])
+		require.NoError(t, err)
+		_, err = ParseAdvertisement(data, SigningAlgorithms)
+		require.Error(t, err)
+
+		adv, err := ParseAdvertisement(data, []jose.SignatureAlgorithm{jose.ES256, jose.ES384})
+		require.NoError(t, err)
+		require.Len(t, adv.SigningKeys(), 2)
+	})
+}
@@ -0,0 +1,87 @@
+package internal
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/sha512"
+	"fmt"
+	"io"
+	"math/big"
+
+	"github.com/go-jose/go-jose/v4"
+	"golang.org/x/crypto/hkdf"
+)
+
+/*
+Deterministic key derivation from a master seed, the scalar being reduced as in FIPS 186-5 A.2.1 for a negligible bias:
+  - PRK    = HKDF-Extract(salt = "citrus key derivation", seed)
+  - OKM    = HKDF-Expand(PRK, info = use "/" curve "/" label, bit size of n + 64 bits)
+  - scalar = OKM mod (n - 1) + 1
+
+Identical seeds, uses, curves and labels always give the same key, and so the same thumbprints.
+*/
+const (
+	MinSeedSize    = 32
+	derivationSalt = "citrus key derivation"
+)
+
+// HKDF implements RFC 5869 with SHA-512, see golang.org/x/crypto/hkdf.
+func HKDF(secret []byte, salt []byte, info []byte, length int) ([]byte, error) {
+	if length > 255*sha512.Size {
+		return nil, fmt.Errorf("HKDF output length %d is too large", length)
+	}
+	okm := make([]byte, length)
+	if _, err := io.ReadFull(hkdf.New(sha512.New, secret, salt, info), okm); err != nil {
+		WipeBytes(okm)
+		return nil, err
+	}
+	return okm, nil
+}
+
+// DeriveExchangeKey derives the exchange key of curve from seed and label.
+func DeriveExchangeKey(seed []byte, curve elliptic.Curve, label string) (jose.JSONWebKey, error) {
+	return deriveKey(seed, curve, defaultExchangeAlgorithm, ExchangeKeyUse, label)
+}
+
+// DeriveSigningKey derives the signing key of curve from seed and label, signing with the ECDSA algorithm of curve.
+func DeriveSigningKey(seed []byte, curve elliptic.Curve, label string) (jose.JSONWebKey, error) {
+	var algorithm jose.SignatureAlgorithm
+	switch curve {
+	case elliptic.P256():
+		algorithm = jose.ES256
+	case elliptic.P384():
+		algorithm = jose.ES384
+	case elliptic.P521():
+		algorithm = jose.ES512
+	default:
+		return jose.JSONWebKey{}, fmt.Errorf("unsupported key derivation curve %s", curve.Params().Name)
+	}
+	return deriveKey(seed, curve, string(algorithm), SigningKeyUse, label)
+}
+
+func deriveKey(seed []byte, curve elliptic.Curve, algorithm string, usage string, label string) (jose.JSONWebKey, error) {
+	if len(seed) < MinSeedSize {
+		return jose.JSONWebKey{}, fmt.Errorf("key derivation seed is shorter than %d bytes", MinSeedSize)
+	}
+	params := curve.Params()
+	okm, err := HKDF(seed, []byte(derivationSalt), []byte(usage+"/"+params.Name+"/"+label), (params.N.BitLen()+64+7)/8)
+	if err != nil {
+		return jose.JSONWebKey{}, err
+	}
+	defer WipeBytes(okm)
+
+	d := new(big.Int).SetBytes(okm)
+	order := new(big.Int).Sub(params.N, big.NewInt(1))
+	d.Mod(d, order)
+	d.Add(d, big.NewInt(1))
+
+	key := &ecdsa.PrivateKey{PublicKey: ecdsa.PublicKey{Curve: curve}, D: d}
+	scalar := d.FillBytes(make([]byte, (params.BitSize+7)/8))
+	defer WipeBytes(scalar)
+	key.X, key.Y = curve.ScalarBaseMult(scalar)
+	return jose.JSONWebKey{
+		Key:       key,
+		Algorithm: algorithm,
+		Use:       usage,
+	}, nil
+}
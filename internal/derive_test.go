@@ -0,0 +1,117 @@
+package internal
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"testing"
+
+	"github.com/go-jose/go-jose/v4"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHKDF(t *testing.T) {
+	// RFC 5869 test cases 1 and 3 inputs, with SHA-512.
+	ikm := bytes.Repeat([]byte{0x0b}, 22)
+	salt, _ := hex.DecodeString("000102030405060708090a0b0c")
+	info, _ := hex.DecodeString("f0f1f2f3f4f5f6f7f8f9")
+	for name, test := range map[string]struct {
+		salt, info []byte
+		okm        string
+	}{
+		"salt and info": {salt, info, "832390086cda71fb47625bb5ceb168e4c8e26a1a16ed34d9fc7fe92c1481579338da362cb8d9f925d7cb"},
+		"empty":         {nil, nil, "f5fa02b18298a72a8c23898a8703472c6eb179dc204c03425c970e3b164bf90fff22d04836d0e2343bac"},
+	} {
+		okm, err := HKDF(ikm, test.salt, test.info, 42)
+		require.NoError(t, err, name)
+		require.Equal(t, test.okm, hex.EncodeToString(okm), name)
+	}
+
+	okm, err := HKDF([]byte("secret"), []byte("salt"), []byte("info"), 200)
+	require.NoError(t, err)
+	require.Len(t, okm, 200)
+	prefix, err := HKDF([]byte("secret"), []byte("salt"), []byte("info"), 42)
+	require.NoError(t, err)
+	require.Equal(t, okm[:42], prefix, "shorter outputs are prefixes")
+
+	other, err := HKDF([]byte("secret"), []byte("salt"), []byte("other"), 42)
+	require.NoError(t, err)
+	require.NotEqual(t, prefix, other)
+
+	_, err = HKDF([]byte("secret"), nil, nil, 255*64+1)
+	require.Error(t, err)
+}
+
+func TestDeriveKey(t *testing.T) {
+	seed := bytes.Repeat([]byte{0x42}, MinSeedSize)
+
+	for _, curve := range []elliptic.Curve{elliptic.P256(), elliptic.P384(), elliptic.P521()} {
+		t.Run(curve.Params().Name, func(t *testing.T) {
+			exchange, err := DeriveExchangeKey(seed, curve, "epoch-1")
+			require.NoError(t, err)
+			require.True(t, IsExchangeKey(exchange))
+			require.True(t, exchange.Valid())
+
+			again, err := DeriveExchangeKey(seed, curve, "epoch-1")
+			require.NoError(t, err)
+			thp, err := Thumbprints(exchange)
+			require.NoError(t, err)
+			thpAgain, err := Thumbprints(again)
+			require.NoError(t, err)
+			require.Equal(t, thp, thpAgain, "derivation is deterministic")
+
+			for _, derive := range []func() (jose.JSONWebKey, error){
+				func() (jose.JSONWebKey, error) { return DeriveExchangeKey(seed, curve, "epoch-2") },
+				func() (jose.JSONWebKey, error) { return DeriveSigningKey(seed, curve, "epoch-1") },
+				func() (jose.JSONWebKey, error) {
+					return DeriveExchangeKey(bytes.Repeat([]byte{0x43}, MinSeedSize), curve, "epoch-1")
+				},
+			} {
+				other, err := derive()
+				require.NoError(t, err)
+				require.False(t, exchange.Key.(*ecdsa.PrivateKey).Equal(other.Key), "labels, uses and seeds give distinct keys")
+			}
+
+			signing, err := DeriveSigningKey(seed, curve, "epoch-1")
+			require.NoError(t, err)
+			require.True(t, IsSigningKey(signing))
+			digest := sha256.Sum256([]byte("advertisement"))
+			private := signing.Key.(*ecdsa.PrivateKey)
+			signature, err := ecdsa.SignASN1(rand.Reader, private, digest[:])
+			require.NoError(t, err)
+			require.True(t, ecdsa.VerifyASN1(&private.PublicKey, digest[:], signature))
+		})
+	}
+
+	// Replicas of any version must derive the same keys from the same seed: these thumbprints never change.
+	t.Run("golden thumbprints", func(t *testing.T) {
+		for _, golden := range []struct {
+			curve             elliptic.Curve
+			exchange, signing string
+		}{
+			{elliptic.P256(), "2U4bFPHXluNV4gWmoxi0VwBQQpVvj3WJB3C7TlpGQVQ", "OkSRGt2LmSB-iiATLNCE6lGlkF7AIHphnHWM5xWARj8"},
+			{elliptic.P384(), "166m85Yj9QkwfHDxDMyyuNtkggnCZhHTRqc4fIkrNRE", "kNgncLNuRZzGNgSURJxoqE6ZYo79c40eMTUHn5g5drE"},
+			{elliptic.P521(), "pXERhbUDs7xsRlAFuLEQukYWD60DBK4Mi8k-2AY-8MA", "3ZNsruTtvMZNyCivi0ayrwj7hLMdSalIHAFvx8qNM_M"},
+		} {
+			exchange, err := DeriveExchangeKey(seed, golden.curve, "epoch-1")
+			require.NoError(t, err)
+			signing, err := DeriveSigningKey(seed, golden.curve, "epoch-1")
+			require.NoError(t, err)
+			for key, expected := range map[*jose.JSONWebKey]string{&exchange: golden.exchange, &signing: golden.signing} {
+				thp, err := key.Thumbprint(crypto.SHA256)
+				require.NoError(t, err)
+				require.Equal(t, expected, base64.RawURLEncoding.EncodeToString(thp), golden.curve.Params().Name)
+			}
+		}
+	})
+
+	t.Run("short seeds are refused", func(t *testing.T) {
+		_, err := DeriveExchangeKey(seed[:MinSeedSize-1], elliptic.P521(), "epoch-1")
+		require.Error(t, err)
+	})
+}
@@ -31,3 +31,15 @@ func (t ECAlgorithm) Multiply(p *ecdsa.PublicKey, P *ecdsa.PrivateKey) *ecdsa.Pu
 	X, Y := t.Curve.ScalarMult(p.X, p.Y, P.D.Bytes())
 	return t.key(X, Y)
 }
+
+func (t ECAlgorithm) Add(p *ecdsa.PublicKey, q *ecdsa.PublicKey) *ecdsa.PublicKey {
+	X, Y := t.Curve.Add(p.X, p.Y, q.X, q.Y)
+	return t.key(X, Y)
+}
+
+// Subtract computes p - q, that is p + (-q), -q being the reflection of q over the x-axis.
+func (t ECAlgorithm) Subtract(p *ecdsa.PublicKey, q *ecdsa.PublicKey) *ecdsa.PublicKey {
+	negY := new(big.Int).Sub(t.Curve.Params().P, q.Y)
+	negY.Mod(negY, t.Curve.Params().P)
+	return t.Add(p, t.key(q.X, negY))
+}
@@ -1,7 +1,9 @@
 package internal
 
 import (
+	"crypto/ecdsa"
 	"crypto/elliptic"
+	"crypto/rand"
 	"encoding/base64"
 	"math/big"
 	"testing"
@@ -32,3 +34,25 @@ func TestECDHKey(t *testing.T) {
 		require.Equal(t, pubECDH.Curve, elliptic.P521())
 	})
 }
+
+func TestECAlgorithm(t *testing.T) {
+	algo := NewECAlgorithm(elliptic.P521())
+	s, err := ecdsa.GenerateKey(elliptic.P521(), rand.Reader)
+	require.NoError(t, err)
+	c, err := ecdsa.GenerateKey(elliptic.P521(), rand.Reader)
+	require.NoError(t, err)
+	e, err := ecdsa.GenerateKey(elliptic.P521(), rand.Reader)
+	require.NoError(t, err)
+
+	t.Run("subtract reverts add", func(t *testing.T) {
+		sum := algo.Add(&c.PublicKey, &e.PublicKey)
+		require.True(t, algo.Subtract(sum, &e.PublicKey).Equal(&c.PublicKey))
+	})
+
+	t.Run("unblinding recovers the shared secret", func(t *testing.T) {
+		K := algo.Multiply(&s.PublicKey, c)
+		y := algo.Multiply(algo.Add(&c.PublicKey, &e.PublicKey), s)
+		z := algo.Multiply(&s.PublicKey, e)
+		require.True(t, algo.Subtract(y, z).Equal(K))
+	})
+}
@@ -3,9 +3,11 @@ package internal
 import (
 	"crypto"
 	"crypto/ecdsa"
+	"crypto/ed25519"
 	"crypto/elliptic"
 	"crypto/rand"
 	"encoding/base64"
+	"fmt"
 
 	"github.com/go-jose/go-jose/v4"
 )
@@ -13,8 +15,21 @@ import (
 const (
 	defaultExchangeAlgorithm  = "ECMR"
 	DefaultSignatureAlgorithm = jose.ES512
+
+	ExchangeKeyUse = "exchange"
+	SigningKeyUse  = "signECMR"
 )
 
+// SigningAlgorithms are the algorithms of the advertisement signing keys, which need no ECMR operation.
+var SigningAlgorithms = []jose.SignatureAlgorithm{jose.ES256, jose.ES384, jose.ES512, jose.EdDSA}
+
+// Curves of the ECDSA signing algorithms.
+var signingCurves = map[jose.SignatureAlgorithm]elliptic.Curve{
+	jose.ES256: elliptic.P256(),
+	jose.ES384: elliptic.P384(),
+	jose.ES512: elliptic.P521(),
+}
+
 // Helper functions related to Javascript Object Signing and Encryption (JOSE) framework
 
 // JSON Web Keys
@@ -40,11 +55,51 @@ func isECKey(key jose.JSONWebKey) bool {
 
 // ECMR-specific Keys
 func GenerateExchangeKey() (jose.JSONWebKey, error) {
-	return generateKey(defaultExchangeAlgorithm, "exchange")
+	return generateKey(defaultExchangeAlgorithm, ExchangeKeyUse)
 }
 
 func GenerateSigningKey() (jose.JSONWebKey, error) {
-	return generateKey(defaultExchangeAlgorithm, "signECMR")
+	return generateKey(string(DefaultSignatureAlgorithm), SigningKeyUse)
+}
+
+// GenerateSigningKeyWith generates a signing key for one of the SigningAlgorithms.
+func GenerateSigningKeyWith(algorithm jose.SignatureAlgorithm) (jose.JSONWebKey, error) {
+	if algorithm == jose.EdDSA {
+		_, pk, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			return jose.JSONWebKey{}, err
+		}
+		return jose.JSONWebKey{Key: pk, Algorithm: string(algorithm), Use: SigningKeyUse}, nil
+	}
+	curve, ok := signingCurves[algorithm]
+	if !ok {
+		return jose.JSONWebKey{}, fmt.Errorf("unsupported signing algorithm '%s'", algorithm)
+	}
+	pk, err := ecdsa.GenerateKey(curve, rand.Reader)
+	if err != nil {
+		return jose.JSONWebKey{}, err
+	}
+	return jose.JSONWebKey{Key: pk, Algorithm: string(algorithm), Use: SigningKeyUse}, nil
+}
+
+// SigningKeyAlgorithm returns the algorithm of a signing key, once checked it is one of SigningAlgorithms and fits the key.
+func SigningKeyAlgorithm(key jose.JSONWebKey) (jose.SignatureAlgorithm, error) {
+	algorithm := jose.SignatureAlgorithm(key.Algorithm)
+	var fits bool
+	switch k := key.Key.(type) {
+	case *ecdsa.PublicKey:
+		fits = signingCurves[algorithm] == k.Curve
+	case *ecdsa.PrivateKey:
+		fits = signingCurves[algorithm] == k.Curve
+	case ed25519.PublicKey, ed25519.PrivateKey:
+		fits = algorithm == jose.EdDSA
+	default:
+		return "", fmt.Errorf("unsupported signing key type %T", key.Key)
+	}
+	if !fits {
+		return "", fmt.Errorf("signing key algorithm '%s' does not fit its key", algorithm)
+	}
+	return algorithm, nil
 }
 
 func IsECMRKey(key jose.JSONWebKey) bool {
@@ -52,18 +107,18 @@ func IsECMRKey(key jose.JSONWebKey) bool {
 }
 
 func IsSigningKey(key jose.JSONWebKey) bool {
-	return key.Use == "signECMR"
+	return key.Use == SigningKeyUse
 }
 
 func IsExchangeKey(key jose.JSONWebKey) bool {
-	return IsECMRKey(key) && key.Use == "exchange"
+	return IsECMRKey(key) && key.Use == ExchangeKeyUse
 }
 
 func CreateExchangeKey(key interface{}) jose.JSONWebKey {
 	return jose.JSONWebKey{
 		Key:       key,
 		Algorithm: defaultExchangeAlgorithm,
-		Use:       "exchange",
+		Use:       ExchangeKeyUse,
 	}
 }
 
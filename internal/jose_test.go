@@ -30,6 +30,37 @@ func TestGenerateSigningKey(t *testing.T) {
 	})
 }
 
+func TestGenerateSigningKeyWith(t *testing.T) {
+	for _, algorithm := range SigningAlgorithms {
+		t.Run(string(algorithm), func(t *testing.T) {
+			jwk, err := GenerateSigningKeyWith(algorithm)
+			require.NoError(t, err)
+			require.True(t, IsSigningKey(jwk))
+			require.False(t, jwk.IsPublic())
+
+			actual, err := SigningKeyAlgorithm(jwk)
+			require.NoError(t, err)
+			require.Equal(t, algorithm, actual)
+			actual, err = SigningKeyAlgorithm(jwk.Public())
+			require.NoError(t, err)
+			require.Equal(t, algorithm, actual)
+		})
+	}
+
+	t.Run("unsupported algorithm", func(t *testing.T) {
+		_, err := GenerateSigningKeyWith(jose.RS256)
+		require.Error(t, err)
+	})
+
+	t.Run("algorithm not fitting the key", func(t *testing.T) {
+		jwk, err := GenerateSigningKeyWith(jose.ES256)
+		require.NoError(t, err)
+		jwk.Algorithm = string(jose.ES512)
+		_, err = SigningKeyAlgorithm(jwk)
+		require.Error(t, err)
+	})
+}
+
 func TestIsECKey(t *testing.T) {
 	t.Run("check validity of a EC key", func(t *testing.T) {
 		require.True(t, isECKey(ExchangeKey1))
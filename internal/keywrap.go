@@ -0,0 +1,73 @@
+package internal
+
+import (
+	"bytes"
+	"fmt"
+
+	"github.com/go-jose/go-jose/v4"
+)
+
+const (
+	KeyWrapAlgorithm  = jose.PBES2_HS512_A256KW
+	KeyWrapEncryption = jose.A256GCM
+	keyWrapType       = "jwk+json"
+)
+
+// Encrypted-at-rest private keys
+// A private JWK is wrapped into a compact JWE, with the content key derived from a passphrase using PBES2.
+
+// WrapKey encrypts the JSON form of key under passphrase, returning a compact serialized JWE.
+// A non-positive iterations count falls back to the go-jose PBES2 default.
+func WrapKey(key jose.JSONWebKey, passphrase []byte, iterations int) ([]byte, error) {
+	if len(passphrase) == 0 {
+		return nil, fmt.Errorf("empty passphrase for key wrapping")
+	}
+	plaintext, err := key.MarshalJSON()
+	if err != nil {
+		return nil, err
+	}
+	recipient := jose.Recipient{
+		Algorithm:  KeyWrapAlgorithm,
+		Key:        passphrase,
+		PBES2Count: iterations,
+	}
+	opts := &jose.EncrypterOptions{}
+	encrypter, err := jose.NewEncrypter(KeyWrapEncryption, recipient, opts.WithContentType(keyWrapType))
+	if err != nil {
+		return nil, err
+	}
+	jwe, err := encrypter.Encrypt(plaintext)
+	if err != nil {
+		return nil, err
+	}
+	serialized, err := jwe.CompactSerialize()
+	if err != nil {
+		return nil, err
+	}
+	return []byte(serialized), nil
+}
+
+// UnwrapKey reverts WrapKey, only accepting JWEs protected with KeyWrapAlgorithm and KeyWrapEncryption.
+func UnwrapKey(data []byte, passphrase []byte) (jose.JSONWebKey, error) {
+	jwe, err := jose.ParseEncrypted(string(data), []jose.KeyAlgorithm{KeyWrapAlgorithm}, []jose.ContentEncryption{KeyWrapEncryption})
+	if err != nil {
+		return jose.JSONWebKey{}, err
+	}
+	plaintext, err := jwe.Decrypt(passphrase)
+	if err != nil {
+		return jose.JSONWebKey{}, fmt.Errorf("unable to decrypt wrapped key: %w", err)
+	}
+	defer clear(plaintext)
+
+	var key jose.JSONWebKey
+	if err = key.UnmarshalJSON(plaintext); err != nil {
+		return jose.JSONWebKey{}, fmt.Errorf("unable to parse wrapped key: %w", err)
+	}
+	return key, nil
+}
+
+// IsWrappedKey reports whether data looks like a compact JWE rather than a plain JSON key.
+func IsWrappedKey(data []byte) bool {
+	data = bytes.TrimSpace(data)
+	return len(data) > 0 && data[0] != '{' && bytes.Count(data, []byte(".")) == 4
+}
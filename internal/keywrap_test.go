@@ -0,0 +1,49 @@
+package internal
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// Keep PBKDF2 cheap in tests.
+const testWrapIterations = 1000
+
+func TestWrapKey(t *testing.T) {
+	passphrase := []byte("correct horse battery staple")
+
+	t.Run("wrap and unwrap a private key", func(t *testing.T) {
+		wrapped, err := WrapKey(ExchangeKey1, passphrase, testWrapIterations)
+		require.NoError(t, err)
+		require.True(t, IsWrappedKey(wrapped))
+		require.NotContains(t, string(wrapped), `"d"`)
+
+		restored, err := UnwrapKey(wrapped, passphrase)
+		require.NoError(t, err)
+		require.False(t, restored.IsPublic())
+
+		thumbs, err := Thumbprints(restored)
+		require.NoError(t, err)
+		require.Contains(t, thumbs, ExchangeKey1Thp)
+	})
+
+	t.Run("unwrap with a wrong passphrase", func(t *testing.T) {
+		wrapped, err := WrapKey(SigningKey1, passphrase, testWrapIterations)
+		require.NoError(t, err)
+
+		_, err = UnwrapKey(wrapped, []byte("wrong"))
+		require.Error(t, err)
+	})
+
+	t.Run("wrap with an empty passphrase", func(t *testing.T) {
+		_, err := WrapKey(SigningKey1, nil, testWrapIterations)
+		require.Error(t, err)
+	})
+}
+
+func TestIsWrappedKey(t *testing.T) {
+	plain, err := ExchangeKey1.MarshalJSON()
+	require.NoError(t, err)
+	require.False(t, IsWrappedKey(plain))
+	require.False(t, IsWrappedKey(nil))
+}
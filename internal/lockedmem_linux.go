@@ -0,0 +1,62 @@
+package internal
+
+import (
+	"math/big"
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+// MADV_DONTDUMP, missing from the syscall package.
+const madvDontDump = 0x10
+
+/*
+LockedWords is memory for big.Int words which is locked in RAM (mlock), so that it is never swapped,
+and excluded from core dumps (MADV_DONTDUMP).
+*/
+type LockedWords struct {
+	mem   []byte
+	words []big.Word
+}
+
+// LockWords maps and locks memory for n words. It fails when the memory lock limit (RLIMIT_MEMLOCK) is reached.
+func LockWords(n int) (*LockedWords, error) {
+	size := max(n, 1) * int(unsafe.Sizeof(big.Word(0)))
+	page := os.Getpagesize()
+	size = (size + page - 1) / page * page
+
+	mem, err := syscall.Mmap(-1, 0, size, syscall.PROT_READ|syscall.PROT_WRITE, syscall.MAP_PRIVATE|syscall.MAP_ANON)
+	if err != nil {
+		return nil, err
+	}
+	if err = syscall.Mlock(mem); err != nil {
+		_ = syscall.Munmap(mem)
+		return nil, err
+	}
+	// Best effort, older kernels do not support it.
+	_ = syscall.Madvise(mem, madvDontDump)
+
+	return &LockedWords{
+		mem:   mem,
+		words: unsafe.Slice((*big.Word)(unsafe.Pointer(&mem[0])), n),
+	}, nil
+}
+
+// Words returns the locked words, only valid until Free.
+func (t *LockedWords) Words() []big.Word {
+	return t.words
+}
+
+// Free zeroes, unlocks and unmaps the memory. Every big.Int using the words must be reset beforehand.
+func (t *LockedWords) Free() error {
+	if t.mem == nil {
+		return nil
+	}
+	clear(t.mem)
+	err := syscall.Munlock(t.mem)
+	if unmapErr := syscall.Munmap(t.mem); err == nil {
+		err = unmapErr
+	}
+	t.mem, t.words = nil, nil
+	return err
+}
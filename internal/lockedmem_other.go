@@ -0,0 +1,27 @@
+//go:build !linux
+
+package internal
+
+import (
+	"errors"
+	"math/big"
+)
+
+var errLockUnsupported = errors.New("memory locking is only supported on Linux")
+
+// LockedWords is memory for big.Int words locked in RAM, only supported on Linux.
+type LockedWords struct {
+	words []big.Word
+}
+
+func LockWords(n int) (*LockedWords, error) {
+	return nil, errLockUnsupported
+}
+
+func (t *LockedWords) Words() []big.Word {
+	return t.words
+}
+
+func (t *LockedWords) Free() error {
+	return nil
+}
@@ -0,0 +1,45 @@
+package internal
+
+import (
+	"crypto/ecdsa"
+	"math/big"
+	"unsafe"
+)
+
+// Zeroization of secret values once they are no longer needed.
+// Go may still have made transient copies (e.g. big.Int.Bytes() during a scalar multiplication), those are out of reach.
+
+func WipeBytes(data []byte) {
+	clear(data)
+}
+
+// WordBytes returns the memory of words as bytes, e.g. to keep a byte string secret in LockedWords.
+func WordBytes(words []big.Word) []byte {
+	return unsafe.Slice((*byte)(unsafe.Pointer(unsafe.SliceData(words))), len(words)*int(unsafe.Sizeof(big.Word(0))))
+}
+
+// WipeBigInt zeroes the memory backing n, then sets n to 0.
+func WipeBigInt(n *big.Int) {
+	if n == nil {
+		return
+	}
+	clear(n.Bits())
+	n.SetBits(nil)
+}
+
+func WipePrivateKey(key *ecdsa.PrivateKey) {
+	if key == nil {
+		return
+	}
+	WipeBigInt(key.D)
+	WipePoint(&key.PublicKey)
+}
+
+// WipePoint zeroes the coordinates of a secret point, e.g. an ECDH shared secret.
+func WipePoint(point *ecdsa.PublicKey) {
+	if point == nil {
+		return
+	}
+	WipeBigInt(point.X)
+	WipeBigInt(point.Y)
+}
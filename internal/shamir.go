@@ -0,0 +1,125 @@
+package internal
+
+import (
+	"crypto/rand"
+	"fmt"
+)
+
+/*
+Shamir secret sharing over GF(2^8), each byte of the secret being the constant term of its own random polynomial
+of degree threshold-1. A share holds the polynomial values at a single non-zero point x:
+
+	share = f_0(x) || f_1(x) || ... || f_n(x) || x
+
+Any threshold shares rebuild the secret by Lagrange interpolation at x = 0, fewer reveal nothing about it.
+*/
+
+// GF(2^8) with the AES reduction polynomial x^8 + x^4 + x^3 + x + 1, 3 generating its multiplicative group.
+var gfExp, gfLog = func() ([510]byte, [256]byte) {
+	var exp [510]byte
+	var log [256]byte
+	x := byte(1)
+	for i := 0; i < 255; i++ {
+		exp[i], exp[i+255] = x, x
+		log[x] = byte(i)
+		// x * 3 = x * 2 + x
+		double := x << 1
+		if x&0x80 != 0 {
+			double ^= 0x1b
+		}
+		x ^= double
+	}
+	return exp, log
+}()
+
+func gfMul(a byte, b byte) byte {
+	if a == 0 || b == 0 {
+		return 0
+	}
+	return gfExp[int(gfLog[a])+int(gfLog[b])]
+}
+
+func gfDiv(a byte, b byte) byte {
+	if a == 0 {
+		return 0
+	}
+	return gfExp[int(gfLog[a])+255-int(gfLog[b])]
+}
+
+// SplitSecret splits secret into the given number of shares, any threshold of them rebuilding it (see CombineShares).
+func SplitSecret(secret []byte, shares int, threshold int) ([][]byte, error) {
+	if threshold < 1 || shares < threshold || shares > 255 {
+		return nil, fmt.Errorf("invalid secret sharing of %d shares with threshold %d", shares, threshold)
+	}
+	if len(secret) == 0 {
+		return nil, fmt.Errorf("empty secret")
+	}
+
+	coefficients := make([]byte, threshold-1)
+	defer WipeBytes(coefficients)
+	result := make([][]byte, shares)
+	for i := range result {
+		result[i] = make([]byte, len(secret)+1)
+		result[i][len(secret)] = byte(i + 1)
+	}
+	for b, constant := range secret {
+		if _, err := rand.Read(coefficients); err != nil {
+			return nil, err
+		}
+		for _, share := range result {
+			// Horner's method, from the highest degree coefficient down to the secret byte.
+			x, y := share[len(secret)], byte(0)
+			for c := len(coefficients) - 1; c >= 0; c-- {
+				y = gfMul(y, x) ^ coefficients[c]
+			}
+			share[b] = gfMul(y, x) ^ constant
+		}
+	}
+	return result, nil
+}
+
+// CombineShares rebuilds the secret from shares of a single SplitSecret call.
+// NOTE: fewer shares than the threshold silently combine into a wrong secret, callers must authenticate the result.
+func CombineShares(shares [][]byte) ([]byte, error) {
+	if len(shares) == 0 {
+		return nil, fmt.Errorf("no secret shares")
+	}
+	size := len(shares[0])
+	if size < 2 {
+		return nil, fmt.Errorf("invalid secret share")
+	}
+	xs := make([]byte, len(shares))
+	for i, share := range shares {
+		if len(share) != size {
+			return nil, fmt.Errorf("secret shares have different sizes")
+		}
+		xs[i] = share[size-1]
+		if xs[i] == 0 {
+			return nil, fmt.Errorf("invalid secret share")
+		}
+		for j := 0; j < i; j++ {
+			if xs[j] == xs[i] {
+				return nil, fmt.Errorf("duplicate secret share %d", xs[i])
+			}
+		}
+	}
+
+	// Lagrange basis polynomials at 0: l_i(0) = prod_{j != i} x_j / (x_j - x_i), subtraction being XOR.
+	basis := make([]byte, len(shares))
+	for i := range shares {
+		basis[i] = 1
+		for j := range shares {
+			if i != j {
+				basis[i] = gfMul(basis[i], gfDiv(xs[j], xs[j]^xs[i]))
+			}
+		}
+	}
+
+	secret := make([]byte, size-1)
+	for b := range secret {
+		for i, share := range shares {
+			secret[b] ^= gfMul(share[b], basis[i])
+		}
+	}
+	return secret, nil
+}
@@ -0,0 +1,59 @@
+package internal
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestShamir(t *testing.T) {
+	secret := []byte("0123456789abcdef0123456789abcdef")
+
+	t.Run("any threshold shares rebuild the secret", func(t *testing.T) {
+		shares, err := SplitSecret(secret, 5, 3)
+		require.NoError(t, err)
+		require.Len(t, shares, 5)
+		for i := 0; i < 5; i++ {
+			for j := i + 1; j < 5; j++ {
+				for k := j + 1; k < 5; k++ {
+					combined, err := CombineShares([][]byte{shares[k], shares[i], shares[j]})
+					require.NoError(t, err)
+					require.Equal(t, secret, combined)
+				}
+			}
+		}
+		combined, err := CombineShares(shares)
+		require.NoError(t, err)
+		require.Equal(t, secret, combined, "extra shares do not hurt")
+
+		combined, err = CombineShares(shares[:2])
+		require.NoError(t, err)
+		require.NotEqual(t, secret, combined)
+	})
+
+	t.Run("a threshold of one copies the secret", func(t *testing.T) {
+		shares, err := SplitSecret(secret, 2, 1)
+		require.NoError(t, err)
+		require.Equal(t, secret, shares[1][:len(secret)])
+	})
+
+	t.Run("invalid parameters", func(t *testing.T) {
+		for _, params := range [][2]int{{3, 4}, {3, 0}, {256, 2}} {
+			_, err := SplitSecret(secret, params[0], params[1])
+			require.Error(t, err)
+		}
+		_, err := SplitSecret(nil, 3, 2)
+		require.Error(t, err)
+	})
+
+	t.Run("invalid shares", func(t *testing.T) {
+		shares, err := SplitSecret(secret, 3, 2)
+		require.NoError(t, err)
+		_, err = CombineShares([][]byte{shares[0], shares[0]})
+		require.ErrorContains(t, err, "duplicate")
+		_, err = CombineShares([][]byte{shares[0], shares[1][1:]})
+		require.Error(t, err)
+		_, err = CombineShares(nil)
+		require.Error(t, err)
+	})
+}
@@ -2,10 +2,20 @@ package internal
 
 import (
 	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
 	"crypto/rand"
 	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
 	"encoding/base64"
 	"encoding/json"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"time"
 
 	"github.com/go-jose/go-jose/v4"
 )
@@ -100,3 +110,91 @@ func GenerateRSAKey() (*jose.JSONWebKey, error) {
 
 	return &jose.JSONWebKey{Key: k}, nil
 }
+
+// TestPKI lists the PEM files written by WriteTestPKI.
+type TestPKI struct {
+	CAFile         string
+	ServerCertFile string
+	ServerKeyFile  string
+	ClientCertFile string
+	ClientKeyFile  string
+}
+
+// WriteTestPKI writes a fresh CA, a server certificate for localhost and a client certificate for clientName into dir.
+func WriteTestPKI(dir string, clientName string) (TestPKI, error) {
+	pki := TestPKI{
+		CAFile:         filepath.Join(dir, "ca.pem"),
+		ServerCertFile: filepath.Join(dir, "server.pem"),
+		ServerKeyFile:  filepath.Join(dir, "server-key.pem"),
+		ClientCertFile: filepath.Join(dir, "client.pem"),
+		ClientKeyFile:  filepath.Join(dir, "client-key.pem"),
+	}
+
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return pki, err
+	}
+	ca := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "citrus test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	caDER, err := x509.CreateCertificate(rand.Reader, ca, ca, &caKey.PublicKey, caKey)
+	if err != nil {
+		return pki, err
+	}
+	if err = writeTestPEM(pki.CAFile, "CERTIFICATE", caDER); err != nil {
+		return pki, err
+	}
+
+	leaves := []struct {
+		name     string
+		usage    x509.ExtKeyUsage
+		certFile string
+		keyFile  string
+	}{
+		{"localhost", x509.ExtKeyUsageServerAuth, pki.ServerCertFile, pki.ServerKeyFile},
+		{clientName, x509.ExtKeyUsageClientAuth, pki.ClientCertFile, pki.ClientKeyFile},
+	}
+	for i, leaf := range leaves {
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			return pki, err
+		}
+		template := &x509.Certificate{
+			SerialNumber: big.NewInt(int64(i + 2)),
+			Subject:      pkix.Name{CommonName: leaf.name},
+			DNSNames:     []string{leaf.name},
+			NotBefore:    time.Now().Add(-time.Hour),
+			NotAfter:     time.Now().Add(time.Hour),
+			KeyUsage:     x509.KeyUsageDigitalSignature,
+			ExtKeyUsage:  []x509.ExtKeyUsage{leaf.usage},
+		}
+		if leaf.usage == x509.ExtKeyUsageServerAuth {
+			template.IPAddresses = []net.IP{net.IPv4(127, 0, 0, 1), net.IPv6loopback}
+		}
+		der, err := x509.CreateCertificate(rand.Reader, template, ca, &key.PublicKey, caKey)
+		if err != nil {
+			return pki, err
+		}
+		keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+		if err != nil {
+			return pki, err
+		}
+		if err = writeTestPEM(leaf.certFile, "CERTIFICATE", der); err != nil {
+			return pki, err
+		}
+		if err = writeTestPEM(leaf.keyFile, "PRIVATE KEY", keyDER); err != nil {
+			return pki, err
+		}
+	}
+	return pki, nil
+}
+
+func writeTestPEM(path string, blockType string, der []byte) error {
+	return os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: der}), 0o600)
+}
@@ -0,0 +1,165 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+/*
+Process supervisor integration:
+  - systemd socket activation (Accept=no): listening sockets are passed from fd 3 on, LISTEN_FDS telling how many,
+    LISTEN_PID which process they are meant for, and LISTEN_FDNAMES their names,
+  - inetd mode, as tangd runs under a tangd.socket unit (Accept=yes): a single connection on stdin/stdout,
+    serving one request per process.
+*/
+const listenFdsStart = 3
+
+var errConnServed = errors.New("connection served")
+
+// ActivationListeners returns the listeners passed by systemd, none when the process was not socket activated.
+// The activation variables are cleared, so that child processes do not inherit them.
+func ActivationListeners() ([]net.Listener, error) {
+	defer func() {
+		_ = os.Unsetenv("LISTEN_PID")
+		_ = os.Unsetenv("LISTEN_FDS")
+		_ = os.Unsetenv("LISTEN_FDNAMES")
+	}()
+	return activationListeners(os.Getenv, os.Getpid(), listenFdsStart)
+}
+
+func activationListeners(getenv func(string) string, pid int, start int) ([]net.Listener, error) {
+	if getenv("LISTEN_PID") != strconv.Itoa(pid) {
+		return nil, nil
+	}
+	count, err := strconv.Atoi(getenv("LISTEN_FDS"))
+	if err != nil || count < 0 {
+		return nil, fmt.Errorf("invalid LISTEN_FDS '%s'", getenv("LISTEN_FDS"))
+	}
+	names := strings.Split(getenv("LISTEN_FDNAMES"), ":")
+
+	var listeners []net.Listener
+	for i := 0; i < count; i++ {
+		fd := start + i
+		name := fmt.Sprintf("LISTEN_FD_%d", fd)
+		if i < len(names) && names[i] != "" {
+			name = names[i]
+		}
+
+		file := os.NewFile(uintptr(fd), name)
+		// FileListener works on a close-on-exec duplicate, the passed descriptor is not needed anymore.
+		listener, err := net.FileListener(file)
+		_ = file.Close()
+		if err != nil {
+			for _, l := range listeners {
+				_ = l.Close()
+			}
+			return nil, fmt.Errorf("passed file descriptor %d (%s) is not a listening socket: %w", fd, name, err)
+		}
+		listeners = append(listeners, listener)
+	}
+	return listeners, nil
+}
+
+// InetdConn returns the connection of an inetd-style process: stdin when it is a socket, stdin and stdout otherwise.
+func InetdConn() net.Conn {
+	if conn, err := net.FileConn(os.Stdin); err == nil {
+		return conn
+	}
+	return &stdioConn{in: os.Stdin, out: os.Stdout}
+}
+
+// ServeConn serves a single request read from conn with the given server, then closes conn.
+func ServeConn(srv *http.Server, conn net.Conn) error {
+	srv.SetKeepAlivesEnabled(false)
+	listener := &connListener{conn: conn, done: make(chan struct{})}
+	if err := srv.Serve(listener); !errors.Is(err, errConnServed) {
+		return err
+	}
+	return nil
+}
+
+// connListener hands out a single connection, then waits for the server to close it.
+type connListener struct {
+	conn net.Conn
+	once sync.Once
+	done chan struct{}
+}
+
+func (t *connListener) Accept() (net.Conn, error) {
+	var conn net.Conn
+	t.once.Do(func() {
+		conn = &closeNotifyConn{Conn: t.conn, done: t.done}
+	})
+	if conn != nil {
+		return conn, nil
+	}
+	<-t.done
+	return nil, errConnServed
+}
+
+func (t *connListener) Close() error {
+	return nil
+}
+
+func (t *connListener) Addr() net.Addr {
+	return t.conn.LocalAddr()
+}
+
+type closeNotifyConn struct {
+	net.Conn
+	once sync.Once
+	done chan struct{}
+}
+
+func (t *closeNotifyConn) Close() error {
+	err := t.Conn.Close()
+	t.once.Do(func() { close(t.done) })
+	return err
+}
+
+// stdioConn is a connection over a pair of pipes, e.g. stdin and stdout.
+type stdioConn struct {
+	in  io.ReadCloser
+	out io.WriteCloser
+}
+
+type stdioAddr struct{}
+
+func (stdioAddr) Network() string { return "stdio" }
+func (stdioAddr) String() string  { return "stdio" }
+
+func (t *stdioConn) Read(b []byte) (int, error)  { return t.in.Read(b) }
+func (t *stdioConn) Write(b []byte) (int, error) { return t.out.Write(b) }
+func (t *stdioConn) LocalAddr() net.Addr         { return stdioAddr{} }
+func (t *stdioConn) RemoteAddr() net.Addr        { return stdioAddr{} }
+
+func (t *stdioConn) Close() error {
+	return errors.Join(t.in.Close(), t.out.Close())
+}
+
+func (t *stdioConn) SetDeadline(deadline time.Time) error {
+	return errors.Join(t.SetReadDeadline(deadline), t.SetWriteDeadline(deadline))
+}
+
+func (t *stdioConn) SetReadDeadline(deadline time.Time) error {
+	if file, ok := t.in.(*os.File); ok {
+		// Not every file supports deadlines (e.g. a terminal), the request is then read without.
+		_ = file.SetReadDeadline(deadline)
+	}
+	return nil
+}
+
+func (t *stdioConn) SetWriteDeadline(deadline time.Time) error {
+	if file, ok := t.out.(*os.File); ok {
+		_ = file.SetWriteDeadline(deadline)
+	}
+	return nil
+}
@@ -0,0 +1,112 @@
+package server
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/go-jose/go-jose/v4"
+	"github.com/stretchr/testify/require"
+
+	. "go-citrus/internal"
+)
+
+func TestActivationListeners(t *testing.T) {
+	t.Run("not activated", func(t *testing.T) {
+		env := map[string]string{}
+		listeners, err := activationListeners(func(key string) string { return env[key] }, os.Getpid(), listenFdsStart)
+		require.NoError(t, err)
+		require.Empty(t, listeners)
+	})
+
+	t.Run("meant for another process", func(t *testing.T) {
+		env := map[string]string{"LISTEN_PID": "1", "LISTEN_FDS": "1"}
+		listeners, err := activationListeners(func(key string) string { return env[key] }, os.Getpid(), listenFdsStart)
+		require.NoError(t, err)
+		require.Empty(t, listeners)
+	})
+
+	t.Run("invalid LISTEN_FDS", func(t *testing.T) {
+		env := map[string]string{"LISTEN_PID": strconv.Itoa(os.Getpid()), "LISTEN_FDS": "many"}
+		_, err := activationListeners(func(key string) string { return env[key] }, os.Getpid(), listenFdsStart)
+		require.Error(t, err)
+	})
+
+	t.Run("passed listening socket", func(t *testing.T) {
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		require.NoError(t, err)
+		file, err := listener.(*net.TCPListener).File()
+		require.NoError(t, err)
+		require.NoError(t, listener.Close())
+
+		// The passed socket becomes fd 3 of the helper process.
+		cmd := exec.Command(os.Args[0], "-test.run=^TestActivationHelperProcess$")
+		cmd.ExtraFiles = []*os.File{file}
+		cmd.Env = append(os.Environ(), "CITRUS_TEST_ACTIVATION=1", "LISTEN_FDS=1", "LISTEN_FDNAMES=citrus")
+		require.NoError(t, cmd.Start())
+		require.NoError(t, file.Close())
+
+		resp, err := http.Get("http://" + listener.Addr().String() + "/adv")
+		require.NoError(t, err)
+		body, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		_ = resp.Body.Close()
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		_, err = ParseAdvertisement(body, []jose.SignatureAlgorithm{DefaultSignatureAlgorithm})
+		require.NoError(t, err)
+		require.NoError(t, cmd.Wait())
+	})
+}
+
+// TestActivationHelperProcess serves a single connection on the socket passed by TestActivationListeners.
+func TestActivationHelperProcess(t *testing.T) {
+	if os.Getenv("CITRUS_TEST_ACTIVATION") != "1" {
+		t.Skip("helper process")
+	}
+	// systemd sets LISTEN_PID after forking, the parent test cannot know it.
+	require.NoError(t, os.Setenv("LISTEN_PID", strconv.Itoa(os.Getpid())))
+
+	listeners, err := ActivationListeners()
+	require.NoError(t, err)
+	require.Len(t, listeners, 1)
+	require.Empty(t, os.Getenv("LISTEN_FDS"))
+
+	conn, err := listeners[0].Accept()
+	require.NoError(t, err)
+	require.NoError(t, ServeConn(&http.Server{Handler: newTestHandler(t)}, conn))
+}
+
+func TestServeConn(t *testing.T) {
+	requestReader, requestWriter, err := os.Pipe()
+	require.NoError(t, err)
+	responseReader, responseWriter, err := os.Pipe()
+	require.NoError(t, err)
+
+	served := make(chan error)
+	go func() {
+		srv := &http.Server{Handler: newTestHandler(t), ReadHeaderTimeout: time.Second}
+		served <- ServeConn(srv, &stdioConn{in: requestReader, out: responseWriter})
+	}()
+
+	_, err = io.WriteString(requestWriter, "GET /adv/"+SigningKey1Thp+" HTTP/1.1\r\nHost: localhost\r\n\r\n")
+	require.NoError(t, err)
+
+	resp, err := http.ReadResponse(bufio.NewReader(responseReader), nil)
+	require.NoError(t, err)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.Equal(t, advertisementContentType, resp.Header.Get("Content-Type"))
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	_, err = ParseAdvertisement(body, []jose.SignatureAlgorithm{DefaultSignatureAlgorithm})
+	require.NoError(t, err)
+
+	require.NoError(t, <-served)
+	_ = requestWriter.Close()
+	_ = responseReader.Close()
+}
@@ -0,0 +1,493 @@
+package server
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/go-jose/go-jose/v4"
+
+	. "go-citrus/internal"
+)
+
+/*
+Admin API, served on its own listener so that it is never exposed along with the Tang API:
+  - POST /admin/keys/list           - keys of the key directory with their state
+  - POST /admin/keys/generate       - new active key, of the kind given by the request "use" (exchange or signing),
+    signing keys with the request "alg" when given
+  - POST /admin/keys/rotate         - replace every active key right away
+  - POST /admin/keys/{thp}/demote   - stop advertising an active key, which remains usable for recovery
+  - POST /admin/keys/{thp}/retire   - delete a demoted key
+  - POST /admin/reload              - re-read the key directory
+
+With an approval queue (see WithApprovals and ApprovalQueue):
+  - POST /admin/keys/{thp}/require-approvals - set the approvals required by each recovery, the request "approvals"
+  - POST /admin/approvals/pending            - recoveries waiting for approvals
+  - POST /admin/approvals/{ticket}/approve   - approve a recovery, as the operator who signed the request
+
+On replication secondaries (see WithReplication and Replicator):
+  - POST /admin/replicate - apply the key set of the primary, the request "key_set"
+
+Every request body is a compact JWS over an AdminRequest, signed by an operator key of the allowlist (see OperatorKeys).
+The request names its action and key, so that a signature is only good for one endpoint, and is refused when replayed:
+it must be issued within adminMaxSkew of the server clock, with a nonce the server has not seen yet.
+*/
+const (
+	AdminActionList     = "list"
+	AdminActionGenerate = "generate"
+	AdminActionRotate   = "rotate"
+	AdminActionDemote   = "demote"
+	AdminActionRetire   = "retire"
+	AdminActionReload   = "reload"
+
+	AdminActionRequireApprovals = "require-approvals"
+	AdminActionPending          = "pending"
+	AdminActionApprove          = "approve"
+
+	AdminActionReplicate = "replicate"
+
+	RouteAdmin = "admin"
+
+	adminContentType    = "application/json"
+	adminMaxSkew        = 5 * time.Minute
+	maxAdminRequestSize = 1024 * 1024 // replicated key sets included
+	maxNonceSize        = 128
+)
+
+// Signature algorithms accepted from operator keys.
+var operatorAlgorithms = []jose.SignatureAlgorithm{
+	jose.ES256, jose.ES384, jose.ES512, jose.EdDSA, jose.RS256, jose.PS256,
+}
+
+// AdminRequest is the signed payload of every admin API request.
+type AdminRequest struct {
+	Action     string `json:"action"`
+	Thumbprint string `json:"thumbprint,omitempty"` // key of the demote, retire and require-approvals actions
+	Ticket     string `json:"ticket,omitempty"`     // approval ticket of the approve action
+	Use        string `json:"use,omitempty"`        // key kind of the generate action
+	Algorithm  string `json:"alg,omitempty"`        // signing key algorithm of the generate action, the default one when empty
+	Approvals  int    `json:"approvals,omitempty"`  // approvals of the require-approvals action, 0 requiring none
+	KeySet     string `json:"key_set,omitempty"`    // JWE of the replicated key set, replicate action
+	Nonce      string `json:"nonce"`
+	IssuedAt   int64  `json:"iat"` // Unix time
+}
+
+// NewAdminRequest creates a request for action, issued now with a random nonce.
+func NewAdminRequest(action string, thumbprint string) (AdminRequest, error) {
+	nonce := make([]byte, 16)
+	if _, err := rand.Read(nonce); err != nil {
+		return AdminRequest{}, err
+	}
+	return AdminRequest{
+		Action:     action,
+		Thumbprint: thumbprint,
+		Nonce:      base64.RawURLEncoding.EncodeToString(nonce),
+		IssuedAt:   time.Now().Unix(),
+	}, nil
+}
+
+// SignAdminRequest signs request with an operator private key, whose key ID names the operator.
+func SignAdminRequest(key jose.JSONWebKey, request AdminRequest) ([]byte, error) {
+	if key.KeyID == "" {
+		return nil, fmt.Errorf("operator key has no key ID")
+	}
+	algorithm, err := operatorAlgorithm(key)
+	if err != nil {
+		return nil, err
+	}
+	signer, err := jose.NewSigner(jose.SigningKey{Algorithm: algorithm, Key: key}, nil)
+	if err != nil {
+		return nil, err
+	}
+	payload, err := json.Marshal(request)
+	if err != nil {
+		return nil, err
+	}
+	jws, err := signer.Sign(payload)
+	if err != nil {
+		return nil, err
+	}
+	compact, err := jws.CompactSerialize()
+	return []byte(compact), err
+}
+
+// operatorAlgorithm returns the "alg" of an operator key, or the usual algorithm of its key type.
+func operatorAlgorithm(key jose.JSONWebKey) (jose.SignatureAlgorithm, error) {
+	if key.Algorithm != "" {
+		return jose.SignatureAlgorithm(key.Algorithm), nil
+	}
+	switch k := key.Key.(type) {
+	case *ecdsa.PrivateKey:
+		return ecdsaAlgorithm(k.Curve)
+	case *ecdsa.PublicKey:
+		return ecdsaAlgorithm(k.Curve)
+	case ed25519.PrivateKey, ed25519.PublicKey:
+		return jose.EdDSA, nil
+	case *rsa.PrivateKey, *rsa.PublicKey:
+		return jose.RS256, nil
+	default:
+		return "", fmt.Errorf("unsupported operator key type %T", key.Key)
+	}
+}
+
+func ecdsaAlgorithm(curve elliptic.Curve) (jose.SignatureAlgorithm, error) {
+	switch curve {
+	case elliptic.P256():
+		return jose.ES256, nil
+	case elliptic.P384():
+		return jose.ES384, nil
+	case elliptic.P521():
+		return jose.ES512, nil
+	default:
+		return "", fmt.Errorf("unsupported operator key curve %s", curve.Params().Name)
+	}
+}
+
+// OperatorKeys is the allowlist of operator public keys, by key ID.
+type OperatorKeys map[string]jose.JSONWebKey
+
+// LoadOperatorKeys reads a JWK set file of operator keys. Every key needs a unique key ID, naming its operator.
+func LoadOperatorKeys(path string) (OperatorKeys, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var set jose.JSONWebKeySet
+	if err = json.Unmarshal(data, &set); err != nil {
+		return nil, fmt.Errorf("unable to parse operator keys '%s': %w", path, err)
+	}
+
+	operators := make(OperatorKeys)
+	for _, key := range set.Keys {
+		if key.KeyID == "" {
+			return nil, fmt.Errorf("operator key without key ID in '%s'", path)
+		}
+		if _, ok := operators[key.KeyID]; ok {
+			return nil, fmt.Errorf("duplicate operator key ID '%s' in '%s'", key.KeyID, path)
+		}
+		if _, err = operatorAlgorithm(key); err != nil {
+			return nil, fmt.Errorf("operator key '%s': %w", key.KeyID, err)
+		}
+		operators[key.KeyID] = key.Public()
+	}
+	if len(operators) == 0 {
+		return nil, fmt.Errorf("no operator key found in '%s'", path)
+	}
+	return operators, nil
+}
+
+// AdminPath returns the admin API path of action, target naming its key thumbprint or approval ticket.
+func AdminPath(action string, target string) string {
+	switch action {
+	case AdminActionDemote, AdminActionRetire, AdminActionRequireApprovals:
+		return "/admin/keys/" + target + "/" + action
+	case AdminActionApprove:
+		return "/admin/approvals/" + target + "/" + action
+	case AdminActionPending:
+		return "/admin/approvals/" + action
+	case AdminActionReload, AdminActionReplicate:
+		return "/admin/" + action
+	default:
+		return "/admin/keys/" + action
+	}
+}
+
+// AdminAuthError is returned for admin requests which are not properly signed, or replayed.
+type AdminAuthError struct {
+	Reason string
+}
+
+func (e *AdminAuthError) Error() string {
+	return "admin request refused: " + e.Reason
+}
+
+type AdminHandler struct {
+	rotator   *Rotator
+	operators OperatorKeys
+	approvals *ApprovalQueue
+	replica   jose.JSONWebKey // private key replicated key sets are encrypted to
+	audit     AuditSink
+	now       func() time.Time
+	mux       *http.ServeMux
+
+	mu     sync.Mutex
+	nonces map[string]time.Time // seen nonces, until they leave the accepted time window
+}
+
+// NewAdminHandler serves the admin API, performing key operations with rotator (see Rotator).
+func NewAdminHandler(rotator *Rotator, operators OperatorKeys) *AdminHandler {
+	h := AdminHandler{
+		rotator:   rotator,
+		operators: operators,
+		now:       time.Now,
+		mux:       http.NewServeMux(),
+		nonces:    make(map[string]time.Time),
+	}
+	h.mux.HandleFunc("POST /admin/keys/list", h.action(AdminActionList, h.list))
+	h.mux.HandleFunc("POST /admin/keys/generate", h.action(AdminActionGenerate, h.generate))
+	h.mux.HandleFunc("POST /admin/keys/rotate", h.action(AdminActionRotate, h.rotate))
+	h.mux.HandleFunc("POST /admin/keys/{thp}/demote", h.action(AdminActionDemote, h.demote))
+	h.mux.HandleFunc("POST /admin/keys/{thp}/retire", h.action(AdminActionRetire, h.retire))
+	h.mux.HandleFunc("POST /admin/reload", h.action(AdminActionReload, h.reload))
+	return &h
+}
+
+// WithApprovals lets operators manage the recoveries waiting for approvals in queue, see ApprovalQueue.
+func (t *AdminHandler) WithApprovals(queue *ApprovalQueue) *AdminHandler {
+	t.approvals = queue
+	t.mux.HandleFunc("POST /admin/keys/{thp}/require-approvals", t.action(AdminActionRequireApprovals, t.requireApprovals))
+	t.mux.HandleFunc("POST /admin/approvals/pending", t.action(AdminActionPending, t.pending))
+	t.mux.HandleFunc("POST /admin/approvals/{ticket}/approve", t.action(AdminActionApprove, t.approve))
+	return t
+}
+
+// WithReplication applies the key sets pushed by a primary server, encrypted to key (see Replicator).
+// The primary signing key must be among the operator keys.
+func (t *AdminHandler) WithReplication(key jose.JSONWebKey) *AdminHandler {
+	t.replica = key
+	t.mux.HandleFunc("POST /admin/replicate", t.action(AdminActionReplicate, t.replicate))
+	return t
+}
+
+// WithAudit records every admin request into sink, along with the operator who signed it.
+func (t *AdminHandler) WithAudit(sink AuditSink) *AdminHandler {
+	t.audit = sink
+	return t
+}
+
+func (t *AdminHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	t.mux.ServeHTTP(w, r)
+}
+
+// adminActionFn performs an admin request authenticated as operator, and returns the thumbprint of the key it changed, if any.
+type adminActionFn func(w http.ResponseWriter, request AdminRequest, operator string) (string, error)
+
+func (t *AdminHandler) action(action string, next adminActionFn) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		sw := &statusWriter{ResponseWriter: w, status: http.StatusOK}
+		thumbprint := r.PathValue("thp")
+
+		request, operator, err := t.authenticate(sw, r, action)
+		if err == nil {
+			var changed string
+			if changed, err = next(sw, request, operator); changed != "" {
+				thumbprint = changed
+			}
+		}
+		if err != nil {
+			http.Error(sw, err.Error(), adminErrorStatus(err))
+		}
+		status := sw.status
+		slog.Info("admin request", "action", action, "operator", operator, "thumbprint", thumbprint, "status", status)
+
+		if t.audit == nil {
+			return
+		}
+		err = t.audit.Record(AuditRecord{
+			Time:       start.UTC(),
+			Client:     ClientAddress(r),
+			Subject:    ClientSubject(r),
+			Route:      RouteAdmin,
+			Action:     action,
+			Operator:   operator,
+			Thumbprint: thumbprint,
+			Status:     status,
+			Latency:    time.Since(start),
+			Ticket:     r.PathValue("ticket"),
+		})
+		if err != nil {
+			slog.Error("unable to write audit record", "error", err)
+		}
+	}
+}
+
+// authenticate verifies the request signature against the operator allowlist, and that it is meant for action.
+// It returns the request along with the operator key ID.
+func (t *AdminHandler) authenticate(w http.ResponseWriter, r *http.Request, action string) (AdminRequest, string, error) {
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxAdminRequestSize))
+	if err != nil {
+		return AdminRequest{}, "", NewInvalidKeyError("unable to read admin request")
+	}
+	jws, err := jose.ParseSigned(string(body), operatorAlgorithms)
+	if err != nil {
+		return AdminRequest{}, "", &AdminAuthError{Reason: "request is not a signed JWS"}
+	}
+	if len(jws.Signatures) != 1 {
+		return AdminRequest{}, "", &AdminAuthError{Reason: "request must carry exactly one signature"}
+	}
+	operator := jws.Signatures[0].Header.KeyID
+	key, ok := t.operators[operator]
+	if !ok {
+		return AdminRequest{}, "", &AdminAuthError{Reason: fmt.Sprintf("unknown operator key '%s'", operator)}
+	}
+	payload, err := jws.Verify(key)
+	if err != nil {
+		return AdminRequest{}, "", &AdminAuthError{Reason: "invalid signature"}
+	}
+
+	var request AdminRequest
+	if err = json.Unmarshal(payload, &request); err != nil {
+		return AdminRequest{}, operator, NewInvalidKeyError("unable to parse admin request: %v", err)
+	}
+	if request.Action != action || request.Thumbprint != r.PathValue("thp") || request.Ticket != r.PathValue("ticket") {
+		return AdminRequest{}, operator, &AdminAuthError{Reason: "request was signed for another action or key"}
+	}
+	if err = t.checkReplay(request); err != nil {
+		return AdminRequest{}, operator, err
+	}
+	return request, operator, nil
+}
+
+// checkReplay accepts a request once: issued within adminMaxSkew, with a nonce which was not seen in that window.
+func (t *AdminHandler) checkReplay(request AdminRequest) error {
+	if request.Nonce == "" || len(request.Nonce) > maxNonceSize {
+		return &AdminAuthError{Reason: "missing or oversized nonce"}
+	}
+	now := t.now()
+	issued := time.Unix(request.IssuedAt, 0)
+	if issued.Before(now.Add(-adminMaxSkew)) || issued.After(now.Add(adminMaxSkew)) {
+		return &AdminAuthError{Reason: "request issued too far from the server time"}
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for nonce, expiry := range t.nonces {
+		if now.After(expiry) {
+			delete(t.nonces, nonce)
+		}
+	}
+	if _, seen := t.nonces[request.Nonce]; seen {
+		return &AdminAuthError{Reason: "replayed request"}
+	}
+	// Past its expiry, the request is refused for its time anyway.
+	t.nonces[request.Nonce] = issued.Add(adminMaxSkew)
+	return nil
+}
+
+func (t *AdminHandler) list(w http.ResponseWriter, _ AdminRequest, _ string) (string, error) {
+	keys, err := t.rotator.Keys()
+	if err != nil {
+		return "", err
+	}
+	return "", writeAdminResponse(w, keys)
+}
+
+func (t *AdminHandler) generate(w http.ResponseWriter, request AdminRequest, _ string) (string, error) {
+	if request.Use != KeyKindExchange && request.Use != KeyKindSigning {
+		return "", NewInvalidKeyError("invalid key use '%s', expecting %s or %s", request.Use, KeyKindExchange, KeyKindSigning)
+	}
+	if request.Algorithm != "" && (request.Use != KeyKindSigning || !slices.Contains(SigningAlgorithms, jose.SignatureAlgorithm(request.Algorithm))) {
+		return "", NewInvalidKeyError("invalid algorithm '%s' for %s keys, expecting one of %v", request.Algorithm, request.Use, SigningAlgorithms)
+	}
+	thp, err := t.rotator.Generate(request.Use, request.Algorithm)
+	if err != nil {
+		return thp, err
+	}
+	return thp, writeAdminResponse(w, map[string]string{"thumbprint": thp})
+}
+
+func (t *AdminHandler) rotate(w http.ResponseWriter, _ AdminRequest, _ string) (string, error) {
+	if err := t.rotator.RotateNow(); err != nil {
+		return "", err
+	}
+	w.WriteHeader(http.StatusNoContent)
+	return "", nil
+}
+
+func (t *AdminHandler) demote(w http.ResponseWriter, request AdminRequest, _ string) (string, error) {
+	if err := t.rotator.Demote(request.Thumbprint); err != nil {
+		return "", err
+	}
+	w.WriteHeader(http.StatusNoContent)
+	return "", nil
+}
+
+func (t *AdminHandler) retire(w http.ResponseWriter, request AdminRequest, _ string) (string, error) {
+	if err := t.rotator.Retire(request.Thumbprint); err != nil {
+		return "", err
+	}
+	w.WriteHeader(http.StatusNoContent)
+	return "", nil
+}
+
+func (t *AdminHandler) reload(w http.ResponseWriter, _ AdminRequest, _ string) (string, error) {
+	if err := t.rotator.Reload(); err != nil {
+		return "", err
+	}
+	w.WriteHeader(http.StatusNoContent)
+	return "", nil
+}
+
+func (t *AdminHandler) requireApprovals(w http.ResponseWriter, request AdminRequest, _ string) (string, error) {
+	if request.Approvals < 0 {
+		return "", NewInvalidKeyError("invalid approvals count %d", request.Approvals)
+	}
+	if err := t.rotator.SetApprovals(request.Thumbprint, request.Approvals); err != nil {
+		return "", err
+	}
+	w.WriteHeader(http.StatusNoContent)
+	return "", nil
+}
+
+func (t *AdminHandler) pending(w http.ResponseWriter, _ AdminRequest, _ string) (string, error) {
+	return "", writeAdminResponse(w, t.approvals.Pending())
+}
+
+func (t *AdminHandler) approve(w http.ResponseWriter, request AdminRequest, operator string) (string, error) {
+	ticket, err := t.approvals.Approve(request.Ticket, operator)
+	if err != nil {
+		return "", err
+	}
+	return ticket.Thumbprint, writeAdminResponse(w, ticket)
+}
+
+func (t *AdminHandler) replicate(w http.ResponseWriter, request AdminRequest, _ string) (string, error) {
+	plaintext, err := decryptWith([]byte(request.KeySet), t.replica)
+	if err != nil {
+		return "", NewInvalidKeyError("unable to decrypt replicated key set: %v", err)
+	}
+	defer WipeBytes(plaintext)
+	var snapshot replicationSnapshot
+	if err = json.Unmarshal(plaintext, &snapshot); err != nil {
+		return "", NewInvalidKeyError("invalid replicated key set: %v", err)
+	}
+	defer snapshot.wipe()
+
+	if err = t.rotator.replicate(snapshot); err != nil {
+		return "", err
+	}
+	w.WriteHeader(http.StatusNoContent)
+	return "", nil
+}
+
+func writeAdminResponse(w http.ResponseWriter, response interface{}) error {
+	data, err := json.Marshal(response)
+	if err != nil {
+		return err
+	}
+	w.Header().Set("Content-Type", adminContentType)
+	_, _ = w.Write(data)
+	return nil
+}
+
+func adminErrorStatus(err error) int {
+	var auth *AdminAuthError
+	if errors.As(err, &auth) {
+		return http.StatusUnauthorized
+	}
+	return recoveryErrorStatus(err)
+}
@@ -0,0 +1,250 @@
+package server
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/go-jose/go-jose/v4"
+	"github.com/stretchr/testify/require"
+
+	. "go-citrus/internal"
+)
+
+func newOperatorKey(t *testing.T, name string) jose.JSONWebKey {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	return jose.JSONWebKey{Key: key, KeyID: name}
+}
+
+func newTestAdminHandler(t *testing.T, operators ...jose.JSONWebKey) (*AdminHandler, *Protocol, string) {
+	rotator, protocol, dir := newTestRotator(t, ExchangeKey1, SigningKey1)
+
+	allowlist := make(OperatorKeys)
+	for _, key := range operators {
+		allowlist[key.KeyID] = key.Public()
+	}
+	return NewAdminHandler(rotator, allowlist), protocol, dir
+}
+
+func adminCall(t *testing.T, handler http.Handler, path string, body []byte) *httptest.ResponseRecorder {
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, path, bytes.NewReader(body)))
+	return rec
+}
+
+func signedAdminRequest(t *testing.T, operator jose.JSONWebKey, request AdminRequest) []byte {
+	body, err := SignAdminRequest(operator, request)
+	require.NoError(t, err)
+	return body
+}
+
+func newSignedAdminRequest(t *testing.T, operator jose.JSONWebKey, action string, thumbprint string) []byte {
+	request, err := NewAdminRequest(action, thumbprint)
+	require.NoError(t, err)
+	return signedAdminRequest(t, operator, request)
+}
+
+func TestAdminHandler(t *testing.T) {
+	alice := newOperatorKey(t, "alice")
+	sink := &memoryAuditSink{}
+	handler, protocol, dir := newTestAdminHandler(t, alice)
+	handler.WithAudit(sink)
+
+	t.Run("list keys", func(t *testing.T) {
+		rec := adminCall(t, handler, "/admin/keys/list", newSignedAdminRequest(t, alice, AdminActionList, ""))
+		require.Equal(t, http.StatusOK, rec.Code)
+
+		var keys []KeyInfo
+		require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &keys))
+		require.Len(t, keys, 2)
+		for _, key := range keys {
+			require.Equal(t, KeyStateActive, key.State)
+		}
+	})
+
+	var generated string
+	t.Run("generate a key", func(t *testing.T) {
+		request, err := NewAdminRequest(AdminActionGenerate, "")
+		require.NoError(t, err)
+		request.Use = KeyKindExchange
+		rec := adminCall(t, handler, "/admin/keys/generate", signedAdminRequest(t, alice, request))
+		require.Equal(t, http.StatusOK, rec.Code)
+
+		var response map[string]string
+		require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &response))
+		generated = response["thumbprint"]
+		require.FileExists(t, filepath.Join(dir, generated+".jwk"))
+
+		adv, err := ParseAdvertisement(protocol.GetAdvertisement(""), []jose.SignatureAlgorithm{DefaultSignatureAlgorithm})
+		require.NoError(t, err)
+		require.Len(t, adv.ExchangeKeys(), 2)
+	})
+
+	t.Run("last advertised key of its kind", func(t *testing.T) {
+		rec := adminCall(t, handler, "/admin/keys/"+SigningKey1Thp+"/demote", newSignedAdminRequest(t, alice, AdminActionDemote, SigningKey1Thp))
+		require.Equal(t, http.StatusBadRequest, rec.Code)
+		require.FileExists(t, filepath.Join(dir, SigningKey1Thp+".jwk"))
+		require.NoError(t, protocol.Ready())
+	})
+
+	t.Run("demote then retire a key", func(t *testing.T) {
+		rec := adminCall(t, handler, "/admin/keys/"+ExchangeKey1Thp+"/retire", newSignedAdminRequest(t, alice, AdminActionRetire, ExchangeKey1Thp))
+		require.Equal(t, http.StatusNotFound, rec.Code, "active keys are demoted first")
+
+		rec = adminCall(t, handler, "/admin/keys/"+ExchangeKey1Thp+"/demote", newSignedAdminRequest(t, alice, AdminActionDemote, ExchangeKey1Thp))
+		require.Equal(t, http.StatusNoContent, rec.Code)
+		require.FileExists(t, filepath.Join(dir, "."+ExchangeKey1Thp+".jwk"))
+		x, err := GenerateExchangeKey()
+		require.NoError(t, err)
+		_, err = protocol.computeRecoverKey(ExchangeKey1Thp, x.Public())
+		require.NoError(t, err, "demoted keys remain recoverable")
+
+		rec = adminCall(t, handler, "/admin/keys/"+ExchangeKey1Thp+"/retire", newSignedAdminRequest(t, alice, AdminActionRetire, ExchangeKey1Thp))
+		require.Equal(t, http.StatusNoContent, rec.Code)
+		_, err = protocol.computeRecoverKey(ExchangeKey1Thp, x.Public())
+		require.Error(t, err)
+	})
+
+	t.Run("rotate every key", func(t *testing.T) {
+		rec := adminCall(t, handler, "/admin/keys/rotate", newSignedAdminRequest(t, alice, AdminActionRotate, ""))
+		require.Equal(t, http.StatusNoContent, rec.Code)
+		require.FileExists(t, filepath.Join(dir, "."+generated+".jwk"))
+		require.Nil(t, protocol.GetAdvertisement(SigningKey1Thp))
+	})
+
+	t.Run("reload", func(t *testing.T) {
+		_, err := WriteKey(dir, ExchangeKey2, nil)
+		require.NoError(t, err)
+		rec := adminCall(t, handler, "/admin/reload", newSignedAdminRequest(t, alice, AdminActionReload, ""))
+		require.Equal(t, http.StatusNoContent, rec.Code)
+		x, err := GenerateExchangeKey()
+		require.NoError(t, err)
+		_, err = protocol.computeRecoverKey(ExchangeKey2Thp, x.Public())
+		require.NoError(t, err)
+	})
+
+	t.Run("every action is audited", func(t *testing.T) {
+		var actions []string
+		for _, record := range sink.records {
+			require.Equal(t, RouteAdmin, record.Route)
+			require.Equal(t, "alice", record.Operator)
+			actions = append(actions, record.Action)
+		}
+		require.Equal(t, []string{
+			AdminActionList, AdminActionGenerate, AdminActionDemote, AdminActionRetire, AdminActionDemote, AdminActionRetire,
+			AdminActionRotate, AdminActionReload,
+		}, actions)
+		require.Equal(t, generated, sink.records[1].Thumbprint)
+		require.Equal(t, http.StatusBadRequest, sink.records[2].Status)
+		require.Equal(t, http.StatusNotFound, sink.records[3].Status)
+	})
+}
+
+func TestAdminHandler_Authentication(t *testing.T) {
+	alice := newOperatorKey(t, "alice")
+	mallory := newOperatorKey(t, "mallory")
+	sink := &memoryAuditSink{}
+	handler, _, _ := newTestAdminHandler(t, alice)
+	handler.WithAudit(sink)
+	now := time.Now()
+	handler.now = func() time.Time { return now }
+
+	t.Run("unsigned requests are refused", func(t *testing.T) {
+		request, err := NewAdminRequest(AdminActionList, "")
+		require.NoError(t, err)
+		payload, err := json.Marshal(request)
+		require.NoError(t, err)
+		rec := adminCall(t, handler, "/admin/keys/list", payload)
+		require.Equal(t, http.StatusUnauthorized, rec.Code)
+	})
+
+	t.Run("operators outside the allowlist are refused", func(t *testing.T) {
+		rec := adminCall(t, handler, "/admin/keys/list", newSignedAdminRequest(t, mallory, AdminActionList, ""))
+		require.Equal(t, http.StatusUnauthorized, rec.Code)
+
+		// Claiming an allowed key ID does not help without its private key.
+		impostor := mallory
+		impostor.KeyID = "alice"
+		rec = adminCall(t, handler, "/admin/keys/list", newSignedAdminRequest(t, impostor, AdminActionList, ""))
+		require.Equal(t, http.StatusUnauthorized, rec.Code)
+	})
+
+	t.Run("requests are bound to their action and key", func(t *testing.T) {
+		rec := adminCall(t, handler, "/admin/keys/rotate", newSignedAdminRequest(t, alice, AdminActionList, ""))
+		require.Equal(t, http.StatusUnauthorized, rec.Code)
+
+		rec = adminCall(t, handler, "/admin/keys/"+ExchangeKey1Thp+"/demote", newSignedAdminRequest(t, alice, AdminActionDemote, SigningKey1Thp))
+		require.Equal(t, http.StatusUnauthorized, rec.Code)
+	})
+
+	t.Run("replayed requests are refused", func(t *testing.T) {
+		body := newSignedAdminRequest(t, alice, AdminActionList, "")
+		require.Equal(t, http.StatusOK, adminCall(t, handler, "/admin/keys/list", body).Code)
+		require.Equal(t, http.StatusUnauthorized, adminCall(t, handler, "/admin/keys/list", body).Code)
+	})
+
+	t.Run("stale and future requests are refused", func(t *testing.T) {
+		for _, issued := range []time.Time{now.Add(-adminMaxSkew - time.Second), now.Add(adminMaxSkew + time.Second)} {
+			request, err := NewAdminRequest(AdminActionList, "")
+			require.NoError(t, err)
+			request.IssuedAt = issued.Unix()
+			rec := adminCall(t, handler, "/admin/keys/list", signedAdminRequest(t, alice, request))
+			require.Equal(t, http.StatusUnauthorized, rec.Code)
+		}
+	})
+
+	t.Run("seen nonces are forgotten once out of the time window", func(t *testing.T) {
+		request, err := NewAdminRequest(AdminActionList, "")
+		require.NoError(t, err)
+		request.IssuedAt = now.Unix()
+		require.Equal(t, http.StatusOK, adminCall(t, handler, "/admin/keys/list", signedAdminRequest(t, alice, request)).Code)
+
+		now = now.Add(2*adminMaxSkew + time.Second)
+		require.NoError(t, handler.checkReplay(AdminRequest{Nonce: "sweep", IssuedAt: now.Unix()}))
+		handler.mu.Lock()
+		_, kept := handler.nonces[request.Nonce]
+		handler.mu.Unlock()
+		require.False(t, kept)
+	})
+
+	t.Run("refusals are audited", func(t *testing.T) {
+		require.NotEmpty(t, sink.records)
+		for _, record := range sink.records {
+			require.Equal(t, RouteAdmin, record.Route)
+		}
+		require.Equal(t, http.StatusUnauthorized, sink.records[0].Status)
+		require.Empty(t, sink.records[0].Operator)
+	})
+}
+
+func TestLoadOperatorKeys(t *testing.T) {
+	alice := newOperatorKey(t, "alice")
+	write := func(t *testing.T, keys ...jose.JSONWebKey) string {
+		data, err := json.Marshal(jose.JSONWebKeySet{Keys: keys})
+		require.NoError(t, err)
+		path := filepath.Join(t.TempDir(), "operators.jwks")
+		require.NoError(t, os.WriteFile(path, data, 0o600))
+		return path
+	}
+
+	operators, err := LoadOperatorKeys(write(t, alice.Public()))
+	require.NoError(t, err)
+	require.Contains(t, operators, "alice")
+
+	_, err = LoadOperatorKeys(write(t, alice.Public(), alice.Public()))
+	require.ErrorContains(t, err, "duplicate")
+
+	anonymous := alice.Public()
+	anonymous.KeyID = ""
+	_, err = LoadOperatorKeys(write(t, anonymous))
+	require.ErrorContains(t, err, "key ID")
+}
@@ -0,0 +1,223 @@
+package server
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"sort"
+	"sync"
+	"time"
+)
+
+/*
+Dual-control recoveries, for exchange keys whose metadata requires operator approvals (KeyMetadata.Approvals):
+ 1. the first POST /rec/{thp} is answered 202 Accepted with a ticket, the recovery is queued as pending,
+ 2. operators list the pending tickets and approve them through the admin API, each operator counting once,
+ 3. the client retries the very same request with the ticket in the ApprovalTicketHeader header,
+    and gets 'y' once enough operators approved; the ticket is then used up.
+
+Tickets are bound to the exchange key and to the request 'x', and expire after the queue TTL, approved or not.
+Resubmitting a request gets its live ticket back, and the number of pending tickets is capped (see WithMaxPending).
+*/
+const (
+	ApprovalTicketHeader = "Citrus-Ticket"
+
+	approvalContentType = "application/json"
+
+	DefaultMaxPendingTickets = 100
+)
+
+var (
+	ErrApprovalRequired = errors.New("approval queue not configured for a key requiring approvals")
+	ErrTicketNotFound   = errors.New("unknown or expired approval ticket")
+	ErrTicketMismatch   = errors.New("approval ticket was issued for another request")
+	ErrTooManyTickets   = errors.New("too many recoveries waiting for approvals")
+)
+
+// Ticket is a recovery waiting for operator approvals.
+type Ticket struct {
+	ID         string    `json:"ticket"`
+	Thumbprint string    `json:"thumbprint"`
+	Client     string    `json:"client"`
+	Subject    string    `json:"subject,omitempty"`
+	Required   int       `json:"required"`
+	Approvers  []string  `json:"approvers"` // operator key IDs, see AdminHandler
+	CreatedAt  time.Time `json:"created_at"`
+	ExpiresAt  time.Time `json:"expires_at"`
+
+	request [sha256.Size]byte // digest of 'x'
+}
+
+func (t Ticket) Approved() bool {
+	return len(t.Approvers) >= t.Required
+}
+
+// ApprovalPendingError is returned for recoveries waiting for approvals, it carries their ticket.
+type ApprovalPendingError struct {
+	Ticket Ticket
+}
+
+func (e *ApprovalPendingError) Error() string {
+	return fmt.Sprintf("recovery waiting for approvals (%d/%d), ticket '%s'",
+		len(e.Ticket.Approvers), e.Ticket.Required, e.Ticket.ID)
+}
+
+type ApprovalQueue struct {
+	ttl        time.Duration
+	maxPending int
+	now        func() time.Time
+
+	mu      sync.Mutex
+	tickets map[string]*Ticket
+}
+
+// NewApprovalQueue creates a queue whose tickets expire after ttl.
+func NewApprovalQueue(ttl time.Duration) *ApprovalQueue {
+	return &ApprovalQueue{
+		ttl:        ttl,
+		maxPending: DefaultMaxPendingTickets,
+		now:        time.Now,
+		tickets:    make(map[string]*Ticket),
+	}
+}
+
+// WithMaxPending caps the number of tickets waiting in the queue, DefaultMaxPendingTickets by default.
+func (t *ApprovalQueue) WithMaxPending(n int) *ApprovalQueue {
+	t.maxPending = n
+	return t
+}
+
+// Submit queues the recovery request for the exchange key thumbprint, requiring the given number of approvals.
+// The live ticket of the same request is returned when there is one. A full queue fails with ErrTooManyTickets.
+func (t *ApprovalQueue) Submit(client RecoveryClient, thumbprint string, request []byte, required int) (Ticket, error) {
+	digest := sha256.Sum256(request)
+	now := t.now().UTC()
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.sweep(now)
+	for _, ticket := range t.tickets {
+		if ticket.Thumbprint == thumbprint && ticket.request == digest {
+			return ticket.clone(), nil
+		}
+	}
+	if len(t.tickets) >= t.maxPending {
+		return Ticket{}, ErrTooManyTickets
+	}
+
+	id := make([]byte, 18)
+	if _, err := rand.Read(id); err != nil {
+		return Ticket{}, err
+	}
+	ticket := Ticket{
+		ID:         base64.RawURLEncoding.EncodeToString(id),
+		Thumbprint: thumbprint,
+		Client:     client.Address,
+		Subject:    client.Subject,
+		Required:   required,
+		Approvers:  []string{},
+		CreatedAt:  now,
+		ExpiresAt:  now.Add(t.ttl),
+		request:    digest,
+	}
+	t.tickets[ticket.ID] = &ticket
+	return ticket, nil
+}
+
+// Approve records the approval of operator, and returns the updated ticket.
+func (t *ApprovalQueue) Approve(id string, operator string) (Ticket, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.sweep(t.now())
+
+	ticket, ok := t.tickets[id]
+	if !ok {
+		return Ticket{}, ErrTicketNotFound
+	}
+	if !slices.Contains(ticket.Approvers, operator) {
+		ticket.Approvers = append(ticket.Approvers, operator)
+	}
+	return ticket.clone(), nil
+}
+
+// Pending lists the tickets which did not expire yet, oldest first.
+func (t *ApprovalQueue) Pending() []Ticket {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.sweep(t.now())
+
+	tickets := make([]Ticket, 0, len(t.tickets))
+	for _, ticket := range t.tickets {
+		tickets = append(tickets, ticket.clone())
+	}
+	sort.Slice(tickets, func(i, j int) bool {
+		return tickets[i].CreatedAt.Before(tickets[j].CreatedAt)
+	})
+	return tickets
+}
+
+// Check verifies that the ticket is approved for the recovery request it was issued for, see Redeem.
+// A ticket still waiting for approvals fails with an ApprovalPendingError.
+func (t *ApprovalQueue) Check(id string, thumbprint string, request []byte) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.sweep(t.now())
+
+	ticket, ok := t.tickets[id]
+	if !ok {
+		return ErrTicketNotFound
+	}
+	if ticket.Thumbprint != thumbprint || ticket.request != sha256.Sum256(request) {
+		return ErrTicketMismatch
+	}
+	if !ticket.Approved() {
+		return &ApprovalPendingError{Ticket: ticket.clone()}
+	}
+	return nil
+}
+
+// Redeem uses up a checked ticket, once its recovery succeeded.
+func (t *ApprovalQueue) Redeem(id string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	delete(t.tickets, id)
+}
+
+// sweep drops the expired tickets, mu must be held.
+func (t *ApprovalQueue) sweep(now time.Time) {
+	for id, ticket := range t.tickets {
+		if !now.Before(ticket.ExpiresAt) {
+			delete(t.tickets, id)
+		}
+	}
+}
+
+func (t *Ticket) clone() Ticket {
+	ticket := *t
+	ticket.Approvers = slices.Clone(t.Approvers)
+	return ticket
+}
+
+// writeTicket answers 202 Accepted with the ticket of a recovery waiting for approvals.
+// Clients only learn how many operators approved, not who.
+func writeTicket(w http.ResponseWriter, ticket Ticket) {
+	data, err := json.Marshal(struct {
+		ID        string    `json:"ticket"`
+		Approvals int       `json:"approvals"`
+		Required  int       `json:"required"`
+		ExpiresAt time.Time `json:"expires_at"`
+	}{ticket.ID, len(ticket.Approvers), ticket.Required, ticket.ExpiresAt})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", approvalContentType)
+	w.Header().Set(ApprovalTicketHeader, ticket.ID)
+	w.WriteHeader(http.StatusAccepted)
+	_, _ = w.Write(data)
+}
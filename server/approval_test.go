@@ -0,0 +1,196 @@
+package server
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/go-jose/go-jose/v4"
+	"github.com/stretchr/testify/require"
+
+	. "go-citrus/internal"
+)
+
+func TestApprovalQueue(t *testing.T) {
+	queue := NewApprovalQueue(time.Hour)
+	now := time.Now()
+	queue.now = func() time.Time { return now }
+	request := []byte(`{"x": 1}`)
+
+	ticket, err := queue.Submit(RecoveryClient{Address: "192.0.2.1"}, ExchangeKey1Thp, request, 2)
+	require.NoError(t, err)
+	require.False(t, ticket.Approved())
+
+	t.Run("operators approve once", func(t *testing.T) {
+		for _, operator := range []string{"alice", "alice"} {
+			ticket, err = queue.Approve(ticket.ID, operator)
+			require.NoError(t, err)
+		}
+		require.Equal(t, []string{"alice"}, ticket.Approvers)
+
+		var pending *ApprovalPendingError
+		require.ErrorAs(t, queue.Check(ticket.ID, ExchangeKey1Thp, request), &pending)
+		require.Equal(t, ticket.ID, pending.Ticket.ID)
+	})
+
+	t.Run("tickets are bound to their request", func(t *testing.T) {
+		require.ErrorIs(t, queue.Check(ticket.ID, ExchangeKey2Thp, request), ErrTicketMismatch)
+		require.ErrorIs(t, queue.Check(ticket.ID, ExchangeKey1Thp, []byte(`{"x": 2}`)), ErrTicketMismatch)
+	})
+
+	t.Run("resubmitted requests get their ticket back", func(t *testing.T) {
+		again, err := queue.Submit(RecoveryClient{Address: "192.0.2.1"}, ExchangeKey1Thp, request, 2)
+		require.NoError(t, err)
+		require.Equal(t, ticket.ID, again.ID)
+		require.Equal(t, []string{"alice"}, again.Approvers)
+		require.Len(t, queue.Pending(), 1)
+	})
+
+	t.Run("approved tickets are used up", func(t *testing.T) {
+		_, err = queue.Approve(ticket.ID, "bob")
+		require.NoError(t, err)
+		require.NoError(t, queue.Check(ticket.ID, ExchangeKey1Thp, request))
+		require.NoError(t, queue.Check(ticket.ID, ExchangeKey1Thp, request), "checks do not use tickets up")
+		queue.Redeem(ticket.ID)
+		require.ErrorIs(t, queue.Check(ticket.ID, ExchangeKey1Thp, request), ErrTicketNotFound)
+	})
+
+	t.Run("pending tickets are capped", func(t *testing.T) {
+		queue := NewApprovalQueue(time.Hour).WithMaxPending(2)
+		for i := range 2 {
+			_, err := queue.Submit(RecoveryClient{}, ExchangeKey1Thp, []byte(fmt.Sprintf(`{"x": %d}`, i)), 1)
+			require.NoError(t, err)
+		}
+		_, err := queue.Submit(RecoveryClient{}, ExchangeKey1Thp, []byte(`{"x": 2}`), 1)
+		require.ErrorIs(t, err, ErrTooManyTickets)
+		_, err = queue.Submit(RecoveryClient{}, ExchangeKey1Thp, []byte(`{"x": 1}`), 1)
+		require.NoError(t, err, "live tickets are still handed out")
+	})
+
+	t.Run("tickets expire", func(t *testing.T) {
+		ticket, err := queue.Submit(RecoveryClient{}, ExchangeKey1Thp, request, 1)
+		require.NoError(t, err)
+		require.Len(t, queue.Pending(), 1)
+
+		now = now.Add(time.Hour)
+		require.Empty(t, queue.Pending())
+		_, err = queue.Approve(ticket.ID, "alice")
+		require.ErrorIs(t, err, ErrTicketNotFound)
+	})
+}
+
+func TestApprovalFlow(t *testing.T) {
+	alice, bob := newOperatorKey(t, "alice"), newOperatorKey(t, "bob")
+	admin, protocol, _ := newTestAdminHandler(t, alice, bob)
+	queue := NewApprovalQueue(time.Hour)
+	protocol.SetApprovalQueue(queue)
+	admin.WithApprovals(queue)
+	sink := &memoryAuditSink{}
+	handler := NewHandler(protocol).WithAudit(sink)
+
+	postRecovery := func(t *testing.T, request []byte, ticket string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodPost, "/rec/"+ExchangeKey1Thp, bytes.NewReader(request))
+		if ticket != "" {
+			req.Header.Set(ApprovalTicketHeader, ticket)
+		}
+		handler.ServeHTTP(rec, req)
+		return rec
+	}
+
+	request := recoveryRequest(t)
+	require.Equal(t, http.StatusOK, postRecovery(t, request, "").Code, "keys do not require approvals by default")
+
+	marked, err := NewAdminRequest(AdminActionRequireApprovals, ExchangeKey1Thp)
+	require.NoError(t, err)
+	marked.Approvals = 2
+	rec := adminCall(t, admin, AdminPath(AdminActionRequireApprovals, ExchangeKey1Thp), signedAdminRequest(t, alice, marked))
+	require.Equal(t, http.StatusNoContent, rec.Code)
+
+	rec = postRecovery(t, request, "")
+	require.Equal(t, http.StatusAccepted, rec.Code)
+	var accepted struct {
+		ID        string `json:"ticket"`
+		Approvals int    `json:"approvals"`
+		Required  int    `json:"required"`
+	}
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &accepted))
+	require.Equal(t, 2, accepted.Required)
+	require.Equal(t, accepted.ID, rec.Header().Get(ApprovalTicketHeader))
+
+	t.Run("pending recoveries are listed", func(t *testing.T) {
+		rec := adminCall(t, admin, AdminPath(AdminActionPending, ""), newSignedAdminRequest(t, bob, AdminActionPending, ""))
+		require.Equal(t, http.StatusOK, rec.Code)
+		var pending []Ticket
+		require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &pending))
+		require.Len(t, pending, 1)
+		require.Equal(t, accepted.ID, pending[0].ID)
+		require.Equal(t, ExchangeKey1Thp, pending[0].Thumbprint)
+	})
+
+	approve := func(t *testing.T, operator jose.JSONWebKey) {
+		request, err := NewAdminRequest(AdminActionApprove, "")
+		require.NoError(t, err)
+		request.Ticket = accepted.ID
+		rec := adminCall(t, admin, AdminPath(AdminActionApprove, accepted.ID), signedAdminRequest(t, operator, request))
+		require.Equal(t, http.StatusOK, rec.Code)
+	}
+
+	t.Run("retries wait for enough approvals", func(t *testing.T) {
+		approve(t, alice)
+		require.Equal(t, http.StatusAccepted, postRecovery(t, request, accepted.ID).Code)
+		approve(t, alice)
+		require.Equal(t, http.StatusAccepted, postRecovery(t, request, accepted.ID).Code, "an operator counts once")
+	})
+
+	t.Run("the ticket only serves its request", func(t *testing.T) {
+		require.Equal(t, http.StatusConflict, postRecovery(t, recoveryRequest(t), accepted.ID).Code)
+	})
+
+	t.Run("approved retries get y", func(t *testing.T) {
+		approve(t, bob)
+		rec := postRecovery(t, request, accepted.ID)
+		require.Equal(t, http.StatusOK, rec.Code)
+		require.Equal(t, recoveryContentType, rec.Header().Get("Content-Type"))
+
+		require.Equal(t, http.StatusGone, postRecovery(t, request, accepted.ID).Code, "tickets are used up")
+	})
+
+	t.Run("recoveries are audited with their ticket", func(t *testing.T) {
+		var tickets int
+		for _, record := range sink.records {
+			if record.Ticket == accepted.ID {
+				tickets++
+			}
+		}
+		require.Equal(t, 6, tickets)
+	})
+
+	t.Run("requests which cannot succeed are not queued", func(t *testing.T) {
+		pending := len(queue.Pending())
+		x, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		require.NoError(t, err)
+		for name, key := range map[string]jose.JSONWebKey{
+			"not an ECMR key": {Key: &x.PublicKey},
+			"another curve":   {Key: &x.PublicKey, Algorithm: "ECMR"},
+		} {
+			request, err := key.MarshalJSON()
+			require.NoError(t, err)
+			rec := postRecovery(t, request, "")
+			require.Equal(t, http.StatusBadRequest, rec.Code, name)
+			require.Len(t, queue.Pending(), pending, name)
+		}
+	})
+
+	t.Run("keys requiring approvals fail without queue", func(t *testing.T) {
+		protocol.SetApprovalQueue(nil)
+		require.Equal(t, http.StatusForbidden, postRecovery(t, request, "").Code)
+	})
+}
@@ -0,0 +1,150 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"sync"
+	"time"
+)
+
+/*
+Audit trail of the requests served by the server.
+Records only hold request metadata: the recovery request 'x' and response 'y' are never part of them.
+*/
+type AuditRecord struct {
+	Time         time.Time     `json:"time"`
+	Client       string        `json:"client"`
+	Subject      string        `json:"subject,omitempty"` // client certificate subject, with mutual TLS
+	Route        string        `json:"route"`
+	Thumbprint   string        `json:"thumbprint,omitempty"`
+	Status       int           `json:"status"`
+	Latency      time.Duration `json:"latency_ns"`
+	PolicyRule   string        `json:"policy_rule,omitempty"`   // recovery policy rule which decided the request
+	PolicyAction string        `json:"policy_action,omitempty"` // its decision, PolicyAllow or PolicyDeny
+	Action       string        `json:"action,omitempty"`        // admin API action, see RouteAdmin
+	Operator     string        `json:"operator,omitempty"`      // key ID of the operator who signed the admin request
+	Ticket       string        `json:"ticket,omitempty"`        // approval ticket of the recovery, see ApprovalQueue
+	Namespace    string        `json:"namespace,omitempty"`     // namespace of the request, empty for the default one, see NamespaceRouter
+}
+
+type AuditSink interface {
+	Record(record AuditRecord) error
+}
+
+// SlogAuditSink forwards audit records to a log/slog logger.
+type SlogAuditSink struct {
+	logger *slog.Logger
+}
+
+func NewSlogAuditSink(logger *slog.Logger) *SlogAuditSink {
+	return &SlogAuditSink{logger: logger}
+}
+
+func (t *SlogAuditSink) Record(record AuditRecord) error {
+	t.logger.LogAttrs(context.Background(), slog.LevelInfo, "audit",
+		slog.Time("start", record.Time),
+		slog.String("client", record.Client),
+		slog.String("subject", record.Subject),
+		slog.String("route", record.Route),
+		slog.String("thumbprint", record.Thumbprint),
+		slog.Int("status", record.Status),
+		slog.Duration("latency", record.Latency),
+		slog.String("policy_rule", record.PolicyRule),
+		slog.String("policy_action", record.PolicyAction),
+		slog.String("action", record.Action),
+		slog.String("operator", record.Operator),
+		slog.String("ticket", record.Ticket),
+		slog.String("namespace", record.Namespace),
+	)
+	return nil
+}
+
+// AuditFile writes audit records as JSON lines, rotating the file once it reaches maxSize bytes.
+// Rotated files are renamed <path>.1 (most recent) up to <path>.<backups>, older ones are deleted.
+type AuditFile struct {
+	path    string
+	maxSize int64
+	backups int
+
+	mu   sync.Mutex
+	file *os.File
+	size int64
+}
+
+// NewAuditFile opens (or creates) the audit file at path. A zero maxSize disables rotation.
+func NewAuditFile(path string, maxSize int64, backups int) (*AuditFile, error) {
+	t := AuditFile{
+		path:    path,
+		maxSize: maxSize,
+		backups: backups,
+	}
+	if err := t.open(); err != nil {
+		return nil, err
+	}
+	return &t, nil
+}
+
+func (t *AuditFile) Record(record AuditRecord) error {
+	line, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	return t.WriteLine(line)
+}
+
+// WriteLine appends a single line to the audit file, rotating it beforehand when the line would not fit.
+func (t *AuditFile) WriteLine(line []byte) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.maxSize > 0 && t.size > 0 && t.size+int64(len(line))+1 > t.maxSize {
+		if err := t.rotate(); err != nil {
+			return err
+		}
+	}
+	n, err := t.file.Write(append(line, '\n'))
+	t.size += int64(n)
+	return err
+}
+
+func (t *AuditFile) Close() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.file.Close()
+}
+
+func (t *AuditFile) open() error {
+	file, err := os.OpenFile(t.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o600)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		_ = file.Close()
+		return err
+	}
+	t.file = file
+	t.size = info.Size()
+	return nil
+}
+
+func (t *AuditFile) rotate() error {
+	if err := t.file.Close(); err != nil {
+		return err
+	}
+	if t.backups > 0 {
+		_ = os.Remove(fmt.Sprintf("%s.%d", t.path, t.backups))
+		for i := t.backups - 1; i > 0; i-- {
+			_ = os.Rename(fmt.Sprintf("%s.%d", t.path, i), fmt.Sprintf("%s.%d", t.path, i+1))
+		}
+		if err := os.Rename(t.path, t.path+".1"); err != nil {
+			return err
+		}
+	} else if err := os.Remove(t.path); err != nil {
+		return err
+	}
+	return t.open()
+}
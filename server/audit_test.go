@@ -0,0 +1,108 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	. "go-citrus/internal"
+)
+
+type memoryAuditSink struct {
+	records []AuditRecord
+}
+
+func (t *memoryAuditSink) Record(record AuditRecord) error {
+	t.records = append(t.records, record)
+	return nil
+}
+
+func TestHandler_Audit(t *testing.T) {
+	sink := &memoryAuditSink{}
+	handler := newTestHandler(t).WithAudit(sink)
+
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/adv", nil))
+	require.Equal(t, http.StatusOK, rec.Code)
+
+	rec = httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodPost, "/rec/"+ExchangeKey1Thp, bytes.NewReader(recoveryRequest(t)))
+	req.RemoteAddr = "192.0.2.1:4242"
+	handler.ServeHTTP(rec, req)
+	require.Equal(t, http.StatusOK, rec.Code)
+
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/rec/"+ExchangeKey2Thp, bytes.NewReader(recoveryRequest(t))))
+	require.Equal(t, http.StatusNotFound, rec.Code)
+
+	require.Len(t, sink.records, 3)
+	require.Equal(t, RouteAdvertisement, sink.records[0].Route)
+	require.Empty(t, sink.records[0].Thumbprint)
+
+	recovery := sink.records[1]
+	require.Equal(t, RouteRecovery, recovery.Route)
+	require.Equal(t, "192.0.2.1", recovery.Client)
+	require.Equal(t, ExchangeKey1Thp, recovery.Thumbprint)
+	require.Equal(t, http.StatusOK, recovery.Status)
+	require.False(t, recovery.Time.IsZero())
+
+	require.Equal(t, http.StatusNotFound, sink.records[2].Status)
+}
+
+func TestAuditFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+	record := AuditRecord{Time: time.Now().UTC(), Client: "192.0.2.1", Route: RouteRecovery, Thumbprint: ExchangeKey1Thp, Status: 200}
+	line, err := json.Marshal(record)
+	require.NoError(t, err)
+
+	// Room for two records per file
+	audit, err := NewAuditFile(path, int64(2*(len(line)+1)), 2)
+	require.NoError(t, err)
+	for i := 0; i < 7; i++ {
+		require.NoError(t, audit.Record(record))
+	}
+	require.NoError(t, audit.Close())
+
+	for _, name := range []string{path, path + ".1", path + ".2"} {
+		data, err := os.ReadFile(name)
+		require.NoError(t, err)
+		lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+		for _, l := range lines {
+			var restored AuditRecord
+			require.NoError(t, json.Unmarshal([]byte(l), &restored))
+			require.Equal(t, record, restored)
+		}
+	}
+	require.NoFileExists(t, path+".3")
+
+	t.Run("reopen keeps appending", func(t *testing.T) {
+		audit, err := NewAuditFile(path, 0, 0)
+		require.NoError(t, err)
+		require.NoError(t, audit.Record(record))
+		require.NoError(t, audit.Close())
+
+		data, err := os.ReadFile(path)
+		require.NoError(t, err)
+		require.Equal(t, 2, strings.Count(string(data), "\n"))
+	})
+}
+
+func TestSlogAuditSink(t *testing.T) {
+	var buf bytes.Buffer
+	sink := NewSlogAuditSink(slog.New(slog.NewJSONHandler(&buf, nil)))
+	require.NoError(t, sink.Record(AuditRecord{Client: "192.0.2.1", Route: RouteRecovery, Thumbprint: ExchangeKey1Thp, Status: 404}))
+
+	var entry map[string]interface{}
+	require.NoError(t, json.Unmarshal(buf.Bytes(), &entry))
+	require.Equal(t, ExchangeKey1Thp, entry["thumbprint"])
+	require.Equal(t, float64(404), entry["status"])
+}
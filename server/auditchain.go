@@ -0,0 +1,329 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/go-jose/go-jose/v4"
+
+	. "go-citrus/internal"
+)
+
+/*
+Tamper-evident audit trail.
+Every line of the audit file is a chain entry holding the SHA-256 of the previous line, and either:
+  - a record: {"seq": n, "prev": hex(sha256(line n-1)), "record": {...}}
+  - a checkpoint, sealing the chain up to the previous entry with the server signing keys:
+    {"seq": n, "prev": hex(sha256(line n-1)), "checkpoint": JWS({"seq": n-1, "head": hex(sha256(line n-1))})}
+
+Editing, removing or reordering entries breaks the chain, and truncating the file removes the last checkpoint.
+The chain alone cannot tell a file cut right after a checkpoint from a complete one: truncation is only detected
+up to an AuditAnchor, a checkpoint kept apart from the audit files, e.g. published out of band after a verification.
+*/
+const AuditCheckpointContentType = jose.ContentType("audit-checkpoint+json")
+
+// Hash preceding the first entry of a chain.
+var auditGenesis = hex.EncodeToString(make([]byte, sha256.Size))
+
+type auditEntry struct {
+	Seq        uint64          `json:"seq"`
+	Prev       string          `json:"prev"`
+	Record     *AuditRecord    `json:"record,omitempty"`
+	Checkpoint json.RawMessage `json:"checkpoint,omitempty"`
+}
+
+type auditCheckpoint struct {
+	Seq  uint64 `json:"seq"`
+	Head string `json:"head"`
+}
+
+// AuditChain is an AuditSink appending hash-chained records to an AuditFile, signing a checkpoint every checkpointEvery records.
+type AuditChain struct {
+	file            *AuditFile
+	signer          KeyStore
+	checkpointEvery int
+
+	mu      sync.Mutex
+	seq     uint64 // sequence number of the next entry
+	head    string // hash of the last entry
+	pending int    // records since the last checkpoint
+}
+
+// NewAuditChain resumes the chain from the last entry of the audit file (or of its most recent backup after a rotation).
+func NewAuditChain(file *AuditFile, signer KeyStore, checkpointEvery int) (*AuditChain, error) {
+	chain := AuditChain{
+		file:            file,
+		signer:          signer,
+		checkpointEvery: checkpointEvery,
+		head:            auditGenesis,
+	}
+	for _, path := range []string{file.path, file.path + ".1"} {
+		line, err := lastLine(path)
+		if err != nil {
+			return nil, err
+		}
+		if line == nil {
+			continue
+		}
+		var last auditEntry
+		if err = json.Unmarshal(line, &last); err != nil {
+			return nil, fmt.Errorf("unable to resume audit chain from '%s': %w", path, err)
+		}
+		chain.seq = last.Seq + 1
+		chain.head = auditHash(line)
+		if last.Checkpoint == nil {
+			chain.pending = 1
+		}
+		break
+	}
+	return &chain, nil
+}
+
+func (t *AuditChain) Record(record AuditRecord) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if err := t.append(auditEntry{Record: &record}); err != nil {
+		return err
+	}
+	t.pending++
+	if t.checkpointEvery > 0 && t.pending >= t.checkpointEvery {
+		return t.checkpoint()
+	}
+	return nil
+}
+
+// Checkpoint seals the records written since the previous checkpoint.
+func (t *AuditChain) Checkpoint() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.pending == 0 {
+		return nil
+	}
+	return t.checkpoint()
+}
+
+// Run writes a checkpoint every interval until ctx is done, then seals the chain a last time.
+func (t *AuditChain) Run(ctx context.Context, interval time.Duration) error {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return t.Checkpoint()
+		case <-ticker.C:
+			if err := t.Checkpoint(); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// Close seals the chain and closes the audit file.
+func (t *AuditChain) Close() error {
+	err := t.Checkpoint()
+	return errors.Join(err, t.file.Close())
+}
+
+func (t *AuditChain) checkpoint() error {
+	payload, err := json.Marshal(auditCheckpoint{Seq: t.seq - 1, Head: t.head})
+	if err != nil {
+		return err
+	}
+	signature, err := t.signer.Sign(payload, AuditCheckpointContentType)
+	if err != nil {
+		return err
+	}
+	if err = t.append(auditEntry{Checkpoint: signature}); err != nil {
+		return err
+	}
+	t.pending = 0
+	return nil
+}
+
+func (t *AuditChain) append(entry auditEntry) error {
+	entry.Seq = t.seq
+	entry.Prev = t.head
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	if err = t.file.WriteLine(line); err != nil {
+		return err
+	}
+	t.seq++
+	t.head = auditHash(line)
+	return nil
+}
+
+// AuditVerification summarizes a verified audit chain.
+type AuditVerification struct {
+	First       uint64      // Sequence number of the first entry
+	Entries     int         // Number of entries, checkpoints included
+	Checkpoints int         // Number of valid checkpoints
+	Unsealed    int         // Records after the last checkpoint, which truncation could have removed undetected
+	Sealed      AuditAnchor // Last checkpoint, to verify the next versions of the chain against
+}
+
+// AuditAnchor identifies a chain entry by its sequence number and hash.
+type AuditAnchor struct {
+	Seq  uint64
+	Head string // hex SHA-256 of the entry line, not checked when empty
+}
+
+func (t AuditAnchor) String() string {
+	return fmt.Sprintf("seq %d head %s", t.Seq, t.Head)
+}
+
+/*
+VerifyAuditChain checks the hash chain of the given audit files, oldest first, and the signatures of every checkpoint
+using the public signing keys. Unless partial is set, the chain must start from its first entry.
+With an anchor, e.g. the Sealed checkpoint of a previous verification, the chain must also reach the anchor entry,
+which detects the truncation of the entries up to it.
+*/
+func VerifyAuditChain(files []io.Reader, signingKeys KeyList, partial bool, anchor *AuditAnchor) (AuditVerification, error) {
+	var result AuditVerification
+	head := ""
+	var seq uint64
+	anchored := false
+
+	for _, file := range files {
+		scanner := bufio.NewScanner(file)
+		scanner.Buffer(make([]byte, 64*1024), maxAuditLine)
+		for scanner.Scan() {
+			line := bytes.Clone(scanner.Bytes())
+			var entry auditEntry
+			if err := json.Unmarshal(line, &entry); err != nil {
+				return result, fmt.Errorf("entry after seq %d is not a valid audit entry: %w", seq, err)
+			}
+
+			if result.Entries == 0 {
+				switch {
+				case entry.Seq == 0 && entry.Prev != auditGenesis:
+					return result, fmt.Errorf("first entry does not start the chain")
+				case entry.Seq != 0 && !partial:
+					return result, fmt.Errorf("chain starts at seq %d, earlier entries are missing", entry.Seq)
+				}
+				result.First = entry.Seq
+			} else {
+				if entry.Seq != seq {
+					return result, fmt.Errorf("entry seq %d found where seq %d was expected", entry.Seq, seq)
+				}
+				if entry.Prev != head {
+					return result, fmt.Errorf("entry seq %d does not chain to the previous entry", entry.Seq)
+				}
+			}
+
+			switch {
+			case entry.Checkpoint != nil:
+				if err := verifyAuditCheckpoint(entry, signingKeys); err != nil {
+					return result, err
+				}
+				result.Checkpoints++
+				result.Unsealed = 0
+				result.Sealed = AuditAnchor{Seq: entry.Seq, Head: auditHash(line)}
+			case entry.Record != nil:
+				result.Unsealed++
+			default:
+				return result, fmt.Errorf("entry seq %d is neither a record nor a checkpoint", entry.Seq)
+			}
+
+			result.Entries++
+			seq = entry.Seq + 1
+			head = auditHash(line)
+			if anchor != nil && entry.Seq == anchor.Seq {
+				if anchor.Head != "" && anchor.Head != head {
+					return result, fmt.Errorf("entry seq %d does not match the anchor head", entry.Seq)
+				}
+				anchored = true
+			}
+		}
+		if err := scanner.Err(); err != nil {
+			return result, err
+		}
+	}
+	if anchor != nil && !anchored {
+		if result.Entries > 0 && anchor.Seq < result.First {
+			return result, fmt.Errorf("anchor seq %d precedes the first verified entry, seq %d", anchor.Seq, result.First)
+		}
+		return result, fmt.Errorf("chain ends before the anchor seq %d, the audit files were truncated", anchor.Seq)
+	}
+	return result, nil
+}
+
+func verifyAuditCheckpoint(entry auditEntry, signingKeys KeyList) error {
+	jws, err := jose.ParseSigned(string(entry.Checkpoint), SigningAlgorithms)
+	if err != nil {
+		return fmt.Errorf("checkpoint seq %d: %w", entry.Seq, err)
+	}
+	var payload []byte
+	for _, key := range signingKeys {
+		if _, _, payload, err = jws.VerifyMulti(key); err == nil {
+			break
+		}
+	}
+	if payload == nil {
+		return fmt.Errorf("checkpoint seq %d is not signed by any known signing key", entry.Seq)
+	}
+	for _, signature := range jws.Signatures {
+		if signature.Protected.ExtraHeaders[jose.HeaderContentType] != string(AuditCheckpointContentType) {
+			return fmt.Errorf("checkpoint seq %d is not an audit checkpoint", entry.Seq)
+		}
+	}
+
+	var checkpoint auditCheckpoint
+	if err = json.Unmarshal(payload, &checkpoint); err != nil {
+		return fmt.Errorf("checkpoint seq %d: %w", entry.Seq, err)
+	}
+	if checkpoint.Seq+1 != entry.Seq || checkpoint.Head != entry.Prev {
+		return fmt.Errorf("checkpoint seq %d does not seal its previous entry", entry.Seq)
+	}
+	return nil
+}
+
+func auditHash(line []byte) string {
+	sum := sha256.Sum256(line)
+	return hex.EncodeToString(sum[:])
+}
+
+// Longest audit line lastLine can find.
+const maxAuditLine = 1024 * 1024
+
+// lastLine returns the last non-empty line of a file, nil if the file is missing or empty.
+func lastLine(path string) ([]byte, error) {
+	file, err := os.Open(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+	offset := max(info.Size()-maxAuditLine, 0)
+	data := make([]byte, info.Size()-offset)
+	if _, err = file.ReadAt(data, offset); err != nil && !errors.Is(err, io.EOF) {
+		return nil, err
+	}
+
+	data = bytes.TrimRight(data, "\n")
+	if len(data) == 0 {
+		return nil, nil
+	}
+	return data[bytes.LastIndexByte(data, '\n')+1:], nil
+}
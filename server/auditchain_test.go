@@ -0,0 +1,147 @@
+package server
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	. "go-citrus/internal"
+)
+
+func writeAuditChain(t *testing.T, path string, records int, checkpointEvery int) {
+	file, err := NewAuditFile(path, 0, 0)
+	require.NoError(t, err)
+	chain, err := NewAuditChain(file, NewMemoryKeyStore(KeyList{ExchangeKey1, SigningKey1}), checkpointEvery)
+	require.NoError(t, err)
+	for i := 0; i < records; i++ {
+		require.NoError(t, chain.Record(AuditRecord{Client: "192.0.2.1", Route: RouteRecovery, Thumbprint: ExchangeKey1Thp, Status: 200}))
+	}
+	require.NoError(t, chain.Close())
+}
+
+func readAuditLines(t *testing.T, path string) []string {
+	data, err := os.ReadFile(path)
+	require.NoError(t, err)
+	return strings.Split(strings.TrimSuffix(string(data), "\n"), "\n")
+}
+
+func verifyAuditLines(lines []string, partial bool) (AuditVerification, error) {
+	reader := strings.NewReader(strings.Join(lines, "\n") + "\n")
+	return VerifyAuditChain([]io.Reader{reader}, KeyList{SigningKey1.Public()}, partial, nil)
+}
+
+func TestAuditChain(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+	writeAuditChain(t, path, 7, 3)
+	lines := readAuditLines(t, path)
+	// 7 records, 2 periodic checkpoints and a final one on close
+	require.Len(t, lines, 10)
+
+	t.Run("verify an intact chain", func(t *testing.T) {
+		result, err := verifyAuditLines(lines, false)
+		require.NoError(t, err)
+		require.Equal(t, 10, result.Entries)
+		require.Equal(t, 3, result.Checkpoints)
+		require.Zero(t, result.Unsealed)
+	})
+
+	t.Run("detect edited entries", func(t *testing.T) {
+		edited := append([]string{}, lines...)
+		edited[4] = strings.Replace(edited[4], "192.0.2.1", "192.0.2.2", 1)
+		_, err := verifyAuditLines(edited, false)
+		require.Error(t, err)
+	})
+
+	t.Run("detect reordered entries", func(t *testing.T) {
+		reordered := append([]string{}, lines...)
+		reordered[1], reordered[2] = reordered[2], reordered[1]
+		_, err := verifyAuditLines(reordered, false)
+		require.Error(t, err)
+	})
+
+	t.Run("detect removed entries", func(t *testing.T) {
+		_, err := verifyAuditLines(append(append([]string{}, lines[:2]...), lines[3:]...), false)
+		require.Error(t, err)
+		_, err = verifyAuditLines(lines[1:], false)
+		require.Error(t, err)
+
+		// A partial chain is fine when asked for
+		result, err := verifyAuditLines(lines[4:], true)
+		require.NoError(t, err)
+		require.Equal(t, uint64(4), result.First)
+	})
+
+	t.Run("detect truncation", func(t *testing.T) {
+		result, err := verifyAuditLines(lines[:len(lines)-1], false)
+		require.NoError(t, err)
+		require.Equal(t, 1, result.Unsealed)
+	})
+
+	t.Run("detect truncation after a checkpoint with an anchor", func(t *testing.T) {
+		result, err := verifyAuditLines(lines, false)
+		require.NoError(t, err)
+		require.Equal(t, uint64(9), result.Sealed.Seq)
+		anchor := result.Sealed
+
+		// Cut right after the second checkpoint: sealed, so only the anchor tells.
+		truncated := strings.NewReader(strings.Join(lines[:8], "\n") + "\n")
+		result, err = VerifyAuditChain([]io.Reader{truncated}, KeyList{SigningKey1.Public()}, false, nil)
+		require.NoError(t, err)
+		require.Zero(t, result.Unsealed)
+		truncated = strings.NewReader(strings.Join(lines[:8], "\n") + "\n")
+		_, err = VerifyAuditChain([]io.Reader{truncated}, KeyList{SigningKey1.Public()}, false, &anchor)
+		require.ErrorContains(t, err, "truncated")
+
+		intact := strings.NewReader(strings.Join(lines, "\n") + "\n")
+		_, err = VerifyAuditChain([]io.Reader{intact}, KeyList{SigningKey1.Public()}, false, &anchor)
+		require.NoError(t, err)
+
+		forged := anchor
+		forged.Head = auditGenesis
+		intact = strings.NewReader(strings.Join(lines, "\n") + "\n")
+		_, err = VerifyAuditChain([]io.Reader{intact}, KeyList{SigningKey1.Public()}, false, &forged)
+		require.ErrorContains(t, err, "anchor head")
+	})
+
+	t.Run("checkpoints signed by unknown keys", func(t *testing.T) {
+		reader := strings.NewReader(strings.Join(lines, "\n"))
+		_, err := VerifyAuditChain([]io.Reader{reader}, KeyList{SigningKey2.Public()}, false, nil)
+		require.Error(t, err)
+	})
+
+	t.Run("resume an existing chain", func(t *testing.T) {
+		writeAuditChain(t, path, 2, 0)
+		result, err := verifyAuditLines(readAuditLines(t, path), false)
+		require.NoError(t, err)
+		require.Equal(t, 13, result.Entries)
+		require.Equal(t, 4, result.Checkpoints)
+	})
+}
+
+func TestAuditChain_Rotation(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+	file, err := NewAuditFile(path, 2048, 3)
+	require.NoError(t, err)
+	chain, err := NewAuditChain(file, NewMemoryKeyStore(KeyList{ExchangeKey1, SigningKey1}), 2)
+	require.NoError(t, err)
+	for i := 0; i < 20; i++ {
+		require.NoError(t, chain.Record(AuditRecord{Client: "192.0.2.1", Route: RouteRecovery, Status: 200}))
+	}
+	require.NoError(t, chain.Close())
+
+	var readers []io.Reader
+	for _, name := range []string{path + ".3", path + ".2", path + ".1", path} {
+		data, err := os.ReadFile(name)
+		require.NoError(t, err)
+		readers = append(readers, bytes.NewReader(data))
+	}
+	result, err := VerifyAuditChain(readers, KeyList{SigningKey1.Public()}, true, nil)
+	require.NoError(t, err)
+	require.NotZero(t, result.First)
+	require.Zero(t, result.Unsealed)
+}
@@ -0,0 +1,314 @@
+package server
+
+import (
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/go-jose/go-jose/v4"
+
+	. "go-citrus/internal"
+)
+
+/*
+Key directory backups, split among administrators:
+  - the full key set (advertised and rotated keys, with their metadata) is encrypted into a single JWE under a random key,
+  - that key is split into Shamir shares (see SplitSecret), one per administrator, any threshold of them restoring the backup,
+  - each share may itself be encrypted to the public JWK of its administrator, see EncryptShare.
+
+Shares are bound to their backup by its SHA-256 digest, the backup JWE alone reveals nothing but its size.
+*/
+const (
+	backupEncryption = jose.A256GCM
+	backupType       = "citrus-backup+json"
+	backupKeySize    = 32
+	shareType        = "citrus-share+json"
+)
+
+// keySet is the full content of a key directory, the plaintext of a backup JWE.
+type keySet struct {
+	Keys     KeyList  `json:"keys"`
+	Rotated  KeyList  `json:"rotated"`
+	Metadata Metadata `json:"metadata"`
+}
+
+func loadKeySet(dir string, passphrase PassphraseFn) (keySet, error) {
+	var set keySet
+	var err error
+	if set.Keys, err = LoadKeys(dir, passphrase); err != nil {
+		return keySet{}, err
+	}
+	if set.Rotated, err = LoadRotatedKeys(dir, passphrase); err != nil {
+		set.wipe()
+		return keySet{}, err
+	}
+	if set.Metadata, err = LoadMetadata(dir); err != nil {
+		set.wipe()
+		return keySet{}, err
+	}
+	return set, nil
+}
+
+func (t keySet) wipe() {
+	for _, key := range append(t.Keys[:len(t.Keys):len(t.Keys)], t.Rotated...) {
+		wipeKey(key)
+	}
+}
+
+// BackupShare is the share of the backup key held by a single administrator.
+type BackupShare struct {
+	Backup    string `json:"backup"` // base64url SHA-256 digest of the backup JWE
+	Index     int    `json:"index"`
+	Shares    int    `json:"shares"`
+	Threshold int    `json:"threshold"`
+	Share     []byte `json:"share"`
+}
+
+// CreateBackup encrypts every key of dir, along with its metadata, and splits the encryption key into shares.
+func CreateBackup(dir string, passphrase PassphraseFn, shares int, threshold int) ([]byte, []BackupShare, error) {
+	content, err := loadKeySet(dir, passphrase)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer content.wipe()
+	if len(content.Keys)+len(content.Rotated) == 0 {
+		return nil, nil, fmt.Errorf("no keys found in '%s'", dir)
+	}
+
+	plaintext, err := json.Marshal(content)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer WipeBytes(plaintext)
+	key := make([]byte, backupKeySize)
+	defer WipeBytes(key)
+	if _, err = rand.Read(key); err != nil {
+		return nil, nil, err
+	}
+	split, err := SplitSecret(key, shares, threshold)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	opts := &jose.EncrypterOptions{}
+	encrypter, err := jose.NewEncrypter(backupEncryption, jose.Recipient{Algorithm: jose.DIRECT, Key: key}, opts.WithContentType(backupType))
+	if err != nil {
+		return nil, nil, err
+	}
+	jwe, err := encrypter.Encrypt(plaintext)
+	if err != nil {
+		return nil, nil, err
+	}
+	serialized, err := jwe.CompactSerialize()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	backup := []byte(serialized)
+	result := make([]BackupShare, len(split))
+	for i, share := range split {
+		result[i] = BackupShare{
+			Backup:    backupDigest(backup),
+			Index:     i + 1,
+			Shares:    shares,
+			Threshold: threshold,
+			Share:     share,
+		}
+	}
+	return backup, result, nil
+}
+
+// EncryptShare serializes share, encrypted to the public JWK of an administrator when recipient is not nil.
+// EC recipient keys use ECDH-ES+A256KW, RSA ones RSA-OAEP-256.
+func EncryptShare(share BackupShare, recipient *jose.JSONWebKey) ([]byte, error) {
+	plaintext, err := json.MarshalIndent(share, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	if recipient == nil {
+		return plaintext, nil
+	}
+	defer WipeBytes(plaintext)
+	return encryptTo(*recipient, plaintext, shareType)
+}
+
+// ParseShare reverts EncryptShare, decrypting the share with the private key among keys whose ID it was encrypted to.
+func ParseShare(data []byte, keys ...jose.JSONWebKey) (BackupShare, error) {
+	var share BackupShare
+	if !IsWrappedKey(data) {
+		if err := json.Unmarshal(data, &share); err != nil {
+			return share, fmt.Errorf("invalid backup share: %w", err)
+		}
+		return share, nil
+	}
+
+	plaintext, err := decryptWith(data, keys...)
+	if err != nil {
+		return share, fmt.Errorf("unable to decrypt backup share: %w", err)
+	}
+	defer WipeBytes(plaintext)
+	if err = json.Unmarshal(plaintext, &share); err != nil {
+		return share, fmt.Errorf("invalid backup share: %w", err)
+	}
+	return share, nil
+}
+
+// RestoreBackup decrypts backup with at least threshold shares, and writes its keys and metadata into dir,
+// wrapping keys when a passphrase is given. dir must not hold keys yet. It returns the number of restored keys.
+// The key set is written and loaded in a staging subdirectory first, dir is left as it was on failure.
+func RestoreBackup(backup []byte, shares []BackupShare, dir string, passphrase PassphraseFn) (int, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return 0, err
+	}
+	for _, entry := range entries {
+		if ext := filepath.Ext(entry.Name()); ext == plainKeyExt || ext == wrappedKeyExt {
+			return 0, fmt.Errorf("key directory '%s' already holds keys", dir)
+		}
+	}
+
+	digest := backupDigest(backup)
+	split := make([][]byte, 0, len(shares))
+	for _, share := range shares {
+		if share.Backup != digest {
+			return 0, fmt.Errorf("backup share %d was issued for another backup", share.Index)
+		}
+		split = append(split, share.Share)
+	}
+	if len(shares) == 0 {
+		return 0, fmt.Errorf("no backup shares given")
+	}
+	if len(shares) < shares[0].Threshold {
+		return 0, fmt.Errorf("restoring the backup requires %d shares, %d given", shares[0].Threshold, len(shares))
+	}
+	key, err := CombineShares(split)
+	if err != nil {
+		return 0, err
+	}
+	defer WipeBytes(key)
+
+	jwe, err := jose.ParseEncrypted(string(backup), []jose.KeyAlgorithm{jose.DIRECT}, []jose.ContentEncryption{backupEncryption})
+	if err != nil {
+		return 0, err
+	}
+	plaintext, err := jwe.Decrypt(key)
+	if err != nil {
+		return 0, fmt.Errorf("unable to decrypt backup, shares do not match: %w", err)
+	}
+	defer WipeBytes(plaintext)
+	var content keySet
+	if err = json.Unmarshal(plaintext, &content); err != nil {
+		return 0, fmt.Errorf("invalid backup content: %w", err)
+	}
+	defer content.wipe()
+
+	staging, err := os.MkdirTemp(dir, ".restore-")
+	if err != nil {
+		return 0, err
+	}
+	defer os.RemoveAll(staging)
+	if err = writeKeySet(staging, content, passphrase); err != nil {
+		return 0, err
+	}
+	// The restored directory must load as a whole, as the server would.
+	store, err := NewFileKeyStore(staging, passphrase)
+	if err != nil {
+		return 0, err
+	}
+	store.Wipe()
+
+	moved, err := moveFiles(staging, dir)
+	if err != nil {
+		for _, name := range moved {
+			_ = os.Remove(filepath.Join(dir, name))
+		}
+		return 0, err
+	}
+	return len(content.Keys) + len(content.Rotated), nil
+}
+
+// writeKeySet writes the keys of set and their metadata into dir, rotated keys hidden from the advertisement.
+func writeKeySet(dir string, set keySet, passphrase PassphraseFn) error {
+	for i, key := range append(set.Keys[:len(set.Keys):len(set.Keys)], set.Rotated...) {
+		thp, err := KeyThumbprint(key)
+		if err != nil {
+			return err
+		}
+		if _, err = WriteKey(dir, key, passphrase); err != nil {
+			return err
+		}
+		if meta, ok := set.Metadata[thp]; ok {
+			if err = WriteMetadata(dir, thp, meta); err != nil {
+				return err
+			}
+		}
+		if i >= len(set.Keys) {
+			if err = RotateKey(dir, thp); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func backupDigest(backup []byte) string {
+	digest := sha256.Sum256(backup)
+	return base64.RawURLEncoding.EncodeToString(digest[:])
+}
+
+// encryptTo encrypts plaintext to the public key of recipient, with ECDH-ES+A256KW for EC keys and RSA-OAEP-256 for RSA ones.
+func encryptTo(recipient jose.JSONWebKey, plaintext []byte, contentType jose.ContentType) ([]byte, error) {
+	var algorithm jose.KeyAlgorithm
+	switch recipient.Key.(type) {
+	case *ecdsa.PublicKey:
+		algorithm = jose.ECDH_ES_A256KW
+	case *rsa.PublicKey:
+		algorithm = jose.RSA_OAEP_256
+	default:
+		return nil, fmt.Errorf("recipient '%s' is not an EC or RSA public key", recipient.KeyID)
+	}
+	opts := &jose.EncrypterOptions{}
+	encrypter, err := jose.NewEncrypter(backupEncryption,
+		jose.Recipient{Algorithm: algorithm, Key: recipient.Key, KeyID: recipient.KeyID}, opts.WithContentType(contentType))
+	if err != nil {
+		return nil, err
+	}
+	jwe, err := encrypter.Encrypt(plaintext)
+	if err != nil {
+		return nil, err
+	}
+	serialized, err := jwe.CompactSerialize()
+	if err != nil {
+		return nil, err
+	}
+	return []byte(serialized), nil
+}
+
+// decryptWith reverts encryptTo, with the private key among keys whose ID data was encrypted to.
+func decryptWith(data []byte, keys ...jose.JSONWebKey) ([]byte, error) {
+	jwe, err := jose.ParseEncrypted(string(data),
+		[]jose.KeyAlgorithm{jose.ECDH_ES_A256KW, jose.RSA_OAEP_256}, []jose.ContentEncryption{backupEncryption})
+	if err != nil {
+		return nil, err
+	}
+	for _, key := range keys {
+		if key.KeyID == jwe.Header.KeyID {
+			return jwe.Decrypt(key.Key)
+		}
+	}
+	return nil, fmt.Errorf("no private key given for '%s'", jwe.Header.KeyID)
+}
+
+func wipeKeys(lists ...KeyList) {
+	for _, keys := range lists {
+		for _, key := range keys {
+			wipeKey(key)
+		}
+	}
+}
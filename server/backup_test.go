@@ -0,0 +1,124 @@
+package server
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/go-jose/go-jose/v4"
+	"github.com/stretchr/testify/require"
+
+	. "go-citrus/internal"
+)
+
+func TestBackup(t *testing.T) {
+	keyWrapIterations = 1000
+	t.Cleanup(func() { keyWrapIterations = 0 })
+	passphrase := func() ([]byte, error) { return []byte("secret"), nil }
+
+	dir := t.TempDir()
+	for _, key := range []jose.JSONWebKey{ExchangeKey1, SigningKey1, ExchangeKey2} {
+		_, err := WriteKey(dir, key, passphrase)
+		require.NoError(t, err)
+	}
+	require.NoError(t, RotateKey(dir, ExchangeKey2Thp))
+	meta, err := NewKeyMetadata(ExchangeKey1, time.Now())
+	require.NoError(t, err)
+	meta.Labels = map[string]string{"team": "storage"}
+	require.NoError(t, WriteMetadata(dir, ExchangeKey1Thp, meta))
+
+	backup, shares, err := CreateBackup(dir, passphrase, 3, 2)
+	require.NoError(t, err)
+	require.Len(t, shares, 3)
+	require.NotContains(t, string(backup), "storage")
+
+	ecAdmin, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	rsaAdmin, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	admins := []jose.JSONWebKey{{Key: ecAdmin, KeyID: "alice"}, {Key: rsaAdmin, KeyID: "bob"}}
+
+	t.Run("shares are encrypted to their administrator", func(t *testing.T) {
+		for i, admin := range admins {
+			public := admin.Public()
+			data, err := EncryptShare(shares[i], &public)
+			require.NoError(t, err)
+			require.True(t, IsWrappedKey(data))
+
+			_, err = ParseShare(data, admins[1-i])
+			require.ErrorContains(t, err, "no private key")
+			share, err := ParseShare(data, admins...)
+			require.NoError(t, err)
+			require.Equal(t, shares[i], share)
+		}
+
+		data, err := EncryptShare(shares[2], nil)
+		require.NoError(t, err)
+		share, err := ParseShare(data)
+		require.NoError(t, err)
+		require.Equal(t, shares[2], share)
+	})
+
+	t.Run("any threshold shares restore the key directory", func(t *testing.T) {
+		restored := t.TempDir()
+		count, err := RestoreBackup(backup, []BackupShare{shares[2], shares[0]}, restored, nil)
+		require.NoError(t, err)
+		require.Equal(t, 3, count)
+
+		keys, err := ListKeys(restored, nil, time.Now())
+		require.NoError(t, err)
+		original, err := ListKeys(dir, passphrase, time.Now())
+		require.NoError(t, err)
+		require.Equal(t, original, keys)
+		require.FileExists(t, filepath.Join(restored, "."+ExchangeKey2Thp+".jwk"))
+	})
+
+	t.Run("restored keys are wrapped with a passphrase", func(t *testing.T) {
+		restored := t.TempDir()
+		_, err := RestoreBackup(backup, shares[1:], restored, passphrase)
+		require.NoError(t, err)
+		data, err := os.ReadFile(filepath.Join(restored, ExchangeKey1Thp+".jwe"))
+		require.NoError(t, err)
+		require.True(t, IsWrappedKey(data))
+	})
+
+	t.Run("restore failures", func(t *testing.T) {
+		_, err := RestoreBackup(backup, shares[:1], t.TempDir(), nil)
+		require.ErrorContains(t, err, "requires 2 shares")
+
+		_, err = RestoreBackup(backup, shares, dir, nil)
+		require.ErrorContains(t, err, "already holds keys")
+
+		other, otherShares, err := CreateBackup(dir, passphrase, 2, 2)
+		require.NoError(t, err)
+		_, err = RestoreBackup(other, []BackupShare{otherShares[0], shares[1]}, t.TempDir(), nil)
+		require.ErrorContains(t, err, "another backup")
+
+		restored := t.TempDir()
+		calls := 0
+		failing := func() ([]byte, error) {
+			if calls++; calls > 1 {
+				return nil, errors.New("passphrase unavailable")
+			}
+			return passphrase()
+		}
+		_, err = RestoreBackup(backup, shares, restored, failing)
+		require.ErrorContains(t, err, "passphrase unavailable")
+		entries, err := os.ReadDir(restored)
+		require.NoError(t, err)
+		require.Empty(t, entries, "no partial key set is left behind")
+		_, err = RestoreBackup(backup, shares, restored, passphrase)
+		require.NoError(t, err)
+
+		forged := shares[0]
+		forged.Share = append([]byte{forged.Share[0] ^ 1}, forged.Share[1:]...)
+		_, err = RestoreBackup(backup, []BackupShare{forged, shares[1]}, t.TempDir(), nil)
+		require.ErrorContains(t, err, "shares do not match")
+	})
+}
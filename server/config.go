@@ -0,0 +1,334 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+/*
+Declarative server configuration, read from a YAML file:
+  - unknown fields are errors, so that a typo does not silently fall back to a default,
+  - ${VAR} and $VAR references in values are replaced by the environment variables, before typing (so numbers and
+    durations may come from the environment); an unset variable is an error, $$ stands for a literal $,
+  - missing settings take the defaults of DefaultConfig, which match the citrus server flags.
+
+Settings are checked together by Validate once read, e.g. after the command line flags overrode some of them.
+
+Durations are written in Go form, e.g. 30s, 15m or 720h.
+*/
+
+type ListenConfig struct {
+	Address         string        `yaml:"address"`          // TCP address, or unix:PATH for a Unix domain socket
+	UnixMode        string        `yaml:"unix_mode"`        // Unix domain socket file mode, in octal
+	UnixOwner       string        `yaml:"unix_owner"`       // Unix domain socket file owner[:group], names or ids
+	Inetd           bool          `yaml:"inetd"`            // serve a single request on stdin/stdout
+	ShutdownTimeout time.Duration `yaml:"shutdown_timeout"` // wait for the in-flight requests on SIGTERM
+}
+
+type TLSConfig struct {
+	Cert     string `yaml:"cert"`      // PEM certificate file, serving HTTPS when set
+	Key      string `yaml:"key"`       // PEM private key file, when not in the certificate file
+	ClientCA string `yaml:"client_ca"` // PEM CA bundle file, requiring client certificates when set
+}
+
+type PassphraseConfig struct {
+	File       string `yaml:"file"`
+	Env        string `yaml:"env"`
+	Credential string `yaml:"credential"` // systemd credential name
+}
+
+// Source returns the configured passphrase source, nil when none is, meaning keys are kept in plain JWK form.
+func (t PassphraseConfig) Source() (PassphraseFn, error) {
+	var sources []PassphraseFn
+	if t.File != "" {
+		sources = append(sources, PassphraseFromFile(t.File))
+	}
+	if t.Env != "" {
+		sources = append(sources, PassphraseFromEnv(t.Env))
+	}
+	if t.Credential != "" {
+		sources = append(sources, PassphraseFromCredential(t.Credential))
+	}
+	if len(sources) > 1 {
+		return nil, fmt.Errorf("only one passphrase source may be given")
+	}
+	if len(sources) == 0 {
+		return nil, nil
+	}
+	return sources[0], nil
+}
+
+// SeedConfig derives the server keys from a master seed, see DerivedKeyStore.
+type SeedConfig struct {
+	File   string        `yaml:"file"`
+	Curve  string        `yaml:"curve"`  // P-256, P-384 or P-521
+	Epoch  time.Duration `yaml:"epoch"`  // see Derivation
+	Retain int           `yaml:"retain"` // see Derivation
+}
+
+type KeysConfig struct {
+	Dir        string           `yaml:"dir"`
+	Passphrase PassphraseConfig `yaml:"passphrase"`
+	Seed       SeedConfig       `yaml:"seed"` // the keys are derived instead of read from Dir when its file is set
+}
+
+type RotationConfig struct {
+	RotateAfter time.Duration `yaml:"rotate_after"` // see RotationPolicy, 0 disables rotation
+	RetireAfter time.Duration `yaml:"retire_after"` // see RotationPolicy, 0 keeps rotated keys
+	Check       time.Duration `yaml:"check"`        // rotation check interval
+}
+
+type AdminConfig struct {
+	Listen      string        `yaml:"listen"`       // admin API address, or unix:PATH
+	Operators   string        `yaml:"operators"`    // JWK set file of the operator keys, see LoadOperatorKeys
+	ApprovalTTL time.Duration `yaml:"approval_ttl"` // see ApprovalQueue
+	MaxPending  int           `yaml:"max_pending"`  // recoveries waiting for approvals, see ApprovalQueue.WithMaxPending
+}
+
+type ReplicationConfig struct {
+	Replicas   string        `yaml:"replicas"`    // JSON file of the replicas fed as a primary, see LoadReplicas
+	Key        string        `yaml:"key"`         // private JWK file signing the pushes of a primary
+	Interval   time.Duration `yaml:"interval"`    // pushes happen at least every interval, see Replicator
+	ReplicaKey string        `yaml:"replica_key"` // private JWK file receiving the pushes, as a replica
+}
+
+type AuditConfig struct {
+	File               string        `yaml:"file"`
+	MaxSize            int64         `yaml:"max_size"` // see NewAuditFile
+	Backups            int           `yaml:"backups"`
+	Log                bool          `yaml:"log"`   // write the records to the server log instead
+	Chain              bool          `yaml:"chain"` // see AuditChain
+	CheckpointEvery    int           `yaml:"checkpoint_every"`
+	CheckpointInterval time.Duration `yaml:"checkpoint_interval"`
+}
+
+// Config describes a whole server, see LoadConfig.
+type Config struct {
+	Listen        ListenConfig         `yaml:"listen"`
+	TLS           TLSConfig            `yaml:"tls"`
+	Keys          KeysConfig           `yaml:"keys"`
+	Rotation      RotationConfig       `yaml:"rotation"`
+	RateLimits    map[string]RateLimit `yaml:"rate_limits"` // route -> per client limit, see RateLimiter
+	MaxRecoveries int                  `yaml:"max_recoveries"`
+	Admin         AdminConfig          `yaml:"admin"`
+	Replication   ReplicationConfig    `yaml:"replication"`
+	Namespaces    []NamespaceConfig    `yaml:"namespaces"`
+	Policy        string               `yaml:"policy"` // recovery policy JSON file, see LoadPolicy
+	Metrics       bool                 `yaml:"metrics"`
+	Audit         AuditConfig          `yaml:"audit"`
+}
+
+// DefaultConfig returns the settings of a server without configuration.
+func DefaultConfig() *Config {
+	return &Config{
+		Listen: ListenConfig{
+			Address:         ":8080",
+			UnixMode:        "0660",
+			ShutdownTimeout: 30 * time.Second,
+		},
+		Keys: KeysConfig{
+			Dir:  "/var/db/citrus",
+			Seed: SeedConfig{Curve: "P-521", Epoch: 30 * 24 * time.Hour, Retain: 3},
+		},
+		Rotation:    RotationConfig{Check: time.Hour},
+		RateLimits:  make(map[string]RateLimit),
+		Admin:       AdminConfig{ApprovalTTL: 15 * time.Minute, MaxPending: DefaultMaxPendingTickets},
+		Replication: ReplicationConfig{Interval: 5 * time.Minute},
+		Audit:       AuditConfig{Backups: 5, CheckpointEvery: 100, CheckpointInterval: time.Minute},
+	}
+}
+
+// LoadConfig reads a YAML configuration file over the defaults. The settings are checked by Validate.
+func LoadConfig(path string) (*Config, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	config, err := ParseConfig(data)
+	if err != nil {
+		return nil, fmt.Errorf("invalid configuration '%s': %w", path, err)
+	}
+	return config, nil
+}
+
+// ParseConfig parses a YAML configuration over the defaults, see LoadConfig.
+func ParseConfig(data []byte) (*Config, error) {
+	config := DefaultConfig()
+	var document yaml.Node
+	if err := yaml.Unmarshal(data, &document); err != nil {
+		return nil, err
+	}
+	if document.Kind == 0 {
+		return config, nil // empty file
+	}
+	if err := expandNode(&document); err != nil {
+		return nil, err
+	}
+	if err := checkFields(&document, reflect.TypeOf(config).Elem()); err != nil {
+		return nil, err
+	}
+	if err := document.Decode(config); err != nil {
+		return nil, err
+	}
+	if config.RateLimits == nil {
+		config.RateLimits = make(map[string]RateLimit)
+	}
+	return config, nil
+}
+
+// expandNode replaces the environment variable references of every scalar value.
+func expandNode(node *yaml.Node) error {
+	if node.Kind == yaml.ScalarNode && strings.Contains(node.Value, "$") {
+		var missing []string
+		value := os.Expand(node.Value, func(name string) string {
+			if name == "$" {
+				return "$"
+			}
+			value, ok := os.LookupEnv(name)
+			if !ok {
+				missing = append(missing, name)
+			}
+			return value
+		})
+		if len(missing) > 0 {
+			return fmt.Errorf("line %d: environment variable '%s' is not set", node.Line, missing[0])
+		}
+		node.Value = value
+		if node.Style == 0 {
+			node.Tag = "" // resolved again from the expanded value, e.g. as a number
+		}
+	}
+	for _, child := range node.Content {
+		if err := expandNode(child); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkFields fails on the mapping keys which match no field of the structures decoded from node.
+func checkFields(node *yaml.Node, typ reflect.Type) error {
+	for typ.Kind() == reflect.Pointer {
+		typ = typ.Elem()
+	}
+	switch node.Kind {
+	case yaml.DocumentNode:
+		for _, child := range node.Content {
+			if err := checkFields(child, typ); err != nil {
+				return err
+			}
+		}
+	case yaml.SequenceNode:
+		if typ.Kind() != reflect.Slice {
+			return nil // reported by Decode
+		}
+		for _, child := range node.Content {
+			if err := checkFields(child, typ.Elem()); err != nil {
+				return err
+			}
+		}
+	case yaml.MappingNode:
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			key, value := node.Content[i], node.Content[i+1]
+			switch typ.Kind() {
+			case reflect.Map:
+				if err := checkFields(value, typ.Elem()); err != nil {
+					return err
+				}
+			case reflect.Struct:
+				field, ok := yamlField(typ, key.Value)
+				if !ok {
+					return fmt.Errorf("line %d: unknown field '%s'", key.Line, key.Value)
+				}
+				if err := checkFields(value, field.Type); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+func yamlField(typ reflect.Type, name string) (reflect.StructField, bool) {
+	for i := 0; i < typ.NumField(); i++ {
+		field := typ.Field(i)
+		tag, _, _ := strings.Cut(field.Tag.Get("yaml"), ",")
+		if field.IsExported() && tag == name {
+			return field, true
+		}
+	}
+	return reflect.StructField{}, false
+}
+
+// Validate checks the settings which do not need any file, see the citrus server check-config command for the others.
+func (t *Config) Validate() error {
+	var errs []error
+	check := func(failed bool, format string, a ...interface{}) {
+		if failed {
+			errs = append(errs, fmt.Errorf(format, a...))
+		}
+	}
+
+	perm, err := strconv.ParseUint(t.Listen.UnixMode, 8, 32)
+	check(err != nil || perm > 0o777, "invalid listen.unix_mode '%s'", t.Listen.UnixMode)
+	check(t.Listen.ShutdownTimeout <= 0, "listen.shutdown_timeout must be positive")
+	check(t.TLS.Cert == "" && (t.TLS.Key != "" || t.TLS.ClientCA != ""), "tls.key and tls.client_ca require tls.cert")
+
+	_, err = t.Keys.Passphrase.Source()
+	check(err != nil, "keys.passphrase: %v", err)
+	check(t.Keys.Dir == "" && t.Keys.Seed.File == "", "keys.dir must be set")
+	if t.Keys.Seed.File != "" {
+		_, err = ParseCurve(t.Keys.Seed.Curve)
+		check(err != nil, "keys.seed.curve: %v", err)
+		check(t.Keys.Seed.Epoch <= 0, "keys.seed.epoch must be positive")
+		check(t.Keys.Seed.Retain < 0, "keys.seed.retain must not be negative")
+		check(t.rotates() || t.Admin.Listen != "" || t.Replication.Replicas != "",
+			"keys.seed cannot be used with rotation, the admin API or replication, derived keys follow their epochs")
+	}
+
+	check(t.Rotation.RotateAfter < 0 || t.Rotation.RetireAfter < 0, "rotation durations must not be negative")
+	check(t.Rotation.Check <= 0, "rotation.check must be positive")
+	for route, limit := range t.RateLimits {
+		check(route != RouteAdvertisement && route != RouteRecovery, "rate_limits: unknown route '%s', one of: %s, %s",
+			route, RouteAdvertisement, RouteRecovery)
+		check(limit.Rate <= 0 || limit.Burst <= 0, "rate_limits: invalid %s rate limit", route)
+	}
+	check(t.MaxRecoveries < 0, "max_recoveries must not be negative")
+
+	check((t.Admin.Listen == "") != (t.Admin.Operators == ""), "admin.listen and admin.operators must be given together")
+	check(t.Admin.Listen != "" && t.Listen.Inetd, "admin.listen cannot be used with listen.inetd")
+	check(t.Admin.ApprovalTTL <= 0, "admin.approval_ttl must be positive")
+	check(t.Admin.MaxPending <= 0, "admin.max_pending must be positive")
+
+	check((t.Replication.Replicas == "") != (t.Replication.Key == ""), "replication.replicas and replication.key must be given together")
+	check(t.Replication.ReplicaKey != "" && (t.Replication.Replicas != "" || t.rotates()),
+		"replication.replica_key cannot be used with replication.replicas or rotation, the primary manages the keys")
+	check(t.Replication.ReplicaKey != "" && t.Admin.Listen == "", "replication.replica_key requires admin.listen")
+	check(t.Replication.Interval <= 0, "replication.interval must be positive")
+
+	names := make(map[string]bool)
+	for i := range t.Namespaces {
+		err = t.Namespaces[i].Compile()
+		check(err != nil, "namespaces: %v", err)
+		check(names[t.Namespaces[i].Name], "namespaces: namespace '%s' is listed twice", t.Namespaces[i].Name)
+		names[t.Namespaces[i].Name] = true
+	}
+
+	check(t.Audit.File != "" && t.Audit.Log, "only one of audit.file and audit.log may be given")
+	check(t.Audit.Chain && t.Audit.File == "", "audit.chain requires audit.file")
+	check(t.Audit.MaxSize < 0 || t.Audit.Backups < 0, "audit.max_size and audit.backups must not be negative")
+	check(t.Audit.Chain && (t.Audit.CheckpointEvery <= 0 || t.Audit.CheckpointInterval <= 0),
+		"audit.checkpoint_every and audit.checkpoint_interval must be positive")
+	return errors.Join(errs...)
+}
+
+func (t *Config) rotates() bool {
+	return t.Rotation.RotateAfter > 0 || t.Rotation.RetireAfter > 0
+}
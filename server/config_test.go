@@ -0,0 +1,144 @@
+package server
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseConfig(t *testing.T) {
+	t.Run("defaults", func(t *testing.T) {
+		config, err := ParseConfig(nil)
+		require.NoError(t, err)
+		require.Equal(t, DefaultConfig(), config)
+		require.NoError(t, config.Validate())
+	})
+
+	t.Run("settings over the defaults", func(t *testing.T) {
+		config, err := ParseConfig([]byte(`
+listen:
+  address: 127.0.0.1:9090
+keys:
+  dir: /srv/citrus
+  passphrase:
+    env: CITRUS_PASSPHRASE
+rotation:
+  rotate_after: 720h
+rate_limits:
+  rec: {rate: 0.5, burst: 5}
+namespaces:
+  - name: team-a
+    dir: /srv/citrus/team-a
+    rotate_after: 2160h
+audit:
+  file: /var/log/citrus/audit.log
+  chain: true
+`))
+		require.NoError(t, err)
+		require.NoError(t, config.Validate())
+		require.Equal(t, "127.0.0.1:9090", config.Listen.Address)
+		require.Equal(t, "0660", config.Listen.UnixMode)
+		require.Equal(t, 30*time.Second, config.Listen.ShutdownTimeout)
+		require.Equal(t, "/srv/citrus", config.Keys.Dir)
+		require.Equal(t, "CITRUS_PASSPHRASE", config.Keys.Passphrase.Env)
+		require.Equal(t, 720*time.Hour, config.Rotation.RotateAfter)
+		require.Equal(t, time.Hour, config.Rotation.Check)
+		require.Equal(t, map[string]RateLimit{RouteRecovery: {Rate: 0.5, Burst: 5}}, config.RateLimits)
+		require.Len(t, config.Namespaces, 1)
+		require.Equal(t, RotationPolicy{RotateAfter: 2160 * time.Hour}, config.Namespaces[0].rotation)
+		require.True(t, config.Audit.Chain)
+		require.Equal(t, 100, config.Audit.CheckpointEvery)
+	})
+
+	t.Run("unknown fields", func(t *testing.T) {
+		for _, content := range []string{
+			"listn:\n  address: :8080\n",
+			"keys:\n  directory: /srv/citrus\n",
+			"rate_limits:\n  rec: {rate: 1, burst: 1, bursts: 2}\n",
+			"namespaces:\n  - name: team-a\n    dir: /a\n    rotate: 1h\n",
+		} {
+			_, err := ParseConfig([]byte(content))
+			require.ErrorContains(t, err, "unknown field", content)
+		}
+	})
+
+	t.Run("environment variables", func(t *testing.T) {
+		t.Setenv("CITRUS_DIR", "/srv/citrus")
+		t.Setenv("CITRUS_MAX_RECOVERIES", "8")
+		t.Setenv("CITRUS_TIMEOUT", "1m")
+		config, err := ParseConfig([]byte(`
+keys:
+  dir: ${CITRUS_DIR}/keys
+  passphrase:
+    file: /run/$$secrets
+max_recoveries: $CITRUS_MAX_RECOVERIES
+listen:
+  shutdown_timeout: ${CITRUS_TIMEOUT}
+`))
+		require.NoError(t, err)
+		require.Equal(t, "/srv/citrus/keys", config.Keys.Dir)
+		require.Equal(t, "/run/$secrets", config.Keys.Passphrase.File)
+		require.Equal(t, 8, config.MaxRecoveries)
+		require.Equal(t, time.Minute, config.Listen.ShutdownTimeout)
+
+		_, err = ParseConfig([]byte("keys:\n  dir: ${CITRUS_UNSET_VARIABLE}\n"))
+		require.ErrorContains(t, err, "CITRUS_UNSET_VARIABLE")
+	})
+
+	t.Run("environment values stay values", func(t *testing.T) {
+		t.Setenv("CITRUS_DIR", "/srv/citrus\nmetrics: true")
+		config, err := ParseConfig([]byte("keys:\n  dir: ${CITRUS_DIR}\n"))
+		require.NoError(t, err)
+		require.Equal(t, "/srv/citrus\nmetrics: true", config.Keys.Dir)
+		require.False(t, config.Metrics)
+	})
+
+	t.Run("invalid types", func(t *testing.T) {
+		_, err := ParseConfig([]byte("rotation:\n  rotate_after: monthly\n"))
+		require.Error(t, err)
+	})
+}
+
+func TestConfig_Validate(t *testing.T) {
+	for name, change := range map[string]func(config *Config){
+		"admin without operators": func(config *Config) { config.Admin.Listen = ":8081" },
+		"admin with inetd": func(config *Config) {
+			config.Admin.Listen, config.Admin.Operators, config.Listen.Inetd = ":8081", "ops.jwks", true
+		},
+		"seed with rotation":          func(config *Config) { config.Keys.Seed.File, config.Rotation.RotateAfter = "seed", time.Hour },
+		"unknown seed curve":          func(config *Config) { config.Keys.Seed.File, config.Keys.Seed.Curve = "seed", "P-224" },
+		"replicas without key":        func(config *Config) { config.Replication.Replicas = "replicas.json" },
+		"replica without admin":       func(config *Config) { config.Replication.ReplicaKey = "replica.jwk" },
+		"audit chain without file":    func(config *Config) { config.Audit.Chain = true },
+		"audit file and log":          func(config *Config) { config.Audit.File, config.Audit.Log = "audit.log", true },
+		"tls key without certificate": func(config *Config) { config.TLS.Key = "key.pem" },
+		"unknown rate limit route":    func(config *Config) { config.RateLimits["admin"] = RateLimit{Rate: 1, Burst: 1} },
+		"two passphrase sources":      func(config *Config) { config.Keys.Passphrase.File, config.Keys.Passphrase.Env = "pass", "PASS" },
+		"invalid unix mode":           func(config *Config) { config.Listen.UnixMode = "0999" },
+		"reserved namespace":          func(config *Config) { config.Namespaces = []NamespaceConfig{{Name: "adv", Dir: "/a"}} },
+		"duplicate namespace": func(config *Config) {
+			config.Namespaces = []NamespaceConfig{{Name: "team-a", Dir: "/a"}, {Name: "team-a", Dir: "/b"}}
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			config := DefaultConfig()
+			change(config)
+			require.Error(t, config.Validate())
+		})
+	}
+}
+
+func TestLoadConfig(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "citrus.yaml")
+	require.NoError(t, os.WriteFile(path, []byte("metrics: true\n"), 0o600))
+	config, err := LoadConfig(path)
+	require.NoError(t, err)
+	require.True(t, config.Metrics)
+
+	require.NoError(t, os.WriteFile(path, []byte("metrics: [true]\n"), 0o600))
+	_, err = LoadConfig(path)
+	require.ErrorContains(t, err, path)
+}
@@ -0,0 +1,162 @@
+package server
+
+import (
+	"crypto/elliptic"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/go-jose/go-jose/v4"
+
+	. "go-citrus/internal"
+)
+
+/*
+Stateless key sets, derived from a master seed instead of read from a key directory.
+Time is cut into fixed-length epochs, numbered from the Unix epoch. Each epoch has its own exchange and signing key,
+derived from the seed and the epoch label (see DeriveExchangeKey):
+  - the keys of the current epoch are advertised,
+  - the keys of the Retained previous epochs are rotated, kept for recovery only.
+
+Replicas sharing the seed and the Derivation parameters serve identical key sets, and so identical thumbprints.
+*/
+type Derivation struct {
+	Curve    elliptic.Curve
+	Epoch    time.Duration // length of an epoch
+	Retained int           // previous epochs whose keys stay recoverable
+}
+
+// ParseCurve returns the curve of derived keys named name, one of P-256, P-384 and P-521.
+func ParseCurve(name string) (elliptic.Curve, error) {
+	curves := map[string]elliptic.Curve{"P-256": elliptic.P256(), "P-384": elliptic.P384(), "P-521": elliptic.P521()}
+	curve, ok := curves[name]
+	if !ok {
+		return nil, fmt.Errorf("unsupported key derivation curve '%s', one of: P-256, P-384, P-521", name)
+	}
+	return curve, nil
+}
+
+// EpochAt returns the number of the epoch containing time.
+func (t Derivation) EpochAt(at time.Time) int64 {
+	return at.Unix() / int64(t.Epoch/time.Second)
+}
+
+// EpochStart returns the start time of the given epoch.
+func (t Derivation) EpochStart(epoch int64) time.Time {
+	return time.Unix(epoch*int64(t.Epoch/time.Second), 0).UTC()
+}
+
+// EpochLabel names the keys of an epoch, the epoch length being part of it so that epochs of different lengths never collide.
+func (t Derivation) EpochLabel(epoch int64) string {
+	return fmt.Sprintf("%ds/%d", int64(t.Epoch/time.Second), epoch)
+}
+
+// Keys derives the advertised and rotated keys, and their metadata, for the epoch containing now.
+func (t Derivation) Keys(seed []byte, now time.Time) (KeyList, KeyList, Metadata, error) {
+	if t.Epoch < time.Second {
+		return nil, nil, nil, fmt.Errorf("key derivation epoch must last at least a second")
+	}
+	if t.Retained < 0 {
+		return nil, nil, nil, fmt.Errorf("negative number of retained key derivation epochs")
+	}
+
+	current := t.EpochAt(now)
+	var keys, rotated KeyList
+	metadata := make(Metadata)
+	for epoch := current; epoch >= current-int64(t.Retained); epoch-- {
+		for _, derive := range []func([]byte, elliptic.Curve, string) (jose.JSONWebKey, error){DeriveExchangeKey, DeriveSigningKey} {
+			key, err := derive(seed, t.Curve, t.EpochLabel(epoch))
+			if err != nil {
+				wipeKeys(keys, rotated)
+				return nil, nil, nil, err
+			}
+			meta, err := NewKeyMetadata(key, t.EpochStart(epoch))
+			if err != nil {
+				wipeKeys(keys, rotated)
+				return nil, nil, nil, err
+			}
+			if epoch == current {
+				keys = append(keys, key)
+			} else {
+				rotatedAt := t.EpochStart(epoch + 1)
+				meta.RotatedAt = &rotatedAt
+				rotated = append(rotated, key)
+			}
+			thp, _ := KeyThumbprint(key)
+			metadata[thp] = meta
+		}
+	}
+	return keys, rotated, metadata, nil
+}
+
+// DerivedKeyStore serves the keys derived from a master seed, see Derivation.
+// Reload moves the key set to the current epoch.
+type DerivedKeyStore struct {
+	swappableKeyStore
+	derivation Derivation
+	now        func() time.Time
+
+	seedMu sync.Mutex // serializes reloads, and guards seed
+	seed   []byte     // nil once wiped
+}
+
+// NewDerivedKeyStore derives the key set of the current epoch. The store keeps its own copy of seed, erased by Wipe.
+func NewDerivedKeyStore(seed []byte, derivation Derivation) (*DerivedKeyStore, error) {
+	if len(seed) < MinSeedSize {
+		return nil, fmt.Errorf("key derivation seed is shorter than %d bytes", MinSeedSize)
+	}
+	store := DerivedKeyStore{
+		seed:       append([]byte(nil), seed...),
+		derivation: derivation,
+		now:        time.Now,
+	}
+	if err := store.Reload(); err != nil {
+		WipeBytes(store.seed)
+		return nil, err
+	}
+	return &store, nil
+}
+
+// Reload derives the key set of the current epoch.
+func (t *DerivedKeyStore) Reload() error {
+	t.seedMu.Lock()
+	defer t.seedMu.Unlock()
+	if t.seed == nil {
+		return ErrKeysWiped
+	}
+	keys, rotated, metadata, err := t.derivation.Keys(t.seed, t.now())
+	if err != nil {
+		return err
+	}
+	memory := newMemoryKeyStore(keys, rotated, metadata, func() time.Time { return t.now() })
+	wipeKeys(keys, rotated)
+	t.swap(memory)
+	return nil
+}
+
+// NextEpoch returns when the key set must be reloaded to move to the next epoch.
+func (t *DerivedKeyStore) NextEpoch() time.Time {
+	return t.derivation.EpochStart(t.derivation.EpochAt(t.now()) + 1)
+}
+
+func (t *DerivedKeyStore) Wipe() {
+	t.seedMu.Lock()
+	defer t.seedMu.Unlock()
+	t.swappableKeyStore.Wipe()
+	WipeBytes(t.seed)
+	t.seed = nil
+}
+
+// LoadSeed reads a key derivation seed file, made of at least MinSeedSize random bytes (e.g. head -c 64 /dev/urandom).
+func LoadSeed(path string) ([]byte, error) {
+	seed, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if len(seed) < MinSeedSize {
+		WipeBytes(seed)
+		return nil, fmt.Errorf("key derivation seed '%s' is shorter than %d bytes", path, MinSeedSize)
+	}
+	return seed, nil
+}
@@ -0,0 +1,107 @@
+package server
+
+import (
+	"bytes"
+	"crypto/elliptic"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	. "go-citrus/internal"
+)
+
+func TestDerivedKeyStore(t *testing.T) {
+	seed := bytes.Repeat([]byte{0x42}, MinSeedSize)
+	derivation := Derivation{Curve: elliptic.P256(), Epoch: 24 * time.Hour, Retained: 2}
+	now := time.Date(2026, 10, 19, 12, 0, 0, 0, time.UTC)
+	newStore := func(t *testing.T) *DerivedKeyStore {
+		store, err := NewDerivedKeyStore(seed, derivation)
+		require.NoError(t, err)
+		store.now = func() time.Time { return now }
+		require.NoError(t, store.Reload())
+		return store
+	}
+	store := newStore(t)
+
+	t.Run("replicas derive identical key sets", func(t *testing.T) {
+		keys, err := store.PublicKeys()
+		require.NoError(t, err)
+		require.Len(t, keys, 2)
+		replica, err := newStore(t).PublicKeys()
+		require.NoError(t, err)
+		require.Equal(t, thumbprintsOf(t, keys), thumbprintsOf(t, replica))
+
+		require.Equal(t, map[string]int{KeyStateActive: 2, KeyStateExpired: 0, KeyStateRotated: 4}, store.KeyStates())
+		_, err = NewProtocol(store)
+		require.NoError(t, err)
+	})
+
+	t.Run("previous epochs stay recoverable", func(t *testing.T) {
+		keys, err := store.PublicKeys()
+		require.NoError(t, err)
+		advertised := thumbprintsOf(t, keys)
+
+		now = now.Add(24 * time.Hour)
+		require.Equal(t, time.Date(2026, 10, 21, 0, 0, 0, 0, time.UTC), store.NextEpoch())
+		require.NoError(t, store.Reload())
+		keys, err = store.PublicKeys()
+		require.NoError(t, err)
+		require.NotEqual(t, advertised, thumbprintsOf(t, keys))
+
+		x, err := GenerateExchangeKey()
+		require.NoError(t, err)
+		previous, err := DeriveExchangeKey(seed, derivation.Curve, derivation.EpochLabel(derivation.EpochAt(now)-1))
+		require.NoError(t, err)
+		thp, err := KeyThumbprint(previous)
+		require.NoError(t, err)
+		_, found := store.DescribeExchangeKey(thp)
+		require.True(t, found)
+
+		expired, err := DeriveExchangeKey(seed, derivation.Curve, derivation.EpochLabel(derivation.EpochAt(now)-3))
+		require.NoError(t, err)
+		thp, err = KeyThumbprint(expired)
+		require.NoError(t, err)
+		_, err = store.ECMRMultiply(thp, publicPoint(t, x))
+		require.Error(t, err, "keys older than the retained epochs are gone")
+	})
+
+	t.Run("wiped stores do not derive keys anymore", func(t *testing.T) {
+		store := newStore(t)
+		store.Wipe()
+		require.ErrorIs(t, store.Reload(), ErrKeysWiped)
+	})
+
+	t.Run("invalid parameters", func(t *testing.T) {
+		_, err := NewDerivedKeyStore(seed[:MinSeedSize-1], derivation)
+		require.Error(t, err)
+		_, err = NewDerivedKeyStore(seed, Derivation{Curve: elliptic.P256(), Epoch: time.Millisecond})
+		require.Error(t, err)
+		_, err = NewDerivedKeyStore(seed, Derivation{Curve: elliptic.P224(), Epoch: time.Hour})
+		require.Error(t, err)
+	})
+
+	t.Run("seed files", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "seed")
+		require.NoError(t, os.WriteFile(path, seed, 0o600))
+		loaded, err := LoadSeed(path)
+		require.NoError(t, err)
+		require.Equal(t, seed, loaded)
+
+		require.NoError(t, os.WriteFile(path, seed[:8], 0o600))
+		_, err = LoadSeed(path)
+		require.Error(t, err)
+	})
+}
+
+func thumbprintsOf(t *testing.T, keys KeyList) []string {
+	var result []string
+	for _, key := range keys {
+		thp, err := KeyThumbprint(key)
+		require.NoError(t, err)
+		result = append(result, thp)
+	}
+	return result
+}
@@ -0,0 +1,92 @@
+package server
+
+import (
+	"crypto/ecdsa"
+	"crypto/rand"
+	"fmt"
+
+	"github.com/go-jose/go-jose/v4"
+
+	. "go-citrus/internal"
+)
+
+/*
+Readiness self-test, run every time the advertisements are (re)built:
+  - the default advertisement must verify through ParseAdvertisement, as a client would check it,
+  - every exchange key it advertises must serve a recovery: for a random point x = r * G,
+    the server half y = x * S must match the client side r * s.
+*/
+
+// SelfTestError tells which exchange key failed the self-test.
+type SelfTestError struct {
+	Thumbprint string
+	Err        error
+}
+
+func (e *SelfTestError) Error() string {
+	return fmt.Sprintf("self-test of exchange key '%s' failed: %v", e.Thumbprint, e.Err)
+}
+
+func (e *SelfTestError) Unwrap() error {
+	return e.Err
+}
+
+// SelfTest checks the served advertisement and recovers through every advertised exchange key.
+func (t *Protocol) SelfTest() error {
+	data := t.GetAdvertisement("")
+	if data == nil {
+		return fmt.Errorf("no advertisement built")
+	}
+	adv, err := ParseAdvertisement(data, SigningAlgorithms)
+	if err != nil {
+		return fmt.Errorf("advertisement does not verify: %w", err)
+	}
+
+	for _, key := range adv.ExchangeKeys() {
+		thp, err := KeyThumbprint(key)
+		if err != nil {
+			return err
+		}
+		if err = t.selfTestRecovery(thp, key); err != nil {
+			return &SelfTestError{Thumbprint: thp, Err: err}
+		}
+	}
+	return nil
+}
+
+func (t *Protocol) selfTestRecovery(thumbprint string, key jose.JSONWebKey) error {
+	s, ok := key.Key.(*ecdsa.PublicKey)
+	if !ok {
+		return fmt.Errorf("advertised key is not an EC public key")
+	}
+	r, err := ecdsa.GenerateKey(s.Curve, rand.Reader)
+	if err != nil {
+		return err
+	}
+
+	jwkY, err := t.computeRecoverKey(thumbprint, CreateExchangeKey(&r.PublicKey))
+	if err != nil {
+		return err
+	}
+	y, ok := jwkY.Key.(*ecdsa.PublicKey)
+	if !ok {
+		return fmt.Errorf("recovery did not return an EC public key")
+	}
+	expected := NewECAlgorithm(s.Curve).Multiply(s, r)
+	if y.X.Cmp(expected.X) != 0 || y.Y.Cmp(expected.Y) != 0 {
+		return fmt.Errorf("recovery does not match the advertised key")
+	}
+	return nil
+}
+
+// Ready returns the self-test result of the served advertisements, nil when recoveries can be served.
+// A draining protocol is never ready.
+func (t *Protocol) Ready() error {
+	if t.draining.Load() {
+		return ErrShuttingDown
+	}
+	t.rebuildExpired()
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	return t.readiness
+}
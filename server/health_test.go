@@ -0,0 +1,78 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	. "go-citrus/internal"
+)
+
+func TestProtocol_SelfTest(t *testing.T) {
+	t.Run("advertised keys pass", func(t *testing.T) {
+		protocol, err := NewProtocol(NewMemoryKeyStore(KeyList{ExchangeKey1, ExchangeKey2, SigningKey1}))
+		require.NoError(t, err)
+		require.NoError(t, protocol.SelfTest())
+		require.NoError(t, protocol.Ready())
+	})
+
+	t.Run("private key does not match the advertised key", func(t *testing.T) {
+		store := NewMemoryKeyStore(KeyList{ExchangeKey1, ExchangeKey2, SigningKey1})
+		for _, thp := range exchangeKey1Thumbprints(t) {
+			store.exchange[thp] = ExchangeKey2
+		}
+		protocol, err := NewProtocol(store)
+		require.NoError(t, err)
+
+		var selfTestErr *SelfTestError
+		require.ErrorAs(t, protocol.Ready(), &selfTestErr)
+		require.Equal(t, ExchangeKey1Thp, selfTestErr.Thumbprint)
+	})
+
+	t.Run("exchange key missing from the key store", func(t *testing.T) {
+		store := NewMemoryKeyStore(KeyList{ExchangeKey1, SigningKey1})
+		delete(store.exchange, ExchangeKey1Thp)
+		protocol, err := NewProtocol(store)
+		require.NoError(t, err)
+
+		var notFound *KeyNotFoundError
+		require.ErrorAs(t, protocol.Ready(), &notFound)
+		require.ErrorContains(t, protocol.Ready(), ExchangeKey1Thp)
+	})
+}
+
+func exchangeKey1Thumbprints(t *testing.T) []string {
+	thumbs, err := Thumbprints(ExchangeKey1)
+	require.NoError(t, err)
+	return thumbs
+}
+
+func TestHandler_Health(t *testing.T) {
+	t.Run("ready", func(t *testing.T) {
+		handler := newTestHandler(t)
+		for _, path := range []string{"/healthz", "/readyz"} {
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path, nil))
+			require.Equal(t, http.StatusOK, rec.Code, path)
+		}
+	})
+
+	t.Run("not ready", func(t *testing.T) {
+		store := NewMemoryKeyStore(KeyList{ExchangeKey1, SigningKey1})
+		delete(store.exchange, ExchangeKey1Thp)
+		protocol, err := NewProtocol(store)
+		require.NoError(t, err)
+		handler := NewHandler(protocol)
+
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/healthz", nil))
+		require.Equal(t, http.StatusOK, rec.Code)
+
+		rec = httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+		require.Equal(t, http.StatusServiceUnavailable, rec.Code)
+		require.Contains(t, rec.Body.String(), ExchangeKey1Thp)
+	})
+}
@@ -0,0 +1,263 @@
+package server
+
+import (
+	"cmp"
+	"errors"
+	"io"
+	"log/slog"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+/*
+Tang HTTP API, as used by clevis:
+  - GET  /adv       - default signed advertisement, also on /adv/
+  - GET  /adv/{thp} - advertisement signed by the signing key with thumbprint thp
+  - POST /rec/{thp} - recovery using the exchange key with thumbprint thp, body 'x', response 'y';
+    202 and a ticket for keys requiring approvals, see ApprovalQueue
+  - GET  /metrics   - server metrics, when enabled with WithMetrics
+  - GET  /healthz   - liveness, always 200 while the process serves requests
+  - GET  /readyz    - readiness, 200 once the advertised keys passed the self-test (see Protocol.SelfTest), 503 otherwise
+
+Multi-tenant servers serve the same API under /{ns}/ for each namespace, see NamespaceRouter.
+*/
+const (
+	advertisementContentType = "application/jose+json"
+	recoveryContentType      = "application/jwk+json"
+
+	maxRecoveryRequestSize = 64 * 1024
+)
+
+type Handler struct {
+	protocol  *Protocol
+	limiter   *RateLimiter
+	audit     AuditSink
+	metrics   *Metrics
+	namespace string // recorded into the audit records, see NamespaceRouter
+	mux       *http.ServeMux
+}
+
+func NewHandler(protocol *Protocol) *Handler {
+	h := Handler{
+		protocol: protocol,
+		mux:      http.NewServeMux(),
+	}
+	h.mux.HandleFunc("GET /adv", h.observe(RouteAdvertisement, h.advertisement))
+	// clevis requests {url}/adv/{thp}, that is /adv/ without a thumbprint
+	h.mux.HandleFunc("GET /adv/{$}", h.observe(RouteAdvertisement, h.advertisement))
+	h.mux.HandleFunc("GET /adv/{thp}", h.observe(RouteAdvertisement, h.advertisement))
+	h.mux.HandleFunc("POST /rec/{thp}", h.observe(RouteRecovery, h.recovery))
+	h.mux.HandleFunc("GET /healthz", h.health)
+	h.mux.HandleFunc("GET /readyz", h.ready)
+	return &h
+}
+
+// WithRateLimiter throttles requests per client address, see RateLimiter.
+func (t *Handler) WithRateLimiter(limiter *RateLimiter) *Handler {
+	t.limiter = limiter
+	return t
+}
+
+// WithAudit records every advertisement and recovery request into sink.
+func (t *Handler) WithAudit(sink AuditSink) *Handler {
+	t.audit = sink
+	return t
+}
+
+// WithNamespace records name as the namespace of the audit records, for handlers serving a namespace.
+func (t *Handler) WithNamespace(name string) *Handler {
+	t.namespace = name
+	return t
+}
+
+// WithMetrics counts requests into metrics, and serves them on /metrics.
+func (t *Handler) WithMetrics(metrics *Metrics) *Handler {
+	t.metrics = metrics
+	t.mux.Handle("GET /metrics", metrics)
+	return t
+}
+
+func (t *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	t.mux.ServeHTTP(w, r)
+}
+
+func (t *Handler) advertisement(w http.ResponseWriter, r *http.Request) {
+	if !t.allow(w, r, RouteAdvertisement) {
+		return
+	}
+
+	adv := t.protocol.GetAdvertisement(r.PathValue("thp"))
+	if adv == nil {
+		http.Error(w, "advertisement not found", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", advertisementContentType)
+	_, _ = w.Write(adv)
+}
+
+func (t *Handler) recovery(w http.ResponseWriter, r *http.Request) {
+	if !t.allow(w, r, RouteRecovery) {
+		return
+	}
+
+	request, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxRecoveryRequestSize))
+	if err != nil {
+		http.Error(w, "unable to read recovery request", http.StatusBadRequest)
+		return
+	}
+
+	if t.limiter != nil {
+		release, ok := t.limiter.AcquireRecovery()
+		if !ok {
+			t.reject(RouteRecovery, RejectConcurrency)
+			tooManyRequests(w, time.Second)
+			return
+		}
+		defer release()
+	}
+
+	client := RecoveryClient{Address: ClientAddress(r), Subject: ClientSubject(r), Ticket: r.Header.Get(ApprovalTicketHeader)}
+	response, decision, err := t.protocol.RecoverFor(client, r.PathValue("thp"), request)
+	// The decision is part of the audit record, see observe.
+	if sw, ok := w.(*statusWriter); ok && decision.Rule != "" {
+		sw.policyRule, sw.policyAction = decision.Rule, PolicyDeny
+		if decision.Allowed {
+			sw.policyAction = PolicyAllow
+		}
+	}
+	var pending *ApprovalPendingError
+	if errors.As(err, &pending) {
+		if sw, ok := w.(*statusWriter); ok {
+			sw.ticket = pending.Ticket.ID
+		}
+		writeTicket(w, pending.Ticket)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), recoveryErrorStatus(err))
+		return
+	}
+	w.Header().Set("Content-Type", recoveryContentType)
+	_, _ = w.Write(response)
+}
+
+func (t *Handler) health(w http.ResponseWriter, _ *http.Request) {
+	_, _ = io.WriteString(w, "ok\n")
+}
+
+func (t *Handler) ready(w http.ResponseWriter, _ *http.Request) {
+	if err := t.protocol.Ready(); err != nil {
+		http.Error(w, "not ready: "+err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	_, _ = io.WriteString(w, "ready\n")
+}
+
+// observe wraps a route handler to record the outcome of each request.
+func (t *Handler) observe(route string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		sw := &statusWriter{ResponseWriter: w, status: http.StatusOK}
+		next(sw, r)
+		latency := time.Since(start)
+
+		if t.metrics != nil {
+			t.metrics.Observe(route, sw.status, r.PathValue("thp"), latency)
+		}
+		if t.audit == nil {
+			return
+		}
+		err := t.audit.Record(AuditRecord{
+			Time:         start.UTC(),
+			Client:       ClientAddress(r),
+			Subject:      ClientSubject(r),
+			Route:        route,
+			Thumbprint:   r.PathValue("thp"),
+			Status:       sw.status,
+			Latency:      latency,
+			PolicyRule:   sw.policyRule,
+			PolicyAction: sw.policyAction,
+			Ticket:       cmp.Or(sw.ticket, r.Header.Get(ApprovalTicketHeader)),
+			Namespace:    t.namespace,
+		})
+		if err != nil {
+			slog.Error("unable to write audit record", "error", err)
+		}
+	}
+}
+
+func (t *Handler) allow(w http.ResponseWriter, r *http.Request, route string) bool {
+	if t.limiter == nil {
+		return true
+	}
+	ok, retryAfter := t.limiter.Allow(route, ClientAddress(r))
+	if !ok {
+		t.reject(route, RejectRateLimit)
+		tooManyRequests(w, retryAfter)
+	}
+	return ok
+}
+
+func (t *Handler) reject(route string, reason string) {
+	if t.metrics != nil {
+		t.metrics.Reject(route, reason)
+	}
+}
+
+func tooManyRequests(w http.ResponseWriter, retryAfter time.Duration) {
+	if retryAfter > 0 {
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+	}
+	http.Error(w, "too many requests", http.StatusTooManyRequests)
+}
+
+func recoveryErrorStatus(err error) int {
+	var notFound *KeyNotFoundError
+	var invalid *InvalidKeyError
+	var denied *PolicyDeniedError
+	switch {
+	case errors.Is(err, ErrTicketNotFound):
+		return http.StatusGone
+	case errors.Is(err, ErrTicketMismatch):
+		return http.StatusConflict
+	case errors.Is(err, ErrApprovalRequired):
+		return http.StatusForbidden
+	case errors.Is(err, ErrTooManyTickets):
+		return http.StatusTooManyRequests
+	case errors.As(err, &notFound):
+		return http.StatusNotFound
+	case errors.As(err, &invalid):
+		return http.StatusBadRequest
+	case errors.As(err, &denied):
+		return http.StatusForbidden
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+// ClientAddress returns the IP address of the client, without port.
+func ClientAddress(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// statusWriter remembers the response status code, the recovery policy rule which decided the request,
+// and the approval ticket issued for it.
+type statusWriter struct {
+	http.ResponseWriter
+	status       int
+	policyRule   string
+	policyAction string
+	ticket       string
+}
+
+func (t *statusWriter) WriteHeader(status int) {
+	t.status = status
+	t.ResponseWriter.WriteHeader(status)
+}
@@ -0,0 +1,80 @@
+package server
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/go-jose/go-jose/v4"
+	"github.com/stretchr/testify/require"
+
+	. "go-citrus/internal"
+)
+
+func newTestHandler(t *testing.T) *Handler {
+	protocol, err := NewProtocol(NewMemoryKeyStore(KeyList{ExchangeKey1, SigningKey1}))
+	require.NoError(t, err)
+	return NewHandler(protocol)
+}
+
+func recoveryRequest(t *testing.T) []byte {
+	x, err := GenerateExchangeKey()
+	require.NoError(t, err)
+	public := x.Public()
+	body, err := public.MarshalJSON()
+	require.NoError(t, err)
+	return body
+}
+
+func TestHandler_Advertisement(t *testing.T) {
+	handler := newTestHandler(t)
+
+	for _, path := range []string{"/adv", "/adv/", "/adv/" + SigningKey1Thp} {
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path, nil))
+		require.Equal(t, http.StatusOK, rec.Code, path)
+		require.Equal(t, advertisementContentType, rec.Header().Get("Content-Type"))
+
+		_, err := ParseAdvertisement(rec.Body.Bytes(), []jose.SignatureAlgorithm{DefaultSignatureAlgorithm})
+		require.NoError(t, err)
+	}
+
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/adv/"+ExchangeKey2Thp, nil))
+	require.Equal(t, http.StatusNotFound, rec.Code)
+}
+
+func TestHandler_Recovery(t *testing.T) {
+	handler := newTestHandler(t)
+
+	t.Run("recover with an exchange key", func(t *testing.T) {
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/rec/"+ExchangeKey1Thp, bytes.NewReader(recoveryRequest(t))))
+		require.Equal(t, http.StatusOK, rec.Code)
+		require.Equal(t, recoveryContentType, rec.Header().Get("Content-Type"))
+
+		var y jose.JSONWebKey
+		require.NoError(t, y.UnmarshalJSON(rec.Body.Bytes()))
+		require.True(t, IsExchangeKey(y))
+		require.True(t, y.IsPublic())
+	})
+
+	t.Run("unknown exchange key", func(t *testing.T) {
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/rec/"+ExchangeKey2Thp, bytes.NewReader(recoveryRequest(t))))
+		require.Equal(t, http.StatusNotFound, rec.Code)
+	})
+
+	t.Run("invalid recovery request", func(t *testing.T) {
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/rec/"+ExchangeKey1Thp, bytes.NewReader([]byte("{}"))))
+		require.Equal(t, http.StatusBadRequest, rec.Code)
+	})
+
+	t.Run("recovery requires POST", func(t *testing.T) {
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/rec/"+ExchangeKey1Thp, nil))
+		require.Equal(t, http.StatusMethodNotAllowed, rec.Code)
+	})
+}
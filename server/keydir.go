@@ -0,0 +1,193 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/go-jose/go-jose/v4"
+
+	. "go-citrus/internal"
+)
+
+/*
+Server key directory, laid out the same way as tangd's `/var/db/tang`:
+one key per file, named by its SHA-256 thumbprint.
+  - <thp>.jwk - plain private JWK
+  - <thp>.jwe - private JWK wrapped with a passphrase (see internal.WrapKey)
+
+Rotated keys are hidden files (.<thp>.jwk, .<thp>.jwe): no longer advertised, but still used for recovery.
+*/
+const (
+	plainKeyExt   = ".jwk"
+	wrappedKeyExt = ".jwe"
+)
+
+// PBES2 iteration count used when wrapping keys, zero picks the go-jose default.
+var keyWrapIterations = 0
+
+// LoadKeys reads every advertised key file from dir. Wrapped keys are decrypted in memory only,
+// which requires a passphrase source.
+func LoadKeys(dir string, passphrase PassphraseFn) (KeyList, error) {
+	return loadKeys(dir, passphrase, false)
+}
+
+// LoadRotatedKeys reads every rotated key file from dir, see LoadKeys.
+func LoadRotatedKeys(dir string, passphrase PassphraseFn) (KeyList, error) {
+	return loadKeys(dir, passphrase, true)
+}
+
+func loadKeys(dir string, passphrase PassphraseFn, rotated bool) (KeyList, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var secret []byte
+	defer func() { clear(secret) }()
+
+	var keys KeyList
+	for _, entry := range entries {
+		name := entry.Name()
+		ext := filepath.Ext(name)
+		if entry.IsDir() || strings.HasPrefix(name, ".") != rotated || (ext != plainKeyExt && ext != wrappedKeyExt) {
+			continue
+		}
+
+		data, err := os.ReadFile(filepath.Join(dir, name))
+		if err != nil {
+			return nil, err
+		}
+
+		var key jose.JSONWebKey
+		if IsWrappedKey(data) {
+			if secret == nil {
+				if passphrase == nil {
+					return nil, fmt.Errorf("key file '%s' is encrypted but no passphrase was provided", name)
+				}
+				if secret, err = passphrase(); err != nil {
+					return nil, err
+				}
+			}
+			key, err = UnwrapKey(data, secret)
+		} else {
+			err = key.UnmarshalJSON(data)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("unable to load key file '%s': %w", name, err)
+		}
+		keys = append(keys, key)
+	}
+	return keys, nil
+}
+
+// WriteKey stores key into dir and returns the written file path.
+// When a passphrase source is given, only the wrapped form of the key reaches the disk.
+func WriteKey(dir string, key jose.JSONWebKey, passphrase PassphraseFn) (string, error) {
+	name, err := KeyThumbprint(key)
+	if err != nil {
+		return "", err
+	}
+
+	var data []byte
+	if passphrase != nil {
+		secret, err := passphrase()
+		if err != nil {
+			return "", err
+		}
+		data, err = WrapKey(key, secret, keyWrapIterations)
+		clear(secret)
+		if err != nil {
+			return "", err
+		}
+		name += wrappedKeyExt
+	} else {
+		if data, err = key.MarshalJSON(); err != nil {
+			return "", err
+		}
+		name += plainKeyExt
+	}
+
+	path := filepath.Join(dir, name)
+	return path, writeFileAtomic(path, data)
+}
+
+// RotateKey hides the key with the given SHA-256 thumbprint from the advertisement.
+func RotateKey(dir string, thumbprint string) error {
+	for _, ext := range []string{plainKeyExt, wrappedKeyExt} {
+		err := os.Rename(filepath.Join(dir, thumbprint+ext), filepath.Join(dir, "."+thumbprint+ext))
+		if !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+	}
+	return fmt.Errorf("advertised key file for thumbprint '%s' not found", thumbprint)
+}
+
+// RetireKey deletes the key with the given SHA-256 thumbprint, advertised or rotated, along with its metadata.
+func RetireKey(dir string, thumbprint string) error {
+	found := false
+	for _, name := range []string{
+		thumbprint + plainKeyExt, thumbprint + wrappedKeyExt,
+		"." + thumbprint + plainKeyExt, "." + thumbprint + wrappedKeyExt,
+	} {
+		err := os.Remove(filepath.Join(dir, name))
+		if err == nil {
+			found = true
+		} else if !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+	}
+	if !found {
+		return fmt.Errorf("key file for thumbprint '%s' not found", thumbprint)
+	}
+	err := os.Remove(filepath.Join(dir, thumbprint+metadataExt))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	return err
+}
+
+// moveFiles moves the files of staging into dir, replacing the files of the same name, and returns the moved names.
+// Both directories must be on the same file system, e.g. staging being a subdirectory of dir.
+func moveFiles(staging string, dir string) ([]string, error) {
+	entries, err := os.ReadDir(staging)
+	if err != nil {
+		return nil, err
+	}
+	var moved []string
+	for _, entry := range entries {
+		if entry.IsDir() {
+			continue
+		}
+		if err = os.Rename(filepath.Join(staging, entry.Name()), filepath.Join(dir, entry.Name())); err != nil {
+			return moved, err
+		}
+		moved = append(moved, entry.Name())
+	}
+	return moved, nil
+}
+
+// writeFileAtomic writes to a temporary sibling file first, so readers never observe a partial key.
+func writeFileAtomic(path string, data []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".tmp-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err = tmp.Write(data); err != nil {
+		_ = tmp.Close()
+		return err
+	}
+	if err = tmp.Chmod(0o600); err != nil {
+		_ = tmp.Close()
+		return err
+	}
+	if err = tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
@@ -0,0 +1,107 @@
+package server
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/go-jose/go-jose/v4"
+	"github.com/stretchr/testify/require"
+
+	. "go-citrus/internal"
+)
+
+func TestKeyDir(t *testing.T) {
+	keyWrapIterations = 1000
+	t.Cleanup(func() { keyWrapIterations = 0 })
+
+	passphrase := func() ([]byte, error) { return []byte("secret"), nil }
+
+	t.Run("load plain and wrapped keys", func(t *testing.T) {
+		dir := t.TempDir()
+		plain, err := WriteKey(dir, ExchangeKey1, nil)
+		require.NoError(t, err)
+		require.Equal(t, filepath.Join(dir, ExchangeKey1Thp+".jwk"), plain)
+
+		wrapped, err := WriteKey(dir, SigningKey1, passphrase)
+		require.NoError(t, err)
+		require.Equal(t, filepath.Join(dir, SigningKey1Thp+".jwe"), wrapped)
+
+		data, err := os.ReadFile(wrapped)
+		require.NoError(t, err)
+		require.True(t, IsWrappedKey(data))
+
+		keys, err := LoadKeys(dir, passphrase)
+		require.NoError(t, err)
+		require.Len(t, keys, 2)
+
+		server, err := NewProtocolFromDir(dir, passphrase)
+		require.NoError(t, err)
+		require.NotEmpty(t, server.GetAdvertisement(SigningKey1Thp))
+	})
+
+	t.Run("load freshly generated keys", func(t *testing.T) {
+		dir := t.TempDir()
+		exchange, err := GenerateExchangeKey()
+		require.NoError(t, err)
+		signing, err := GenerateSigningKey()
+		require.NoError(t, err)
+		for _, key := range []jose.JSONWebKey{exchange, signing} {
+			_, err = WriteKey(dir, key, passphrase)
+			require.NoError(t, err)
+		}
+
+		_, err = NewProtocolFromDir(dir, passphrase)
+		require.NoError(t, err)
+	})
+
+	t.Run("wrapped key without passphrase", func(t *testing.T) {
+		dir := t.TempDir()
+		_, err := WriteKey(dir, ExchangeKey1, passphrase)
+		require.NoError(t, err)
+
+		_, err = LoadKeys(dir, nil)
+		require.Error(t, err)
+	})
+
+	t.Run("hidden and unrelated files are ignored", func(t *testing.T) {
+		dir := t.TempDir()
+		require.NoError(t, os.WriteFile(filepath.Join(dir, "README"), []byte("not a key"), 0o600))
+		require.NoError(t, os.WriteFile(filepath.Join(dir, ".tmp-123"), []byte("{"), 0o600))
+
+		keys, err := LoadKeys(dir, nil)
+		require.NoError(t, err)
+		require.Empty(t, keys)
+	})
+}
+
+func TestPassphraseSources(t *testing.T) {
+	t.Run("from file", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "passphrase")
+		require.NoError(t, os.WriteFile(path, []byte("secret\n"), 0o600))
+
+		secret, err := PassphraseFromFile(path)()
+		require.NoError(t, err)
+		require.Equal(t, []byte("secret"), secret)
+	})
+
+	t.Run("from environment", func(t *testing.T) {
+		t.Setenv("CITRUS_TEST_PASSPHRASE", "secret")
+		secret, err := PassphraseFromEnv("CITRUS_TEST_PASSPHRASE")()
+		require.NoError(t, err)
+		require.Equal(t, []byte("secret"), secret)
+
+		_, err = PassphraseFromEnv("CITRUS_TEST_PASSPHRASE_UNSET")()
+		require.Error(t, err)
+	})
+
+	t.Run("from systemd credential", func(t *testing.T) {
+		dir := t.TempDir()
+		require.NoError(t, os.WriteFile(filepath.Join(dir, "citrus.passphrase"), []byte("secret"), 0o600))
+		t.Setenv("CREDENTIALS_DIRECTORY", dir)
+
+		secret, err := PassphraseFromCredential("citrus.passphrase")()
+		require.NoError(t, err)
+		require.Equal(t, []byte("secret"), secret)
+	})
+}
@@ -0,0 +1,81 @@
+package server
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"log/slog"
+	"math/big"
+	"math/bits"
+	"sync"
+
+	"github.com/go-jose/go-jose/v4"
+
+	. "go-citrus/internal"
+)
+
+// Locked words holding an Ed25519 private key.
+const ed25519Words = ed25519.PrivateKeySize / (bits.UintSize / 8)
+
+// Warn only once when the private keys cannot be locked in memory, e.g. because of RLIMIT_MEMLOCK.
+var lockWarning sync.Once
+
+// lockKeys copies keys, moving the private scalars of the copies into locked memory (see LockedWords).
+// Ed25519 private keys, which are byte slices, are moved there as well.
+// When memory cannot be locked, the copies stay on the heap and nil is returned.
+func lockKeys(keys KeyList) (KeyList, *LockedWords) {
+	size := 0
+	for _, key := range keys {
+		switch private := key.Key.(type) {
+		case *ecdsa.PrivateKey:
+			if private.D != nil {
+				size += len(private.D.Bits())
+			}
+		case ed25519.PrivateKey:
+			size += ed25519Words
+		}
+	}
+
+	var words []big.Word
+	locked, err := LockWords(size)
+	if err != nil {
+		lockWarning.Do(func() {
+			slog.Warn("unable to lock private keys in memory, they may be swapped to disk", "error", err)
+		})
+		words = make([]big.Word, size)
+	} else {
+		words = locked.Words()
+	}
+
+	copies := make(KeyList, 0, len(keys))
+	for _, key := range keys {
+		if private, ok := key.Key.(ed25519.PrivateKey); ok {
+			data := WordBytes(words[:ed25519Words:ed25519Words])
+			words = words[ed25519Words:]
+			key.Key = ed25519.PrivateKey(data[:copy(data, private)])
+			copies = append(copies, key)
+			continue
+		}
+		private, ok := key.Key.(*ecdsa.PrivateKey)
+		if !ok || private.D == nil {
+			copies = append(copies, key)
+			continue
+		}
+		bits := private.D.Bits()
+		scalar := words[:len(bits):len(bits)]
+		words = words[len(bits):]
+		copy(scalar, bits)
+
+		key.Key = &ecdsa.PrivateKey{PublicKey: private.PublicKey, D: new(big.Int).SetBits(scalar)}
+		copies = append(copies, key)
+	}
+	return copies, locked
+}
+
+func wipeKey(key jose.JSONWebKey) {
+	switch private := key.Key.(type) {
+	case *ecdsa.PrivateKey:
+		WipeBigInt(private.D)
+	case ed25519.PrivateKey:
+		WipeBytes(private)
+	}
+}
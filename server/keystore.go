@@ -0,0 +1,394 @@
+package server
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"errors"
+	"log/slog"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/go-jose/go-jose/v4"
+
+	. "go-citrus/internal"
+)
+
+/*
+KeyStore holds the server private keys and performs every private key operation itself,
+so that a backend (e.g. an HSM or a remote signer) never has to hand out 'S'.
+*/
+type KeyStore interface {
+	// PublicKeys lists the public portion of every advertised key.
+	PublicKeys() (KeyList, error)
+	// ECMRMultiply computes the server half of the recovery y = point * S, 'S' being the exchange key identified by thumbprint.
+	ECMRMultiply(thumbprint string, point *ecdsa.PublicKey) (*ecdsa.PublicKey, error)
+	// Sign returns payload signed by every advertised signing key, in JWS JSON serialization.
+	// The content type tells advertisements (AdvertisementContentType) apart from other signed server documents.
+	Sign(payload []byte, contentType jose.ContentType) ([]byte, error)
+}
+
+// Key states, as reported by KeyStateCounter.
+const (
+	KeyStateActive  = "active"  // advertised
+	KeyStateExpired = "expired" // past its metadata NotAfter, no longer advertised
+	KeyStateRotated = "rotated" // kept for recovery only
+)
+
+// KeyStateCounter is implemented by key stores able to tell how many keys they hold in each state.
+type KeyStateCounter interface {
+	KeyStates() map[string]int
+}
+
+// ExchangeKeyDescriber is implemented by key stores able to describe their exchange keys, e.g. to the recovery policy.
+type ExchangeKeyDescriber interface {
+	DescribeExchangeKey(thumbprint string) (ExchangeKeyDescription, bool)
+}
+
+type ExchangeKeyDescription struct {
+	Thumbprints []string          // every thumbprint of the key, any thumbprint algorithm
+	Labels      map[string]string // metadata labels
+	Approvals   int               // operator approvals required by each recovery, see ApprovalQueue
+	Curve       elliptic.Curve    // curve of the key, recovery requests must be points of it
+}
+
+// KeyExpirer is implemented by key stores hiding expired keys from the advertisement, see KeyMetadata.NotAfter.
+// Protocol rebuilds its advertisements once the next expiry changed, i.e. once an advertised key expired.
+type KeyExpirer interface {
+	// NextExpiry returns when the next advertised key expires, the zero time when none does.
+	NextExpiry() time.Time
+}
+
+// Wiper is implemented by key stores able to erase their private key material, e.g. on shutdown.
+// A wiped key store refuses every private key operation.
+type Wiper interface {
+	Wipe()
+}
+
+var ErrKeysWiped = errors.New("server keys were wiped")
+
+/*
+MemoryKeyStore keeps plain private JWKs in process memory.
+It works on its own copies of the private keys, kept in locked memory on Linux (see lockKeys),
+and zeroed by Wipe.
+*/
+type MemoryKeyStore struct {
+	keys     KeyList
+	rotated  int
+	metadata Metadata
+	now      func() time.Time
+	exchange map[string]jose.JSONWebKey // exchange key thumbprint -> server key
+	expiries []time.Time                // NotAfter of the advertised keys, sorted
+	locked   *LockedWords               // private scalars memory, nil when not locked
+
+	mu    sync.RWMutex // held for reading during private key operations
+	wiped bool
+}
+
+func NewMemoryKeyStore(keys KeyList) *MemoryKeyStore {
+	return newMemoryKeyStore(keys, nil, nil, time.Now)
+}
+
+// newMemoryKeyStore keeps rotated keys for recovery only, assigns the key IDs from metadata,
+// and hides expired keys from the advertisement.
+func newMemoryKeyStore(keys KeyList, rotated KeyList, metadata Metadata, now func() time.Time) *MemoryKeyStore {
+	all, locked := lockKeys(append(keys[:len(keys):len(keys)], rotated...))
+	store := MemoryKeyStore{
+		rotated:  len(rotated),
+		metadata: metadata,
+		now:      now,
+		exchange: make(map[string]jose.JSONWebKey),
+		locked:   locked,
+	}
+	for i, key := range all {
+		if metadata != nil && key.KeyID == "" {
+			if thp, err := KeyThumbprint(key); err == nil {
+				key.KeyID = metadata.Get(thp).KeyID
+			}
+		}
+		if i < len(keys) {
+			store.keys = append(store.keys, key)
+			if thp, err := KeyThumbprint(key); err == nil && metadata != nil {
+				if notAfter := metadata.Get(thp).NotAfter; notAfter != nil {
+					store.expiries = append(store.expiries, *notAfter)
+				}
+			}
+		}
+
+		if !IsExchangeKey(key) {
+			continue
+		}
+		thumbs, err := Thumbprints(key)
+		if err != nil {
+			// Not advertisable either, NewAdvertisement reports it.
+			continue
+		}
+		for _, thumb := range thumbs {
+			store.exchange[thumb] = key
+		}
+	}
+	slices.SortFunc(store.expiries, time.Time.Compare)
+	return &store
+}
+
+// NextExpiry returns the first NotAfter of the advertised keys still to come.
+func (t *MemoryKeyStore) NextExpiry() time.Time {
+	now := t.now()
+	for _, expiry := range t.expiries {
+		if now.Before(expiry) {
+			return expiry
+		}
+	}
+	return time.Time{}
+}
+
+// advertised returns the keys which did not expire yet.
+func (t *MemoryKeyStore) advertised() KeyList {
+	if t.metadata == nil {
+		return t.keys
+	}
+	now := t.now()
+	var result KeyList
+	for _, key := range t.keys {
+		thp, err := KeyThumbprint(key)
+		if err == nil && t.metadata.Get(thp).Expired(now) {
+			continue
+		}
+		result = append(result, key)
+	}
+	return result
+}
+
+func (t *MemoryKeyStore) PublicKeys() (KeyList, error) {
+	// Ed25519 public keys are read from the private key memory, which Wipe replaces.
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	return t.advertised().PublicKeys(), nil
+}
+
+func (t *MemoryKeyStore) KeyStates() map[string]int {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	active := len(t.advertised())
+	return map[string]int{
+		KeyStateActive:  active,
+		KeyStateExpired: len(t.keys) - active,
+		KeyStateRotated: t.rotated,
+	}
+}
+
+func (t *MemoryKeyStore) DescribeExchangeKey(thumbprint string) (ExchangeKeyDescription, bool) {
+	key, ok := t.exchange[thumbprint]
+	if !ok {
+		return ExchangeKeyDescription{}, false
+	}
+	thumbs, err := Thumbprints(key)
+	if err != nil {
+		return ExchangeKeyDescription{}, false
+	}
+	description := ExchangeKeyDescription{Thumbprints: thumbs}
+	if private, ok := key.Key.(*ecdsa.PrivateKey); ok {
+		description.Curve = private.Curve
+	}
+	if thp, err := KeyThumbprint(key); err == nil && t.metadata != nil {
+		meta := t.metadata.Get(thp)
+		description.Labels, description.Approvals = meta.Labels, meta.Approvals
+	}
+	return description, true
+}
+
+func (t *MemoryKeyStore) ECMRMultiply(thumbprint string, point *ecdsa.PublicKey) (*ecdsa.PublicKey, error) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	if t.wiped {
+		return nil, ErrKeysWiped
+	}
+
+	jwkS, ok := t.exchange[thumbprint]
+	if !ok {
+		return nil, NewKeyNotFoundError("server key (thumbprint='%s') not found", thumbprint)
+	}
+	S, ok := jwkS.Key.(*ecdsa.PrivateKey)
+	if !ok {
+		return nil, NewInvalidKeyError("failed to read private key from server (thumbprint='%s')", thumbprint)
+	}
+	if !S.Curve.IsOnCurve(point.X, point.Y) {
+		return nil, NewInvalidKeyError("recovery request key is not on the same EC curve point with server private key")
+	}
+
+	ec := NewECAlgorithm(S.Curve)
+	return ec.Multiply(point, S), nil
+}
+
+func (t *MemoryKeyStore) Sign(payload []byte, contentType jose.ContentType) ([]byte, error) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	if t.wiped {
+		return nil, ErrKeysWiped
+	}
+
+	var signing KeyList
+	for _, key := range t.advertised() {
+		if !IsSigningKey(key) {
+			continue
+		}
+		// crypto/ed25519 caches by key address, which must be Go memory: sign with a transient copy of locked keys.
+		if private, ok := key.Key.(ed25519.PrivateKey); ok {
+			key.Key = slices.Clone(private)
+		}
+		signing = append(signing, key)
+	}
+	signed, err := SignPayload(payload, contentType, signing)
+	for _, key := range signing {
+		if private, ok := key.Key.(ed25519.PrivateKey); ok {
+			WipeBytes(private)
+		}
+	}
+	return signed, err
+}
+
+// Wipe zeroes the private keys of the store, once the private key operations in progress are done.
+func (t *MemoryKeyStore) Wipe() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.wiped {
+		return
+	}
+	for i, key := range t.keys {
+		// The locked memory is released below, Ed25519 keys keep their public half only.
+		if private, ok := key.Key.(ed25519.PrivateKey); ok {
+			t.keys[i].Key = slices.Clone(private.Public().(ed25519.PublicKey))
+		}
+		wipeKey(key)
+	}
+	// Rotated keys are only referenced from the exchange map.
+	for _, key := range t.exchange {
+		wipeKey(key)
+	}
+	if t.locked != nil {
+		if err := t.locked.Free(); err != nil {
+			slog.Warn("unable to release locked key memory", "error", err)
+		}
+	}
+	t.wiped = true
+}
+
+// FileKeyStore serves the keys of a server key directory (see LoadKeys and LoadMetadata) from memory,
+// and can re-read it on demand.
+type FileKeyStore struct {
+	swappableKeyStore
+	dir        string
+	passphrase PassphraseFn
+	now        func() time.Time
+}
+
+func NewFileKeyStore(dir string, passphrase PassphraseFn) (*FileKeyStore, error) {
+	// A replication interrupted by a stop is completed first, see Rotator.replicate.
+	if err := finishReplication(dir); err != nil {
+		return nil, err
+	}
+	store := FileKeyStore{
+		dir:        dir,
+		passphrase: passphrase,
+		now:        time.Now,
+	}
+	if err := store.Reload(); err != nil {
+		return nil, err
+	}
+	return &store, nil
+}
+
+// Reload re-reads the key directory, replacing the served keys only once all of them loaded.
+func (t *FileKeyStore) Reload() error {
+	memory, err := loadKeyDir(t.dir, t.passphrase, func() time.Time { return t.now() })
+	if err != nil {
+		return err
+	}
+	t.swap(memory)
+	return nil
+}
+
+// LoadKeyStore reads the keys and metadata of a server key directory into a MemoryKeyStore, leaving the directory
+// untouched: unlike NewFileKeyStore, a pending replication is not applied (see PendingReplication).
+func LoadKeyStore(dir string, passphrase PassphraseFn) (*MemoryKeyStore, error) {
+	return loadKeyDir(dir, passphrase, time.Now)
+}
+
+func loadKeyDir(dir string, passphrase PassphraseFn, now func() time.Time) (*MemoryKeyStore, error) {
+	keys, err := LoadKeys(dir, passphrase)
+	if err != nil {
+		return nil, err
+	}
+	rotated, err := LoadRotatedKeys(dir, passphrase)
+	if err != nil {
+		return nil, err
+	}
+	metadata, err := LoadMetadata(dir)
+	if err != nil {
+		return nil, err
+	}
+	memory := newMemoryKeyStore(keys, rotated, metadata, now)
+	// The store made its own copies, the decrypted keys are not needed anymore.
+	for _, key := range append(keys, rotated...) {
+		wipeKey(key)
+	}
+	return memory, nil
+}
+
+// swappableKeyStore serves a MemoryKeyStore which reloading key stores replace as a whole, see swap.
+type swappableKeyStore struct {
+	mu     sync.RWMutex
+	memory *MemoryKeyStore
+}
+
+// swap starts serving memory, and wipes the previously served keys.
+func (t *swappableKeyStore) swap(memory *MemoryKeyStore) {
+	// Private key operations hold the read lock, the previous keys are not used anymore once the lock is acquired.
+	t.mu.Lock()
+	previous := t.memory
+	t.memory = memory
+	t.mu.Unlock()
+	if previous != nil {
+		previous.Wipe()
+	}
+}
+
+func (t *swappableKeyStore) current() *MemoryKeyStore {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	return t.memory
+}
+
+func (t *swappableKeyStore) PublicKeys() (KeyList, error) {
+	return t.current().PublicKeys()
+}
+
+func (t *swappableKeyStore) KeyStates() map[string]int {
+	return t.current().KeyStates()
+}
+
+func (t *swappableKeyStore) NextExpiry() time.Time {
+	return t.current().NextExpiry()
+}
+
+func (t *swappableKeyStore) Wipe() {
+	t.current().Wipe()
+}
+
+func (t *swappableKeyStore) DescribeExchangeKey(thumbprint string) (ExchangeKeyDescription, bool) {
+	return t.current().DescribeExchangeKey(thumbprint)
+}
+
+func (t *swappableKeyStore) ECMRMultiply(thumbprint string, point *ecdsa.PublicKey) (*ecdsa.PublicKey, error) {
+	// Private key operations keep the read lock, so that swap does not wipe their keys under them.
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	return t.memory.ECMRMultiply(thumbprint, point)
+}
+
+func (t *swappableKeyStore) Sign(payload []byte, contentType jose.ContentType) ([]byte, error) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	return t.memory.Sign(payload, contentType)
+}
@@ -0,0 +1,137 @@
+package server
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"slices"
+	"testing"
+	"unsafe"
+
+	"github.com/go-jose/go-jose/v4"
+	"github.com/stretchr/testify/require"
+
+	. "go-citrus/internal"
+)
+
+func TestMemoryKeyStore(t *testing.T) {
+	store := NewMemoryKeyStore(KeyList{ExchangeKey1, SigningKey1})
+
+	t.Run("list public keys", func(t *testing.T) {
+		keys, err := store.PublicKeys()
+		require.NoError(t, err)
+		require.Len(t, keys, 2)
+		ensurePublic(t, keys...)
+	})
+
+	t.Run("sign an advertisement payload", func(t *testing.T) {
+		keys, err := store.PublicKeys()
+		require.NoError(t, err)
+		adv, err := NewAdvertisement(keys...)
+		require.NoError(t, err)
+		payload, err := adv.Payload()
+		require.NoError(t, err)
+
+		signed, err := store.Sign(payload, AdvertisementContentType)
+		require.NoError(t, err)
+		_, err = ParseAdvertisement(signed, []jose.SignatureAlgorithm{DefaultSignatureAlgorithm})
+		require.NoError(t, err)
+	})
+
+	t.Run("multiply with an exchange key", func(t *testing.T) {
+		x, err := GenerateExchangeKey()
+		require.NoError(t, err)
+		point := publicPoint(t, x)
+
+		y, err := store.ECMRMultiply(ExchangeKey1Thp, point)
+		require.NoError(t, err)
+		require.True(t, y.Curve.IsOnCurve(y.X, y.Y))
+	})
+
+	t.Run("multiply with an unknown or signing key", func(t *testing.T) {
+		x, err := GenerateExchangeKey()
+		require.NoError(t, err)
+		point := publicPoint(t, x)
+
+		_, err = store.ECMRMultiply(ExchangeKey2Thp, point)
+		require.Error(t, err)
+		_, err = store.ECMRMultiply(SigningKey1Thp, point)
+		require.Error(t, err)
+	})
+}
+
+func TestMemoryKeyStore_EdDSA(t *testing.T) {
+	eddsa, err := GenerateSigningKeyWith(jose.EdDSA)
+	require.NoError(t, err)
+	original := slices.Clone(eddsa.Key.(ed25519.PrivateKey))
+	store := NewMemoryKeyStore(KeyList{ExchangeKey1, eddsa})
+
+	private, ok := store.keys[1].Key.(ed25519.PrivateKey)
+	require.True(t, ok)
+	require.Equal(t, original, private)
+	if store.locked != nil {
+		mem := WordBytes(store.locked.Words())
+		start := uintptr(unsafe.Pointer(unsafe.SliceData(mem)))
+		key := uintptr(unsafe.Pointer(unsafe.SliceData(private)))
+		require.True(t, key >= start && key+uintptr(len(private)) <= start+uintptr(len(mem)), "key kept in locked memory")
+	}
+
+	// The store works on its own copy of the key.
+	wipeKey(eddsa)
+	keys, err := store.PublicKeys()
+	require.NoError(t, err)
+	ensurePublic(t, keys...)
+	adv, err := NewAdvertisement(keys...)
+	require.NoError(t, err)
+	payload, err := adv.Payload()
+	require.NoError(t, err)
+	signed, err := store.Sign(payload, AdvertisementContentType)
+	require.NoError(t, err)
+	_, err = ParseAdvertisement(signed, []jose.SignatureAlgorithm{jose.EdDSA})
+	require.NoError(t, err)
+
+	store.Wipe()
+	wiped, err := store.PublicKeys()
+	require.NoError(t, err)
+	require.Equal(t, keys, wiped, "public keys outlive the private key memory")
+}
+
+func TestFileKeyStore(t *testing.T) {
+	dir := t.TempDir()
+	_, err := WriteKey(dir, ExchangeKey1, nil)
+	require.NoError(t, err)
+	_, err = WriteKey(dir, SigningKey1, nil)
+	require.NoError(t, err)
+
+	store, err := NewFileKeyStore(dir, nil)
+	require.NoError(t, err)
+	keys, err := store.PublicKeys()
+	require.NoError(t, err)
+	require.Len(t, keys, 2)
+
+	t.Run("reload picks up new keys", func(t *testing.T) {
+		_, err = WriteKey(dir, ExchangeKey2, nil)
+		require.NoError(t, err)
+		require.NoError(t, store.Reload())
+
+		x, err := GenerateExchangeKey()
+		require.NoError(t, err)
+		_, err = store.ECMRMultiply(ExchangeKey2Thp, publicPoint(t, x))
+		require.NoError(t, err)
+	})
+
+	t.Run("reload wipes the previous keys", func(t *testing.T) {
+		previous := store.current()
+		require.NoError(t, store.Reload())
+
+		_, err = previous.Sign([]byte("payload"), AdvertisementContentType)
+		require.ErrorIs(t, err, ErrKeysWiped)
+		_, err = store.Sign([]byte("payload"), AdvertisementContentType)
+		require.NoError(t, err)
+	})
+}
+
+func publicPoint(t *testing.T, key jose.JSONWebKey) *ecdsa.PublicKey {
+	point, ok := key.Public().Key.(*ecdsa.PublicKey)
+	require.True(t, ok)
+	return point
+}
@@ -0,0 +1,170 @@
+package server
+
+import (
+	"crypto"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/go-jose/go-jose/v4"
+)
+
+/*
+Key metadata, stored next to each key in the key directory as <thp>.meta.json.
+Keys without a sidecar file (e.g. copied over from tangd) get default metadata, their key ID being the thumbprint itself.
+*/
+const metadataExt = ".meta.json"
+
+type KeyMetadata struct {
+	KeyID     string            `json:"kid"`
+	CreatedAt time.Time         `json:"created_at"`
+	NotAfter  *time.Time        `json:"not_after,omitempty"`
+	RotatedAt *time.Time        `json:"rotated_at,omitempty"`
+	Labels    map[string]string `json:"labels,omitempty"`
+	Approvals int               `json:"approvals,omitempty"` // operator approvals required by each recovery, exchange keys only
+}
+
+// Metadata lookup map - SHA-256 key thumbprint -> key metadata
+type Metadata map[string]KeyMetadata
+
+// NewKeyMetadata creates the metadata of a new key, keeping its "kid" when it has one.
+func NewKeyMetadata(key jose.JSONWebKey, createdAt time.Time) (KeyMetadata, error) {
+	thp, err := KeyThumbprint(key)
+	if err != nil {
+		return KeyMetadata{}, err
+	}
+	kid := key.KeyID
+	if kid == "" {
+		kid = thp
+	}
+	return KeyMetadata{
+		KeyID:     kid,
+		CreatedAt: createdAt.UTC().Truncate(time.Second),
+	}, nil
+}
+
+// Expired reports whether the key must not be advertised anymore.
+func (t KeyMetadata) Expired(now time.Time) bool {
+	return t.NotAfter != nil && !now.Before(*t.NotAfter)
+}
+
+// Get returns the metadata of the key with the given SHA-256 thumbprint, defaulting the key ID to the thumbprint.
+func (t Metadata) Get(thumbprint string) KeyMetadata {
+	meta, ok := t[thumbprint]
+	if !ok || meta.KeyID == "" {
+		meta.KeyID = thumbprint
+	}
+	return meta
+}
+
+// LoadMetadata reads every metadata sidecar file of a key directory.
+func LoadMetadata(dir string) (Metadata, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	result := make(Metadata)
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || !strings.HasSuffix(name, metadataExt) {
+			continue
+		}
+
+		data, err := os.ReadFile(filepath.Join(dir, name))
+		if err != nil {
+			return nil, err
+		}
+		var meta KeyMetadata
+		if err = json.Unmarshal(data, &meta); err != nil {
+			return nil, fmt.Errorf("unable to parse metadata file '%s': %w", name, err)
+		}
+		result[strings.TrimSuffix(name, metadataExt)] = meta
+	}
+	return result, nil
+}
+
+// WriteMetadata stores the metadata sidecar file of the key with the given SHA-256 thumbprint.
+func WriteMetadata(dir string, thumbprint string, meta KeyMetadata) error {
+	data, err := json.MarshalIndent(meta, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(filepath.Join(dir, thumbprint+metadataExt), data)
+}
+
+// KeyThumbprint returns the SHA-256 thumbprint naming a key within the key directory.
+func KeyThumbprint(key jose.JSONWebKey) (string, error) {
+	thp, err := key.Thumbprint(crypto.SHA256)
+	if err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(thp), nil
+}
+
+// KeyInfo describes a key of a key directory, without its private part.
+type KeyInfo struct {
+	Thumbprint string            `json:"thumbprint"`
+	KeyID      string            `json:"kid"`
+	Use        string            `json:"use"`
+	Algorithm  string            `json:"alg"`
+	State      string            `json:"state"` // KeyStateActive, KeyStateExpired or KeyStateRotated
+	CreatedAt  *time.Time        `json:"created_at,omitempty"`
+	NotAfter   *time.Time        `json:"not_after,omitempty"`
+	RotatedAt  *time.Time        `json:"rotated_at,omitempty"`
+	Labels     map[string]string `json:"labels,omitempty"`
+	Approvals  int               `json:"approvals,omitempty"`
+}
+
+// ListKeys describes every key of a key directory, advertised keys first. The private keys it decrypts are wiped on return.
+func ListKeys(dir string, passphrase PassphraseFn, now time.Time) ([]KeyInfo, error) {
+	keys, err := LoadKeys(dir, passphrase)
+	if err != nil {
+		return nil, err
+	}
+	defer wipeKeys(keys)
+	rotated, err := LoadRotatedKeys(dir, passphrase)
+	if err != nil {
+		return nil, err
+	}
+	defer wipeKeys(rotated)
+	metadata, err := LoadMetadata(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	infos := make([]KeyInfo, 0, len(keys)+len(rotated))
+	for i, key := range append(keys, rotated...) {
+		thp, err := KeyThumbprint(key)
+		if err != nil {
+			return nil, err
+		}
+		meta := metadata.Get(thp)
+
+		info := KeyInfo{
+			Thumbprint: thp,
+			KeyID:      meta.KeyID,
+			Use:        key.Use,
+			Algorithm:  key.Algorithm,
+			State:      KeyStateActive,
+			NotAfter:   meta.NotAfter,
+			RotatedAt:  meta.RotatedAt,
+			Labels:     meta.Labels,
+			Approvals:  meta.Approvals,
+		}
+		if !meta.CreatedAt.IsZero() {
+			info.CreatedAt = &meta.CreatedAt
+		}
+		if i >= len(keys) {
+			info.State = KeyStateRotated
+		} else if meta.Expired(now) {
+			info.State = KeyStateExpired
+		}
+		infos = append(infos, info)
+	}
+	return infos, nil
+}
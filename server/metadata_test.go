@@ -0,0 +1,131 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/go-jose/go-jose/v4"
+	"github.com/stretchr/testify/require"
+
+	. "go-citrus/internal"
+)
+
+func TestKeyMetadata(t *testing.T) {
+	now := time.Date(2025, time.January, 1, 0, 0, 0, 0, time.UTC)
+
+	t.Run("keep an existing key ID", func(t *testing.T) {
+		meta, err := NewKeyMetadata(ExchangeKey1, now)
+		require.NoError(t, err)
+		require.Equal(t, ExchangeKey1Id, meta.KeyID)
+		require.Equal(t, now, meta.CreatedAt)
+	})
+
+	t.Run("assign the thumbprint as key ID", func(t *testing.T) {
+		meta, err := NewKeyMetadata(SigningKey1, now)
+		require.NoError(t, err)
+		require.Equal(t, SigningKey1Thp, meta.KeyID)
+	})
+
+	t.Run("expiry", func(t *testing.T) {
+		meta := KeyMetadata{}
+		require.False(t, meta.Expired(now))
+
+		notAfter := now.Add(time.Hour)
+		meta.NotAfter = &notAfter
+		require.False(t, meta.Expired(now))
+		require.True(t, meta.Expired(notAfter))
+	})
+
+	t.Run("write and load metadata", func(t *testing.T) {
+		dir := t.TempDir()
+		meta, err := NewKeyMetadata(SigningKey1, now)
+		require.NoError(t, err)
+		meta.Labels = map[string]string{"env": "test"}
+		require.NoError(t, WriteMetadata(dir, SigningKey1Thp, meta))
+
+		// Sidecar files are not mistaken for keys
+		keys, err := LoadKeys(dir, nil)
+		require.NoError(t, err)
+		require.Empty(t, keys)
+
+		metadata, err := LoadMetadata(dir)
+		require.NoError(t, err)
+		require.Equal(t, meta, metadata.Get(SigningKey1Thp))
+		require.Equal(t, ExchangeKey1Thp, metadata.Get(ExchangeKey1Thp).KeyID)
+	})
+}
+
+func TestFileKeyStore_Metadata(t *testing.T) {
+	now := time.Date(2025, time.January, 1, 0, 0, 0, 0, time.UTC)
+	dir := t.TempDir()
+	for _, key := range []jose.JSONWebKey{ExchangeKey1, ExchangeKey2, SigningKey1} {
+		_, err := WriteKey(dir, key, nil)
+		require.NoError(t, err)
+	}
+
+	notAfter := now.Add(24 * time.Hour)
+	require.NoError(t, WriteMetadata(dir, ExchangeKey2Thp, KeyMetadata{KeyID: "exchange-2", CreatedAt: now, NotAfter: &notAfter}))
+	signingNotAfter := notAfter.Add(time.Hour)
+	require.NoError(t, WriteMetadata(dir, SigningKey1Thp, KeyMetadata{CreatedAt: now, NotAfter: &signingNotAfter}))
+
+	store, err := NewFileKeyStore(dir, nil)
+	require.NoError(t, err)
+	store.now = func() time.Time { return now }
+
+	t.Run("advertise keys with their key IDs", func(t *testing.T) {
+		server, err := NewProtocol(store)
+		require.NoError(t, err)
+		adv, err := ParseAdvertisement(server.GetAdvertisement(""), []jose.SignatureAlgorithm{DefaultSignatureAlgorithm})
+		require.NoError(t, err)
+		require.Len(t, adv.ExchangeKeys(), 2)
+		require.Equal(t, SigningKey1Thp, adv.SigningKeys()[0].KeyID)
+	})
+
+	t.Run("expired keys are not advertised", func(t *testing.T) {
+		store.now = func() time.Time { return notAfter }
+		server, err := NewProtocol(store)
+		require.NoError(t, err)
+		adv, err := ParseAdvertisement(server.GetAdvertisement(""), []jose.SignatureAlgorithm{DefaultSignatureAlgorithm})
+		require.NoError(t, err)
+		require.Len(t, adv.ExchangeKeys(), 1)
+		require.Equal(t, ExchangeKey1Id, adv.ExchangeKeys()[0].KeyID)
+
+		// but remain recoverable
+		x, err := GenerateExchangeKey()
+		require.NoError(t, err)
+		_, err = server.computeRecoverKey(ExchangeKey2Thp, x.Public())
+		require.NoError(t, err)
+	})
+
+	t.Run("keys expiring while served are not advertised anymore", func(t *testing.T) {
+		store.now = func() time.Time { return now }
+		server, err := NewProtocol(store)
+		require.NoError(t, err)
+		handler := NewHandler(server)
+		advertised := func() []jose.JSONWebKey {
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/adv", nil))
+			require.Equal(t, http.StatusOK, rec.Code)
+			adv, err := ParseAdvertisement(rec.Body.Bytes(), []jose.SignatureAlgorithm{DefaultSignatureAlgorithm})
+			require.NoError(t, err)
+			return adv.ExchangeKeys()
+		}
+		require.Len(t, advertised(), 2)
+
+		store.now = func() time.Time { return notAfter }
+		require.Len(t, advertised(), 1)
+		builds := server.AdvertisementBuilds()
+		require.Len(t, advertised(), 1)
+		require.Equal(t, builds, server.AdvertisementBuilds(), "rebuilt once per expiry")
+
+		// Without any signing key left, nothing is advertised.
+		store.now = func() time.Time { return signingNotAfter }
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/adv", nil))
+		require.Equal(t, http.StatusNotFound, rec.Code)
+		require.Nil(t, server.GetAdvertisement(SigningKey1Thp))
+		require.Error(t, server.Ready())
+	})
+}
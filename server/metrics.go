@@ -0,0 +1,202 @@
+package server
+
+import (
+	"bufio"
+	"cmp"
+	"fmt"
+	"io"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+/*
+Server metrics, served in the Prometheus text exposition format (version 0.0.4):
+  - citrus_http_requests_total{route, status}         - requests served
+  - citrus_recovery_duration_seconds                  - recovery latency histogram
+  - citrus_recoveries_total{thumbprint}               - successful recoveries per exchange key
+  - citrus_rate_limit_rejections_total{route, reason} - requests rejected by the rate limiter
+  - citrus_advertisement_builds_total                 - advertisement (re)builds
+  - citrus_keys{state}                                - keys per state, when the key store is a KeyStateCounter
+
+Only successful recoveries are counted per thumbprint, so clients cannot grow the label set with made-up thumbprints.
+*/
+const metricsContentType = "text/plain; version=0.0.4; charset=utf-8"
+
+// Reasons of a rate limiter rejection.
+const (
+	RejectRateLimit   = "rate_limit"  // client bucket empty
+	RejectConcurrency = "concurrency" // no recovery computation slot left
+)
+
+// Recovery latency histogram upper bounds, in seconds. A P-521 multiplication takes about a millisecond.
+var recoveryLatencyBuckets = []float64{0.0005, 0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1}
+
+type requestLabels struct {
+	route  string
+	status int
+}
+
+type rejectionLabels struct {
+	route  string
+	reason string
+}
+
+type histogram struct {
+	bounds []float64
+	counts []uint64 // per bound, not cumulative
+	sum    float64
+	count  uint64
+}
+
+func (t *histogram) observe(value float64) {
+	if i, _ := slices.BinarySearch(t.bounds, value); i < len(t.bounds) {
+		t.counts[i]++
+	}
+	t.sum += value
+	t.count++
+}
+
+type Metrics struct {
+	protocol *Protocol
+
+	mu         sync.Mutex
+	requests   map[requestLabels]uint64
+	recoveries map[string]uint64 // exchange key thumbprint -> successful recoveries
+	rejections map[rejectionLabels]uint64
+	latency    histogram
+}
+
+func NewMetrics(protocol *Protocol) *Metrics {
+	return &Metrics{
+		protocol:   protocol,
+		requests:   make(map[requestLabels]uint64),
+		recoveries: make(map[string]uint64),
+		rejections: make(map[rejectionLabels]uint64),
+		latency: histogram{
+			bounds: recoveryLatencyBuckets,
+			counts: make([]uint64, len(recoveryLatencyBuckets)),
+		},
+	}
+}
+
+// Observe counts a served request.
+func (t *Metrics) Observe(route string, status int, thumbprint string, latency time.Duration) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.requests[requestLabels{route, status}]++
+	if route != RouteRecovery {
+		return
+	}
+	t.latency.observe(latency.Seconds())
+	if status == http.StatusOK {
+		t.recoveries[thumbprint]++
+	}
+}
+
+// Reject counts a request turned down by the rate limiter.
+func (t *Metrics) Reject(route string, reason string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.rejections[rejectionLabels{route, reason}]++
+}
+
+func (t *Metrics) ServeHTTP(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Content-Type", metricsContentType)
+	_ = t.Expose(w)
+}
+
+// Expose writes every metric in the text exposition format, series sorted by labels.
+func (t *Metrics) Expose(w io.Writer) error {
+	b := bufio.NewWriter(w)
+
+	t.mu.Lock()
+	writeHeader(b, "citrus_http_requests_total", "counter", "Requests served, by route and status code.")
+	requests := sortedKeys(t.requests, func(a, b requestLabels) int {
+		return cmp.Or(strings.Compare(a.route, b.route), a.status-b.status)
+	})
+	for _, labels := range requests {
+		writeSample(b, "citrus_http_requests_total", t.requests[labels], "route", labels.route, "status", strconv.Itoa(labels.status))
+	}
+
+	writeHeader(b, "citrus_recovery_duration_seconds", "histogram", "Recovery request latency.")
+	var cumulative uint64
+	for i, bound := range t.latency.bounds {
+		cumulative += t.latency.counts[i]
+		writeSample(b, "citrus_recovery_duration_seconds_bucket", cumulative, "le", formatFloat(bound))
+	}
+	writeSample(b, "citrus_recovery_duration_seconds_bucket", t.latency.count, "le", "+Inf")
+	writeSample(b, "citrus_recovery_duration_seconds_sum", t.latency.sum)
+	writeSample(b, "citrus_recovery_duration_seconds_count", t.latency.count)
+
+	writeHeader(b, "citrus_recoveries_total", "counter", "Successful recoveries, by exchange key thumbprint.")
+	for _, thp := range sortedKeys(t.recoveries, strings.Compare) {
+		writeSample(b, "citrus_recoveries_total", t.recoveries[thp], "thumbprint", thp)
+	}
+
+	writeHeader(b, "citrus_rate_limit_rejections_total", "counter", "Requests rejected by the rate limiter, by route and reason.")
+	rejections := sortedKeys(t.rejections, func(a, b rejectionLabels) int {
+		return cmp.Or(strings.Compare(a.route, b.route), strings.Compare(a.reason, b.reason))
+	})
+	for _, labels := range rejections {
+		writeSample(b, "citrus_rate_limit_rejections_total", t.rejections[labels], "route", labels.route, "reason", labels.reason)
+	}
+	t.mu.Unlock()
+
+	writeHeader(b, "citrus_advertisement_builds_total", "counter", "Advertisement builds, reloads included.")
+	writeSample(b, "citrus_advertisement_builds_total", t.protocol.AdvertisementBuilds())
+
+	if counter, ok := t.protocol.store.(KeyStateCounter); ok {
+		writeHeader(b, "citrus_keys", "gauge", "Server keys, by state.")
+		states := counter.KeyStates()
+		for _, state := range sortedKeys(states, strings.Compare) {
+			writeSample(b, "citrus_keys", states[state], "state", state)
+		}
+	}
+	return b.Flush()
+}
+
+func writeHeader(w *bufio.Writer, name string, kind string, help string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+}
+
+// writeSample writes a single sample line, labels given as name, value pairs.
+func writeSample[V uint64 | int | float64](w *bufio.Writer, name string, value V, labels ...string) {
+	w.WriteString(name)
+	if len(labels) > 0 {
+		w.WriteByte('{')
+		for i := 0; i+1 < len(labels); i += 2 {
+			if i > 0 {
+				w.WriteByte(',')
+			}
+			fmt.Fprintf(w, "%s=\"%s\"", labels[i], escapeLabelValue(labels[i+1]))
+		}
+		w.WriteByte('}')
+	}
+	w.WriteByte(' ')
+	w.WriteString(formatFloat(float64(value)))
+	w.WriteByte('\n')
+}
+
+var labelValueEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func escapeLabelValue(value string) string {
+	return labelValueEscaper.Replace(value)
+}
+
+func formatFloat(value float64) string {
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
+
+func sortedKeys[K comparable, V any](m map[K]V, cmp func(a, b K) int) []K {
+	keys := make([]K, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	slices.SortFunc(keys, cmp)
+	return keys
+}
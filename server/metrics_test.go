@@ -0,0 +1,98 @@
+package server
+
+import (
+	"bytes"
+	"flag"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	. "go-citrus/internal"
+)
+
+var updateGolden = flag.Bool("update", false, "rewrite the golden files of the tests")
+
+// requireGolden compares actual with testdata/<name>, or rewrites it when the tests run with -update.
+func requireGolden(t *testing.T, name string, actual []byte) {
+	path := filepath.Join("testdata", name)
+	if *updateGolden {
+		require.NoError(t, os.WriteFile(path, actual, 0o644))
+	}
+	expected, err := os.ReadFile(path)
+	require.NoError(t, err)
+	require.Equal(t, string(expected), string(actual))
+}
+
+func TestMetrics_Expose(t *testing.T) {
+	t.Run("no requests", func(t *testing.T) {
+		protocol, err := NewProtocol(NewMemoryKeyStore(KeyList{ExchangeKey1, SigningKey1}))
+		require.NoError(t, err)
+
+		var out bytes.Buffer
+		require.NoError(t, NewMetrics(protocol).Expose(&out))
+		requireGolden(t, "metrics_empty.golden", out.Bytes())
+	})
+
+	t.Run("requests", func(t *testing.T) {
+		notAfter := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+		metadata := Metadata{ExchangeKey2Thp: KeyMetadata{NotAfter: &notAfter}}
+		store := newMemoryKeyStore(KeyList{ExchangeKey1, ExchangeKey2, SigningKey1}, KeyList{SigningKey2}, metadata,
+			func() time.Time { return notAfter.Add(time.Hour) })
+		protocol, err := NewProtocol(store)
+		require.NoError(t, err)
+		require.NoError(t, protocol.Reload())
+
+		metrics := NewMetrics(protocol)
+		metrics.Observe(RouteAdvertisement, http.StatusOK, "", time.Millisecond)
+		metrics.Observe(RouteAdvertisement, http.StatusOK, SigningKey1Thp, time.Millisecond)
+		metrics.Observe(RouteAdvertisement, http.StatusNotFound, "unknown", time.Millisecond)
+		metrics.Observe(RouteRecovery, http.StatusOK, ExchangeKey1Thp, 800*time.Microsecond)
+		metrics.Observe(RouteRecovery, http.StatusOK, ExchangeKey1Thp, 3*time.Millisecond)
+		metrics.Observe(RouteRecovery, http.StatusOK, ExchangeKey2Thp, 2*time.Second)
+		metrics.Observe(RouteRecovery, http.StatusNotFound, "unknown", 100*time.Microsecond)
+		metrics.Reject(RouteRecovery, RejectRateLimit)
+		metrics.Reject(RouteRecovery, RejectConcurrency)
+		metrics.Reject(RouteAdvertisement, RejectRateLimit)
+		metrics.Reject(RouteRecovery, RejectRateLimit)
+
+		var out bytes.Buffer
+		require.NoError(t, metrics.Expose(&out))
+		requireGolden(t, "metrics.golden", out.Bytes())
+	})
+
+	t.Run("label values are escaped", func(t *testing.T) {
+		require.Equal(t, `a\\b\"c\nd`, escapeLabelValue("a\\b\"c\nd"))
+	})
+}
+
+func TestHandler_Metrics(t *testing.T) {
+	handler := newTestHandler(t)
+	handler.WithMetrics(NewMetrics(handler.protocol)).
+		WithRateLimiter(NewRateLimiter(map[string]RateLimit{RouteAdvertisement: {Rate: 0.001, Burst: 1}}, 0))
+
+	for range 2 {
+		handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/adv", nil))
+	}
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/rec/"+ExchangeKey1Thp, bytes.NewReader(recoveryRequest(t))))
+	require.Equal(t, http.StatusOK, rec.Code)
+
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	require.Equal(t, http.StatusOK, rec.Code)
+	require.Equal(t, metricsContentType, rec.Header().Get("Content-Type"))
+
+	body := rec.Body.String()
+	require.Contains(t, body, `citrus_http_requests_total{route="adv",status="200"} 1`+"\n")
+	require.Contains(t, body, `citrus_http_requests_total{route="adv",status="429"} 1`+"\n")
+	require.Contains(t, body, `citrus_http_requests_total{route="rec",status="200"} 1`+"\n")
+	require.Contains(t, body, `citrus_recoveries_total{thumbprint="`+ExchangeKey1Thp+`"} 1`+"\n")
+	require.Contains(t, body, `citrus_recovery_duration_seconds_count 1`+"\n")
+	require.Contains(t, body, `citrus_rate_limit_rejections_total{route="adv",reason="rate_limit"} 1`+"\n")
+	require.Contains(t, body, `citrus_keys{state="active"} 2`+"\n")
+}
@@ -0,0 +1,214 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+)
+
+/*
+Multi-tenant serving: namespaces keep the keys of several tenants apart on a single server.
+Each namespace has its own key directory, rotation policy, rate limits and audit stream, and serves the Tang API under its name:
+  - GET  /{ns}/adv       - default signed advertisement of namespace ns
+  - GET  /{ns}/adv/{thp} - advertisement of namespace ns signed by the signing key with thumbprint thp
+  - POST /{ns}/rec/{thp} - recovery using the exchange key of namespace ns with thumbprint thp
+  - GET  /{ns}/healthz, /{ns}/readyz
+
+Every other path goes to the default namespace, so that clevis bindings against plain /adv and /rec/{thp} keep working.
+The recovery policy, approvals, admin API and metrics only apply to the default namespace.
+*/
+
+var namespaceName = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]{0,62}$`)
+
+// Names which would shadow the routes of the default namespace.
+var reservedNamespaces = []string{RouteAdvertisement, RouteRecovery, "metrics", "healthz", "readyz", "admin"}
+
+// ValidateNamespaceName checks name is usable as a namespace, as the first segment of the request paths.
+func ValidateNamespaceName(name string) error {
+	if !namespaceName.MatchString(name) {
+		return fmt.Errorf("invalid namespace name '%s', expecting lower case letters, digits, '-' and '_'", name)
+	}
+	if slices.Contains(reservedNamespaces, name) {
+		return fmt.Errorf("namespace name '%s' is reserved", name)
+	}
+	return nil
+}
+
+// NamespaceConfig describes a namespace in a namespaces file (see LoadNamespaces), or in a server configuration.
+type NamespaceConfig struct {
+	Name          string               `json:"name" yaml:"name"`
+	Dir           string               `json:"dir" yaml:"dir"`                                 // key directory
+	RotateAfter   string               `json:"rotate_after,omitempty" yaml:"rotate_after"`     // duration, e.g. "720h", see RotationPolicy
+	RetireAfter   string               `json:"retire_after,omitempty" yaml:"retire_after"`     // duration, see RotationPolicy
+	RateLimits    map[string]RateLimit `json:"rate_limits,omitempty" yaml:"rate_limits"`       // route -> per client limit, see RateLimiter
+	MaxRecoveries int                  `json:"max_recoveries,omitempty" yaml:"max_recoveries"` // concurrent recovery computations, 0 means unlimited
+	AuditFile     string               `json:"audit_file,omitempty" yaml:"audit_file"`         // audit records are written to the server audit sink without
+	AuditMaxSize  int64                `json:"audit_max_size,omitempty" yaml:"audit_max_size"` // see NewAuditFile
+	AuditBackups  int                  `json:"audit_backups,omitempty" yaml:"audit_backups"`
+
+	rotation RotationPolicy
+}
+
+// LoadNamespaces reads a JSON file listing namespaces, see NamespaceConfig.
+func LoadNamespaces(path string) ([]NamespaceConfig, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var configs []NamespaceConfig
+	if err = json.Unmarshal(data, &configs); err != nil {
+		return nil, fmt.Errorf("unable to parse namespaces '%s': %w", path, err)
+	}
+	names := make(map[string]bool)
+	for i := range configs {
+		if err = configs[i].Compile(); err != nil {
+			return nil, fmt.Errorf("invalid namespaces '%s': %w", path, err)
+		}
+		if names[configs[i].Name] {
+			return nil, fmt.Errorf("invalid namespaces '%s': namespace '%s' is listed twice", path, configs[i].Name)
+		}
+		names[configs[i].Name] = true
+	}
+	return configs, nil
+}
+
+// Compile validates the configuration, and must be called before NewNamespace on a configuration not read by LoadNamespaces.
+func (t *NamespaceConfig) Compile() error {
+	if err := ValidateNamespaceName(t.Name); err != nil {
+		return err
+	}
+	if t.Dir == "" {
+		return fmt.Errorf("namespace '%s' has no key directory", t.Name)
+	}
+	for route, limit := range t.RateLimits {
+		if route != RouteAdvertisement && route != RouteRecovery {
+			return fmt.Errorf("namespace '%s' limits unknown route '%s', one of: %s, %s", t.Name, route, RouteAdvertisement, RouteRecovery)
+		}
+		if limit.Rate <= 0 || limit.Burst <= 0 {
+			return fmt.Errorf("namespace '%s' has an invalid %s rate limit", t.Name, route)
+		}
+	}
+	if t.MaxRecoveries < 0 {
+		return fmt.Errorf("namespace '%s' has a negative max_recoveries", t.Name)
+	}
+	var err error
+	if t.rotation.RotateAfter, err = parseNamespaceDuration(t.Name, "rotate_after", t.RotateAfter); err != nil {
+		return err
+	}
+	t.rotation.RetireAfter, err = parseNamespaceDuration(t.Name, "retire_after", t.RetireAfter)
+	return err
+}
+
+func parseNamespaceDuration(name string, field string, value string) (time.Duration, error) {
+	if value == "" {
+		return 0, nil
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil || d < 0 {
+		return 0, fmt.Errorf("namespace '%s' has an invalid %s '%s'", name, field, value)
+	}
+	return d, nil
+}
+
+// Namespace is a tenant of a multi-tenant server, with the protocol, rotator and handler serving its key directory.
+type Namespace struct {
+	Name     string
+	Protocol *Protocol
+	Rotator  *Rotator
+	Handler  *Handler
+
+	audit *AuditFile // audit file owned by the namespace, nil when writing to a shared sink
+}
+
+// NewNamespace loads the key directory of a compiled namespace configuration.
+// Audit records go to the namespace audit file when configured, to audit otherwise (which may be nil).
+func NewNamespace(config NamespaceConfig, passphrase PassphraseFn, audit AuditSink, logger *slog.Logger) (*Namespace, error) {
+	protocol, err := NewProtocolFromDir(config.Dir, passphrase)
+	if err != nil {
+		return nil, fmt.Errorf("namespace '%s': %w", config.Name, err)
+	}
+	logger = logger.With("namespace", config.Name)
+	ns := Namespace{
+		Name:     config.Name,
+		Protocol: protocol,
+		Rotator:  NewRotator(protocol, config.Dir, passphrase, config.rotation, logger),
+		Handler:  NewHandler(protocol).WithNamespace(config.Name),
+	}
+	if len(config.RateLimits) > 0 || config.MaxRecoveries > 0 {
+		ns.Handler = ns.Handler.WithRateLimiter(NewRateLimiter(config.RateLimits, config.MaxRecoveries))
+	}
+	if config.AuditFile != "" {
+		if ns.audit, err = NewAuditFile(config.AuditFile, config.AuditMaxSize, config.AuditBackups); err != nil {
+			protocol.Close()
+			return nil, fmt.Errorf("namespace '%s': %w", config.Name, err)
+		}
+		audit = ns.audit
+	}
+	if audit != nil {
+		ns.Handler = ns.Handler.WithAudit(audit)
+	}
+	return &ns, nil
+}
+
+// Run performs the rotation passes of the namespace every interval until ctx is done, when its rotation policy has any.
+func (t *Namespace) Run(ctx context.Context, interval time.Duration) {
+	if t.Rotator.policy == (RotationPolicy{}) {
+		return
+	}
+	t.Rotator.Run(ctx, interval)
+}
+
+// Close wipes the private keys of the namespace, and closes its audit file.
+func (t *Namespace) Close() {
+	t.Protocol.Close()
+	if t.audit != nil {
+		_ = t.audit.Close()
+	}
+}
+
+// NamespaceRouter dispatches the requests to the handler of their namespace, see Namespace.
+type NamespaceRouter struct {
+	fallback   http.Handler            // handler of the default namespace
+	namespaces map[string]http.Handler // namespace name -> handler
+}
+
+// NewNamespaceRouter serves every request outside of a namespace with fallback, the handler of the default namespace.
+func NewNamespaceRouter(fallback http.Handler) *NamespaceRouter {
+	return &NamespaceRouter{
+		fallback:   fallback,
+		namespaces: make(map[string]http.Handler),
+	}
+}
+
+// Handle serves the requests under /{name}/ with handler, which sees the paths without the namespace prefix.
+func (t *NamespaceRouter) Handle(name string, handler http.Handler) error {
+	if err := ValidateNamespaceName(name); err != nil {
+		return err
+	}
+	if _, ok := t.namespaces[name]; ok {
+		return fmt.Errorf("namespace '%s' is already served", name)
+	}
+	t.namespaces[name] = handler
+	return nil
+}
+
+func (t *NamespaceRouter) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	name, rest, ok := strings.Cut(strings.TrimPrefix(r.URL.Path, "/"), "/")
+	handler, found := t.namespaces[name]
+	if !ok || !found {
+		t.fallback.ServeHTTP(w, r)
+		return
+	}
+
+	stripped := r.Clone(r.Context())
+	stripped.URL.Path = "/" + rest
+	stripped.URL.RawPath = ""
+	handler.ServeHTTP(w, stripped)
+}
@@ -0,0 +1,142 @@
+package server
+
+import (
+	"bytes"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/go-jose/go-jose/v4"
+	"github.com/stretchr/testify/require"
+
+	. "go-citrus/internal"
+)
+
+func newTestNamespace(t *testing.T, config NamespaceConfig, audit AuditSink, keys ...jose.JSONWebKey) *Namespace {
+	config.Dir = t.TempDir()
+	for _, key := range keys {
+		_, err := WriteKey(config.Dir, key, nil)
+		require.NoError(t, err)
+	}
+	require.NoError(t, config.Compile())
+	ns, err := NewNamespace(config, nil, audit, slog.New(slog.NewTextHandler(io.Discard, nil)))
+	require.NoError(t, err)
+	t.Cleanup(ns.Close)
+	return ns
+}
+
+func TestNamespaceRouter(t *testing.T) {
+	sink := &memoryAuditSink{}
+	router := NewNamespaceRouter(newTestHandler(t).WithAudit(sink))
+	teamA := newTestNamespace(t, NamespaceConfig{Name: "team-a"}, sink, ExchangeKey2, SigningKey2)
+	require.NoError(t, router.Handle(teamA.Name, teamA.Handler))
+
+	serve := func(method string, path string, body []byte) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, httptest.NewRequest(method, path, bytes.NewReader(body)))
+		return rec
+	}
+
+	t.Run("default namespace on plain paths", func(t *testing.T) {
+		rec := serve(http.MethodGet, "/adv", nil)
+		require.Equal(t, http.StatusOK, rec.Code)
+		adv, err := ParseAdvertisement(rec.Body.Bytes(), []jose.SignatureAlgorithm{DefaultSignatureAlgorithm})
+		require.NoError(t, err)
+		require.Equal(t, []string{ExchangeKey1Thp}, thumbprintsOf(t, adv.ExchangeKeys()))
+
+		require.Equal(t, http.StatusOK, serve(http.MethodPost, "/rec/"+ExchangeKey1Thp, recoveryRequest(t)).Code)
+		require.Equal(t, http.StatusNotFound, serve(http.MethodPost, "/rec/"+ExchangeKey2Thp, recoveryRequest(t)).Code)
+	})
+
+	t.Run("namespace keys under its prefix", func(t *testing.T) {
+		rec := serve(http.MethodGet, "/team-a/adv", nil)
+		require.Equal(t, http.StatusOK, rec.Code)
+		adv, err := ParseAdvertisement(rec.Body.Bytes(), []jose.SignatureAlgorithm{DefaultSignatureAlgorithm})
+		require.NoError(t, err)
+		require.Equal(t, []string{ExchangeKey2Thp}, thumbprintsOf(t, adv.ExchangeKeys()))
+
+		require.Equal(t, http.StatusOK, serve(http.MethodGet, "/team-a/adv/", nil).Code)
+		require.Equal(t, http.StatusOK, serve(http.MethodGet, "/team-a/adv/"+SigningKey2Thp, nil).Code)
+		require.Equal(t, http.StatusNotFound, serve(http.MethodGet, "/team-a/adv/"+SigningKey1Thp, nil).Code)
+		require.Equal(t, http.StatusOK, serve(http.MethodPost, "/team-a/rec/"+ExchangeKey2Thp, recoveryRequest(t)).Code)
+		require.Equal(t, http.StatusNotFound, serve(http.MethodPost, "/team-a/rec/"+ExchangeKey1Thp, recoveryRequest(t)).Code)
+		require.Equal(t, http.StatusOK, serve(http.MethodGet, "/team-a/readyz", nil).Code)
+	})
+
+	t.Run("unknown namespace", func(t *testing.T) {
+		require.Equal(t, http.StatusNotFound, serve(http.MethodGet, "/team-b/adv", nil).Code)
+	})
+
+	t.Run("audit records carry the namespace", func(t *testing.T) {
+		sink.records = nil
+		serve(http.MethodGet, "/adv", nil)
+		serve(http.MethodGet, "/team-a/adv", nil)
+		require.Len(t, sink.records, 2)
+		require.Equal(t, "", sink.records[0].Namespace)
+		require.Equal(t, "team-a", sink.records[1].Namespace)
+		require.Equal(t, RouteAdvertisement, sink.records[1].Route)
+	})
+
+	t.Run("reserved and duplicate names", func(t *testing.T) {
+		require.Error(t, router.Handle("adv", teamA.Handler))
+		require.Error(t, router.Handle("Team-A", teamA.Handler))
+		require.Error(t, router.Handle("team-a", teamA.Handler))
+	})
+}
+
+func TestNamespace_RateLimits(t *testing.T) {
+	ns := newTestNamespace(t, NamespaceConfig{
+		Name:       "team-a",
+		RateLimits: map[string]RateLimit{RouteAdvertisement: {Rate: 0.001, Burst: 1}},
+	}, nil, ExchangeKey2, SigningKey2)
+	router := NewNamespaceRouter(newTestHandler(t))
+	require.NoError(t, router.Handle(ns.Name, ns.Handler))
+
+	for _, expected := range []int{http.StatusOK, http.StatusTooManyRequests} {
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/team-a/adv", nil))
+		require.Equal(t, expected, rec.Code)
+	}
+	// The default namespace is not throttled by the limits of another.
+	rec := httptest.NewRecorder()
+	router.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/adv", nil))
+	require.Equal(t, http.StatusOK, rec.Code)
+}
+
+func TestLoadNamespaces(t *testing.T) {
+	load := func(content string) ([]NamespaceConfig, error) {
+		path := filepath.Join(t.TempDir(), "namespaces.json")
+		require.NoError(t, os.WriteFile(path, []byte(content), 0o600))
+		return LoadNamespaces(path)
+	}
+
+	configs, err := load(`[
+		{"name": "team-a", "dir": "/var/db/citrus/team-a", "rotate_after": "720h", "retire_after": "2160h",
+		 "rate_limits": {"rec": {"rate": 2, "burst": 10}}, "max_recoveries": 4, "audit_file": "/var/log/citrus/team-a.log"},
+		{"name": "team-b", "dir": "/var/db/citrus/team-b"}
+	]`)
+	require.NoError(t, err)
+	require.Len(t, configs, 2)
+	require.Equal(t, RotationPolicy{RotateAfter: 720 * time.Hour, RetireAfter: 2160 * time.Hour}, configs[0].rotation)
+	require.Equal(t, RateLimit{Rate: 2, Burst: 10}, configs[0].RateLimits[RouteRecovery])
+	require.Equal(t, RotationPolicy{}, configs[1].rotation)
+
+	for name, content := range map[string]string{
+		"reserved name":  `[{"name": "rec", "dir": "/tmp"}]`,
+		"invalid name":   `[{"name": "team/a", "dir": "/tmp"}]`,
+		"missing dir":    `[{"name": "team-a"}]`,
+		"duplicate name": `[{"name": "team-a", "dir": "/a"}, {"name": "team-a", "dir": "/b"}]`,
+		"unknown route":  `[{"name": "team-a", "dir": "/tmp", "rate_limits": {"admin": {"rate": 1, "burst": 1}}}]`,
+		"bad duration":   `[{"name": "team-a", "dir": "/tmp", "rotate_after": "monthly"}]`,
+	} {
+		t.Run(name, func(t *testing.T) {
+			_, err := load(content)
+			require.Error(t, err)
+		})
+	}
+}
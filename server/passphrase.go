@@ -0,0 +1,55 @@
+package server
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+/*
+Passphrase sources for encrypted-at-rest server keys.
+The passphrase is only read when a wrapped key is found, and the caller is expected to clear the returned buffer.
+*/
+type PassphraseFn func() ([]byte, error)
+
+// PassphraseFromFile reads the passphrase from a file, ignoring a trailing newline.
+func PassphraseFromFile(path string) PassphraseFn {
+	return func() ([]byte, error) {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		return trimPassphrase(data)
+	}
+}
+
+// PassphraseFromEnv reads the passphrase from an environment variable.
+func PassphraseFromEnv(name string) PassphraseFn {
+	return func() ([]byte, error) {
+		value, ok := os.LookupEnv(name)
+		if !ok {
+			return nil, fmt.Errorf("passphrase environment variable '%s' is not set", name)
+		}
+		return trimPassphrase([]byte(value))
+	}
+}
+
+// PassphraseFromCredential reads the passphrase from a systemd credential, see systemd.exec(5) LoadCredential=.
+func PassphraseFromCredential(name string) PassphraseFn {
+	return func() ([]byte, error) {
+		dir, ok := os.LookupEnv("CREDENTIALS_DIRECTORY")
+		if !ok {
+			return nil, fmt.Errorf("no systemd credentials available (CREDENTIALS_DIRECTORY is not set)")
+		}
+		return PassphraseFromFile(filepath.Join(dir, name))()
+	}
+}
+
+func trimPassphrase(data []byte) ([]byte, error) {
+	data = bytes.TrimRight(data, "\r\n")
+	if len(data) == 0 {
+		return nil, fmt.Errorf("empty passphrase")
+	}
+	return data, nil
+}
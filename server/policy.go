@@ -0,0 +1,243 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/netip"
+	"os"
+	"slices"
+	"strings"
+	"time"
+)
+
+/*
+Recovery access policy, evaluated before every recovery computation.
+Rules are evaluated in order, the first rule matching the request decides; requests matching no rule get the
+default action (deny unless set). Every condition of a rule must hold for the rule to match, an empty condition always holds:
+
+	{
+	  "default": "deny",
+	  "timezone": "Europe/Paris",
+	  "rules": [
+	    {"name": "lab", "action": "deny", "labels": {"env": "lab"}, "days": ["sat", "sun"]},
+	    {"name": "datacenter", "action": "allow", "networks": ["10.0.0.0/8", "fd00::/8"]},
+	    {"name": "maintenance", "action": "allow", "networks": ["192.168.0.0/16"], "days": ["tue"], "hours": "22:00-02:00"}
+	  ]
+	}
+
+Conditions:
+  - networks    - client address CIDRs
+  - subjects    - client certificate subjects, with mutual TLS
+  - thumbprints - exchange key thumbprints, any thumbprint algorithm
+  - labels      - exchange key metadata labels, all of them must match
+  - days        - days of week (mon, tue, ...), in the policy timezone
+  - hours       - time of day window HH:MM-HH:MM, in the policy timezone, crossing midnight when it ends before it starts;
+    the hours after midnight then belong to the window of the previous day
+*/
+const (
+	PolicyAllow = "allow"
+	PolicyDeny  = "deny"
+
+	// Name of the decisions taken by the policy default action.
+	PolicyDefaultRule = "default"
+)
+
+var weekdays = map[string]time.Weekday{
+	"sun": time.Sunday, "mon": time.Monday, "tue": time.Tuesday, "wed": time.Wednesday,
+	"thu": time.Thursday, "fri": time.Friday, "sat": time.Saturday,
+}
+
+type PolicyRule struct {
+	Name        string            `json:"name"`
+	Action      string            `json:"action"`
+	Networks    []string          `json:"networks,omitempty"`
+	Subjects    []string          `json:"subjects,omitempty"`
+	Thumbprints []string          `json:"thumbprints,omitempty"`
+	Labels      map[string]string `json:"labels,omitempty"`
+	Days        []string          `json:"days,omitempty"`
+	Hours       string            `json:"hours,omitempty"`
+
+	prefixes []netip.Prefix
+	weekdays []time.Weekday
+	from, to int // hours window, in minutes from midnight, from == to when unset
+}
+
+type Policy struct {
+	Default  string       `json:"default,omitempty"`
+	Timezone string       `json:"timezone,omitempty"`
+	Rules    []PolicyRule `json:"rules"`
+
+	location *time.Location
+}
+
+// PolicyRequest describes a recovery request to a Policy.
+type PolicyRequest struct {
+	Client      string            // client IP address
+	Subject     string            // client certificate subject, empty without mutual TLS
+	Thumbprints []string          // every thumbprint of the requested exchange key
+	Labels      map[string]string // metadata labels of the requested exchange key
+	Time        time.Time
+}
+
+type PolicyDecision struct {
+	Allowed bool
+	Rule    string // name of the rule which matched, PolicyDefaultRule when none did
+}
+
+// PolicyDeniedError is returned for recoveries denied by the policy.
+type PolicyDeniedError struct {
+	Rule string
+}
+
+func (e *PolicyDeniedError) Error() string {
+	return fmt.Sprintf("recovery denied by policy rule '%s'", e.Rule)
+}
+
+// LoadPolicy reads a JSON policy file, see Policy.
+func LoadPolicy(path string) (*Policy, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var policy Policy
+	if err = json.Unmarshal(data, &policy); err != nil {
+		return nil, fmt.Errorf("unable to parse policy '%s': %w", path, err)
+	}
+	if err = policy.Compile(); err != nil {
+		return nil, fmt.Errorf("invalid policy '%s': %w", path, err)
+	}
+	return &policy, nil
+}
+
+// Compile validates the policy, and must be called before Evaluate on a policy not read by LoadPolicy.
+func (t *Policy) Compile() error {
+	switch t.Default {
+	case "":
+		t.Default = PolicyDeny
+	case PolicyAllow, PolicyDeny:
+	default:
+		return fmt.Errorf("invalid default action '%s'", t.Default)
+	}
+
+	t.location = time.Local
+	if t.Timezone != "" {
+		location, err := time.LoadLocation(t.Timezone)
+		if err != nil {
+			return err
+		}
+		t.location = location
+	}
+
+	for i := range t.Rules {
+		rule := &t.Rules[i]
+		if rule.Name == "" {
+			rule.Name = fmt.Sprintf("rule-%d", i+1)
+		}
+		if err := rule.compile(); err != nil {
+			return fmt.Errorf("rule '%s': %w", rule.Name, err)
+		}
+	}
+	return nil
+}
+
+func (t *PolicyRule) compile() error {
+	if t.Action != PolicyAllow && t.Action != PolicyDeny {
+		return fmt.Errorf("invalid action '%s'", t.Action)
+	}
+
+	t.prefixes = nil
+	for _, network := range t.Networks {
+		prefix, err := netip.ParsePrefix(network)
+		if err != nil {
+			return err
+		}
+		t.prefixes = append(t.prefixes, prefix.Masked())
+	}
+
+	t.weekdays = nil
+	for _, day := range t.Days {
+		weekday, ok := weekdays[strings.ToLower(day)]
+		if !ok {
+			return fmt.Errorf("invalid day '%s'", day)
+		}
+		t.weekdays = append(t.weekdays, weekday)
+	}
+
+	t.from, t.to = 0, 0
+	if t.Hours != "" {
+		from, to, ok := strings.Cut(t.Hours, "-")
+		if !ok {
+			return fmt.Errorf("hours '%s' is not in HH:MM-HH:MM form", t.Hours)
+		}
+		var err error
+		if t.from, err = parseTimeOfDay(from); err != nil {
+			return err
+		}
+		if t.to, err = parseTimeOfDay(to); err != nil {
+			return err
+		}
+		if t.from == t.to {
+			return fmt.Errorf("hours '%s' is an empty window", t.Hours)
+		}
+	}
+	return nil
+}
+
+func parseTimeOfDay(value string) (int, error) {
+	parsed, err := time.Parse("15:04", strings.TrimSpace(value))
+	if err != nil {
+		return 0, fmt.Errorf("invalid time of day '%s'", value)
+	}
+	return parsed.Hour()*60 + parsed.Minute(), nil
+}
+
+// Evaluate returns the decision of the first rule matching the request, or of the default action.
+func (t *Policy) Evaluate(request PolicyRequest) PolicyDecision {
+	local := request.Time.In(t.location)
+	client, err := netip.ParseAddr(request.Client)
+	if err == nil {
+		client = client.Unmap()
+	}
+
+	for i := range t.Rules {
+		rule := &t.Rules[i]
+		if rule.matches(request, client, local) {
+			return PolicyDecision{Allowed: rule.Action == PolicyAllow, Rule: rule.Name}
+		}
+	}
+	return PolicyDecision{Allowed: t.Default == PolicyAllow, Rule: PolicyDefaultRule}
+}
+
+func (t *PolicyRule) matches(request PolicyRequest, client netip.Addr, local time.Time) bool {
+	if len(t.prefixes) > 0 && !slices.ContainsFunc(t.prefixes, func(prefix netip.Prefix) bool {
+		return client.IsValid() && prefix.Contains(client)
+	}) {
+		return false
+	}
+	if len(t.Subjects) > 0 && !slices.Contains(t.Subjects, request.Subject) {
+		return false
+	}
+	if len(t.Thumbprints) > 0 && !slices.ContainsFunc(t.Thumbprints, func(thp string) bool {
+		return slices.Contains(request.Thumbprints, thp)
+	}) {
+		return false
+	}
+	for name, value := range t.Labels {
+		if actual, ok := request.Labels[name]; !ok || actual != value {
+			return false
+		}
+	}
+	day := local.Weekday()
+	if t.from != t.to {
+		minute := local.Hour()*60 + local.Minute()
+		switch {
+		case t.from < t.to && (minute < t.from || minute >= t.to):
+			return false
+		case t.from > t.to && minute < t.from && minute >= t.to:
+			return false
+		case t.from > t.to && minute < t.to:
+			day = (day + 6) % 7
+		}
+	}
+	return len(t.weekdays) == 0 || slices.Contains(t.weekdays, day)
+}
@@ -0,0 +1,143 @@
+package server
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	. "go-citrus/internal"
+)
+
+func compiledPolicy(t *testing.T, policy Policy) *Policy {
+	require.NoError(t, policy.Compile())
+	return &policy
+}
+
+func TestPolicy_Evaluate(t *testing.T) {
+	// Tuesday
+	now := time.Date(2024, 6, 4, 12, 0, 0, 0, time.UTC)
+
+	t.Run("first matching rule decides", func(t *testing.T) {
+		policy := compiledPolicy(t, Policy{Rules: []PolicyRule{
+			{Name: "blocked", Action: PolicyDeny, Networks: []string{"10.1.0.0/16"}},
+			{Name: "datacenter", Action: PolicyAllow, Networks: []string{"10.0.0.0/8", "fd00::/8"}},
+		}})
+		require.Equal(t, PolicyDecision{Allowed: false, Rule: "blocked"}, policy.Evaluate(PolicyRequest{Client: "10.1.2.3", Time: now}))
+		require.Equal(t, PolicyDecision{Allowed: true, Rule: "datacenter"}, policy.Evaluate(PolicyRequest{Client: "10.2.2.3", Time: now}))
+		require.Equal(t, PolicyDecision{Allowed: true, Rule: "datacenter"}, policy.Evaluate(PolicyRequest{Client: "::ffff:10.2.2.3", Time: now}))
+		require.Equal(t, PolicyDecision{Allowed: true, Rule: "datacenter"}, policy.Evaluate(PolicyRequest{Client: "fd00::1", Time: now}))
+		require.Equal(t, PolicyDecision{Allowed: false, Rule: PolicyDefaultRule}, policy.Evaluate(PolicyRequest{Client: "192.168.1.1", Time: now}))
+		require.Equal(t, PolicyDecision{Allowed: false, Rule: PolicyDefaultRule}, policy.Evaluate(PolicyRequest{Client: "stdio", Time: now}))
+	})
+
+	t.Run("default action", func(t *testing.T) {
+		policy := compiledPolicy(t, Policy{Default: PolicyAllow, Rules: []PolicyRule{
+			{Action: PolicyDeny, Subjects: []string{"CN=revoked"}},
+		}})
+		require.Equal(t, PolicyDecision{Allowed: false, Rule: "rule-1"}, policy.Evaluate(PolicyRequest{Subject: "CN=revoked", Time: now}))
+		require.Equal(t, PolicyDecision{Allowed: true, Rule: PolicyDefaultRule}, policy.Evaluate(PolicyRequest{Subject: "CN=agent", Time: now}))
+	})
+
+	t.Run("exchange key thumbprints and labels", func(t *testing.T) {
+		policy := compiledPolicy(t, Policy{Rules: []PolicyRule{
+			{Name: "key", Action: PolicyAllow, Thumbprints: []string{"sha1-thp"}},
+			{Name: "production", Action: PolicyAllow, Labels: map[string]string{"env": "prod", "team": "infra"}},
+		}})
+		require.True(t, policy.Evaluate(PolicyRequest{Thumbprints: []string{"sha1-thp", "sha256-thp"}, Time: now}).Allowed)
+		require.True(t, policy.Evaluate(PolicyRequest{Labels: map[string]string{"env": "prod", "team": "infra", "x": "y"}, Time: now}).Allowed)
+		require.False(t, policy.Evaluate(PolicyRequest{Labels: map[string]string{"env": "prod"}, Time: now}).Allowed)
+	})
+
+	t.Run("time windows", func(t *testing.T) {
+		policy := compiledPolicy(t, Policy{Timezone: "Europe/Paris", Rules: []PolicyRule{
+			{Name: "office", Action: PolicyAllow, Days: []string{"mon", "tue", "wed", "thu", "fri"}, Hours: "08:00-18:00"},
+			{Name: "maintenance", Action: PolicyAllow, Days: []string{"Sat"}, Hours: "22:00-02:00"},
+		}})
+		paris, err := time.LoadLocation("Europe/Paris")
+		require.NoError(t, err)
+		at := func(day int, hour int, minute int) PolicyDecision {
+			return policy.Evaluate(PolicyRequest{Time: time.Date(2024, 6, day, hour, minute, 0, 0, paris)})
+		}
+
+		require.Equal(t, "office", at(4, 8, 0).Rule)
+		require.Equal(t, "office", at(4, 17, 59).Rule)
+		require.Equal(t, PolicyDefaultRule, at(4, 18, 0).Rule)
+		require.Equal(t, PolicyDefaultRule, at(8, 12, 0).Rule, "saturday")
+		// 08:00 in Paris is 06:00 UTC
+		require.Equal(t, "office", policy.Evaluate(PolicyRequest{Time: time.Date(2024, 6, 4, 6, 0, 0, 0, time.UTC)}).Rule)
+
+		require.Equal(t, "maintenance", at(8, 23, 0).Rule, "saturday night")
+		require.Equal(t, "maintenance", at(9, 1, 59).Rule, "after midnight, still the saturday window")
+		require.Equal(t, PolicyDefaultRule, at(9, 2, 0).Rule)
+		require.Equal(t, PolicyDefaultRule, at(9, 23, 0).Rule, "sunday night")
+	})
+
+	t.Run("invalid policies", func(t *testing.T) {
+		for name, policy := range map[string]Policy{
+			"default":  {Default: "maybe"},
+			"timezone": {Timezone: "Mars/Olympus"},
+			"action":   {Rules: []PolicyRule{{Action: "permit"}}},
+			"network":  {Rules: []PolicyRule{{Action: PolicyAllow, Networks: []string{"10.0.0.0/33"}}}},
+			"day":      {Rules: []PolicyRule{{Action: PolicyAllow, Days: []string{"monday"}}}},
+			"hours":    {Rules: []PolicyRule{{Action: PolicyAllow, Hours: "8:00"}}},
+			"empty":    {Rules: []PolicyRule{{Action: PolicyAllow, Hours: "08:00-08:00"}}},
+		} {
+			require.Error(t, policy.Compile(), name)
+		}
+	})
+}
+
+func TestLoadPolicy(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "policy.json")
+	require.NoError(t, os.WriteFile(path, []byte(`{
+		"rules": [{"name": "local", "action": "allow", "networks": ["127.0.0.0/8"]}]
+	}`), 0o600))
+
+	policy, err := LoadPolicy(path)
+	require.NoError(t, err)
+	require.Equal(t, PolicyDeny, policy.Default)
+	require.True(t, policy.Evaluate(PolicyRequest{Client: "127.0.0.1", Time: time.Now()}).Allowed)
+
+	require.NoError(t, os.WriteFile(path, []byte(`{"rules": [{"action": "allow", "hours": "25:00-26:00"}]}`), 0o600))
+	_, err = LoadPolicy(path)
+	require.Error(t, err)
+}
+
+func TestHandler_RecoveryPolicy(t *testing.T) {
+	metadata := Metadata{ExchangeKey1Thp: KeyMetadata{Labels: map[string]string{"env": "prod"}}}
+	store := newMemoryKeyStore(KeyList{ExchangeKey1, SigningKey1}, nil, metadata, time.Now)
+	protocol, err := NewProtocol(store)
+	require.NoError(t, err)
+	protocol.SetPolicy(compiledPolicy(t, Policy{Rules: []PolicyRule{
+		{Name: "prod-from-lan", Action: PolicyAllow, Networks: []string{"192.0.2.0/24"}, Labels: map[string]string{"env": "prod"}},
+	}}))
+	sink := &memoryAuditSink{}
+	handler := NewHandler(protocol).WithAudit(sink)
+
+	recoverFrom := func(client string) int {
+		req := httptest.NewRequest(http.MethodPost, "/rec/"+ExchangeKey1Thp, bytes.NewReader(recoveryRequest(t)))
+		req.RemoteAddr = client
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		return rec.Code
+	}
+
+	require.Equal(t, http.StatusOK, recoverFrom("192.0.2.10:4000"))
+	require.Equal(t, http.StatusForbidden, recoverFrom("198.51.100.10:4000"))
+
+	require.Len(t, sink.records, 2)
+	require.Equal(t, "prod-from-lan", sink.records[0].PolicyRule)
+	require.Equal(t, PolicyAllow, sink.records[0].PolicyAction)
+	require.Equal(t, PolicyDefaultRule, sink.records[1].PolicyRule)
+	require.Equal(t, PolicyDeny, sink.records[1].PolicyAction)
+	require.Equal(t, http.StatusForbidden, sink.records[1].Status)
+
+	// The self-test is not subject to the policy.
+	require.NoError(t, protocol.SelfTest())
+}
@@ -3,6 +3,9 @@ package server
 import (
 	"crypto/ecdsa"
 	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/go-jose/go-jose/v4"
 
@@ -15,8 +18,17 @@ import (
 */
 
 type Protocol struct {
-	advertisements map[string][]byte          // Advertisement lookup map - signing key thumbprint -> client advertisement
-	exchange       map[string]jose.JSONWebKey // Recovery lookup map - exchange key thumbprint -> server key map
+	store     KeyStore                      // Server private keys, never leaving the store
+	policy    atomic.Pointer[Policy]        // Recovery policy, every recovery is allowed when nil
+	approvals atomic.Pointer[ApprovalQueue] // Queue of the recoveries waiting for approvals, see ApprovalQueue
+
+	mu             sync.RWMutex
+	advertisements map[string][]byte // Advertisement lookup map - signing key thumbprint -> client advertisement
+	builds         atomic.Uint64     // Number of times the advertisements were built
+	readiness      error             // SelfTest result of the served advertisements
+	expiry         time.Time         // KeyExpirer.NextExpiry when the advertisements were built
+	rebuild        sync.Mutex        // serializes the rebuilds on key expiry, see GetAdvertisement
+	draining       atomic.Bool       // Set once the server is shutting down
 }
 
 /* ----- Server key advertisement -----
@@ -26,72 +38,148 @@ NOTE:
 	while the exchange thumbprint is generated from the `s` key will be sent from client to find `S`.
 */
 
-func NewProtocol(adv KeyList) (*Protocol, error) {
+func NewProtocol(store KeyStore) (*Protocol, error) {
 	p := Protocol{
-		advertisements: make(map[string][]byte),
-		exchange:       make(map[string]jose.JSONWebKey),
+		store: store,
+	}
+	if err := p.buildAdvertisements(); err != nil {
+		return nil, err
+	}
+	return &p, nil
+}
+
+// Reloader is implemented by key stores able to re-read their backend, e.g. FileKeyStore.
+type Reloader interface {
+	Reload() error
+}
+
+// Reload refreshes the key store when supported, then rebuilds every advertisement.
+// The previous advertisements keep being served until the new ones are ready.
+func (t *Protocol) Reload() error {
+	if reloader, ok := t.store.(Reloader); ok {
+		if err := reloader.Reload(); err != nil {
+			return err
+		}
+	}
+	return t.buildAdvertisements()
+}
+
+func (t *Protocol) buildAdvertisements() error {
+	advertisements := make(map[string][]byte)
+	// Taken first, a key expiring meanwhile only causes another rebuild.
+	var expiry time.Time
+	if expirer, ok := t.store.(KeyExpirer); ok {
+		expiry = expirer.NextExpiry()
 	}
 
-	defaultAdv, err := NewAdvertisement(adv...)
+	keys, err := t.store.PublicKeys()
 	if err != nil {
-		return nil, err
+		return err
+	}
+	defaultAdv, err := NewAdvertisement(keys...)
+	if err != nil {
+		return err
 	}
-	exchange := defaultAdv.ExchangeKeys()
 	signing := defaultAdv.SigningKeys()
 
-	bytes, err := defaultAdv.Marshall()
+	payload, err := defaultAdv.Payload()
 	if err != nil {
-		return nil, err
+		return err
+	}
+	bytes, err := t.store.Sign(payload, AdvertisementContentType)
+	if err != nil {
+		return err
 	}
 
 	// Always return the default advertisement,
-	p.advertisements[""] = bytes
+	advertisements[""] = bytes
 
 	// as well as the signing keys with provided thumbprints.
 	for _, key := range signing {
-		if err = p.addAdvertisementKey(key, bytes); err != nil {
-			return nil, err
+		if err = addAdvertisementKey(advertisements, key, bytes); err != nil {
+			return err
 		}
 	}
 
-	// Add advertised exchange keys.
-	for _, key := range exchange {
-		if err = p.addExchangeKey(key); err != nil {
-			return nil, err
-		}
-	}
+	t.mu.Lock()
+	t.advertisements = advertisements
+	t.expiry = expiry
+	t.mu.Unlock()
+	t.builds.Add(1)
+
+	// A failed self-test keeps the server up but not ready, see Ready.
+	readiness := t.SelfTest()
+	t.mu.Lock()
+	t.readiness = readiness
+	t.mu.Unlock()
+	return nil
+}
 
-	return &p, nil
+// AdvertisementBuilds returns how many times the advertisements were (re)built.
+func (t *Protocol) AdvertisementBuilds() uint64 {
+	return t.builds.Load()
 }
 
-func (t *Protocol) addAdvertisementKey(key jose.JSONWebKey, advertisement []byte) error {
+// NewProtocolFromDir loads the server keys from a key directory, decrypting wrapped keys with the given passphrase.
+// Decrypted keys are only kept in memory.
+func NewProtocolFromDir(dir string, passphrase PassphraseFn) (*Protocol, error) {
+	store, err := NewFileKeyStore(dir, passphrase)
+	if err != nil {
+		return nil, err
+	}
+	return NewProtocol(store)
+}
+
+func addAdvertisementKey(advertisements map[string][]byte, key jose.JSONWebKey, advertisement []byte) error {
 	thumbs, err := Thumbprints(key)
 	if err != nil {
 		return err
 	}
 
 	for _, thumb := range thumbs {
-		t.advertisements[thumb] = advertisement
+		advertisements[thumb] = advertisement
 	}
-
 	return nil
 }
 
+// GetAdvertisement returns the advertisement signed by the signing key with the given thumbprint, or the default one.
+// Advertisements are rebuilt first once one of their keys expired, without waiting for a reload.
 func (t *Protocol) GetAdvertisement(thumbprint string) []byte {
+	t.rebuildExpired()
+	t.mu.RLock()
+	defer t.mu.RUnlock()
 	return t.advertisements[thumbprint]
 }
 
-func (t *Protocol) addExchangeKey(key jose.JSONWebKey) error {
-	thumbs, err := Thumbprints(key)
-	if err != nil {
-		return err
+// rebuildExpired rebuilds the advertisements when an advertised key expired since they were built.
+// Expired keys are never served: when no advertisement can be built anymore, none is served and the server is not ready.
+func (t *Protocol) rebuildExpired() {
+	expirer, ok := t.store.(KeyExpirer)
+	if !ok {
+		return
 	}
-
-	for _, thumb := range thumbs {
-		t.exchange[thumb] = key
+	t.mu.RLock()
+	built := t.expiry
+	t.mu.RUnlock()
+	if expirer.NextExpiry().Equal(built) {
+		return
 	}
 
-	return nil
+	t.rebuild.Lock()
+	defer t.rebuild.Unlock()
+	t.mu.RLock()
+	rebuilt := !t.expiry.Equal(built)
+	t.mu.RUnlock()
+	if rebuilt {
+		return
+	}
+	if err := t.buildAdvertisements(); err != nil {
+		t.mu.Lock()
+		t.advertisements = nil
+		t.expiry = expirer.NextExpiry()
+		t.readiness = fmt.Errorf("advertised keys expired: %w", err)
+		t.mu.Unlock()
+	}
 }
 
 /*
@@ -100,52 +188,140 @@ func (t *Protocol) addExchangeKey(key jose.JSONWebKey) error {
  	Server recovery operation: y = x * S
 */
 
+// RecoveryClient identifies the client of a recovery to the recovery policy.
+type RecoveryClient struct {
+	Address string // IP address
+	Subject string // client certificate subject, with mutual TLS
+	Ticket  string // approval ticket of a retried recovery, see ApprovalQueue
+}
+
+// SetPolicy replaces the recovery policy, nil allowing every recovery.
+func (t *Protocol) SetPolicy(policy *Policy) {
+	t.policy.Store(policy)
+}
+
+// SetApprovalQueue sets the queue of recoveries waiting for operator approvals.
+// Without, recoveries using a key which requires approvals fail with ErrApprovalRequired.
+func (t *Protocol) SetApprovalQueue(queue *ApprovalQueue) {
+	t.approvals.Store(queue)
+}
+
 func (t *Protocol) Recover(thumbprint string, request []byte) ([]byte, error) {
-	var jwkX jose.JSONWebKey
+	response, _, err := t.RecoverFor(RecoveryClient{}, thumbprint, request)
+	return response, err
+}
 
+// RecoverFor performs the recovery once the recovery policy allowed it for client, and returns the policy decision.
+// A denied recovery fails with a PolicyDeniedError, a recovery waiting for approvals with an ApprovalPendingError.
+func (t *Protocol) RecoverFor(client RecoveryClient, thumbprint string, request []byte) ([]byte, PolicyDecision, error) {
+	decision := t.authorize(client, thumbprint)
+	if !decision.Allowed {
+		return nil, decision, &PolicyDeniedError{Rule: decision.Rule}
+	}
+
+	var jwkX jose.JSONWebKey
 	if err := jwkX.UnmarshalJSON(request); err != nil {
-		return nil, err
+		return nil, decision, NewInvalidKeyError("unable to parse client recovery request: %v", err)
+	}
+	redeem, err := t.approve(client, thumbprint, jwkX, request)
+	if err != nil {
+		return nil, decision, err
 	}
 
 	y, err := t.computeRecoverKey(thumbprint, jwkX)
 	if err != nil {
-		return nil, err
+		return nil, decision, err
 	}
+	redeem()
 
-	return y.MarshalJSON()
+	response, err := y.MarshalJSON()
+	return response, decision, err
 }
 
-func (t *Protocol) computeRecoverKey(thumbprint string, jwkX jose.JSONWebKey) (jose.JSONWebKey, error) {
-	// Validate request and fetch 'x'
-	if !IsECMRKey(jwkX) {
-		return jose.JSONWebKey{}, NewInvalidKeyError("client recovery request does not contain a valid ECMR key")
+func (t *Protocol) authorize(client RecoveryClient, thumbprint string) PolicyDecision {
+	policy := t.policy.Load()
+	if policy == nil {
+		return PolicyDecision{Allowed: true}
 	}
 
-	x, ok := jwkX.Key.(*ecdsa.PublicKey)
-	if !ok {
-		return jose.JSONWebKey{}, NewInvalidKeyError("failed to fetch public key from client recovery request")
+	request := PolicyRequest{
+		Client:      client.Address,
+		Subject:     client.Subject,
+		Thumbprints: []string{thumbprint},
+		Time:        time.Now(),
 	}
-
-	// Get the server private key 'S'
-	jwkS, ok := t.exchange[thumbprint]
-	if !ok {
-		return jose.JSONWebKey{}, NewKeyNotFoundError("server key (thumbprint='%s') not found", thumbprint)
+	if describer, ok := t.store.(ExchangeKeyDescriber); ok {
+		if description, ok := describer.DescribeExchangeKey(thumbprint); ok {
+			request.Thumbprints, request.Labels = description.Thumbprints, description.Labels
+		}
 	}
+	return policy.Evaluate(request)
+}
 
-	S, ok := jwkS.Key.(*ecdsa.PrivateKey)
+// approve lets the recovery through when its key requires no approvals, or with an approved ticket.
+// Otherwise the recovery is queued, and fails with an ApprovalPendingError.
+// redeem must be called once the recovery succeeded, to use up the ticket.
+// Requests which cannot succeed are refused before being queued, so that they take no ticket.
+func (t *Protocol) approve(client RecoveryClient, thumbprint string, jwkX jose.JSONWebKey, request []byte) (redeem func(), err error) {
+	describer, ok := t.store.(ExchangeKeyDescriber)
 	if !ok {
-		return jose.JSONWebKey{}, NewInvalidKeyError("failed to read private key from server (thumbprint='%s')", thumbprint)
+		return func() {}, nil
+	}
+	description, ok := describer.DescribeExchangeKey(thumbprint)
+	if !ok || description.Approvals == 0 {
+		return func() {}, nil
 	}
 
-	if !S.Curve.IsOnCurve(x.X, x.Y) {
-		return jose.JSONWebKey{}, NewInvalidKeyError("recovery request key is not on the same EC curve point with server private key")
+	queue := t.approvals.Load()
+	if queue == nil {
+		return nil, ErrApprovalRequired
+	}
+	if client.Ticket != "" {
+		if err = queue.Check(client.Ticket, thumbprint, request); err != nil {
+			return nil, err
+		}
+		return func() { queue.Redeem(client.Ticket) }, nil
+	}
+	x, err := recoveryPoint(jwkX)
+	if err != nil {
+		return nil, err
+	}
+	if description.Curve == nil || x.Curve.Params().Name != description.Curve.Params().Name {
+		return nil, NewInvalidKeyError("recovery request key is not on the curve of the server key (thumbprint='%s')", thumbprint)
 	}
+	ticket, err := queue.Submit(client, thumbprint, request, description.Approvals)
+	if err != nil {
+		return nil, err
+	}
+	return nil, &ApprovalPendingError{Ticket: ticket}
+}
 
-	ec := NewECAlgorithm(S.Curve)
+// recoveryPoint validates the client recovery request and fetches 'x', a point of its curve.
+func recoveryPoint(jwkX jose.JSONWebKey) (*ecdsa.PublicKey, error) {
+	if !IsECMRKey(jwkX) {
+		return nil, NewInvalidKeyError("client recovery request does not contain a valid ECMR key")
+	}
+	x, ok := jwkX.Key.(*ecdsa.PublicKey)
+	if !ok {
+		return nil, NewInvalidKeyError("failed to fetch public key from client recovery request")
+	}
+	if x.X == nil || x.Y == nil || !x.Curve.IsOnCurve(x.X, x.Y) {
+		return nil, NewInvalidKeyError("client recovery request key is not on its EC curve")
+	}
+	return x, nil
+}
 
-	// Final recovery computation: y = x * S
-	y := ec.Multiply(x, S)
+func (t *Protocol) computeRecoverKey(thumbprint string, jwkX jose.JSONWebKey) (jose.JSONWebKey, error) {
+	x, err := recoveryPoint(jwkX)
+	if err != nil {
+		return jose.JSONWebKey{}, err
+	}
 
+	// Final recovery computation inside the key store: y = x * S
+	y, err := t.store.ECMRMultiply(thumbprint, x)
+	if err != nil {
+		return jose.JSONWebKey{}, err
+	}
 	return CreateExchangeKey(y), nil
 }
 
@@ -170,7 +346,7 @@ type KeyNotFoundError struct {
 }
 
 func NewKeyNotFoundError(format string, a ...interface{}) error {
-	return &InvalidKeyError{
+	return &KeyNotFoundError{
 		msg: fmt.Sprintf(format, a...),
 	}
 }
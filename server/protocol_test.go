@@ -13,7 +13,7 @@ import (
 func TestProtocol_NewServer(t *testing.T) {
 	t.Run("building a vanilla server", func(t *testing.T) {
 		server, err := NewProtocol(
-			KeyList{ExchangeKey1, ExchangeKey2, SigningKey1},
+			NewMemoryKeyStore(KeyList{ExchangeKey1, ExchangeKey2, SigningKey1}),
 		)
 		require.NotNil(t, server)
 		require.NoError(t, err)
@@ -26,7 +26,7 @@ func TestProtocol_NewServer(t *testing.T) {
 
 	t.Run("building a server with no exchange key", func(t *testing.T) {
 		_, err := NewProtocol(
-			KeyList{SigningKey1, SigningKey2},
+			NewMemoryKeyStore(KeyList{SigningKey1, SigningKey2}),
 		)
 
 		require.Error(t, err)
@@ -34,7 +34,7 @@ func TestProtocol_NewServer(t *testing.T) {
 
 	t.Run("building a server with no signing key", func(t *testing.T) {
 		_, err := NewProtocol(
-			KeyList{ExchangeKey1, ExchangeKey2},
+			NewMemoryKeyStore(KeyList{ExchangeKey1, ExchangeKey2}),
 		)
 
 		require.Error(t, err)
@@ -45,7 +45,7 @@ func TestProtocol_NewServer(t *testing.T) {
 		require.NoError(t, err)
 
 		_, err = NewProtocol(
-			KeyList{*rsa, SigningKey1},
+			NewMemoryKeyStore(KeyList{*rsa, SigningKey1}),
 		)
 		require.Error(t, fmt.Errorf("advertised key 0 is not an EC public key"), err)
 	})
@@ -53,7 +53,7 @@ func TestProtocol_NewServer(t *testing.T) {
 
 func TestProtocol_GetAdvertisement(t *testing.T) {
 	server, err := NewProtocol(
-		KeyList{ExchangeKey1, ExchangeKey2, SigningKey1},
+		NewMemoryKeyStore(KeyList{ExchangeKey1, ExchangeKey2, SigningKey1}),
 	)
 	require.NotEmpty(t, server)
 	require.NoError(t, err)
@@ -90,7 +90,7 @@ func TestProtocol_GetAdvertisement(t *testing.T) {
 
 func TestProtocol_Recover(t *testing.T) {
 	server, err := NewProtocol(
-		KeyList{ExchangeKey1, ExchangeKey2, ExchangeKey3, SigningKey1},
+		NewMemoryKeyStore(KeyList{ExchangeKey1, ExchangeKey2, ExchangeKey3, SigningKey1}),
 	)
 	require.NotEmpty(t, server)
 	require.NoError(t, err)
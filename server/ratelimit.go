@@ -0,0 +1,116 @@
+package server
+
+import (
+	"math"
+	"sync"
+	"time"
+)
+
+/*
+Per-client token bucket rate limiting, with a global cap on concurrent recovery computations.
+Every recovery costs a scalar multiplication on the server, so an anonymous client must not be able to pin the CPUs.
+*/
+const (
+	RouteAdvertisement = "adv"
+	RouteRecovery      = "rec"
+)
+
+// Full buckets are dropped periodically, so tracking clients does not grow unbounded.
+const bucketSweepInterval = time.Minute
+
+type RateLimit struct {
+	Rate  float64 `json:"rate" yaml:"rate"`   // Tokens refilled per second
+	Burst int     `json:"burst" yaml:"burst"` // Bucket size
+}
+
+type bucket struct {
+	limit  RateLimit
+	tokens float64
+	last   time.Time
+}
+
+func (t *bucket) refill(now time.Time) {
+	t.tokens = math.Min(float64(t.limit.Burst), t.tokens+now.Sub(t.last).Seconds()*t.limit.Rate)
+	t.last = now
+}
+
+type RateLimiter struct {
+	limits     map[string]RateLimit // route -> limit, routes without limit are not throttled
+	recoveries chan struct{}        // recovery computation slots, nil when unlimited
+	now        func() time.Time
+
+	mu        sync.Mutex
+	buckets   map[string]*bucket // route + client address -> bucket
+	lastSweep time.Time
+}
+
+// NewRateLimiter creates a limiter with per-route limits, and at most maxRecoveries concurrent recoveries (0 means unlimited).
+func NewRateLimiter(limits map[string]RateLimit, maxRecoveries int) *RateLimiter {
+	limiter := RateLimiter{
+		limits:  limits,
+		now:     time.Now,
+		buckets: make(map[string]*bucket),
+	}
+	if maxRecoveries > 0 {
+		limiter.recoveries = make(chan struct{}, maxRecoveries)
+	}
+	return &limiter
+}
+
+// Allow takes a token from the client's bucket of the route, or tells how long to wait for the next one.
+func (t *RateLimiter) Allow(route string, client string) (bool, time.Duration) {
+	limit, ok := t.limits[route]
+	if !ok {
+		return true, 0
+	}
+	if limit.Rate <= 0 || limit.Burst <= 0 {
+		// Closed route, there is no point in retrying.
+		return false, 0
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	now := t.now()
+	t.sweep(now)
+
+	key := route + " " + client
+	b, ok := t.buckets[key]
+	if !ok {
+		b = &bucket{limit: limit, tokens: float64(limit.Burst), last: now}
+		t.buckets[key] = b
+	}
+	b.refill(now)
+
+	if b.tokens >= 1 {
+		b.tokens--
+		return true, 0
+	}
+	wait := time.Duration((1 - b.tokens) / limit.Rate * float64(time.Second))
+	return false, wait
+}
+
+// AcquireRecovery reserves a recovery computation slot, the returned function releases it.
+func (t *RateLimiter) AcquireRecovery() (func(), bool) {
+	if t.recoveries == nil {
+		return func() {}, true
+	}
+	select {
+	case t.recoveries <- struct{}{}:
+		return func() { <-t.recoveries }, true
+	default:
+		return nil, false
+	}
+}
+
+func (t *RateLimiter) sweep(now time.Time) {
+	if now.Sub(t.lastSweep) < bucketSweepInterval {
+		return
+	}
+	t.lastSweep = now
+	for key, b := range t.buckets {
+		if b.refill(now); b.tokens >= float64(b.limit.Burst) {
+			delete(t.buckets, key)
+		}
+	}
+}
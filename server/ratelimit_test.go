@@ -0,0 +1,108 @@
+package server
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	. "go-citrus/internal"
+)
+
+func TestRateLimiter_Allow(t *testing.T) {
+	clock := time.Date(2025, time.January, 1, 0, 0, 0, 0, time.UTC)
+	limiter := NewRateLimiter(map[string]RateLimit{RouteRecovery: {Rate: 0.5, Burst: 2}}, 0)
+	limiter.now = func() time.Time { return clock }
+
+	t.Run("burst then throttle", func(t *testing.T) {
+		for i := 0; i < 2; i++ {
+			ok, _ := limiter.Allow(RouteRecovery, "192.0.2.1")
+			require.True(t, ok)
+		}
+		ok, retryAfter := limiter.Allow(RouteRecovery, "192.0.2.1")
+		require.False(t, ok)
+		require.Equal(t, 2*time.Second, retryAfter)
+	})
+
+	t.Run("buckets are per client and per route", func(t *testing.T) {
+		ok, _ := limiter.Allow(RouteRecovery, "192.0.2.2")
+		require.True(t, ok)
+		ok, _ = limiter.Allow(RouteAdvertisement, "192.0.2.1")
+		require.True(t, ok)
+	})
+
+	t.Run("tokens refill over time", func(t *testing.T) {
+		clock = clock.Add(2 * time.Second)
+		ok, _ := limiter.Allow(RouteRecovery, "192.0.2.1")
+		require.True(t, ok)
+		ok, _ = limiter.Allow(RouteRecovery, "192.0.2.1")
+		require.False(t, ok)
+	})
+
+	t.Run("full buckets are swept", func(t *testing.T) {
+		clock = clock.Add(time.Hour)
+		_, _ = limiter.Allow(RouteRecovery, "192.0.2.3")
+		require.Len(t, limiter.buckets, 1)
+	})
+}
+
+func TestRateLimiter_AcquireRecovery(t *testing.T) {
+	limiter := NewRateLimiter(nil, 1)
+
+	release, ok := limiter.AcquireRecovery()
+	require.True(t, ok)
+	_, ok = limiter.AcquireRecovery()
+	require.False(t, ok)
+
+	release()
+	release, ok = limiter.AcquireRecovery()
+	require.True(t, ok)
+	release()
+}
+
+func TestHandler_RateLimit(t *testing.T) {
+	clock := time.Date(2025, time.January, 1, 0, 0, 0, 0, time.UTC)
+	limiter := NewRateLimiter(map[string]RateLimit{RouteRecovery: {Rate: 0.1, Burst: 1}}, 1)
+	limiter.now = func() time.Time { return clock }
+	handler := newTestHandler(t).WithRateLimiter(limiter)
+	metrics := NewMetrics(handler.protocol)
+	handler.WithMetrics(metrics)
+
+	recoverWith := func() *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodPost, "/rec/"+ExchangeKey1Thp, bytes.NewReader(recoveryRequest(t)))
+		handler.ServeHTTP(rec, req)
+		return rec
+	}
+
+	require.Equal(t, http.StatusOK, recoverWith().Code)
+
+	rec := recoverWith()
+	require.Equal(t, http.StatusTooManyRequests, rec.Code)
+	require.Equal(t, "10", rec.Header().Get("Retry-After"))
+
+	// Advertisements are not limited
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/adv", nil))
+	require.Equal(t, http.StatusOK, rec.Code)
+
+	t.Run("concurrency cap", func(t *testing.T) {
+		clock = clock.Add(time.Minute)
+		release, ok := limiter.AcquireRecovery()
+		require.True(t, ok)
+		defer release()
+
+		rec := recoverWith()
+		require.Equal(t, http.StatusTooManyRequests, rec.Code)
+		require.Equal(t, "1", rec.Header().Get("Retry-After"))
+
+		var body strings.Builder
+		require.NoError(t, metrics.Expose(&body))
+		require.Contains(t, body.String(), `citrus_rate_limit_rejections_total{route="rec",reason="concurrency"} 1`+"\n")
+		require.Contains(t, body.String(), `citrus_rate_limit_rejections_total{route="rec",reason="rate_limit"} 1`+"\n")
+	})
+}
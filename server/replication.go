@@ -0,0 +1,384 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-jose/go-jose/v4"
+
+	. "go-citrus/internal"
+)
+
+/*
+Key-set replication from a primary server to secondaries, so that every instance recovers the bindings made against any other:
+  - the primary Replicator pushes its whole key set (advertised and rotated keys, with their metadata) after every change
+    of its Rotator, and on a schedule for secondaries which missed a push; new, rotated and retired keys all reach them so,
+  - each push is encrypted with JWE to the replica key of the secondary (see Replica),
+  - and carried by a replicate admin request (POST /admin/replicate), signed with the primary key,
+    which secondaries list among their operator keys (see AdminHandler.WithReplication).
+
+A secondary checks the key set loads before touching its key directory, then writes it into a staging subdirectory
+and renames that one once complete, which commits the key set. The committed key set replaces the directory content,
+and the directory is reloaded through the protocol reload path. A secondary stopping midway completes the committed
+key set the next time its directory is loaded (see finishReplication), so it serves either key set as a whole.
+Snapshots are versioned with the primary clock: a secondary refuses snapshots older than the last one it applied.
+The version is committed along with the key set, so that a restart does not allow replaying older snapshots.
+*/
+const (
+	replicationType = "citrus-keyset+json"
+
+	// Subdirectories of a secondary key directory, see stageReplication.
+	replicationStaging   = ".replicate.tmp"
+	replicationCommitted = ".replicate"
+	replicationManifest  = "manifest.json" // names of the staged files
+	replicationVersion   = ".replicated"   // version of the applied key set, see Rotator.replicated
+)
+
+// replicationSnapshot is the plaintext of the key set pushed to a replica.
+type replicationSnapshot struct {
+	Version int64 `json:"version"` // primary time of the snapshot, Unix nanoseconds
+	keySet
+}
+
+// Replica is a secondary server fed by a Replicator.
+type Replica struct {
+	URL string          `json:"url"` // admin API URL of the secondary
+	Key jose.JSONWebKey `json:"key"` // public key the key set is encrypted to, its key ID naming the replica
+}
+
+// LoadReplicas reads a JSON file listing the replicas of a primary.
+func LoadReplicas(path string) ([]Replica, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var replicas []Replica
+	if err = json.Unmarshal(data, &replicas); err != nil {
+		return nil, fmt.Errorf("unable to parse replicas '%s': %w", path, err)
+	}
+	for _, replica := range replicas {
+		if replica.URL == "" || replica.Key.KeyID == "" || !replica.Key.IsPublic() {
+			return nil, fmt.Errorf("replicas in '%s' need an URL and a public key with a key ID", path)
+		}
+	}
+	if len(replicas) == 0 {
+		return nil, fmt.Errorf("no replica found in '%s'", path)
+	}
+	return replicas, nil
+}
+
+// Replicator pushes the key set managed by a Rotator to replicas.
+type Replicator struct {
+	rotator  *Rotator
+	signer   jose.JSONWebKey
+	replicas []Replica
+	client   *http.Client
+	logger   *slog.Logger
+}
+
+// NewReplicator pushes the key set of rotator to replicas, signing the pushes with signer, a private key whose key ID
+// is among the operator keys of every replica.
+func NewReplicator(rotator *Rotator, signer jose.JSONWebKey, replicas []Replica, logger *slog.Logger) *Replicator {
+	return &Replicator{
+		rotator:  rotator,
+		signer:   signer,
+		replicas: replicas,
+		client:   &http.Client{Timeout: 30 * time.Second},
+		logger:   logger,
+	}
+}
+
+// WithHTTPClient sets the client of the pushes, e.g. to reach replicas over TLS.
+func (t *Replicator) WithHTTPClient(client *http.Client) *Replicator {
+	t.client = client
+	return t
+}
+
+// Run pushes the key set on every change of the rotator, and every interval, until ctx is done.
+// Failed pushes are logged and retried with the next one.
+func (t *Replicator) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		if err := t.Push(); err != nil {
+			t.logger.Error("key replication failed", "error", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		case <-t.rotator.Changes():
+		}
+	}
+}
+
+// Push sends the current key set to every replica.
+func (t *Replicator) Push() error {
+	snapshot, err := t.rotator.snapshot()
+	if err != nil {
+		return err
+	}
+	defer snapshot.wipe()
+	plaintext, err := json.Marshal(snapshot)
+	if err != nil {
+		return err
+	}
+	defer WipeBytes(plaintext)
+
+	var errs []error
+	for _, replica := range t.replicas {
+		if err = t.push(replica, plaintext); err != nil {
+			errs = append(errs, fmt.Errorf("replica '%s': %w", replica.Key.KeyID, err))
+			continue
+		}
+		t.logger.Info("key set replicated", "replica", replica.Key.KeyID, "version", snapshot.Version)
+	}
+	return errors.Join(errs...)
+}
+
+func (t *Replicator) push(replica Replica, plaintext []byte) error {
+	encrypted, err := encryptTo(replica.Key, plaintext, replicationType)
+	if err != nil {
+		return err
+	}
+	request, err := NewAdminRequest(AdminActionReplicate, "")
+	if err != nil {
+		return err
+	}
+	request.KeySet = string(encrypted)
+	body, err := SignAdminRequest(t.signer, request)
+	if err != nil {
+		return err
+	}
+
+	resp, err := t.client.Post(strings.TrimSuffix(replica.URL, "/")+AdminPath(AdminActionReplicate, ""),
+		"application/jose", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent {
+		message, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("status %d: %s", resp.StatusCode, strings.TrimSpace(string(message)))
+	}
+	return nil
+}
+
+// snapshot reads the key set of the directory, versioned with the current time.
+func (t *Rotator) snapshot() (replicationSnapshot, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	set, err := loadKeySet(t.dir, t.passphrase)
+	if err != nil {
+		return replicationSnapshot{}, err
+	}
+	return replicationSnapshot{Version: t.now().UnixNano(), keySet: set}, nil
+}
+
+// replicate brings the key directory in line with a snapshot of the primary key set, then reloads it.
+func (t *Rotator) replicate(snapshot replicationSnapshot) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if snapshot.Version <= t.replicated {
+		return NewInvalidKeyError("key set version %d is not newer than the applied version %d", snapshot.Version, t.replicated)
+	}
+
+	// Nothing is written unless the key set can be served.
+	check := newMemoryKeyStore(snapshot.Keys, snapshot.Rotated, snapshot.Metadata, t.now)
+	_, err := NewProtocol(check)
+	check.Wipe()
+	if err != nil {
+		return NewInvalidKeyError("replicated key set cannot be served: %v", err)
+	}
+
+	// A key set left committed by a failed replication is completed before staging the next one.
+	if err = finishReplication(t.dir); err != nil {
+		return err
+	}
+	states, err := keyFileStates(t.dir)
+	if err != nil {
+		return err
+	}
+	if err = stageReplication(t.dir, snapshot, t.passphrase); err != nil {
+		return err
+	}
+	if err = finishReplication(t.dir); err != nil {
+		return err
+	}
+
+	wanted := make(map[string]bool)
+	for i, key := range append(snapshot.Keys[:len(snapshot.Keys):len(snapshot.Keys)], snapshot.Rotated...) {
+		thp, err := KeyThumbprint(key)
+		if err != nil {
+			return err
+		}
+		rotated := i >= len(snapshot.Keys)
+		wanted[thp] = true
+		current, exists := states[thp]
+		switch {
+		case !exists:
+			t.logger.Info("key replicated", "thumbprint", thp, "rotated", rotated)
+		case rotated && !current:
+			t.logger.Info("key rotated", "thumbprint", thp)
+		case !rotated && current:
+			t.logger.Info("key advertised again", "thumbprint", thp)
+		}
+	}
+	for thp := range states {
+		if !wanted[thp] {
+			t.logger.Info("key retired", "thumbprint", thp)
+		}
+	}
+
+	if err = t.reload(); err != nil {
+		return err
+	}
+	t.replicated = snapshot.Version
+	return nil
+}
+
+// keyFileStates lists the keys of a key directory by thumbprint, telling whether each one is rotated.
+func keyFileStates(dir string) (map[string]bool, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	states := make(map[string]bool)
+	for _, entry := range entries {
+		name := entry.Name()
+		ext := filepath.Ext(name)
+		if entry.IsDir() || (ext != plainKeyExt && ext != wrappedKeyExt) {
+			continue
+		}
+		thp, rotated := strings.CutPrefix(strings.TrimSuffix(name, ext), ".")
+		states[thp] = rotated
+	}
+	return states, nil
+}
+
+// stageReplication writes the key set and version of snapshot into a staging subdirectory of dir, with the manifest
+// of its files, then commits it by renaming the subdirectory. finishReplication applies the committed key set.
+func stageReplication(dir string, snapshot replicationSnapshot, passphrase PassphraseFn) error {
+	staging := filepath.Join(dir, replicationStaging)
+	if err := os.RemoveAll(staging); err != nil {
+		return err
+	}
+	if err := os.Mkdir(staging, 0o700); err != nil {
+		return err
+	}
+	err := writeKeySet(staging, snapshot.keySet, passphrase)
+	if err == nil {
+		err = writeFileAtomic(filepath.Join(staging, replicationVersion), []byte(strconv.FormatInt(snapshot.Version, 10)))
+	}
+	if err != nil {
+		_ = os.RemoveAll(staging)
+		return err
+	}
+	entries, err := os.ReadDir(staging)
+	if err != nil {
+		return err
+	}
+	names := make([]string, 0, len(entries))
+	for _, entry := range entries {
+		names = append(names, entry.Name())
+	}
+	data, err := json.Marshal(names)
+	if err != nil {
+		return err
+	}
+	if err = writeFileAtomic(filepath.Join(staging, replicationManifest), data); err != nil {
+		return err
+	}
+	return os.Rename(staging, filepath.Join(dir, replicationCommitted))
+}
+
+// finishReplication replaces the keys and metadata of dir with the committed key set of a replication, if any.
+// It can be repeated after an interruption. An uncommitted staging subdirectory is dropped instead.
+func finishReplication(dir string) error {
+	committed := filepath.Join(dir, replicationCommitted)
+	data, err := os.ReadFile(filepath.Join(committed, replicationManifest))
+	if errors.Is(err, fs.ErrNotExist) {
+		return os.RemoveAll(filepath.Join(dir, replicationStaging))
+	}
+	if err != nil {
+		return err
+	}
+	var names []string
+	if err = json.Unmarshal(data, &names); err != nil {
+		return fmt.Errorf("invalid replication manifest in '%s': %w", committed, err)
+	}
+	staged := make(map[string]bool, len(names))
+	for _, name := range names {
+		staged[name] = true
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || staged[name] || !isKeyDirFile(name) {
+			continue
+		}
+		if err = os.Remove(filepath.Join(dir, name)); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+	}
+	for _, name := range names {
+		// Files moved before an interruption are not staged anymore.
+		err = os.Rename(filepath.Join(committed, name), filepath.Join(dir, name))
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+	}
+	return os.RemoveAll(committed)
+}
+
+// PendingReplication returns the directory of the key set a replication committed into dir but did not apply yet,
+// which NewFileKeyStore applies, or an empty string.
+func PendingReplication(dir string) (string, error) {
+	committed := filepath.Join(dir, replicationCommitted)
+	_, err := os.Stat(filepath.Join(committed, replicationManifest))
+	if errors.Is(err, fs.ErrNotExist) {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	return committed, nil
+}
+
+// loadReplicationVersion reads the version of the last key set replicated into dir, 0 when none was.
+func loadReplicationVersion(dir string) (int64, error) {
+	data, err := os.ReadFile(filepath.Join(dir, replicationVersion))
+	if errors.Is(err, fs.ErrNotExist) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	version, err := strconv.ParseInt(strings.TrimSpace(string(data)), 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid replicated key set version in '%s': %w", dir, err)
+	}
+	return version, nil
+}
+
+// isKeyDirFile tells whether name is a key or metadata file name.
+func isKeyDirFile(name string) bool {
+	ext := filepath.Ext(name)
+	return ext == plainKeyExt || ext == wrappedKeyExt || strings.HasSuffix(name, metadataExt)
+}
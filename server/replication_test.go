@@ -0,0 +1,216 @@
+package server
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/go-jose/go-jose/v4"
+	"github.com/stretchr/testify/require"
+
+	. "go-citrus/internal"
+)
+
+func newTestRotator(t *testing.T, keys ...jose.JSONWebKey) (*Rotator, *Protocol, string) {
+	dir := t.TempDir()
+	for _, key := range keys {
+		_, err := WriteKey(dir, key, nil)
+		require.NoError(t, err)
+	}
+	protocol, err := NewProtocolFromDir(dir, nil)
+	require.NoError(t, err)
+	return NewRotator(protocol, dir, nil, RotationPolicy{}, slog.New(slog.NewTextHandler(io.Discard, nil))), protocol, dir
+}
+
+func advertisedThumbprints(t *testing.T, protocol *Protocol) []string {
+	adv, err := ParseAdvertisement(protocol.GetAdvertisement(""), []jose.SignatureAlgorithm{DefaultSignatureAlgorithm})
+	require.NoError(t, err)
+	return thumbprintsOf(t, adv.ExchangeKeys())
+}
+
+func TestReplication(t *testing.T) {
+	primary, primaryProtocol, primaryDir := newTestRotator(t, ExchangeKey1, SigningKey1)
+	secondary, secondaryProtocol, secondaryDir := newTestRotator(t, ExchangeKey2, SigningKey1)
+	meta, err := NewKeyMetadata(ExchangeKey1, time.Now())
+	require.NoError(t, err)
+	meta.Labels = map[string]string{"site": "dc1"}
+	require.NoError(t, WriteMetadata(primaryDir, ExchangeKey1Thp, meta))
+
+	signer := newOperatorKey(t, "primary")
+	replicaKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	replica := jose.JSONWebKey{Key: replicaKey, KeyID: "dc2"}
+	sink := &memoryAuditSink{}
+	admin := NewAdminHandler(secondary, OperatorKeys{"primary": signer.Public()}).WithReplication(replica).WithAudit(sink)
+	srv := httptest.NewServer(admin)
+	t.Cleanup(srv.Close)
+
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	replicator := NewReplicator(primary, signer, []Replica{{URL: srv.URL, Key: replica.Public()}}, logger)
+
+	t.Run("secondaries serve the primary key set", func(t *testing.T) {
+		require.NoError(t, replicator.Push())
+		require.Equal(t, advertisedThumbprints(t, primaryProtocol), advertisedThumbprints(t, secondaryProtocol))
+
+		x, err := GenerateExchangeKey()
+		require.NoError(t, err)
+		_, err = secondaryProtocol.computeRecoverKey(ExchangeKey1Thp, x.Public())
+		require.NoError(t, err)
+		_, err = secondaryProtocol.computeRecoverKey(ExchangeKey2Thp, x.Public())
+		require.Error(t, err, "keys unknown to the primary are retired")
+
+		description, ok := secondaryProtocol.store.(ExchangeKeyDescriber).DescribeExchangeKey(ExchangeKey1Thp)
+		require.True(t, ok)
+		require.Equal(t, meta.Labels, description.Labels)
+		require.Equal(t, "primary", sink.records[0].Operator)
+		require.Equal(t, AdminActionReplicate, sink.records[0].Action)
+	})
+
+	t.Run("rotations reach the secondaries", func(t *testing.T) {
+		require.NoError(t, primary.RotateNow())
+		select {
+		case <-primary.Changes():
+		default:
+			t.Fatal("rotation not signaled")
+		}
+		require.NoError(t, replicator.Push())
+		require.Equal(t, advertisedThumbprints(t, primaryProtocol), advertisedThumbprints(t, secondaryProtocol))
+		require.FileExists(t, filepath.Join(secondaryDir, "."+ExchangeKey1Thp+".jwk"))
+
+		x, err := GenerateExchangeKey()
+		require.NoError(t, err)
+		_, err = secondaryProtocol.computeRecoverKey(ExchangeKey1Thp, x.Public())
+		require.NoError(t, err, "rotated keys stay recoverable")
+	})
+
+	t.Run("older key sets are refused", func(t *testing.T) {
+		snapshot, err := primary.snapshot()
+		require.NoError(t, err)
+		snapshot.Version = secondary.replicated
+		require.ErrorContains(t, secondary.replicate(snapshot), "not newer")
+
+		// A captured push cannot be replayed after a restart either.
+		restarted := NewRotator(secondaryProtocol, secondaryDir, nil, RotationPolicy{}, logger)
+		require.NotZero(t, restarted.replicated)
+		require.Equal(t, secondary.replicated, restarted.replicated)
+		require.ErrorContains(t, restarted.replicate(snapshot), "not newer")
+	})
+
+	t.Run("key sets which cannot be served are refused", func(t *testing.T) {
+		entries, err := os.ReadDir(secondaryDir)
+		require.NoError(t, err)
+		snapshot := replicationSnapshot{Version: time.Now().Add(time.Hour).UnixNano(), keySet: keySet{Keys: KeyList{ExchangeKey2}}}
+		require.Error(t, secondary.replicate(snapshot))
+
+		after, err := os.ReadDir(secondaryDir)
+		require.NoError(t, err)
+		require.Equal(t, len(entries), len(after), "the key directory is left untouched")
+	})
+
+	t.Run("pushes encrypted to another replica key fail", func(t *testing.T) {
+		other := newOperatorKey(t, "dc2")
+		failing := NewReplicator(primary, signer, []Replica{{URL: srv.URL, Key: other.Public()}}, logger)
+		require.ErrorContains(t, failing.Push(), "400")
+	})
+
+	t.Run("pushes signed by unknown keys fail", func(t *testing.T) {
+		failing := NewReplicator(primary, newOperatorKey(t, "mallory"), []Replica{{URL: srv.URL, Key: replica.Public()}}, logger)
+		require.ErrorContains(t, failing.Push(), "401")
+	})
+}
+
+func TestFinishReplication(t *testing.T) {
+	t.Run("committed key sets are completed on load", func(t *testing.T) {
+		dir := t.TempDir()
+		for _, key := range []jose.JSONWebKey{ExchangeKey2, SigningKey1} {
+			_, err := WriteKey(dir, key, nil)
+			require.NoError(t, err)
+		}
+		set := keySet{Keys: KeyList{ExchangeKey1, SigningKey1}, Rotated: KeyList{ExchangeKey2}}
+		require.NoError(t, stageReplication(dir, replicationSnapshot{Version: 1, keySet: set}, nil))
+		// Stopped midway: one file was moved already.
+		require.NoError(t, os.Rename(filepath.Join(dir, replicationCommitted, ExchangeKey1Thp+".jwk"), filepath.Join(dir, ExchangeKey1Thp+".jwk")))
+
+		store, err := NewFileKeyStore(dir, nil)
+		require.NoError(t, err)
+		defer store.Wipe()
+		states, err := keyFileStates(dir)
+		require.NoError(t, err)
+		require.Equal(t, map[string]bool{ExchangeKey1Thp: false, SigningKey1Thp: false, ExchangeKey2Thp: true}, states)
+		require.NoDirExists(t, filepath.Join(dir, replicationCommitted))
+		version, err := loadReplicationVersion(dir)
+		require.NoError(t, err)
+		require.Equal(t, int64(1), version, "the version is committed with the key set")
+	})
+
+	t.Run("pending key sets are left alone by LoadKeyStore", func(t *testing.T) {
+		dir := t.TempDir()
+		for _, key := range []jose.JSONWebKey{ExchangeKey2, SigningKey1} {
+			_, err := WriteKey(dir, key, nil)
+			require.NoError(t, err)
+		}
+		pending, err := PendingReplication(dir)
+		require.NoError(t, err)
+		require.Empty(t, pending)
+		require.NoError(t, stageReplication(dir, replicationSnapshot{Version: 1, keySet: keySet{Keys: KeyList{ExchangeKey1, SigningKey1}}}, nil))
+
+		store, err := LoadKeyStore(dir, nil)
+		require.NoError(t, err)
+		defer store.Wipe()
+		_, ok := store.DescribeExchangeKey(ExchangeKey2Thp)
+		require.True(t, ok, "the current key set is loaded")
+		pending, err = PendingReplication(dir)
+		require.NoError(t, err)
+		require.Equal(t, filepath.Join(dir, replicationCommitted), pending)
+		states, err := keyFileStates(dir)
+		require.NoError(t, err)
+		require.Equal(t, map[string]bool{ExchangeKey2Thp: false, SigningKey1Thp: false}, states)
+	})
+
+	t.Run("uncommitted key sets are dropped", func(t *testing.T) {
+		dir := t.TempDir()
+		for _, key := range []jose.JSONWebKey{ExchangeKey2, SigningKey1} {
+			_, err := WriteKey(dir, key, nil)
+			require.NoError(t, err)
+		}
+		staging := filepath.Join(dir, replicationStaging)
+		require.NoError(t, os.Mkdir(staging, 0o700))
+		_, err := WriteKey(staging, ExchangeKey1, nil)
+		require.NoError(t, err)
+
+		require.NoError(t, finishReplication(dir))
+		states, err := keyFileStates(dir)
+		require.NoError(t, err)
+		require.Equal(t, map[string]bool{ExchangeKey2Thp: false, SigningKey1Thp: false}, states)
+		require.NoDirExists(t, staging)
+	})
+}
+
+func TestLoadReplicas(t *testing.T) {
+	replica := newOperatorKey(t, "dc2")
+	write := func(t *testing.T, replicas []Replica) string {
+		data, err := json.Marshal(replicas)
+		require.NoError(t, err)
+		path := filepath.Join(t.TempDir(), "replicas.json")
+		require.NoError(t, os.WriteFile(path, data, 0o600))
+		return path
+	}
+
+	replicas, err := LoadReplicas(write(t, []Replica{{URL: "https://dc2:8081", Key: replica.Public()}}))
+	require.NoError(t, err)
+	require.Len(t, replicas, 1)
+	require.Equal(t, "dc2", replicas[0].Key.KeyID)
+
+	_, err = LoadReplicas(write(t, []Replica{{URL: "https://dc2:8081", Key: replica}}))
+	require.Error(t, err, "private keys are refused")
+	_, err = LoadReplicas(write(t, nil))
+	require.Error(t, err)
+}
@@ -0,0 +1,477 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"math"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/go-jose/go-jose/v4"
+
+	. "go-citrus/internal"
+)
+
+/*
+Time-based key rotation of a server key directory.
+Key life cycle: active (advertised) -> rotated (hidden, recovery only) -> retired (deleted).
+A key's age is taken from its metadata. Keys without creation or rotation time are adopted,
+i.e. their clock starts at the first rotation pass seeing them.
+*/
+type RotationPolicy struct {
+	RotateAfter time.Duration // Age after which active keys are replaced by new ones and demoted to rotated
+	RetireAfter time.Duration // Time a rotated key stays recoverable before being deleted, 0 keeps rotated keys forever
+}
+
+// Kinds of keys a server needs, one of each being advertised at least.
+// Keys are generated with the algorithm of the keys they replace, the default one of their kind for an empty algorithm.
+var keyKinds = []struct {
+	name     string
+	match    func(jose.JSONWebKey) bool
+	generate generateFn
+}{
+	{KeyKindExchange, IsExchangeKey, func(string) (jose.JSONWebKey, error) { return GenerateExchangeKey() }},
+	{KeyKindSigning, IsSigningKey, generateSigningKey},
+}
+
+type generateFn func(algorithm string) (jose.JSONWebKey, error)
+
+func generateSigningKey(algorithm string) (jose.JSONWebKey, error) {
+	if algorithm == "" {
+		return GenerateSigningKey()
+	}
+	return GenerateSigningKeyWith(jose.SignatureAlgorithm(algorithm))
+}
+
+const (
+	KeyKindExchange = "exchange"
+	KeyKindSigning  = "signing"
+)
+
+// Rotator manages a key directory: rotation passes on a schedule, and on demand key operations (e.g. from the admin API).
+type Rotator struct {
+	protocol   *Protocol // Protocol serving dir, reloaded after every change
+	dir        string
+	passphrase PassphraseFn
+	policy     RotationPolicy
+	logger     *slog.Logger
+	now        func() time.Time
+
+	mu         sync.Mutex    // serializes changes to dir
+	changes    chan struct{} // signaled after every change, see Changes
+	replicated int64         // version of the last replication snapshot applied, see Replicator
+}
+
+// NewRotator manages dir, resuming from the version of the last replication applied to it.
+func NewRotator(protocol *Protocol, dir string, passphrase PassphraseFn, policy RotationPolicy, logger *slog.Logger) *Rotator {
+	replicated, err := loadReplicationVersion(dir)
+	if err != nil {
+		// Refusing every replication rather than accepting older key sets.
+		logger.Error("unable to read the replicated key set version, replication is disabled", "error", err)
+		replicated = math.MaxInt64
+	}
+	return &Rotator{
+		protocol:   protocol,
+		dir:        dir,
+		passphrase: passphrase,
+		policy:     policy,
+		logger:     logger,
+		now:        time.Now,
+		changes:    make(chan struct{}, 1),
+		replicated: replicated,
+	}
+}
+
+// Changes is signaled once the key directory changed and was reloaded. Changes in a row may be signaled once.
+func (t *Rotator) Changes() <-chan struct{} {
+	return t.changes
+}
+
+// reload rebuilds the advertisements after a change to dir, and signals it. mu must be held.
+func (t *Rotator) reload() error {
+	if err := t.protocol.Reload(); err != nil {
+		return err
+	}
+	select {
+	case t.changes <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// Run performs a rotation pass every interval until ctx is done. Failed passes are logged and retried on the next tick.
+func (t *Rotator) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		if err := t.Rotate(); err != nil {
+			t.logger.Error("key rotation failed", "error", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Rotate performs a single rotation pass over the key directory, and rebuilds the advertisements on change.
+func (t *Rotator) Rotate() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.rotate(false)
+}
+
+// RotateNow replaces every active key with a new one right away, whatever its age. Rotated keys are not retired.
+func (t *Rotator) RotateNow() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.rotate(true)
+}
+
+func (t *Rotator) rotate(force bool) error {
+	now := t.now().UTC()
+
+	metadata, err := LoadMetadata(t.dir)
+	if err != nil {
+		return err
+	}
+	active, err := LoadKeys(t.dir, t.passphrase)
+	if err != nil {
+		return err
+	}
+	defer wipeKeys(active)
+	rotated, err := LoadRotatedKeys(t.dir, t.passphrase)
+	if err != nil {
+		return err
+	}
+	defer wipeKeys(rotated)
+
+	changed := false
+	if t.policy.RotateAfter > 0 || force {
+		for _, kind := range keyKinds {
+			var keys KeyList
+			for _, key := range active {
+				if kind.match(key) {
+					keys = append(keys, key)
+				}
+			}
+			rotatedKind, err := t.rotateKind(kind.name, keys, kind.generate, metadata, now, force)
+			if err != nil {
+				return err
+			}
+			changed = changed || rotatedKind
+		}
+	}
+
+	if t.policy.RetireAfter > 0 && !force {
+		retired, err := t.retire(rotated, metadata, now)
+		if err != nil {
+			return err
+		}
+		changed = changed || retired
+	}
+
+	if !changed {
+		return nil
+	}
+	if err = t.reload(); err != nil {
+		return err
+	}
+	t.logger.Info("advertisement rebuilt")
+	return nil
+}
+
+// rotateKind replaces the active keys of one kind with a new key once the youngest of them reached RotateAfter, or when forced.
+// Active keys of different algorithms are each replaced by a new key of their algorithm, so that the mix is kept.
+func (t *Rotator) rotateKind(kind string, keys KeyList, generate generateFn, metadata Metadata, now time.Time, force bool) (bool, error) {
+	var youngest time.Time
+	thumbs := make([]string, 0, len(keys))
+	var algorithms []string
+	for _, key := range keys {
+		if !slices.Contains(algorithms, key.Algorithm) {
+			algorithms = append(algorithms, key.Algorithm)
+		}
+		thp, err := KeyThumbprint(key)
+		if err != nil {
+			return false, err
+		}
+		thumbs = append(thumbs, thp)
+
+		meta, err := t.adopt(key, thp, metadata)
+		if err != nil {
+			return false, err
+		}
+		if meta.CreatedAt.IsZero() {
+			meta.CreatedAt = now
+			if err = t.writeMetadata(thp, meta, metadata); err != nil {
+				return false, err
+			}
+			t.logger.Info("key adopted", "thumbprint", thp, "kind", kind)
+		}
+		if meta.CreatedAt.After(youngest) {
+			youngest = meta.CreatedAt
+		}
+	}
+	if !force && len(keys) > 0 && now.Sub(youngest) < t.policy.RotateAfter {
+		return false, nil
+	}
+
+	if len(algorithms) == 0 {
+		algorithms = []string{""}
+	}
+	for _, algorithm := range algorithms {
+		if _, err := t.generate(kind, generate, algorithm, metadata, now); err != nil {
+			return false, err
+		}
+	}
+	for _, old := range thumbs {
+		if err := t.demote(old, kind, metadata, now); err != nil {
+			return false, err
+		}
+	}
+	return true, nil
+}
+
+func (t *Rotator) generate(kind string, generate generateFn, algorithm string, metadata Metadata, now time.Time) (string, error) {
+	key, err := generate(algorithm)
+	if err != nil {
+		return "", err
+	}
+	defer wipeKey(key)
+	thp, err := KeyThumbprint(key)
+	if err != nil {
+		return "", err
+	}
+	meta, err := NewKeyMetadata(key, now)
+	if err != nil {
+		return "", err
+	}
+	if err = t.writeMetadata(thp, meta, metadata); err != nil {
+		return "", err
+	}
+	if _, err = WriteKey(t.dir, key, t.passphrase); err != nil {
+		return "", err
+	}
+	t.logger.Info("key generated", "thumbprint", thp, "kind", kind)
+	return thp, nil
+}
+
+func (t *Rotator) demote(thp string, kind string, metadata Metadata, now time.Time) error {
+	meta := metadata.Get(thp)
+	meta.RotatedAt = &now
+	if err := t.writeMetadata(thp, meta, metadata); err != nil {
+		return err
+	}
+	if err := RotateKey(t.dir, thp); err != nil {
+		return err
+	}
+	t.logger.Info("key rotated", "thumbprint", thp, "kind", kind)
+	return nil
+}
+
+// retire deletes the rotated keys which have been recoverable for RetireAfter.
+func (t *Rotator) retire(rotated KeyList, metadata Metadata, now time.Time) (bool, error) {
+	changed := false
+	for _, key := range rotated {
+		thp, err := KeyThumbprint(key)
+		if err != nil {
+			return false, err
+		}
+
+		meta, err := t.adopt(key, thp, metadata)
+		if err != nil {
+			return false, err
+		}
+		if meta.RotatedAt == nil {
+			meta.RotatedAt = &now
+			if err = t.writeMetadata(thp, meta, metadata); err != nil {
+				return false, err
+			}
+			t.logger.Info("key adopted", "thumbprint", thp, "kind", "rotated")
+			continue
+		}
+		if now.Sub(*meta.RotatedAt) < t.policy.RetireAfter {
+			continue
+		}
+
+		if err = t.retireKey(thp); err != nil {
+			return false, err
+		}
+		changed = true
+	}
+	return changed, nil
+}
+
+func (t *Rotator) retireKey(thp string) error {
+	if err := RetireKey(t.dir, thp); err != nil {
+		return err
+	}
+	t.logger.Info("key retired", "thumbprint", thp)
+	return nil
+}
+
+// Generate adds a new active key of the given kind (KeyKindExchange or KeyKindSigning), and returns its thumbprint.
+// Signing keys use algorithm, one of SigningAlgorithms, or the default one when empty. Exchange keys ignore it.
+func (t *Rotator) Generate(kind string, algorithm string) (string, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	for _, k := range keyKinds {
+		if k.name != kind {
+			continue
+		}
+		metadata, err := LoadMetadata(t.dir)
+		if err != nil {
+			return "", err
+		}
+		thp, err := t.generate(kind, k.generate, algorithm, metadata, t.now().UTC())
+		if err != nil {
+			return "", err
+		}
+		return thp, t.reload()
+	}
+	return "", fmt.Errorf("unknown key kind '%s'", kind)
+}
+
+// Demote stops advertising the active key with the given thumbprint, which remains usable for recovery.
+// The last advertised key of its kind cannot be demoted, the advertisement needs one of each.
+func (t *Rotator) Demote(thumbprint string) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	active, err := LoadKeys(t.dir, t.passphrase)
+	if err != nil {
+		return err
+	}
+	defer wipeKeys(active)
+	key, ok := findKey(active, thumbprint)
+	if !ok {
+		return NewKeyNotFoundError("active key '%s' not found", thumbprint)
+	}
+	metadata, err := LoadMetadata(t.dir)
+	if err != nil {
+		return err
+	}
+	now := t.now().UTC()
+	kind := KeyKindSigning
+	if IsExchangeKey(key) {
+		kind = KeyKindExchange
+	}
+	if !hasOtherAdvertisedKey(active, key, thumbprint, metadata, now) {
+		return NewInvalidKeyError("key '%s' is the last advertised %s key, generate another one first", thumbprint, kind)
+	}
+	if err = t.demote(thumbprint, kind, metadata, now); err != nil {
+		return err
+	}
+	return t.reload()
+}
+
+// Retire deletes the rotated key with the given thumbprint, recoveries using it fail afterwards.
+// Active keys must be demoted first.
+func (t *Rotator) Retire(thumbprint string) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	rotated, err := LoadRotatedKeys(t.dir, t.passphrase)
+	if err != nil {
+		return err
+	}
+	defer wipeKeys(rotated)
+	if _, ok := findKey(rotated, thumbprint); !ok {
+		return NewKeyNotFoundError("rotated key '%s' not found", thumbprint)
+	}
+	if err = t.retireKey(thumbprint); err != nil {
+		return err
+	}
+	return t.reload()
+}
+
+// SetApprovals sets the operator approvals required by each recovery using the exchange key with the given thumbprint.
+func (t *Rotator) SetApprovals(thumbprint string, approvals int) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	active, err := LoadKeys(t.dir, t.passphrase)
+	if err != nil {
+		return err
+	}
+	defer wipeKeys(active)
+	rotated, err := LoadRotatedKeys(t.dir, t.passphrase)
+	if err != nil {
+		return err
+	}
+	defer wipeKeys(rotated)
+	key, ok := findKey(append(active, rotated...), thumbprint)
+	if !ok || !IsExchangeKey(key) {
+		return NewKeyNotFoundError("exchange key '%s' not found", thumbprint)
+	}
+	metadata, err := LoadMetadata(t.dir)
+	if err != nil {
+		return err
+	}
+	meta, err := t.adopt(key, thumbprint, metadata)
+	if err != nil {
+		return err
+	}
+	meta.Approvals = approvals
+	if err = t.writeMetadata(thumbprint, meta, metadata); err != nil {
+		return err
+	}
+	t.logger.Info("key approvals set", "thumbprint", thumbprint, "approvals", approvals)
+	return t.reload()
+}
+
+// Keys lists the keys of the directory, see ListKeys.
+func (t *Rotator) Keys() ([]KeyInfo, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return ListKeys(t.dir, t.passphrase, t.now())
+}
+
+// Reload re-reads the key directory, e.g. after changes made by hand.
+func (t *Rotator) Reload() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.reload()
+}
+
+func findKey(keys KeyList, thumbprint string) (jose.JSONWebKey, bool) {
+	for _, key := range keys {
+		if thp, err := KeyThumbprint(key); err == nil && thp == thumbprint {
+			return key, true
+		}
+	}
+	return jose.JSONWebKey{}, false
+}
+
+// hasOtherAdvertisedKey tells whether active holds an unexpired key of the kind of key, other than the one with the given thumbprint.
+func hasOtherAdvertisedKey(active KeyList, key jose.JSONWebKey, thumbprint string, metadata Metadata, now time.Time) bool {
+	for _, other := range active {
+		if IsExchangeKey(other) != IsExchangeKey(key) || IsSigningKey(other) != IsSigningKey(key) {
+			continue
+		}
+		if thp, err := KeyThumbprint(other); err == nil && thp != thumbprint && !metadata.Get(thp).Expired(now) {
+			return true
+		}
+	}
+	return false
+}
+
+// adopt returns the metadata of a key, creating it for keys without sidecar file yet (its creation time is left unset).
+func (t *Rotator) adopt(key jose.JSONWebKey, thp string, metadata Metadata) (KeyMetadata, error) {
+	if meta, ok := metadata[thp]; ok {
+		return meta, nil
+	}
+	return NewKeyMetadata(key, time.Time{})
+}
+
+func (t *Rotator) writeMetadata(thp string, meta KeyMetadata, metadata Metadata) error {
+	if err := WriteMetadata(t.dir, thp, meta); err != nil {
+		return err
+	}
+	metadata[thp] = meta
+	return nil
+}
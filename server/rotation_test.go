@@ -0,0 +1,152 @@
+package server
+
+import (
+	"crypto/ed25519"
+	"io"
+	"log/slog"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/go-jose/go-jose/v4"
+	"github.com/stretchr/testify/require"
+
+	. "go-citrus/internal"
+)
+
+func TestRotator(t *testing.T) {
+	start := time.Date(2025, time.January, 1, 0, 0, 0, 0, time.UTC)
+	day := 24 * time.Hour
+
+	dir := t.TempDir()
+	for _, key := range []jose.JSONWebKey{ExchangeKey1, SigningKey1} {
+		_, err := WriteKey(dir, key, nil)
+		require.NoError(t, err)
+		thp, err := KeyThumbprint(key)
+		require.NoError(t, err)
+		meta, err := NewKeyMetadata(key, start)
+		require.NoError(t, err)
+		require.NoError(t, WriteMetadata(dir, thp, meta))
+	}
+
+	server, err := NewProtocolFromDir(dir, nil)
+	require.NoError(t, err)
+
+	rotator := NewRotator(server, dir, nil, RotationPolicy{RotateAfter: 90 * day, RetireAfter: 730 * day},
+		slog.New(slog.NewTextHandler(io.Discard, nil)))
+	clock := start
+	rotator.now = func() time.Time { return clock }
+
+	advertised := func(t *testing.T) *Advertisement {
+		adv, err := ParseAdvertisement(server.GetAdvertisement(""), []jose.SignatureAlgorithm{DefaultSignatureAlgorithm})
+		require.NoError(t, err)
+		return adv
+	}
+	recoverWith := func(thp string) error {
+		x, err := GenerateExchangeKey()
+		require.NoError(t, err)
+		_, err = server.computeRecoverKey(thp, x.Public())
+		return err
+	}
+
+	t.Run("young keys are kept", func(t *testing.T) {
+		clock = start.Add(10 * day)
+		require.NoError(t, rotator.Rotate())
+		require.Equal(t, ExchangeKey1Id, advertised(t).ExchangeKeys()[0].KeyID)
+	})
+
+	t.Run("old keys are rotated", func(t *testing.T) {
+		clock = start.Add(91 * day)
+		require.NoError(t, rotator.Rotate())
+
+		adv := advertised(t)
+		require.Len(t, adv.ExchangeKeys(), 1)
+		require.Len(t, adv.SigningKeys(), 1)
+		require.NotEqual(t, ExchangeKey1Id, adv.ExchangeKeys()[0].KeyID)
+		require.Nil(t, server.GetAdvertisement(SigningKey1Thp))
+		require.FileExists(t, filepath.Join(dir, "."+ExchangeKey1Thp+".jwk"))
+
+		// Rotated keys remain recoverable
+		require.NoError(t, recoverWith(ExchangeKey1Thp))
+
+		metadata, err := LoadMetadata(dir)
+		require.NoError(t, err)
+		require.Equal(t, clock, *metadata.Get(ExchangeKey1Thp).RotatedAt)
+	})
+
+	t.Run("rotated keys are retired", func(t *testing.T) {
+		clock = start.Add(91*day + 729*day)
+		require.NoError(t, rotator.Rotate())
+		require.NoError(t, recoverWith(ExchangeKey1Thp))
+
+		clock = start.Add(91*day + 730*day)
+		require.NoError(t, rotator.Rotate())
+		require.Error(t, recoverWith(ExchangeKey1Thp))
+		require.NoFileExists(t, filepath.Join(dir, "."+ExchangeKey1Thp+".jwk"))
+		require.NoFileExists(t, filepath.Join(dir, ExchangeKey1Thp+".meta.json"))
+	})
+
+	t.Run("keys without metadata are adopted", func(t *testing.T) {
+		_, err := WriteKey(dir, ExchangeKey2, nil)
+		require.NoError(t, err)
+		require.NoError(t, rotator.Rotate())
+
+		metadata, err := LoadMetadata(dir)
+		require.NoError(t, err)
+		require.Equal(t, clock, metadata.Get(ExchangeKey2Thp).CreatedAt)
+		require.Equal(t, ExchangeKey2Id, metadata.Get(ExchangeKey2Thp).KeyID)
+	})
+}
+
+func TestRotator_SigningAlgorithms(t *testing.T) {
+	es256, err := GenerateSigningKeyWith(jose.ES256)
+	require.NoError(t, err)
+	eddsa, err := GenerateSigningKeyWith(jose.EdDSA)
+	require.NoError(t, err)
+	rotator, protocol, dir := newTestRotator(t, ExchangeKey1, es256, eddsa)
+	require.NoError(t, protocol.Ready())
+
+	algorithms := func(t *testing.T) []string {
+		adv, err := ParseAdvertisement(protocol.GetAdvertisement(""), SigningAlgorithms)
+		require.NoError(t, err)
+		var algorithms []string
+		for _, key := range adv.SigningKeys() {
+			algorithms = append(algorithms, key.Algorithm)
+		}
+		return algorithms
+	}
+	require.ElementsMatch(t, []string{"ES256", "EdDSA"}, algorithms(t))
+
+	t.Run("rotation keeps the algorithms", func(t *testing.T) {
+		require.NoError(t, rotator.RotateNow())
+		require.ElementsMatch(t, []string{"ES256", "EdDSA"}, algorithms(t))
+		for _, key := range []jose.JSONWebKey{es256, eddsa} {
+			thp, err := KeyThumbprint(key)
+			require.NoError(t, err)
+			require.Nil(t, protocol.GetAdvertisement(thp))
+			require.FileExists(t, filepath.Join(dir, "."+thp+".jwk"))
+		}
+		require.NoError(t, protocol.Ready())
+	})
+
+	t.Run("generate a signing key of another algorithm", func(t *testing.T) {
+		thp, err := rotator.Generate(KeyKindSigning, string(jose.ES384))
+		require.NoError(t, err)
+		require.NotNil(t, protocol.GetAdvertisement(thp))
+		require.ElementsMatch(t, []string{"ES256", "ES384", "EdDSA"}, algorithms(t))
+
+		_, err = rotator.Generate(KeyKindSigning, string(jose.RS256))
+		require.Error(t, err)
+	})
+
+	t.Run("Ed25519 keys are wiped", func(t *testing.T) {
+		keys, err := LoadKeys(dir, nil)
+		require.NoError(t, err)
+		for _, key := range keys {
+			if private, ok := key.Key.(ed25519.PrivateKey); ok {
+				wipeKey(key)
+				require.Equal(t, make([]byte, ed25519.PrivateKeySize), []byte(private))
+			}
+		}
+	})
+}
@@ -0,0 +1,50 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+/*
+Graceful shutdown:
+ 1. the protocol reports not ready, so that load balancers stop sending requests,
+ 2. the server closes its listeners and waits for the in-flight requests, up to a deadline,
+ 3. the remaining connections are closed, and the private keys wiped.
+*/
+
+var (
+	ErrShuttingDown = errors.New("server is shutting down")
+	ErrDrainTimeout = errors.New("in-flight requests did not complete before the shutdown deadline")
+)
+
+// Drain marks the protocol as shutting down, see Ready.
+func (t *Protocol) Drain() {
+	t.draining.Store(true)
+}
+
+// Close wipes the private keys when the key store supports it. Recoveries fail afterwards.
+func (t *Protocol) Close() {
+	if wiper, ok := t.store.(Wiper); ok {
+		wiper.Wipe()
+	}
+}
+
+// Shutdown stops srv gracefully, giving the in-flight requests up to timeout to complete.
+// It fails with ErrDrainTimeout when requests had to be cut off.
+func Shutdown(srv *http.Server, protocol *Protocol, timeout time.Duration) error {
+	protocol.Drain()
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	err := srv.Shutdown(ctx)
+	if errors.Is(err, context.DeadlineExceeded) {
+		err = fmt.Errorf("%w (%s)", ErrDrainTimeout, timeout)
+		_ = srv.Close()
+	}
+
+	protocol.Close()
+	return err
+}
@@ -0,0 +1,134 @@
+package server
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	. "go-citrus/internal"
+)
+
+// slowKeyStore holds every recovery until released, once armed.
+type slowKeyStore struct {
+	*MemoryKeyStore
+	entered chan struct{}
+	release chan struct{}
+}
+
+func (t *slowKeyStore) ECMRMultiply(thumbprint string, point *ecdsa.PublicKey) (*ecdsa.PublicKey, error) {
+	if t.entered != nil {
+		t.entered <- struct{}{}
+		<-t.release
+	}
+	return t.MemoryKeyStore.ECMRMultiply(thumbprint, point)
+}
+
+// startSlowServer serves a protocol whose recoveries wait for store.release, and returns its URL
+// and the exchange key thumbprint. Shutdown wipes the keys, so they are generated.
+func startSlowServer(t *testing.T) (*http.Server, *Protocol, *slowKeyStore, string, string) {
+	exchange, err := GenerateExchangeKey()
+	require.NoError(t, err)
+	signing, err := GenerateSigningKey()
+	require.NoError(t, err)
+	thp, err := KeyThumbprint(exchange)
+	require.NoError(t, err)
+
+	store := &slowKeyStore{MemoryKeyStore: NewMemoryKeyStore(KeyList{exchange, signing})}
+	protocol, err := NewProtocol(store)
+	require.NoError(t, err)
+	store.entered = make(chan struct{})
+	store.release = make(chan struct{})
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	srv := &http.Server{Handler: NewHandler(protocol)}
+	go func() { _ = srv.Serve(listener) }()
+	return srv, protocol, store, "http://" + listener.Addr().String(), thp
+}
+
+func TestShutdown(t *testing.T) {
+	t.Run("slow recovery completes", func(t *testing.T) {
+		srv, protocol, store, url, thp := startSlowServer(t)
+
+		status := make(chan int)
+		go func() {
+			resp, err := http.Post(url+"/rec/"+thp, recoveryContentType, bytes.NewReader(recoveryRequest(t)))
+			if err != nil {
+				status <- 0
+				return
+			}
+			_ = resp.Body.Close()
+			status <- resp.StatusCode
+		}()
+		<-store.entered
+
+		shutdown := make(chan error)
+		go func() { shutdown <- Shutdown(srv, protocol, 10*time.Second) }()
+
+		require.Eventually(t, func() bool {
+			_, err := net.Dial("tcp", url[len("http://"):])
+			return err != nil
+		}, 5*time.Second, 10*time.Millisecond, "listener still accepting")
+		require.ErrorIs(t, protocol.Ready(), ErrShuttingDown)
+
+		close(store.release)
+		require.Equal(t, http.StatusOK, <-status)
+		require.NoError(t, <-shutdown)
+
+		_, err := store.MemoryKeyStore.ECMRMultiply(thp, publicPoint(t, ExchangeKey1))
+		require.ErrorIs(t, err, ErrKeysWiped)
+	})
+
+	t.Run("drain deadline", func(t *testing.T) {
+		srv, protocol, store, url, thp := startSlowServer(t)
+
+		go func() {
+			resp, err := http.Post(url+"/rec/"+thp, recoveryContentType, bytes.NewReader(recoveryRequest(t)))
+			if err == nil {
+				_ = resp.Body.Close()
+			}
+		}()
+		<-store.entered
+
+		shutdown := make(chan error)
+		go func() { shutdown <- Shutdown(srv, protocol, 50*time.Millisecond) }()
+		// The wipe waits for the recovery in progress.
+		time.Sleep(100 * time.Millisecond)
+		close(store.release)
+		require.ErrorIs(t, <-shutdown, ErrDrainTimeout)
+	})
+}
+
+func TestMemoryKeyStore_Wipe(t *testing.T) {
+	exchange, err := GenerateExchangeKey()
+	require.NoError(t, err)
+	signing, err := GenerateSigningKey()
+	require.NoError(t, err)
+	rotated, err := GenerateExchangeKey()
+	require.NoError(t, err)
+
+	rotatedThp, err := KeyThumbprint(rotated)
+	require.NoError(t, err)
+
+	store := newMemoryKeyStore(KeyList{exchange, signing}, KeyList{rotated}, nil, time.Now)
+	var copies []*ecdsa.PrivateKey
+	for _, key := range append(store.keys, store.exchange[rotatedThp]) {
+		copies = append(copies, key.Key.(*ecdsa.PrivateKey))
+	}
+	store.Wipe()
+
+	for _, key := range copies {
+		require.Zero(t, key.D.Sign())
+	}
+	// The store works on copies, the keys it was created with are left alone.
+	for _, key := range []interface{}{exchange.Key, signing.Key, rotated.Key} {
+		require.NotZero(t, key.(*ecdsa.PrivateKey).D.Sign())
+	}
+	_, err = store.Sign([]byte("payload"), AdvertisementContentType)
+	require.ErrorIs(t, err, ErrKeysWiped)
+}
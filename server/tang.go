@@ -0,0 +1,278 @@
+package server
+
+import (
+	"crypto/ecdsa"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/go-jose/go-jose/v4"
+
+	. "go-citrus/internal"
+)
+
+/*
+tangd key database (e.g. `/var/db/tang`) interoperability.
+tangd names key files by thumbprint as well, hides rotated keys, but tells key usages apart with "key_ops" instead of "use":
+  - exchange keys: {"alg": "ECMR", "key_ops": ["deriveKey"]}
+  - signing keys:  {"alg": "ES512", "key_ops": ["sign", "verify"]}
+*/
+var (
+	tangExchangeOps = []string{"deriveKey"}
+	tangSigningOps  = []string{"sign", "verify"}
+)
+
+// LoadTangKeys reads the advertised and rotated keys of a tangd key database.
+func LoadTangKeys(dir string) (KeyList, KeyList, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var active, rotated KeyList
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || filepath.Ext(name) != plainKeyExt {
+			continue
+		}
+
+		data, err := os.ReadFile(filepath.Join(dir, name))
+		if err != nil {
+			return nil, nil, err
+		}
+		key, err := parseTangKey(data)
+		if err != nil {
+			return nil, nil, fmt.Errorf("unable to load tang key file '%s': %w", name, err)
+		}
+
+		// tangd file names may use any thumbprint algorithm, they must still match the key.
+		thumbs, err := Thumbprints(key)
+		if err != nil {
+			return nil, nil, err
+		}
+		if !slices.Contains(thumbs, strings.TrimPrefix(strings.TrimSuffix(name, plainKeyExt), ".")) {
+			return nil, nil, fmt.Errorf("tang key file '%s' is not named after its thumbprint", name)
+		}
+
+		if strings.HasPrefix(name, ".") {
+			rotated = append(rotated, key)
+		} else {
+			active = append(active, key)
+		}
+	}
+	return active, rotated, nil
+}
+
+// WriteTangKey stores key into a tangd key database, hidden when rotated, and returns the written file path.
+func WriteTangKey(dir string, key jose.JSONWebKey, rotated bool) (string, error) {
+	thp, err := KeyThumbprint(key)
+	if err != nil {
+		return "", err
+	}
+	data, err := marshalTangKey(key)
+	if err != nil {
+		return "", err
+	}
+
+	name := thp + plainKeyExt
+	if rotated {
+		name = "." + name
+	}
+	path := filepath.Join(dir, name)
+	return path, writeFileAtomic(path, data)
+}
+
+// ImportTang copies a tangd key database into a key directory, wrapping keys when a passphrase is given.
+// The key directory is then reloaded to check every thumbprint of the tangd keys still resolves.
+func ImportTang(tangDir string, dir string, passphrase PassphraseFn) (int, error) {
+	active, rotated, err := LoadTangKeys(tangDir)
+	if err != nil {
+		return 0, err
+	}
+
+	for i, key := range append(active[:len(active):len(active)], rotated...) {
+		if _, err = WriteKey(dir, key, passphrase); err != nil {
+			return 0, err
+		}
+		if i < len(active) {
+			continue
+		}
+		thp, err := KeyThumbprint(key)
+		if err != nil {
+			return 0, err
+		}
+		if err = RotateKey(dir, thp); err != nil {
+			return 0, err
+		}
+	}
+
+	store, err := NewFileKeyStore(dir, passphrase)
+	if err != nil {
+		return 0, err
+	}
+	return len(active) + len(rotated), verifyTangImport(store, active, rotated)
+}
+
+// ExportTang writes the keys of a key directory as a tangd key database. tangDir must not hold keys yet.
+// The database is written and checked in a staging subdirectory first, so that a failed export leaves tangDir as it was.
+// NOTE: tangd only reads plain keys, so wrapped keys are exported in their decrypted form.
+func ExportTang(dir string, passphrase PassphraseFn, tangDir string) (int, error) {
+	entries, err := os.ReadDir(tangDir)
+	if err != nil {
+		return 0, err
+	}
+	for _, entry := range entries {
+		if filepath.Ext(entry.Name()) == plainKeyExt {
+			return 0, fmt.Errorf("tangd key database '%s' already holds keys", tangDir)
+		}
+	}
+
+	active, err := LoadKeys(dir, passphrase)
+	if err != nil {
+		return 0, err
+	}
+	rotated, err := LoadRotatedKeys(dir, passphrase)
+	if err != nil {
+		return 0, err
+	}
+
+	staging, err := os.MkdirTemp(tangDir, ".export-")
+	if err != nil {
+		return 0, err
+	}
+	defer os.RemoveAll(staging)
+	for i, key := range append(active[:len(active):len(active)], rotated...) {
+		if _, err = WriteTangKey(staging, key, i >= len(active)); err != nil {
+			return 0, err
+		}
+	}
+
+	exportedActive, exportedRotated, err := LoadTangKeys(staging)
+	if err != nil {
+		return 0, err
+	}
+	if err = sameThumbprints(active, exportedActive); err != nil {
+		return 0, err
+	}
+	if err = sameThumbprints(rotated, exportedRotated); err != nil {
+		return 0, err
+	}
+
+	moved, err := moveFiles(staging, tangDir)
+	if err != nil {
+		for _, name := range moved {
+			_ = os.Remove(filepath.Join(tangDir, name))
+		}
+		return 0, err
+	}
+	return len(active) + len(rotated), nil
+}
+
+// verifyTangImport checks tangd clients can keep using every thumbprint of the imported keys.
+func verifyTangImport(store KeyStore, active KeyList, rotated KeyList) error {
+	protocol, err := NewProtocol(store)
+	if err != nil {
+		return err
+	}
+
+	for i, key := range append(active[:len(active):len(active)], rotated...) {
+		thumbs, err := Thumbprints(key)
+		if err != nil {
+			return err
+		}
+		for _, thp := range thumbs {
+			switch {
+			case IsExchangeKey(key):
+				public := key.Public()
+				point, ok := public.Key.(*ecdsa.PublicKey)
+				if !ok {
+					return fmt.Errorf("imported exchange key '%s' is not an EC key", thp)
+				}
+				if _, err = store.ECMRMultiply(thp, point); err != nil {
+					return fmt.Errorf("imported exchange key '%s' does not resolve: %w", thp, err)
+				}
+			case IsSigningKey(key) && i < len(active):
+				if protocol.GetAdvertisement(thp) == nil {
+					return fmt.Errorf("imported signing key '%s' does not resolve", thp)
+				}
+			}
+		}
+	}
+	return nil
+}
+
+func sameThumbprints(expected KeyList, actual KeyList) error {
+	thumbs := make(map[string]bool)
+	for _, key := range actual {
+		thp, err := KeyThumbprint(key)
+		if err != nil {
+			return err
+		}
+		thumbs[thp] = true
+	}
+	for _, key := range expected {
+		thp, err := KeyThumbprint(key)
+		if err != nil {
+			return err
+		}
+		if !thumbs[thp] {
+			return fmt.Errorf("key '%s' did not survive the export", thp)
+		}
+	}
+	if len(expected) != len(actual) {
+		return fmt.Errorf("exported %d keys, found %d", len(expected), len(actual))
+	}
+	return nil
+}
+
+func parseTangKey(data []byte) (jose.JSONWebKey, error) {
+	var key jose.JSONWebKey
+	if err := key.UnmarshalJSON(data); err != nil {
+		return jose.JSONWebKey{}, err
+	}
+	if key.Use != "" {
+		return key, nil
+	}
+
+	// go-jose does not know about "key_ops"
+	var ops struct {
+		KeyOps []string `json:"key_ops"`
+	}
+	if err := json.Unmarshal(data, &ops); err != nil {
+		return jose.JSONWebKey{}, err
+	}
+	switch {
+	case slices.Contains(ops.KeyOps, "deriveKey"):
+		key.Use = ExchangeKeyUse
+	case slices.Contains(ops.KeyOps, "sign"):
+		key.Use = SigningKeyUse
+	default:
+		return jose.JSONWebKey{}, fmt.Errorf("unsupported key operations %v", ops.KeyOps)
+	}
+	return key, nil
+}
+
+func marshalTangKey(key jose.JSONWebKey) ([]byte, error) {
+	data, err := key.MarshalJSON()
+	if err != nil {
+		return nil, err
+	}
+	var fields map[string]interface{}
+	if err = json.Unmarshal(data, &fields); err != nil {
+		return nil, err
+	}
+
+	delete(fields, "use")
+	switch {
+	case IsExchangeKey(key):
+		fields["key_ops"] = tangExchangeOps
+	case IsSigningKey(key):
+		fields["key_ops"] = tangSigningOps
+	default:
+		return nil, fmt.Errorf("key is neither an exchange nor a signing key")
+	}
+	return json.Marshal(fields)
+}
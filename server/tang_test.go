@@ -0,0 +1,98 @@
+package server
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	. "go-citrus/internal"
+)
+
+// ExchangeKey1 and SigningKey1 as stored by tangd, with "key_ops" instead of "use"
+const (
+	tangExchangeKey = `{"alg":"ECMR","crv":"P-521","d":"AbvskQAdy2M7MHSKvR45mGJLEgUq1-RAngkY3mEdrm-x6-qQGGDX0hQ89NvoERuVwxwhitskrLzC0VTrZ9mBArMN","key_ops":["deriveKey"],"kty":"EC","x":"AQ9iDNelRXRZZQTTpzR7imHIMGYG1-qQ6uif6Lj6eFpbUMf07gydd6K9Z2HQ_DAfRgf5JiQhrUdXzwB5xCqB53Pc","y":"AIpTGuqfOMSLP0cNl1J8rQfgamnIMuTDcUrk3dSpif8jD2cKWTJaaIhffPG2XLxaJtSNZNGFZXvObhBghb_8X8GQ"}`
+	tangSigningKey  = `{"alg":"ES512","crv":"P-521","d":"AcEOnvtRjKPp-QPwSN3yqCDlhsjifuDIAuCse5uv_wV6ENIyADh8lOllF3YsOgmPksjYooD5UV9oBBhArltfQYbb","key_ops":["sign","verify"],"kty":"EC","x":"AZWyek40TOSPIMTgbPCwVrtFPSLDjoIxOhx8d22rMeMnb3ld9k9sS20EGniNJHOxivovazbpbJE5-GcysqG9JafO","y":"ATGtjipFn2p07AtdY_dWCwjWc4b9a-kHh7Bg3gv44T3Xsp-N2OfPCWprG0GQ4lkhNgR4kAXkJJphy0hY5XKriBkO"}`
+)
+
+func TestTangKeys(t *testing.T) {
+	t.Run("load a tangd key database", func(t *testing.T) {
+		dir := t.TempDir()
+		require.NoError(t, os.WriteFile(filepath.Join(dir, ExchangeKey1Thp+".jwk"), []byte(tangExchangeKey), 0o600))
+		require.NoError(t, os.WriteFile(filepath.Join(dir, "."+SigningKey1Thp+".jwk"), []byte(tangSigningKey), 0o600))
+
+		active, rotated, err := LoadTangKeys(dir)
+		require.NoError(t, err)
+		require.Len(t, active, 1)
+		require.True(t, IsExchangeKey(active[0]))
+		require.Len(t, rotated, 1)
+		require.True(t, IsSigningKey(rotated[0]))
+	})
+
+	t.Run("reject misnamed key files", func(t *testing.T) {
+		dir := t.TempDir()
+		require.NoError(t, os.WriteFile(filepath.Join(dir, SigningKey1Thp+".jwk"), []byte(tangExchangeKey), 0o600))
+
+		_, _, err := LoadTangKeys(dir)
+		require.Error(t, err)
+	})
+
+	t.Run("write keys with key_ops", func(t *testing.T) {
+		dir := t.TempDir()
+		path, err := WriteTangKey(dir, ExchangeKey1, false)
+		require.NoError(t, err)
+
+		data, err := os.ReadFile(path)
+		require.NoError(t, err)
+		require.Contains(t, string(data), `"key_ops":["deriveKey"]`)
+		require.NotContains(t, string(data), `"use"`)
+	})
+}
+
+func TestTangImportExport(t *testing.T) {
+	keyWrapIterations = 1000
+	t.Cleanup(func() { keyWrapIterations = 0 })
+	passphrase := func() ([]byte, error) { return []byte("secret"), nil }
+
+	tangDir := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(tangDir, ExchangeKey1Thp+".jwk"), []byte(tangExchangeKey), 0o600))
+	require.NoError(t, os.WriteFile(filepath.Join(tangDir, SigningKey1Thp+".jwk"), []byte(tangSigningKey), 0o600))
+	_, err := WriteTangKey(tangDir, ExchangeKey2, true)
+	require.NoError(t, err)
+
+	dir := t.TempDir()
+	count, err := ImportTang(tangDir, dir, passphrase)
+	require.NoError(t, err)
+	require.Equal(t, 3, count)
+	require.FileExists(t, filepath.Join(dir, ExchangeKey1Thp+".jwe"))
+	require.FileExists(t, filepath.Join(dir, "."+ExchangeKey2Thp+".jwe"))
+
+	exportDir := t.TempDir()
+	count, err = ExportTang(dir, passphrase, exportDir)
+	require.NoError(t, err)
+	require.Equal(t, 3, count)
+
+	active, rotated, err := LoadTangKeys(exportDir)
+	require.NoError(t, err)
+	require.Len(t, active, 2)
+	require.Len(t, rotated, 1)
+
+	// The exported database imports back as is
+	_, err = ImportTang(exportDir, t.TempDir(), nil)
+	require.NoError(t, err)
+
+	t.Run("databases holding keys are left untouched", func(t *testing.T) {
+		_, err := ExportTang(dir, passphrase, tangDir)
+		require.ErrorContains(t, err, "already holds keys")
+		entries, err := os.ReadDir(tangDir)
+		require.NoError(t, err)
+		require.Len(t, entries, 3)
+	})
+
+	t.Run("no staging file is left behind", func(t *testing.T) {
+		entries, err := os.ReadDir(exportDir)
+		require.NoError(t, err)
+		require.Len(t, entries, 3)
+	})
+}
@@ -0,0 +1,154 @@
+package server
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+/*
+HTTPS serving.
+Tang does not need TLS, the recovery is blinded, but TLS lets deployments restrict who may reach the server:
+with a client CA bundle, clients must present a certificate it issued, and their subject is available to the
+recovery policy and the audit trail (see ClientSubject).
+*/
+
+// Certificate files are checked for changes at most this often, when a client connects.
+const tlsReloadCheck = 10 * time.Second
+
+// TLSFiles are the PEM files of the server certificate, and of the optional client CA bundle.
+type TLSFiles struct {
+	CertFile     string
+	KeyFile      string
+	ClientCAFile string // when set, clients must present a certificate issued by one of these CAs
+}
+
+// TLSReloader serves the certificates of TLSFiles, re-reading them once they change on disk.
+type TLSReloader struct {
+	files TLSFiles
+	now   func() time.Time
+
+	mu        sync.Mutex
+	config    *tls.Config
+	modTimes  []time.Time
+	lastCheck time.Time
+}
+
+func NewTLSReloader(files TLSFiles) (*TLSReloader, error) {
+	reloader := TLSReloader{
+		files: files,
+		now:   time.Now,
+	}
+	if err := reloader.Reload(); err != nil {
+		return nil, err
+	}
+	return &reloader, nil
+}
+
+// Reload re-reads the certificate files, keeping the previous ones when any of them fails to load.
+func (t *TLSReloader) Reload() error {
+	modTimes, err := t.stat()
+	if err != nil {
+		return err
+	}
+
+	cert, err := tls.LoadX509KeyPair(t.files.CertFile, t.files.KeyFile)
+	if err != nil {
+		return err
+	}
+	config := &tls.Config{
+		MinVersion:   tls.VersionTLS12,
+		Certificates: []tls.Certificate{cert},
+	}
+	if t.files.ClientCAFile != "" {
+		data, err := os.ReadFile(t.files.ClientCAFile)
+		if err != nil {
+			return err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(data) {
+			return fmt.Errorf("no certificate found in client CA bundle '%s'", t.files.ClientCAFile)
+		}
+		config.ClientCAs = pool
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+
+	t.mu.Lock()
+	t.config = config
+	t.modTimes = modTimes
+	t.lastCheck = t.now()
+	t.mu.Unlock()
+	return nil
+}
+
+// Config returns the server TLS configuration, picking up certificate changes on new connections.
+func (t *TLSReloader) Config() *tls.Config {
+	return &tls.Config{
+		MinVersion:         tls.VersionTLS12,
+		GetConfigForClient: t.configForClient,
+	}
+}
+
+func (t *TLSReloader) configForClient(*tls.ClientHelloInfo) (*tls.Config, error) {
+	if t.changed() {
+		if err := t.Reload(); err != nil {
+			slog.Error("unable to reload TLS certificates, keeping the previous ones", "error", err)
+		}
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.config, nil
+}
+
+// changed tells whether a certificate file changed, checking at most once every tlsReloadCheck.
+func (t *TLSReloader) changed() bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	now := t.now()
+	if now.Sub(t.lastCheck) < tlsReloadCheck {
+		return false
+	}
+	t.lastCheck = now
+
+	modTimes, err := t.stat()
+	if err != nil {
+		// Probably in the middle of a replacement, try again on the next check.
+		return false
+	}
+	for i := range modTimes {
+		if !modTimes[i].Equal(t.modTimes[i]) {
+			return true
+		}
+	}
+	return false
+}
+
+func (t *TLSReloader) stat() ([]time.Time, error) {
+	var modTimes []time.Time
+	for _, path := range []string{t.files.CertFile, t.files.KeyFile, t.files.ClientCAFile} {
+		if path == "" {
+			modTimes = append(modTimes, time.Time{})
+			continue
+		}
+		info, err := os.Stat(path)
+		if err != nil {
+			return nil, err
+		}
+		modTimes = append(modTimes, info.ModTime())
+	}
+	return modTimes, nil
+}
+
+// ClientSubject returns the subject of the verified client certificate, empty without mutual TLS.
+func ClientSubject(r *http.Request) string {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 || len(r.TLS.VerifiedChains[0]) == 0 {
+		return ""
+	}
+	return r.TLS.VerifiedChains[0][0].Subject.String()
+}
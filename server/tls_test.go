@@ -0,0 +1,116 @@
+package server
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	. "go-citrus/internal"
+)
+
+func newTLSTestServer(t *testing.T, reloader *TLSReloader, handler http.Handler) *httptest.Server {
+	srv := httptest.NewUnstartedServer(handler)
+	srv.TLS = reloader.Config()
+	srv.StartTLS()
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func tlsTestClient(t *testing.T, pki TestPKI, withCert bool) *http.Client {
+	roots, err := os.ReadFile(pki.CAFile)
+	require.NoError(t, err)
+	pool := x509.NewCertPool()
+	require.True(t, pool.AppendCertsFromPEM(roots))
+	config := &tls.Config{RootCAs: pool}
+	if withCert {
+		cert, err := tls.LoadX509KeyPair(pki.ClientCertFile, pki.ClientKeyFile)
+		require.NoError(t, err)
+		config.Certificates = []tls.Certificate{cert}
+	}
+	// Every request performs a handshake
+	return &http.Client{Transport: &http.Transport{TLSClientConfig: config, DisableKeepAlives: true}}
+}
+
+func TestTLSReloader(t *testing.T) {
+	t.Run("mutual TLS", func(t *testing.T) {
+		pki, err := WriteTestPKI(t.TempDir(), "unlock-agent")
+		require.NoError(t, err)
+		reloader, err := NewTLSReloader(TLSFiles{CertFile: pki.ServerCertFile, KeyFile: pki.ServerKeyFile, ClientCAFile: pki.CAFile})
+		require.NoError(t, err)
+
+		sink := &memoryAuditSink{}
+		srv := newTLSTestServer(t, reloader, newTestHandler(t).WithAudit(sink))
+
+		_, err = tlsTestClient(t, pki, false).Get(srv.URL + "/adv")
+		require.Error(t, err)
+
+		resp, err := tlsTestClient(t, pki, true).Get(srv.URL + "/adv")
+		require.NoError(t, err)
+		_ = resp.Body.Close()
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		require.Len(t, sink.records, 1)
+		require.Equal(t, "CN=unlock-agent", sink.records[0].Subject)
+	})
+
+	t.Run("without client CA", func(t *testing.T) {
+		pki, err := WriteTestPKI(t.TempDir(), "unlock-agent")
+		require.NoError(t, err)
+		reloader, err := NewTLSReloader(TLSFiles{CertFile: pki.ServerCertFile, KeyFile: pki.ServerKeyFile})
+		require.NoError(t, err)
+
+		srv := newTLSTestServer(t, reloader, newTestHandler(t))
+		resp, err := tlsTestClient(t, pki, false).Get(srv.URL + "/adv")
+		require.NoError(t, err)
+		_ = resp.Body.Close()
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+	})
+
+	t.Run("reload changed certificates", func(t *testing.T) {
+		dir := t.TempDir()
+		pki, err := WriteTestPKI(dir, "unlock-agent")
+		require.NoError(t, err)
+		reloader, err := NewTLSReloader(TLSFiles{CertFile: pki.ServerCertFile, KeyFile: pki.ServerKeyFile, ClientCAFile: pki.CAFile})
+		require.NoError(t, err)
+		now := time.Now()
+		reloader.now = func() time.Time { return now }
+		srv := newTLSTestServer(t, reloader, newTestHandler(t))
+
+		// New CA, the old client certificate is not trusted anymore.
+		oldClient := tlsTestClient(t, pki, true)
+		_, err = WriteTestPKI(dir, "unlock-agent")
+		require.NoError(t, err)
+		future := now.Add(time.Minute)
+		for _, path := range []string{pki.CAFile, pki.ServerCertFile, pki.ServerKeyFile} {
+			require.NoError(t, os.Chtimes(path, future, future))
+		}
+
+		// Not checked again yet
+		resp, err := oldClient.Get(srv.URL + "/adv")
+		require.NoError(t, err)
+		_ = resp.Body.Close()
+
+		reloader.mu.Lock()
+		now = now.Add(tlsReloadCheck)
+		reloader.mu.Unlock()
+		_, err = oldClient.Get(srv.URL + "/adv")
+		require.Error(t, err)
+
+		resp, err = tlsTestClient(t, pki, true).Get(srv.URL + "/adv")
+		require.NoError(t, err)
+		_ = resp.Body.Close()
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+	})
+
+	t.Run("invalid client CA bundle", func(t *testing.T) {
+		pki, err := WriteTestPKI(t.TempDir(), "unlock-agent")
+		require.NoError(t, err)
+		_, err = NewTLSReloader(TLSFiles{CertFile: pki.ServerCertFile, KeyFile: pki.ServerKeyFile, ClientCAFile: pki.ServerKeyFile})
+		require.Error(t, err)
+	})
+}
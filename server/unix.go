@@ -0,0 +1,75 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"net"
+	"os"
+	"path/filepath"
+	"syscall"
+)
+
+// ListenUnix listens on a Unix domain socket, replacing a stale socket file left at path, then applies mode
+// and ownership to the socket file. A negative uid or gid keeps the current one.
+// The socket is bound in a private directory and only moved to path once its mode and ownership are set,
+// and the socket file of a running server is never replaced.
+// The socket file is removed when the listener is closed.
+func ListenUnix(path string, mode os.FileMode, uid int, gid int) (net.Listener, error) {
+	info, err := os.Lstat(path)
+	switch {
+	case err == nil && info.Mode().Type() != fs.ModeSocket:
+		return nil, fmt.Errorf("'%s' exists and is not a socket", path)
+	case err == nil:
+		conn, err := net.Dial("unix", path)
+		if err == nil {
+			_ = conn.Close()
+			return nil, fmt.Errorf("'%s' is in use by a running server", path)
+		}
+		if !errors.Is(err, syscall.ECONNREFUSED) {
+			return nil, err
+		}
+	case !errors.Is(err, fs.ErrNotExist):
+		return nil, err
+	}
+
+	dir, err := os.MkdirTemp(filepath.Dir(path), ".citrus-")
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(dir)
+	bound := filepath.Join(dir, "sock")
+	listener, err := net.ListenUnix("unix", &net.UnixAddr{Name: bound, Net: "unix"})
+	if err != nil {
+		return nil, err
+	}
+	listener.SetUnlinkOnClose(false)
+
+	if err = os.Chmod(bound, mode); err == nil && (uid >= 0 || gid >= 0) {
+		err = os.Lchown(bound, uid, gid)
+	}
+	if err == nil {
+		// Replaces a stale socket file in one step.
+		err = os.Rename(bound, path)
+	}
+	if err != nil {
+		_ = listener.Close()
+		_ = os.Remove(bound)
+		return nil, err
+	}
+	return &unixListener{UnixListener: listener, path: path}, nil
+}
+
+// unixListener removes its socket file, which it was not bound to, on Close.
+type unixListener struct {
+	*net.UnixListener
+	path string
+}
+
+func (t *unixListener) Close() error {
+	err := t.UnixListener.Close()
+	if removeErr := os.Remove(t.path); err == nil && !errors.Is(removeErr, fs.ErrNotExist) {
+		err = removeErr
+	}
+	return err
+}
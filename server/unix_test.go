@@ -0,0 +1,78 @@
+package server
+
+import (
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestListenUnix(t *testing.T) {
+	t.Run("socket mode", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "citrus.sock")
+		listener, err := ListenUnix(path, 0o660, -1, -1)
+		require.NoError(t, err)
+
+		info, err := os.Stat(path)
+		require.NoError(t, err)
+		require.Equal(t, os.ModeSocket|0o660, info.Mode())
+
+		require.NoError(t, listener.Close())
+		require.NoFileExists(t, path)
+	})
+
+	t.Run("replace a stale socket", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "citrus.sock")
+		stale, err := net.ListenUnix("unix", &net.UnixAddr{Name: path, Net: "unix"})
+		require.NoError(t, err)
+		stale.SetUnlinkOnClose(false)
+		require.NoError(t, stale.Close())
+		require.FileExists(t, path)
+
+		listener, err := ListenUnix(path, 0o600, -1, -1)
+		require.NoError(t, err)
+		srv := &http.Server{Handler: newTestHandler(t)}
+		go func() { _ = srv.Serve(listener) }()
+		t.Cleanup(func() { _ = srv.Close() })
+
+		conn, err := net.Dial("unix", path)
+		require.NoError(t, err)
+		require.NoError(t, conn.Close())
+	})
+
+	t.Run("refuse to replace the socket of a running server", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "citrus.sock")
+		running, err := ListenUnix(path, 0o600, -1, -1)
+		require.NoError(t, err)
+		t.Cleanup(func() { _ = running.Close() })
+
+		_, err = ListenUnix(path, 0o600, -1, -1)
+		require.ErrorContains(t, err, "in use")
+		conn, err := net.Dial("unix", path)
+		require.NoError(t, err)
+		require.NoError(t, conn.Close())
+	})
+
+	t.Run("the socket is bound in a private directory", func(t *testing.T) {
+		dir := t.TempDir()
+		listener, err := ListenUnix(filepath.Join(dir, "citrus.sock"), 0o600, -1, -1)
+		require.NoError(t, err)
+		t.Cleanup(func() { _ = listener.Close() })
+
+		entries, err := os.ReadDir(dir)
+		require.NoError(t, err)
+		require.Len(t, entries, 1, "the private directory is removed")
+		require.Equal(t, "citrus.sock", entries[0].Name())
+	})
+
+	t.Run("refuse to replace a regular file", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "citrus.sock")
+		require.NoError(t, os.WriteFile(path, []byte("data"), 0o600))
+		_, err := ListenUnix(path, 0o600, -1, -1)
+		require.Error(t, err)
+		require.FileExists(t, path)
+	})
+}